@@ -0,0 +1,150 @@
+// Command benchmark is a small redis-benchmark style load generator. Each
+// client sends its requests in pipelines of -P commands and waits for all
+// replies before sending the next batch.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/therahulbhati/go-redis-clone/pkg/resp"
+)
+
+func main() {
+	host := flag.String("h", "127.0.0.1", "Server hostname")
+	port := flag.String("p", "6379", "Server port")
+	clients := flag.Int("c", 50, "Number of parallel connections")
+	requests := flag.Int("n", 100000, "Total number of requests")
+	pipeline := flag.Int("P", 1, "Pipeline <numreq> requests")
+	dataSize := flag.Int("d", 3, "Data size of SET values in bytes")
+	keyspace := flag.Int("r", 0, "Use random keys in a keyspace of this size instead of a single key")
+	tests := flag.String("t", "ping,set,get", "Comma separated list of tests to run")
+	flag.Parse()
+
+	if *clients < 1 || *requests < 1 || *pipeline < 1 {
+		fmt.Println("-c, -n and -P must be at least 1")
+		os.Exit(1)
+	}
+
+	addr := net.JoinHostPort(*host, *port)
+	value := strings.Repeat("x", *dataSize)
+	for _, test := range strings.Split(*tests, ",") {
+		var command func(i int) []string
+		switch strings.ToLower(strings.TrimSpace(test)) {
+		case "ping":
+			command = func(int) []string { return []string{"PING"} }
+		case "set":
+			command = func(i int) []string { return []string{"SET", key(i, *keyspace), value} }
+		case "get":
+			command = func(i int) []string { return []string{"GET", key(i, *keyspace)} }
+		default:
+			fmt.Printf("unknown test %q\n", test)
+			continue
+		}
+		if err := run(strings.ToUpper(test), addr, command, *clients, *requests, *pipeline); err != nil {
+			fmt.Printf("%s: %v\n", strings.ToUpper(test), err)
+			os.Exit(1)
+		}
+	}
+}
+
+func key(i, keyspace int) string {
+	if keyspace <= 0 {
+		return "key:__rand_int__"
+	}
+	return "key:" + strconv.Itoa(i%keyspace)
+}
+
+// run spreads requests over the clients and prints the throughput and the
+// latency percentiles of the pipelined batches.
+func run(name, addr string, command func(i int) []string, clients, requests, pipeline int) error {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var latencies []time.Duration
+	var firstErr error
+
+	perClient := (requests + clients - 1) / clients
+	start := time.Now()
+	for c := 0; c < clients; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			lat, err := runClient(addr, command, c*perClient, min(perClient, requests-c*perClient), pipeline)
+			mu.Lock()
+			defer mu.Unlock()
+			latencies = append(latencies, lat...)
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}(c)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	if firstErr != nil {
+		return firstErr
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	fmt.Printf("====== %s ======\n", name)
+	fmt.Printf("  %d requests completed in %.2f seconds\n", requests, elapsed.Seconds())
+	fmt.Printf("  %d parallel clients, pipeline %d\n", clients, pipeline)
+	fmt.Printf("  latency per batch: p50=%s p99=%s max=%s\n",
+		percentile(latencies, 50), percentile(latencies, 99), percentile(latencies, 100))
+	fmt.Printf("  %.2f requests per second\n\n", float64(requests)/elapsed.Seconds())
+	return nil
+}
+
+func runClient(addr string, command func(i int) []string, first, count, pipeline int) ([]time.Duration, error) {
+	if count <= 0 {
+		return nil, nil
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	reader := resp.NewReader(bufio.NewReaderSize(conn, 64*1024), resp.DefaultLimits())
+	var latencies []time.Duration
+	var buf []byte
+	for sent := 0; sent < count; {
+		batch := min(pipeline, count-sent)
+		buf = buf[:0]
+		for i := 0; i < batch; i++ {
+			buf = resp.AppendStringArray(buf, command(first+sent+i))
+		}
+
+		begin := time.Now()
+		if _, err := conn.Write(buf); err != nil {
+			return latencies, err
+		}
+		for i := 0; i < batch; i++ {
+			reply, err := reader.ReadValue()
+			if err != nil {
+				return latencies, err
+			}
+			if reply.Type == resp.TypeError {
+				return latencies, fmt.Errorf("server replied with an error: %s", reply.Str)
+			}
+		}
+		latencies = append(latencies, time.Since(begin))
+		sent += batch
+	}
+	return latencies, nil
+}
+
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := (len(sorted)*p + 99) / 100
+	return sorted[max(i-1, 0)]
+}
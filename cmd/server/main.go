@@ -1,57 +1,100 @@
 package main
 
 import (
-	"flag"
 	"fmt"
 	"github.com/therahulbhati/go-redis-clone/internal/domain"
-	"github.com/therahulbhati/go-redis-clone/internal/rdb"
 	"net"
+	"net/http"
 	"os"
-	"path/filepath"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
+	"github.com/therahulbhati/go-redis-clone/config"
 	"github.com/therahulbhati/go-redis-clone/internal/handler"
+	"github.com/therahulbhati/go-redis-clone/internal/logging"
 	"github.com/therahulbhati/go-redis-clone/internal/replication"
 	"github.com/therahulbhati/go-redis-clone/internal/storage"
+	"github.com/therahulbhati/go-redis-clone/internal/tlsconfig"
 )
 
+// usage is printed by -h and --help.
+const usage = `Usage: go-redis-clone [/path/to/redis.conf] [--directive value ...]
+
+Examples:
+  go-redis-clone (run the server with the default configuration)
+  go-redis-clone /etc/redis/6379.conf
+  go-redis-clone --port 7777
+  go-redis-clone --port 7777 --replicaof 127.0.0.1 8888
+  go-redis-clone /etc/myredis.conf --loglevel verbose
+`
+
 func main() {
-	port := flag.String("port", "6379", "Port to run the Redis server on")
-	replicaof := flag.String("replicaof", "", "Replicate another Redis server")
-	rdbFileDir := flag.String("dir", "", "Directory to store RDB file")
-	rdbFileName := flag.String("dbfilename", "", "Name of the RDB file")
+	args := os.Args[1:]
+	if len(args) == 1 && (args[0] == "-h" || args[0] == "--help") {
+		fmt.Print(usage)
+		return
+	}
+	cfg, err := config.Load(args)
+	if err != nil {
+		fmt.Println("*** FATAL CONFIG FILE ERROR ***")
+		fmt.Println(err)
+		os.Exit(1)
+	}
 
-	flag.Parse()
+	logging.SetLevel(cfg.LogLevel)
 
-	store := storage.NewInMemoryStore()
-	// Load RDB file if it exists
-	if *rdbFileDir != "" && *rdbFileName != "" {
-		rdbFilePath := filepath.Join(*rdbFileDir, *rdbFileName)
-		if _, err := os.Stat(rdbFilePath); err == nil {
-			err := rdb.LoadRDBFile(rdbFilePath, store)
-			if err != nil {
-				fmt.Printf("Error loading RDB file: %v", err)
-			} else {
-				fmt.Printf("Successfully loaded RDB file: %s", rdbFilePath)
-			}
-		} else {
-			fmt.Printf("RDB file does not exist at path: %s", rdbFilePath)
+	store := storage.NewInMemoryStore(cfg.Databases, cfg.Shards)
+	rdbFilePath := cfg.RDBPath()
+
+	var leaderMgr domain.LeaderManager
+	if !cfg.IsReplica() {
+		leaderMgr = replication.NewLeader()
+	}
+	commandHandler := handler.NewCommandHandler(store, leaderMgr, cfg)
+	if err := commandHandler.SetNotifyKeyspaceEvents(cfg.NotifyKeyspaceEvents); err != nil {
+		fmt.Println("notify-keyspace-events:", err)
+		os.Exit(1)
+	}
+	commandHandler.SetRequirePass(cfg.RequirePass)
+	if err := commandHandler.SetACLFile(cfg.ACLFile); err != nil {
+		fmt.Println("aclfile:", err)
+		os.Exit(1)
+	}
+	commandHandler.SetProtectedMode(cfg.ProtectedMode)
+
+	var tlsConfig *tlsconfig.Config
+	if cfg.TLSPort != 0 || cfg.TLSReplication {
+		if tlsConfig, err = tlsconfig.New(cfg.TLS); err != nil {
+			fmt.Println("Failed to configure TLS:", err)
+			os.Exit(1)
 		}
+		commandHandler.SetTLSConfig(tlsConfig)
 	}
 
-	if *replicaof == "" {
+	// Load RDB file if it exists
+	if rdbFilePath != "" {
+		loadRDBFile(rdbFilePath, commandHandler)
+	}
+	go saveOnShutdown(cfg.UnixSocket, commandHandler)
+	if cfg.MetricsPort != 0 {
+		serveMetrics(cfg, commandHandler)
+	}
+
+	if !cfg.IsReplica() {
 		fmt.Println("Starting as Leader")
-		leaderMgr := replication.NewLeader()
-		commandHandler := handler.NewCommandHandler(store, leaderMgr)
-		startServer(*port, commandHandler)
+		startServer(cfg, tlsConfig, commandHandler)
 	} else {
 		fmt.Println("Starting as Follower")
 
-		leaderInfo := strings.Split(*replicaof, " ")
-		leaderHost, leaderPort := leaderInfo[0], leaderInfo[1]
-
-		commandHandler := handler.NewCommandHandler(store, nil)
-		followerManager := replication.NewFollower(store, *port, leaderHost, leaderPort, commandHandler)
+		var leaderTLS *tlsconfig.Config
+		if cfg.TLSReplication {
+			leaderTLS = tlsConfig
+		}
+		followerManager := replication.NewFollower(store, cfg, leaderTLS, commandHandler)
+		commandHandler.SetFollower(followerManager)
 
 		if err := followerManager.ConnectToLeader(); err != nil {
 			fmt.Printf("Failed to connect to leader: %v\n", err)
@@ -59,19 +102,145 @@ func main() {
 
 		go followerManager.ReceiveAndProcessCommands()
 
-		startServer(*port, commandHandler)
+		startServer(cfg, tlsConfig, commandHandler)
 	}
 }
 
-func startServer(port string, handler domain.CommandHandler) {
-	listener, err := net.Listen("tcp", "0.0.0.0:"+port)
+// loadRDBFile loads the RDB file at rdbFilePath, if there is one. The server
+// refuses to start when it can't be read, like Redis does, rather than
+// overwriting it with an incomplete dataset at the next save.
+func loadRDBFile(rdbFilePath string, handler domain.CommandHandler) {
+	file, err := os.Open(rdbFilePath)
+	if os.IsNotExist(err) {
+		fmt.Printf("RDB file does not exist at path: %s\n", rdbFilePath)
+		return
+	}
 	if err != nil {
-		fmt.Println("Failed to bind to port", port)
+		fmt.Printf("Failed to open RDB file: %v\n", err)
 		os.Exit(1)
 	}
-	defer listener.Close()
+	defer file.Close()
 
-	fmt.Printf("Server listening on port %s\n", port)
+	if err := handler.LoadSnapshot(file); err != nil {
+		fmt.Printf("Error loading RDB file %s: %v\n", rdbFilePath, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Successfully loaded RDB file: %s\n", rdbFilePath)
+}
+
+// saveOnShutdown saves the RDB file when the server is asked to stop, like
+// Redis does when save points are configured, and removes the Unix socket.
+// The save points are read at that time, so CONFIG SET save "" disables the
+// final save.
+func saveOnShutdown(unixSocket string, handler domain.CommandHandler) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+
+	if unixSocket != "" {
+		os.Remove(unixSocket)
+	}
+
+	if cfg := handler.Config(); cfg.RDBPath() != "" && len(cfg.Save) > 0 {
+		fmt.Println("Saving the final RDB snapshot before exiting")
+		if err := handler.Save(); err != nil {
+			fmt.Printf("Error saving RDB file: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	os.Exit(0)
+}
+
+// listenUnix creates the Unix socket at path, replacing the one a previous
+// run left behind, and gives it the permissions perm unless it's 0.
+func listenUnix(path string, perm os.FileMode) net.Listener {
+	os.Remove(path)
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		fmt.Printf("Failed to listen on %s: %v\n", path, err)
+		os.Exit(1)
+	}
+	if perm != 0 {
+		if err := os.Chmod(path, perm); err != nil {
+			fmt.Printf("Failed to set the permissions of %s: %v\n", path, err)
+			os.Exit(1)
+		}
+	}
+	fmt.Printf("Server listening on %s\n", path)
+	return listener
+}
+
+// startServer serves plain connections on the port, TLS connections on the
+// TLS port and connections to the Unix socket of cfg, the ports being
+// disabled when 0. All of them are served by the same handler.
+func startServer(cfg *config.Config, tlsConfig *tlsconfig.Config, handler domain.CommandHandler) {
+	var listeners []net.Listener
+	if cfg.Port != 0 {
+		listeners = append(listeners, listen(cfg.Bind, strconv.Itoa(cfg.Port), net.Listen)...)
+	}
+	if cfg.TLSPort != 0 {
+		listeners = append(listeners, listen(cfg.Bind, strconv.Itoa(cfg.TLSPort), tlsConfig.Listen)...)
+	}
+	if cfg.UnixSocket != "" {
+		listeners = append(listeners, listenUnix(cfg.UnixSocket, cfg.UnixSocketPerm))
+	}
+	for _, listener := range listeners[1:] {
+		go serve(listener, handler)
+	}
+	serve(listeners[0], handler)
+}
+
+// listen opens a listener with listenFn for every bind address. Addresses
+// prefixed with '-' are skipped when they aren't available, like IPv6 on
+// hosts without it.
+func listen(bind []string, port string, listenFn func(network, addr string) (net.Listener, error)) []net.Listener {
+	var listeners []net.Listener
+	for _, addr := range bind {
+		optional := strings.HasPrefix(addr, "-")
+		addr = strings.TrimPrefix(addr, "-")
+		network, host := "tcp", addr
+		switch addr {
+		case "*":
+			network, host = "tcp4", "0.0.0.0"
+		case "::*":
+			network, host = "tcp6", "::"
+		}
+		listener, err := listenFn(network, net.JoinHostPort(host, port))
+		if err != nil {
+			if optional {
+				continue
+			}
+			fmt.Printf("Failed to bind to %s: %v\n", net.JoinHostPort(host, port), err)
+			os.Exit(1)
+		}
+		fmt.Printf("Server listening on %s\n", listener.Addr())
+		listeners = append(listeners, listener)
+	}
+	if len(listeners) == 0 {
+		fmt.Println("Failed to bind to any of the addresses", strings.Join(bind, " "))
+		os.Exit(1)
+	}
+	return listeners
+}
+
+// serveMetrics exposes the metrics of handler to Prometheus on /metrics, on
+// the metrics port of every bind address.
+func serveMetrics(cfg *config.Config, handler domain.CommandHandler) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := handler.WriteMetrics(w); err != nil {
+			logging.Verbosef("Error writing metrics to %s: %v", r.RemoteAddr, err)
+		}
+	})
+	for _, listener := range listen(cfg.Bind, strconv.Itoa(cfg.MetricsPort), net.Listen) {
+		server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+		go server.Serve(listener)
+	}
+}
+
+func serve(listener net.Listener, handler domain.CommandHandler) {
+	defer listener.Close()
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
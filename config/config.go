@@ -1 +1,315 @@
+// Package config reads the server configuration from a redis.conf style file
+// and the command line.
+//
+// A configuration file holds one directive per line, a name followed by its
+// arguments, which may be quoted like in redis-cli. Lines starting with '#'
+// are comments, and "include path" reads another file in place. Memory
+// amounts accept the units of Redis: 1k is 1000 bytes, 1kb 1024, and so on
+// with m, mb, g and gb.
+//
+// The command line is an optional configuration file followed by directives
+// written as options, each of them overriding the file:
+//
+//	go-redis-clone /etc/redis.conf --port 6380 --replicaof 127.0.0.1 6379
 package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/therahulbhati/go-redis-clone/internal/tlsconfig"
+	"github.com/therahulbhati/go-redis-clone/pkg/utils"
+)
+
+// maxIncludeDepth bounds the nesting of include directives, so a file
+// including itself fails instead of recursing forever.
+const maxIncludeDepth = 16
+
+// Config is the typed server configuration. Each field is set by the
+// directive named in its comment.
+type Config struct {
+	// File is the configuration file the server was started with, empty
+	// when there is none.
+	File string
+
+	// Port is the TCP port to accept plain connections on, 0 to disable
+	// them (port).
+	Port int
+	// Bind lists the addresses to listen on, "*" for every IPv4 and "::*"
+	// for every IPv6 interface; a '-' prefix makes one optional (bind).
+	Bind []string
+	// ProtectedMode refuses the connections that don't come from the
+	// loopback interface while the default user has no password
+	// (protected-mode).
+	ProtectedMode bool
+	// UnixSocket is the path of a Unix socket to accept connections on,
+	// empty to disable it (unixsocket).
+	UnixSocket string
+	// UnixSocketPerm are the permissions given to the socket, 0 to keep the
+	// default ones (unixsocketperm).
+	UnixSocketPerm os.FileMode
+	// MetricsPort is the port of the HTTP server exposing the Prometheus
+	// metrics on /metrics, 0 to disable it (metrics-port).
+	MetricsPort int
+
+	// TLSPort is the port to accept TLS connections on, 0 to disable them
+	// (tls-port).
+	TLSPort int
+	// TLS holds the certificates and options of the TLS connections
+	// (tls-cert-file, tls-key-file, tls-client-cert-file,
+	// tls-client-key-file, tls-ca-cert-file, tls-ca-cert-dir,
+	// tls-auth-clients and tls-auth-clients-user).
+	TLS tlsconfig.Settings
+	// TLSReplication connects to the leader over TLS (tls-replication).
+	TLSReplication bool
+
+	// RequirePass is the password of the default user (requirepass).
+	RequirePass string
+	// ACLFile is the file the ACL users are loaded from and saved to
+	// (aclfile).
+	ACLFile string
+
+	// ReplicaOfHost and ReplicaOfPort are the address of the leader to
+	// replicate, ReplicaOfHost being empty on a leader (replicaof).
+	ReplicaOfHost string
+	ReplicaOfPort int
+	// MasterUser and MasterAuth are the credentials the follower
+	// authenticates to the leader with (masteruser and masterauth).
+	MasterUser string
+	MasterAuth string
+
+	// Dir and DBFilename locate the RDB file, persistence being disabled
+	// unless both are set (dir and dbfilename).
+	Dir        string
+	DBFilename string
+
+	// Databases is the number of logical databases (databases).
+	Databases int
+	// Shards is the number of independently locked shards per database,
+	// rounded up to a power of two (shards).
+	Shards int
+	// ProtoMaxBulkLen is the largest bulk string accepted in a request
+	// (proto-max-bulk-len).
+	ProtoMaxBulkLen int64
+	// NotifyKeyspaceEvents selects the keyspace notification classes to
+	// publish, like KEA (notify-keyspace-events).
+	NotifyKeyspaceEvents string
+
+	// MaxMemory is the memory the dataset may use before keys are evicted,
+	// 0 for no limit (maxmemory).
+	MaxMemory int64
+	// MaxMemoryPolicy picks the keys to evict (maxmemory-policy), comparing
+	// MaxMemorySamples keys per eviction (maxmemory-samples).
+	MaxMemoryPolicy  string
+	MaxMemorySamples int
+	// Save lists the save points: the RDB file is saved when the dataset
+	// changed at least Changes times in the last Seconds (save).
+	Save []SavePoint
+	// AppendFsync is the appendfsync value of the configuration file,
+	// always, everysec or no. It has no effect, there is no append only file.
+	AppendFsync string
+	// Timeout closes the connections idle for that many seconds, 0 to keep
+	// them open (timeout).
+	Timeout int
+	// BusyReplyThreshold is the time in milliseconds a script may run
+	// before other clients get BUSY (busy-reply-threshold).
+	BusyReplyThreshold int
+	// LogLevel is the verbosity of the log: debug, verbose, notice, warning
+	// or nothing (loglevel).
+	LogLevel string
+	// SlowlogLogSlowerThan is the execution time in microseconds above
+	// which commands are recorded in the slow log, negative to record none
+	// (slowlog-log-slower-than). The log keeps the latest SlowlogMaxLen of
+	// them (slowlog-max-len).
+	SlowlogLogSlowerThan int
+	SlowlogMaxLen        int
+
+	// loadedSave is set once a save directive was loaded, the following ones
+	// adding save points instead of replacing them.
+	loadedSave bool
+}
+
+// SavePoint saves the RDB file after Changes writes within Seconds.
+type SavePoint struct {
+	Seconds int
+	Changes int
+}
+
+// Default returns the configuration used when nothing is set.
+func Default() *Config {
+	return &Config{
+		Port:            6379,
+		Bind:            []string{"*", "-::*"},
+		ProtectedMode:   true,
+		TLS:             tlsconfig.DefaultSettings(),
+		Databases:       16,
+		Shards:          64,
+		ProtoMaxBulkLen: 512 * 1024 * 1024,
+
+		MaxMemoryPolicy:    "noeviction",
+		MaxMemorySamples:   5,
+		Save:               []SavePoint{{3600, 1}, {300, 100}, {60, 10000}},
+		AppendFsync:        "everysec",
+		BusyReplyThreshold: 5000,
+		LogLevel:           "notice",
+
+		SlowlogLogSlowerThan: 10000,
+		SlowlogMaxLen:        128,
+	}
+}
+
+// RDBPath returns the path of the RDB file, empty when persistence is
+// disabled.
+func (c *Config) RDBPath() string {
+	if c.Dir == "" || c.DBFilename == "" {
+		return ""
+	}
+	return filepath.Join(c.Dir, c.DBFilename)
+}
+
+// IsReplica reports whether the server replicates a leader.
+func (c *Config) IsReplica() bool {
+	return c.ReplicaOfHost != ""
+}
+
+// Load builds the configuration from the command line arguments, without the
+// program name: the configuration file, if the first argument isn't an
+// option, then the options overriding it. The result is validated.
+func Load(args []string) (*Config, error) {
+	c := Default()
+	if len(args) > 0 && !isOption(args[0]) {
+		file, err := filepath.Abs(args[0])
+		if err != nil {
+			return nil, err
+		}
+		c.File = file
+		if err := c.ParseFile(c.File); err != nil {
+			return nil, err
+		}
+		args = args[1:]
+	}
+	if err := c.ParseArgs(args); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// isOption reports whether arg starts a command line option. Both --name and
+// the -name form of the Go flag package are options, but "-::*" and "-1" are
+// values.
+func isOption(arg string) bool {
+	name := strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-")
+	if len(name) == len(arg) || name == "" {
+		return false
+	}
+	return name[0] >= 'a' && name[0] <= 'z' || name[0] >= 'A' && name[0] <= 'Z'
+}
+
+// ParseArgs applies the directives written as command line options. An
+// option takes every following argument up to the next option, so
+// "--replicaof host port" works, and "--name=value" is accepted too.
+func (c *Config) ParseArgs(args []string) error {
+	for i := 0; i < len(args); {
+		if !isOption(args[i]) {
+			return fmt.Errorf("invalid argument '%s', options must start with --", args[i])
+		}
+		name := strings.TrimLeft(args[i], "-")
+		var values []string
+		if n, value, ok := strings.Cut(name, "="); ok {
+			name, values = n, []string{value}
+		}
+		for i++; i < len(args) && !isOption(args[i]); i++ {
+			values = append(values, args[i])
+		}
+		if err := c.load(name, values); err != nil {
+			return fmt.Errorf("--%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// ParseFile applies the directives of the configuration file at path.
+func (c *Config) ParseFile(path string) error {
+	return c.parseFile(path, 0)
+}
+
+func (c *Config) parseFile(path string, depth int) error {
+	if depth > maxIncludeDepth {
+		return fmt.Errorf("%s: too many nested includes", path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read the configuration file: %w", err)
+	}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fail := func(err error) error {
+			return fmt.Errorf("%s:%d: '%s': %w", path, i+1, line, err)
+		}
+		args, err := utils.SplitArgs(line)
+		if err != nil {
+			return fail(err)
+		}
+		if len(args) == 0 {
+			continue
+		}
+		name := strings.ToLower(args[0])
+		if name == "include" {
+			if len(args) != 2 {
+				return fail(errWrongArgs)
+			}
+			if err := c.parseFile(args[1], depth+1); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := c.load(name, args[1:]); err != nil {
+			return fail(err)
+		}
+	}
+	return nil
+}
+
+// load applies a directive read from a file or the command line. Unlike
+// with Set, successive save directives add up, so the classic redis.conf
+// with one save line per save point works.
+func (c *Config) load(name string, args []string) error {
+	if !strings.EqualFold(name, "save") {
+		return c.Set(name, args)
+	}
+	previous := c.Save
+	if err := c.Set(name, args); err != nil {
+		return err
+	}
+	if c.loadedSave && len(c.Save) > 0 {
+		c.Save = append(append([]SavePoint{}, previous...), c.Save...)
+	}
+	c.loadedSave = true
+	return nil
+}
+
+// Validate checks the directives that depend on each other.
+func (c *Config) Validate() error {
+	if c.RequirePass != "" && c.ACLFile != "" {
+		return errors.New("requirepass can't be combined with aclfile, set the default user's password in the ACL file")
+	}
+	if c.Port == 0 && c.TLSPort == 0 && c.UnixSocket == "" {
+		return errors.New("both port and tls-port are 0 and there is no unixsocket, no connection can be accepted")
+	}
+	if len(c.Bind) == 0 && (c.Port != 0 || c.TLSPort != 0 || c.MetricsPort != 0) {
+		return errors.New("bind needs at least one address")
+	}
+	if (c.TLSPort != 0 || c.TLSReplication) && (c.TLS.CertFile == "" || c.TLS.KeyFile == "") {
+		return errors.New("tls-cert-file and tls-key-file must be set to enable TLS")
+	}
+	return nil
+}
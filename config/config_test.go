@@ -0,0 +1,415 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeFiles writes files, named relative to a temporary directory, and
+// returns the directory. "$DIR" in their content is replaced by it, so
+// includes can use absolute paths.
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		content = strings.ReplaceAll(content, "$DIR", dir)
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestParseMemory(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{in: "0", want: 0},
+		{in: "100", want: 100},
+		{in: "100b", want: 100},
+		{in: "1k", want: 1000},
+		{in: "1kb", want: 1024},
+		{in: "1K", want: 1000},
+		{in: "1KB", want: 1024},
+		{in: "2m", want: 2 * 1000 * 1000},
+		{in: "2mb", want: 2 * 1024 * 1024},
+		{in: "3g", want: 3 * 1000 * 1000 * 1000},
+		{in: "3Gb", want: 3 * 1024 * 1024 * 1024},
+		{in: "", wantErr: true},
+		{in: "kb", wantErr: true},
+		{in: "-1", wantErr: true},
+		{in: "1.5mb", wantErr: true},
+		{in: "1tb", wantErr: true},
+		{in: "1 kb", wantErr: true},
+		{in: "9223372036854775807", want: 1<<63 - 1},
+		{in: "9223372036854775807k", wantErr: true},
+		{in: "9007199254740992kb", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseMemory(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseMemory(%q) = %d, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ParseMemory(%q) = %d, %v, want %d", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name string
+		// files are written to a temporary directory, the command line
+		// starting with "$DIR/redis.conf" when there is one of that name.
+		files map[string]string
+		args  []string
+		// want maps directive names to their expected value, as Get
+		// returns it.
+		want map[string]string
+		// wantErr is a substring of the expected error.
+		wantErr string
+	}{
+		{
+			name: "defaults",
+			want: map[string]string{"port": "6379", "bind": "* -::*", "save": "3600 1 300 100 60 10000", "replicaof": ""},
+		},
+		{
+			name:  "comments and blank lines",
+			files: map[string]string{"redis.conf": "# a comment\n\n   # an indented one\nport 7000\r\n  bind 127.0.0.1 ::1  \n"},
+			want:  map[string]string{"port": "7000", "bind": "127.0.0.1 ::1"},
+		},
+		{
+			name:  "quoted args",
+			files: map[string]string{"redis.conf": "requirepass \"pa ss\\\"wo\\x72d\"\ndir 'with spaces'\ndbfilename \"\\x64ump.rdb\"\n"},
+			want:  map[string]string{"requirepass": "pa ss\"word", "dir": "with spaces", "dbfilename": "dump.rdb"},
+		},
+		{
+			name:    "unbalanced quotes",
+			files:   map[string]string{"redis.conf": "port 7000\nrequirepass \"secret\n"},
+			wantErr: "redis.conf:2:",
+		},
+		{
+			name:  "directive names are case insensitive",
+			files: map[string]string{"redis.conf": "PORT 7000\nMaxMemory 1mb\n"},
+			want:  map[string]string{"port": "7000", "maxmemory": "1048576"},
+		},
+		{
+			name:  "memory units",
+			files: map[string]string{"redis.conf": "maxmemory 1k\n"},
+			args:  []string{"--proto-max-bulk-len", "2mb"},
+			want:  map[string]string{"maxmemory": "1000", "proto-max-bulk-len": "2097152"},
+		},
+		{
+			name:  "aliases",
+			files: map[string]string{"redis.conf": "slaveof 10.0.0.1 6380\n"},
+			want:  map[string]string{"replicaof": "10.0.0.1 6380"},
+		},
+		{
+			name:    "unknown directive",
+			files:   map[string]string{"redis.conf": "port 7000\nno-such-directive yes\n"},
+			wantErr: "redis.conf:2: 'no-such-directive yes'",
+		},
+		{
+			name:    "invalid value",
+			files:   map[string]string{"redis.conf": "port 70000\n"},
+			wantErr: "redis.conf:1:",
+		},
+		{
+			name:  "save lines accumulate",
+			files: map[string]string{"redis.conf": "save 900 1\nsave 300 10\nsave 60 10000\n"},
+			want:  map[string]string{"save": "900 1 300 10 60 10000"},
+		},
+		{
+			name:  "save replaces the defaults",
+			files: map[string]string{"redis.conf": "save 60 1\n"},
+			want:  map[string]string{"save": "60 1"},
+		},
+		{
+			name:  "save with several points on a line",
+			files: map[string]string{"redis.conf": "save 900 1 300 10\nsave 60 10000\n"},
+			want:  map[string]string{"save": "900 1 300 10 60 10000"},
+		},
+		{
+			name:  "save disabled",
+			files: map[string]string{"redis.conf": "save \"\"\n"},
+			want:  map[string]string{"save": ""},
+		},
+		{
+			name:  "save on the command line adds to the file",
+			files: map[string]string{"redis.conf": "save 900 1\n"},
+			args:  []string{"--save", "300", "10"},
+			want:  map[string]string{"save": "900 1 300 10"},
+		},
+		{
+			name: "save on the command line only",
+			args: []string{"--save", "60 1", "--save", "30 5"},
+			want: map[string]string{"save": "60 1 30 5"},
+		},
+		{
+			name: "nested includes",
+			files: map[string]string{
+				"redis.conf": "port 7000\ninclude $DIR/a.conf\nmaxmemory 1mb\n",
+				"a.conf":     "include $DIR/b.conf\ntimeout 30\n",
+				"b.conf":     "port 7001\nmaxmemory 1gb\n",
+			},
+			want: map[string]string{"port": "7001", "timeout": "30", "maxmemory": "1048576"},
+		},
+		{
+			name: "save lines accumulate across includes",
+			files: map[string]string{
+				"redis.conf": "save 900 1\ninclude $DIR/a.conf\n",
+				"a.conf":     "save 300 10\n",
+			},
+			want: map[string]string{"save": "900 1 300 10"},
+		},
+		{
+			name: "include of a missing file",
+			files: map[string]string{
+				"redis.conf": "include $DIR/missing.conf\n",
+			},
+			wantErr: "failed to read the configuration file",
+		},
+		{
+			name: "include without a path",
+			files: map[string]string{
+				"redis.conf": "include\n",
+			},
+			wantErr: "redis.conf:1: 'include'",
+		},
+		{
+			name:    "include of itself",
+			files:   map[string]string{"redis.conf": "include $DIR/redis.conf\n"},
+			wantErr: "too many nested includes",
+		},
+		{
+			name: "includes including each other",
+			files: map[string]string{
+				"redis.conf": "include $DIR/a.conf\n",
+				"a.conf":     "include $DIR/b.conf\n",
+				"b.conf":     "include $DIR/a.conf\n",
+			},
+			wantErr: "too many nested includes",
+		},
+		{
+			name:  "options override the file",
+			files: map[string]string{"redis.conf": "port 7000\ntimeout 30\n"},
+			args:  []string{"--port", "7001"},
+			want:  map[string]string{"port": "7001", "timeout": "30"},
+		},
+		{
+			name: "replicaof with its two arguments",
+			args: []string{"--replicaof", "127.0.0.1", "6380", "--port", "7000"},
+			want: map[string]string{"replicaof": "127.0.0.1 6380", "port": "7000"},
+		},
+		{
+			name: "replicaof as a single argument",
+			args: []string{"--replicaof", "127.0.0.1 6380"},
+			want: map[string]string{"replicaof": "127.0.0.1 6380"},
+		},
+		{
+			name:    "replicaof without its port",
+			args:    []string{"--replicaof", "127.0.0.1", "--port", "7000"},
+			wantErr: "--replicaof:",
+		},
+		{
+			name: "name=value options",
+			args: []string{"--port=7000", "--requirepass=a=b", "--maxmemory=2kb"},
+			want: map[string]string{"port": "7000", "requirepass": "a=b", "maxmemory": "2048"},
+		},
+		{
+			name: "single dash options",
+			args: []string{"-port", "7000", "-timeout=30"},
+			want: map[string]string{"port": "7000", "timeout": "30"},
+		},
+		{
+			name: "values starting with a dash",
+			args: []string{"--bind", "127.0.0.1", "-::1", "--port", "7000"},
+			want: map[string]string{"bind": "127.0.0.1 -::1", "port": "7000"},
+		},
+		{
+			name:    "argument that isn't an option",
+			files:   map[string]string{"redis.conf": "port 7000\n"},
+			args:    []string{"port", "7001"},
+			wantErr: "invalid argument 'port'",
+		},
+		{
+			name:    "unknown option",
+			args:    []string{"--no-such-directive", "yes"},
+			wantErr: "--no-such-directive:",
+		},
+		{
+			name:    "option without a value",
+			args:    []string{"--port"},
+			wantErr: "--port:",
+		},
+		{
+			name:    "validation",
+			args:    []string{"--requirepass", "secret", "--aclfile", "users.acl"},
+			wantErr: "requirepass can't be combined with aclfile",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeFiles(t, tt.files)
+			var args []string
+			if _, ok := tt.files["redis.conf"]; ok {
+				args = append(args, filepath.Join(dir, "redis.conf"))
+			}
+			args = append(args, tt.args...)
+
+			c, err := Load(args)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Load(%q) error = %v, want one containing %q", args, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load(%q): %v", args, err)
+			}
+			for name, want := range tt.want {
+				if got := c.Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"redis.conf": "port 7000\n"})
+	c, err := Load([]string{filepath.Join(dir, "redis.conf")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(dir, "redis.conf"); c.File != want {
+		t.Errorf("File = %q, want %q", c.File, want)
+	}
+
+	c, err = Load([]string{"--port", "7000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.File != "" {
+		t.Errorf("File = %q without a configuration file, want none", c.File)
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		// set is applied to the loaded configuration before Rewrite.
+		set  map[string]string
+		want string
+	}{
+		{
+			name:  "nothing changed",
+			files: map[string]string{"redis.conf": "# Server\nport 7000\n\n# Snapshots\nsave 900 1\nsave 300 10\n"},
+			want:  "# Server\nport 7000\n\n# Snapshots\nsave 900 1 300 10\n",
+		},
+		{
+			name: "comments, layout and includes are kept",
+			files: map[string]string{
+				"redis.conf":  "# Main configuration\n\ninclude $DIR/common.conf\n\n  # Network\n  port 7000\nbind 127.0.0.1\n\n# Memory\nmaxmemory 1mb\n",
+				"common.conf": "timeout 30\n",
+			},
+			set: map[string]string{"port": "7001", "maxmemory": "2mb"},
+			want: "# Main configuration\n\ninclude $DIR/common.conf\n\n  # Network\nport 7001\nbind 127.0.0.1\n\n# Memory\nmaxmemory 2097152\n" +
+				// Like Redis, what the includes set is written to the main file.
+				rewriteSignature + "\ntimeout 30\n",
+		},
+		{
+			name:  "repeated directives are written once",
+			files: map[string]string{"redis.conf": "save 900 1\n# between\nsave 300 10\nport 7000\nport 7001\n"},
+			set:   map[string]string{"save": "60 5"},
+			want:  "save 60 5\n# between\nport 7001\n",
+		},
+		{
+			name:  "aliases are written under their name",
+			files: map[string]string{"redis.conf": "slaveof 10.0.0.1 6380\n"},
+			set:   map[string]string{"replicaof": "10.0.0.2 6381"},
+			want:  "replicaof 10.0.0.2 6381\n",
+		},
+		{
+			name:  "directives set back to nothing are removed",
+			files: map[string]string{"redis.conf": "port 7000\nreplicaof 10.0.0.1 6380\n"},
+			set:   map[string]string{"replicaof": "no one"},
+			want:  "port 7000\n",
+		},
+		{
+			name:  "changed directives missing from the file are appended",
+			files: map[string]string{"redis.conf": "# Server\nport 7000\n"},
+			set:   map[string]string{"timeout": "30", "requirepass": "pa ss", "port": "7000"},
+			want:  "# Server\nport 7000\n" + rewriteSignature + "\nrequirepass \"pa ss\"\ntimeout 30\n",
+		},
+		{
+			name:  "the signature isn't repeated",
+			files: map[string]string{"redis.conf": "port 7000\n" + rewriteSignature + "\ntimeout 30\n"},
+			set:   map[string]string{"timeout": "60", "maxmemory": "1kb"},
+			want:  "port 7000\n" + rewriteSignature + "\ntimeout 60\nmaxmemory 1024\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeFiles(t, tt.files)
+			path := filepath.Join(dir, "redis.conf")
+			c, err := Load([]string{path})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, value := range tt.set {
+				if err := c.Set(name, []string{value}); err != nil {
+					t.Fatalf("Set(%s, %q): %v", name, value, err)
+				}
+			}
+			if err := c.Rewrite(); err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := strings.ReplaceAll(tt.want, "$DIR", dir)
+			if string(data) != want {
+				t.Errorf("rewritten file:\n%s\nwant:\n%s", data, want)
+			}
+
+			// The rewritten file loads back to the same configuration, and
+			// rewriting it again changes nothing.
+			reloaded, err := Load([]string{path})
+			if err != nil {
+				t.Fatalf("loading the rewritten file: %v", err)
+			}
+			for _, name := range Names() {
+				if got, want := reloaded.Get(name), c.Get(name); got != want {
+					t.Errorf("reloaded %s = %q, want %q", name, got, want)
+				}
+			}
+			if err := reloaded.Rewrite(); err != nil {
+				t.Fatal(err)
+			}
+			if again, _ := os.ReadFile(path); string(again) != string(data) {
+				t.Errorf("second rewrite:\n%s\nwant:\n%s", again, data)
+			}
+		})
+	}
+}
+
+func TestRewriteWithoutFile(t *testing.T) {
+	c, err := Load(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rewrite(); !errors.Is(err, ErrNoFile) {
+		t.Errorf("Rewrite() = %v, want %v", err, ErrNoFile)
+	}
+}
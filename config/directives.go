@@ -0,0 +1,416 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var errWrongArgs = errors.New("wrong number of arguments")
+
+// directive is a configuration directive: how to set it from its arguments
+// and how to write its current value back.
+type directive struct {
+	set func(c *Config, args []string) error
+	// get returns the arguments setting the current value, nil when there
+	// is nothing to set.
+	get func(c *Config) []string
+	// mutable directives can be changed at runtime with CONFIG SET.
+	mutable bool
+}
+
+// directives maps the directive names to their definitions.
+var directives = map[string]*directive{
+	"port":           intDirective(func(c *Config) *int { return &c.Port }, 0, 65535),
+	"bind":           listDirective(func(c *Config) *[]string { return &c.Bind }),
+	"protected-mode": mutable(boolDirective(func(c *Config) *bool { return &c.ProtectedMode })),
+	"unixsocket":     stringDirective(func(c *Config) *string { return &c.UnixSocket }),
+	"unixsocketperm": {set: setPerm, get: getPerm},
+	"metrics-port":   intDirective(func(c *Config) *int { return &c.MetricsPort }, 0, 65535),
+
+	"tls-port":              intDirective(func(c *Config) *int { return &c.TLSPort }, 0, 65535),
+	"tls-cert-file":         mutable(stringDirective(func(c *Config) *string { return &c.TLS.CertFile })),
+	"tls-key-file":          mutable(stringDirective(func(c *Config) *string { return &c.TLS.KeyFile })),
+	"tls-client-cert-file":  mutable(stringDirective(func(c *Config) *string { return &c.TLS.ClientCertFile })),
+	"tls-client-key-file":   mutable(stringDirective(func(c *Config) *string { return &c.TLS.ClientKeyFile })),
+	"tls-ca-cert-file":      mutable(stringDirective(func(c *Config) *string { return &c.TLS.CACertFile })),
+	"tls-ca-cert-dir":       mutable(stringDirective(func(c *Config) *string { return &c.TLS.CACertDir })),
+	"tls-auth-clients":      mutable(enumDirective(func(c *Config) *string { return &c.TLS.AuthClients }, "yes", "optional", "no")),
+	"tls-auth-clients-user": mutable(enumDirective(func(c *Config) *string { return &c.TLS.AuthClientsUser }, "CN", "off")),
+	"tls-replication":       boolDirective(func(c *Config) *bool { return &c.TLSReplication }),
+
+	"requirepass": mutable(stringDirective(func(c *Config) *string { return &c.RequirePass })),
+	"aclfile":     stringDirective(func(c *Config) *string { return &c.ACLFile }),
+
+	"replicaof":  {set: setReplicaOf, get: getReplicaOf},
+	"masteruser": stringDirective(func(c *Config) *string { return &c.MasterUser }),
+	"masterauth": stringDirective(func(c *Config) *string { return &c.MasterAuth }),
+
+	"dir":        mutable(stringDirective(func(c *Config) *string { return &c.Dir })),
+	"dbfilename": {set: setDBFilename, get: func(c *Config) []string { return []string{c.DBFilename} }, mutable: true},
+	"save":       {set: setSave, get: getSave, mutable: true},
+
+	// There is no AOF, appendfsync is only accepted so Redis configuration
+	// files load.
+	"appendfsync": enumDirective(func(c *Config) *string { return &c.AppendFsync }, "always", "everysec", "no"),
+
+	"databases":              intDirective(func(c *Config) *int { return &c.Databases }, 1, 1<<20),
+	"shards":                 intDirective(func(c *Config) *int { return &c.Shards }, 1, 1<<16),
+	"proto-max-bulk-len":     memoryDirective(func(c *Config) *int64 { return &c.ProtoMaxBulkLen }, 1024*1024),
+	"notify-keyspace-events": mutable(stringDirective(func(c *Config) *string { return &c.NotifyKeyspaceEvents })),
+
+	"maxmemory":         mutable(memoryDirective(func(c *Config) *int64 { return &c.MaxMemory }, 0)),
+	"maxmemory-policy":  mutable(enumDirective(func(c *Config) *string { return &c.MaxMemoryPolicy }, MaxMemoryPolicies...)),
+	"maxmemory-samples": mutable(intDirective(func(c *Config) *int { return &c.MaxMemorySamples }, 1, 64)),
+
+	"timeout":              mutable(intDirective(func(c *Config) *int { return &c.Timeout }, 0, 1<<31-1)),
+	"busy-reply-threshold": mutable(intDirective(func(c *Config) *int { return &c.BusyReplyThreshold }, 0, 1<<31-1)),
+	"loglevel":             mutable(enumDirective(func(c *Config) *string { return &c.LogLevel }, "debug", "verbose", "notice", "warning", "nothing")),
+
+	"slowlog-log-slower-than": mutable(intDirective(func(c *Config) *int { return &c.SlowlogLogSlowerThan }, -1<<31, 1<<31-1)),
+	"slowlog-max-len":         mutable(intDirective(func(c *Config) *int { return &c.SlowlogMaxLen }, 0, 1<<31-1)),
+}
+
+// aliases maps the old names Redis still accepts to the directives.
+var aliases = map[string]string{
+	"slaveof":        "replicaof",
+	"lua-time-limit": "busy-reply-threshold",
+}
+
+// MaxMemoryPolicies are the values of maxmemory-policy.
+var MaxMemoryPolicies = []string{
+	"volatile-lru", "volatile-lfu", "volatile-random", "volatile-ttl",
+	"allkeys-lru", "allkeys-lfu", "allkeys-random", "noeviction",
+}
+
+// lookup returns the directive called name, or one of its aliases, and its
+// canonical name.
+func lookup(name string) (*directive, string) {
+	name = strings.ToLower(name)
+	if alias, ok := aliases[name]; ok {
+		name = alias
+	}
+	return directives[name], name
+}
+
+// Names returns the sorted names of the directives, without the aliases.
+func Names() []string {
+	names := make([]string, 0, len(directives))
+	for name := range directives {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Exists reports whether name, case insensitive, is a directive or an alias.
+func Exists(name string) bool {
+	d, _ := lookup(name)
+	return d != nil
+}
+
+// Mutable reports whether the directive name can be changed at runtime.
+func Mutable(name string) bool {
+	d, _ := lookup(name)
+	return d != nil && d.mutable
+}
+
+// Set applies the directive name, case insensitive, with its arguments.
+func (c *Config) Set(name string, args []string) error {
+	d, _ := lookup(name)
+	if d == nil {
+		return errors.New("Bad directive or wrong number of arguments")
+	}
+	return d.set(c, args)
+}
+
+// Get returns the value of the directive name as CONFIG GET shows it, its
+// arguments separated by spaces.
+func (c *Config) Get(name string) string {
+	d, _ := lookup(name)
+	if d == nil {
+		return ""
+	}
+	return strings.Join(d.get(c), " ")
+}
+
+// Clone returns a copy of c, which can be changed with Set without
+// affecting c.
+func (c *Config) Clone() *Config {
+	clone := *c
+	return &clone
+}
+
+func mutable(d *directive) *directive {
+	d.mutable = true
+	return d
+}
+
+func stringDirective(field func(c *Config) *string) *directive {
+	return &directive{
+		set: func(c *Config, args []string) error { return setString(field(c), args) },
+		get: func(c *Config) []string { return []string{*field(c)} },
+	}
+}
+
+func enumDirective(field func(c *Config) *string, values ...string) *directive {
+	return &directive{
+		set: func(c *Config, args []string) error { return setEnum(field(c), args, values...) },
+		get: func(c *Config) []string { return []string{*field(c)} },
+	}
+}
+
+func intDirective(field func(c *Config) *int, min, max int) *directive {
+	return &directive{
+		set: func(c *Config, args []string) error { return setInt(field(c), args, min, max) },
+		get: func(c *Config) []string { return []string{strconv.Itoa(*field(c))} },
+	}
+}
+
+func boolDirective(field func(c *Config) *bool) *directive {
+	return &directive{
+		set: func(c *Config, args []string) error { return setBool(field(c), args) },
+		get: func(c *Config) []string {
+			if *field(c) {
+				return []string{"yes"}
+			}
+			return []string{"no"}
+		},
+	}
+}
+
+func listDirective(field func(c *Config) *[]string) *directive {
+	return &directive{
+		set: func(c *Config, args []string) error { return setList(field(c), args) },
+		get: func(c *Config) []string { return *field(c) },
+	}
+}
+
+func memoryDirective(field func(c *Config) *int64, min int64) *directive {
+	return &directive{
+		set: func(c *Config, args []string) error { return setMemory(field(c), args, min) },
+		get: func(c *Config) []string { return []string{strconv.FormatInt(*field(c), 10)} },
+	}
+}
+
+func oneArg(args []string) (string, error) {
+	if len(args) != 1 {
+		return "", errWrongArgs
+	}
+	return args[0], nil
+}
+
+func setString(p *string, args []string) error {
+	value, err := oneArg(args)
+	if err != nil {
+		return err
+	}
+	*p = value
+	return nil
+}
+
+func setEnum(p *string, args []string, values ...string) error {
+	value, err := oneArg(args)
+	if err != nil {
+		return err
+	}
+	for _, v := range values {
+		if strings.EqualFold(value, v) {
+			*p = v
+			return nil
+		}
+	}
+	return fmt.Errorf("argument must be one of: %s", strings.Join(values, ", "))
+}
+
+func setInt(p *int, args []string, min, max int) error {
+	value, err := oneArg(args)
+	if err != nil {
+		return err
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return errors.New("argument couldn't be parsed into an integer")
+	}
+	if n < min || n > max {
+		return fmt.Errorf("argument must be between %d and %d inclusive", min, max)
+	}
+	*p = n
+	return nil
+}
+
+// setBool accepts yes and no. A boolean without argument is yes, so
+// "--tls-replication" alone enables it.
+func setBool(p *bool, args []string) error {
+	if len(args) == 0 {
+		*p = true
+		return nil
+	}
+	value, err := oneArg(args)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(value) {
+	case "yes":
+		*p = true
+	case "no":
+		*p = false
+	default:
+		return errors.New("argument must be 'yes' or 'no'")
+	}
+	return nil
+}
+
+// words splits the arguments of a directive taking several words, which
+// may be given as separate arguments or as a single one separated by spaces,
+// like CONFIG SET does.
+func words(args []string) []string {
+	var list []string
+	for _, arg := range args {
+		list = append(list, strings.Fields(arg)...)
+	}
+	return list
+}
+
+func setList(p *[]string, args []string) error {
+	*p = words(args)
+	return nil
+}
+
+func setPerm(c *Config, args []string) error {
+	value, err := oneArg(args)
+	if err != nil {
+		return err
+	}
+	perm, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || perm > 0777 {
+		return errors.New("argument must be an octal permission like 700")
+	}
+	c.UnixSocketPerm = os.FileMode(perm)
+	return nil
+}
+
+func getPerm(c *Config) []string {
+	return []string{strconv.FormatUint(uint64(c.UnixSocketPerm), 8)}
+}
+
+func setMemory(p *int64, args []string, min int64) error {
+	value, err := oneArg(args)
+	if err != nil {
+		return err
+	}
+	n, err := ParseMemory(value)
+	if err != nil {
+		return err
+	}
+	if n < min {
+		return fmt.Errorf("argument must be at least %d", min)
+	}
+	*p = n
+	return nil
+}
+
+// setReplicaOf sets the leader from "host port", or makes the server a
+// leader with "no one".
+func setReplicaOf(c *Config, args []string) error {
+	words := words(args)
+	if len(words) != 2 {
+		return errWrongArgs
+	}
+	if strings.EqualFold(words[0], "no") && strings.EqualFold(words[1], "one") {
+		c.ReplicaOfHost, c.ReplicaOfPort = "", 0
+		return nil
+	}
+	port, err := strconv.Atoi(words[1])
+	if err != nil || port < 1 || port > 65535 {
+		return errors.New("Invalid master port")
+	}
+	c.ReplicaOfHost, c.ReplicaOfPort = words[0], port
+	return nil
+}
+
+func getReplicaOf(c *Config) []string {
+	if !c.IsReplica() {
+		return nil
+	}
+	return []string{c.ReplicaOfHost, strconv.Itoa(c.ReplicaOfPort)}
+}
+
+// setDBFilename rejects paths, the file always being in dir.
+func setDBFilename(c *Config, args []string) error {
+	value, err := oneArg(args)
+	if err != nil {
+		return err
+	}
+	if value != filepath.Base(value) {
+		return errors.New("dbfilename can't be a path, just a filename")
+	}
+	c.DBFilename = value
+	return nil
+}
+
+// setSave replaces the save points with the "seconds changes" pairs of
+// args, none of them when args is "".
+func setSave(c *Config, args []string) error {
+	words := words(args)
+	if len(words)%2 != 0 {
+		return errors.New("Invalid save parameters")
+	}
+	points := make([]SavePoint, 0, len(words)/2)
+	for i := 0; i < len(words); i += 2 {
+		seconds, err1 := strconv.Atoi(words[i])
+		changes, err2 := strconv.Atoi(words[i+1])
+		if err1 != nil || err2 != nil || seconds < 1 || changes < 0 {
+			return errors.New("Invalid save parameters")
+		}
+		points = append(points, SavePoint{Seconds: seconds, Changes: changes})
+	}
+	c.Save = points
+	return nil
+}
+
+// getSave returns the save points, or a single empty argument when there
+// are none, as `save ""` disables saving.
+func getSave(c *Config) []string {
+	if len(c.Save) == 0 {
+		return []string{""}
+	}
+	var args []string
+	for _, p := range c.Save {
+		args = append(args, strconv.Itoa(p.Seconds), strconv.Itoa(p.Changes))
+	}
+	return args
+}
+
+// memoryUnits are the multipliers of the units a memory amount may end with.
+var memoryUnits = map[string]int64{
+	"":   1,
+	"b":  1,
+	"k":  1000,
+	"kb": 1024,
+	"m":  1000 * 1000,
+	"mb": 1024 * 1024,
+	"g":  1000 * 1000 * 1000,
+	"gb": 1024 * 1024 * 1024,
+}
+
+// ParseMemory parses a memory amount like 100mb, the unit being case
+// insensitive.
+func ParseMemory(s string) (int64, error) {
+	digits := strings.TrimRightFunc(s, func(r rune) bool {
+		return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z'
+	})
+	unit, ok := memoryUnits[strings.ToLower(s[len(digits):])]
+	if !ok {
+		return 0, errors.New("argument must be a memory value")
+	}
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || n < 0 || n > (1<<63-1)/unit {
+		return 0, errors.New("argument must be a memory value")
+	}
+	return n * unit, nil
+}
@@ -0,0 +1,151 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/therahulbhati/go-redis-clone/pkg/utils"
+)
+
+// ErrNoFile is returned by Rewrite when the server was started without a
+// configuration file.
+var ErrNoFile = errors.New("The server is running without a config file")
+
+// rewriteSignature heads the directives Rewrite appends to the file.
+const rewriteSignature = "# Generated by CONFIG REWRITE"
+
+// Rewrite writes the configuration back to File, keeping its comments,
+// includes and layout. The first line of each directive is replaced by its
+// current value and the other ones are dropped. Directives missing from the
+// file are appended when they differ from the default. The file is replaced
+// atomically.
+func (c *Config) Rewrite() error {
+	if c.File == "" {
+		return ErrNoFile
+	}
+	data, err := os.ReadFile(c.File)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	var lines []string
+	written := make(map[string]bool)
+	signed := false
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == rewriteSignature {
+			signed = true
+		}
+		args, err := utils.SplitArgs(trimmed)
+		if trimmed == "" || trimmed[0] == '#' || err != nil || len(args) == 0 {
+			lines = append(lines, line)
+			continue
+		}
+		d, name := lookup(args[0])
+		if d == nil {
+			// include lines and directives of other servers are kept.
+			lines = append(lines, line)
+			continue
+		}
+		if written[name] {
+			continue
+		}
+		written[name] = true
+		if args := d.get(c); args != nil {
+			lines = append(lines, formatLine(name, args))
+		}
+	}
+
+	defaults := Default()
+	var added []string
+	for _, name := range Names() {
+		d := directives[name]
+		if written[name] || d.get(c) == nil || slices.Equal(d.get(c), d.get(defaults)) {
+			continue
+		}
+		added = append(added, formatLine(name, d.get(c)))
+	}
+	if len(added) > 0 {
+		if !signed {
+			lines = append(lines, rewriteSignature)
+		}
+		lines = append(lines, added...)
+	}
+	return writeFile(c.File, strings.TrimLeft(strings.Join(lines, "\n"), "\n")+"\n")
+}
+
+// formatLine returns the configuration line setting name to args, quoting
+// the arguments SplitArgs wouldn't read back as they are.
+func formatLine(name string, args []string) string {
+	var b strings.Builder
+	b.WriteString(name)
+	for _, arg := range args {
+		b.WriteByte(' ')
+		b.WriteString(quote(arg))
+	}
+	return b.String()
+}
+
+// quote returns arg as is, or double quoted with escapes when it's empty or
+// holds spaces, quotes or control characters.
+func quote(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\r\n\"'\\") && !strings.ContainsFunc(arg, func(r rune) bool {
+		return r < ' ' || r == 0x7f
+	}) {
+		return arg
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(arg); i++ {
+		switch ch := arg[i]; {
+		case ch == '\\' || ch == '"':
+			b.WriteByte('\\')
+			b.WriteByte(ch)
+		case ch == '\n':
+			b.WriteString(`\n`)
+		case ch == '\r':
+			b.WriteString(`\r`)
+		case ch == '\t':
+			b.WriteString(`\t`)
+		case ch < ' ' || ch == 0x7f:
+			fmt.Fprintf(&b, `\x%02x`, ch)
+		default:
+			b.WriteByte(ch)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// writeFile replaces path with content through a temporary file renamed
+// into place, keeping the permissions of the original file.
+func writeFile(path, content string) error {
+	perm := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		perm = info.Mode().Perm()
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "temp-*.conf")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
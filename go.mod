@@ -1,3 +1,5 @@
 module github.com/therahulbhati/go-redis-clone
 
 go 1.22
+
+require github.com/yuin/gopher-lua v1.1.1
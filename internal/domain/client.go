@@ -0,0 +1,272 @@
+package domain
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/therahulbhati/go-redis-clone/pkg/resp"
+)
+
+// maxPendingPushes bounds the bytes of messages pushed to a client that
+// couldn't be written yet, like the hard pubsub client-output-buffer-limit
+// of Redis. The connection is closed once it's exceeded.
+const maxPendingPushes = 32 * 1024 * 1024
+
+// Client is the state a connection carries between commands. It is owned by
+// the goroutine serving the connection, so its fields need no locking, except
+// for the ones used by Push.
+type Client struct {
+	ID   int64
+	Conn net.Conn
+	// Out is where replies and pushed messages are written to Conn through,
+	// which counts the traffic.
+	Out       io.Writer
+	CreatedAt time.Time
+	Name      string
+	// DB is the selected logical database.
+	DB int
+	// User is the ACL user the client is authenticated as, or would be
+	// once Authenticated is set.
+	User          string
+	Authenticated bool
+	// Writer buffers the replies to the client and holds the negotiated
+	// protocol version.
+	Writer *resp.Writer
+	// Tx holds the commands queued since MULTI, nil outside a transaction.
+	Tx *Transaction
+	// Watched holds the keys watched with WATCH and their versions at the
+	// time, which EXEC compares against.
+	Watched []WatchedKey
+	// LastWriteOffset is the replication offset right after the client's
+	// most recent propagated write, which is what WAIT waits for.
+	LastWriteOffset int64
+	// Master marks the follower's link to its leader, whose commands are
+	// applied without replying. Replica marks a follower's connection on the
+	// leader, once it sent PSYNC.
+	Master  bool
+	Replica bool
+	// ListeningPort is the port a follower announced with REPLCONF
+	// listening-port before PSYNC.
+	ListeningPort int
+	// NoEvict is set with CLIENT NO-EVICT and ReplyMode with CLIENT REPLY.
+	NoEvict   bool
+	ReplyMode ReplyMode
+	// QueryBuf is the number of bytes received but not yet processed.
+	QueryBuf int
+	// Channels, Patterns and ShardChannels are the channels and patterns
+	// subscribed to with SUBSCRIBE, PSUBSCRIBE and SSUBSCRIBE.
+	Channels      map[string]struct{}
+	Patterns      map[string]struct{}
+	ShardChannels map[string]struct{}
+
+	// infoMu guards info, the copy of the client state other clients see in
+	// CLIENT LIST.
+	infoMu sync.Mutex
+	info   ClientInfo
+
+	// protocol mirrors the protocol version of Writer for the goroutines
+	// pushing messages, which must not touch Writer.
+	protocol atomic.Int32
+
+	// pushMu guards the messages pushed by other clients. While busy, the
+	// owner is serving commands and owns Writer, so pushes are queued in
+	// pending and written by EndReply. Otherwise a drain goroutine writes
+	// them and drained is closed once it's done.
+	pushMu       sync.Mutex
+	busy         bool
+	drained      chan struct{}
+	pending      []resp.Value
+	pendingBytes int
+}
+
+// ReplyMode selects which replies are sent, see CLIENT REPLY.
+type ReplyMode int
+
+const (
+	ReplyOn ReplyMode = iota
+	ReplyOff
+	// ReplySkip drops the reply of the next command only.
+	ReplySkip
+)
+
+// ClientInfo is the part of the client state shown to other clients, which
+// its goroutine publishes after every command.
+type ClientInfo struct {
+	Name          string
+	User          string
+	DB            int
+	Channels      int
+	Patterns      int
+	ShardChannels int
+	// Multi is the number of queued commands, -1 outside MULTI.
+	Multi           int
+	QueryBuf        int
+	LastCommand     string
+	LastInteraction time.Time
+	Replica         bool
+	NoEvict         bool
+	// Blocked is set while the client waits in a blocking command.
+	Blocked bool
+	// Watched is the number of keys watched with WATCH.
+	Watched int
+}
+
+// Transaction is the state of a MULTI block.
+type Transaction struct {
+	Queued [][]string
+	// Aborted is set when a command failed to queue, so EXEC must fail.
+	Aborted bool
+	// Executing is set while EXEC runs the queued commands, whose writes
+	// are collected in Writes and propagated together.
+	Executing bool
+	Writes    []ReplicatedCommand
+}
+
+// WatchedKey is a key watched by a client.
+type WatchedKey struct {
+	DB      int
+	Key     string
+	Version uint64
+}
+
+// Protocol returns the RESP version negotiated with HELLO.
+func (c *Client) Protocol() int {
+	return c.Writer.Protocol()
+}
+
+// SetProtocol switches the RESP version spoken with the client.
+func (c *Client) SetProtocol(proto int) {
+	c.Writer.SetProtocol(proto)
+	c.protocol.Store(int32(proto))
+}
+
+// PushProtocol returns the RESP version of the client to the goroutines of
+// other clients, which decide on the messages to push with it.
+func (c *Client) PushProtocol() int {
+	if proto := c.protocol.Load(); proto != 0 {
+		return int(proto)
+	}
+	return 2
+}
+
+// SubscriptionCount returns the number of channels, patterns and shard
+// channels the client is subscribed to.
+func (c *Client) SubscriptionCount() int {
+	return len(c.Channels) + len(c.Patterns) + len(c.ShardChannels)
+}
+
+// BeginReply marks the client as serving commands, handing Writer over to
+// its own goroutine until EndReply.
+func (c *Client) BeginReply() {
+	c.pushMu.Lock()
+	defer c.pushMu.Unlock()
+	for c.drained != nil {
+		drained := c.drained
+		c.pushMu.Unlock()
+		<-drained
+		c.pushMu.Lock()
+	}
+	c.busy = true
+}
+
+// EndReply flushes the replies, followed by the messages pushed while they
+// were being produced.
+func (c *Client) EndReply() error {
+	for {
+		if err := c.Writer.Flush(); err != nil {
+			c.pushMu.Lock()
+			c.busy = false
+			c.pushMu.Unlock()
+			return err
+		}
+		c.pushMu.Lock()
+		if len(c.pending) == 0 {
+			c.busy = false
+			c.pushMu.Unlock()
+			return nil
+		}
+		c.writePending(c.Writer)
+		c.pushMu.Unlock()
+	}
+}
+
+// Push delivers an out of band message, such as a pub/sub message, from
+// another client's goroutine. It never blocks on the connection: the message
+// is queued and written once the client's own replies are out of the way.
+func (c *Client) Push(msg resp.Value) {
+	c.pushMu.Lock()
+	defer c.pushMu.Unlock()
+	c.pending = append(c.pending, msg)
+	c.pendingBytes += valueSize(msg)
+	if c.pendingBytes > maxPendingPushes {
+		c.pending, c.pendingBytes = nil, 0
+		c.Conn.Close()
+		return
+	}
+	if !c.busy && c.drained == nil {
+		c.drained = make(chan struct{})
+		go c.drain()
+	}
+}
+
+// drain writes the pushed messages while the client is idle, with a writer
+// of its own so pushes arriving meanwhile aren't blocked by the connection.
+func (c *Client) drain() {
+	w := resp.NewWriter(c.Out)
+	c.pushMu.Lock()
+	for len(c.pending) > 0 {
+		w.SetProtocol(c.Writer.Protocol())
+		c.writePending(w)
+		c.pushMu.Unlock()
+		err := w.Flush()
+		c.pushMu.Lock()
+		if err != nil {
+			break
+		}
+	}
+	close(c.drained)
+	c.drained = nil
+	c.pushMu.Unlock()
+}
+
+// writePending encodes the queued messages into w. It's called with pushMu
+// held.
+func (c *Client) writePending(w *resp.Writer) {
+	for _, msg := range c.pending {
+		w.WriteValue(msg)
+	}
+	c.pending, c.pendingBytes = nil, 0
+}
+
+func valueSize(v resp.Value) int {
+	n := len(v.Str) + 16
+	for _, elem := range v.Array {
+		n += valueSize(elem)
+	}
+	return n
+}
+
+// SetInfo publishes the state of the client shown to other clients.
+func (c *Client) SetInfo(info ClientInfo) {
+	c.infoMu.Lock()
+	c.info = info
+	c.infoMu.Unlock()
+}
+
+// Info returns the state last published with SetInfo.
+func (c *Client) Info() ClientInfo {
+	c.infoMu.Lock()
+	defer c.infoMu.Unlock()
+	return c.info
+}
+
+// PendingPushes returns the number and the approximate size of the messages
+// pushed to the client and not yet written.
+func (c *Client) PendingPushes() (int, int) {
+	c.pushMu.Lock()
+	defer c.pushMu.Unlock()
+	return len(c.pending), c.pendingBytes
+}
@@ -1,8 +1,50 @@
 package domain
 
-import "net"
+import (
+	"io"
+	"net"
+
+	"github.com/therahulbhati/go-redis-clone/config"
+	"github.com/therahulbhati/go-redis-clone/internal/tlsconfig"
+)
 
 type CommandHandler interface {
 	HandleClient(conn net.Conn)
-	ProcessCommand(parts []string, conn net.Conn)
+	// NewClient creates the state of a connection served outside
+	// HandleClient. Master clients are applied without replies.
+	NewClient(conn net.Conn, master bool) *Client
+	// RemoveClient forgets a client created with NewClient once its
+	// connection is gone.
+	RemoveClient(client *Client)
+	// ProcessCommand executes one command on behalf of client. Replies are
+	// buffered in client.Writer and flushing them is up to the caller.
+	ProcessCommand(client *Client, parts []string)
+	// LoadSnapshot replaces the dataset and the function libraries with the
+	// RDB file read from r, leaving them untouched when it can't be read.
+	LoadSnapshot(r io.Reader) error
+	// Save writes the dataset and the function libraries to the RDB file.
+	Save() error
+	// Config returns the current configuration, which CONFIG SET replaces.
+	Config() *config.Config
+	// SetNotifyKeyspaceEvents selects the keyspace notifications published,
+	// in the notify-keyspace-events syntax.
+	SetNotifyKeyspaceEvents(classes string) error
+	// SetRequirePass sets the password of the default user, empty to let
+	// connections in without authenticating.
+	SetRequirePass(password string)
+	// SetACLFile selects the ACL file used by ACL LOAD and ACL SAVE, and
+	// loads the users from it.
+	SetACLFile(path string) error
+	// SetProtectedMode selects whether remote connections are refused
+	// while the default user has no password.
+	SetProtectedMode(enabled bool)
+	// SetTLSConfig selects the TLS configuration CONFIG SET updates and
+	// client certificates are checked with, nil when TLS is disabled.
+	SetTLSConfig(config *tlsconfig.Config)
+	// SetFollower selects the follower manager INFO reports the link to
+	// the leader of, on followers.
+	SetFollower(follower FollowerManager)
+	// WriteMetrics writes the server metrics to w in the Prometheus text
+	// exposition format.
+	WriteMetrics(w io.Writer) error
 }
@@ -1,20 +1,73 @@
 package domain
 
-import "net"
+import (
+	"net"
+	"time"
+)
 
 // ReplicationManager defines the interface for managing replication.
 type LeaderManager interface {
-	SendFullResync(conn net.Conn) error
+	// SendFullResync sends FULLRESYNC followed by the RDB snapshot rdb.
+	SendFullResync(conn net.Conn, rdb []byte) error
 	GetLeaderReplID() string
 	GetLeaderReplOffset() int64
-	AddFollower(conn net.Conn)
-	PropagateCommand(cmd []string)
+	// AddFollower starts streaming the writes to a follower, which listens
+	// for clients on listeningPort, as announced with REPLCONF.
+	AddFollower(conn net.Conn, listeningPort int)
+	// PropagateCommand streams a write executed against database db to all
+	// followers, preceded by a SELECT whenever the database changes, and
+	// returns the replication offset right after it.
+	PropagateCommand(db int, cmd []string) int64
+	// PropagateTransaction streams the writes of a transaction wrapped in
+	// MULTI and EXEC, so followers apply them atomically, and returns the
+	// replication offset right after it.
+	PropagateTransaction(cmds []ReplicatedCommand) int64
 	GetFollowerCount() int
-	WaitForAcknowledgments(numReplicas int, timeout int) (int, error)
+	// WaitForAcknowledgments waits until numReplicas followers acknowledged
+	// offset, or timeout milliseconds passed (0 waits forever), and returns
+	// how many did.
+	WaitForAcknowledgments(numReplicas int, offset int64, timeout int) (int, error)
+	// AckedReplicas returns how many followers acknowledged offset, without
+	// asking them for a fresh acknowledgment.
+	AckedReplicas(offset int64) int
+	// Followers describes the connected followers, for INFO replication.
+	Followers() []FollowerInfo
+}
+
+// FollowerInfo is a follower as seen by its leader.
+type FollowerInfo struct {
+	IP   string
+	Port int
+	// AckOffset is the replication offset the follower last acknowledged,
+	// at LastAck.
+	AckOffset int64
+	LastAck   time.Time
+}
+
+// ReplicatedCommand is a write to propagate and the database it ran against.
+type ReplicatedCommand struct {
+	DB   int
+	Args []string
 }
 
 // FollowerManager defines the interface for follower-specific replication operations.
 type FollowerManager interface {
 	ConnectToLeader() error
 	ReceiveAndProcessCommands()
+	// Status describes the link to the leader, for INFO replication.
+	Status() LeaderLinkStatus
+}
+
+// LeaderLinkStatus is the state of a follower's link to its leader.
+type LeaderLinkStatus struct {
+	Host string
+	Port int
+	// Up is set once the snapshot was loaded and until the connection is
+	// lost, while Syncing is set during the handshake and the transfer.
+	Up      bool
+	Syncing bool
+	// LastIO is when the leader was last heard from.
+	LastIO time.Time
+	ReplID string
+	Offset int64
 }
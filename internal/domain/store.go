@@ -2,8 +2,54 @@ package domain
 
 import "time"
 
-// Store defines the interface for the key-value store.
+// Store defines the interface for the key-value store. Every key operation
+// addresses one of the logical databases by its index. Keys and values are
+// arbitrary byte strings, stored and returned untouched.
 type Store interface {
-	Set(key, value string, expiration time.Duration)
-	Get(key string) (string, bool)
+	Set(db int, key, value string, expiration time.Duration)
+	Get(db int, key string) (string, bool)
+	// Keys returns every live key matching the glob pattern.
+	Keys(db int, pattern string) []string
+	// Scan returns a batch of keys starting at cursor and the cursor to
+	// continue from, which is 0 once the iteration is complete. Empty match
+	// and keyType disable the respective filters.
+	Scan(db int, cursor uint64, match string, count int, keyType string) (uint64, []string)
+	// Move moves key from src to dst, reporting false when the key doesn't
+	// exist in src or already exists in dst.
+	Move(src, dst int, key string) bool
+	SwapDB(a, b int)
+	FlushDB(db int, async bool)
+	FlushAll(async bool)
+	DBSize(db int) int
+	// KeyspaceStats returns the number of keys of db, how many of them have
+	// an expiration and their average time to live, estimated from a
+	// sample.
+	KeyspaceStats(db int) (keys, expires int, avgTTL time.Duration)
+	// ForEach calls fn for every live key of db, with a zero expiresAt for
+	// keys without expiration. fn must not call back into the store.
+	ForEach(db int, fn func(key, value string, expiresAt time.Time))
+	DBCount() int
+
+	// Watch starts tracking modifications of key, including its expiration,
+	// and returns its current version. Every Watch must be paired with an
+	// Unwatch.
+	Watch(db int, key string) uint64
+	Unwatch(db int, key string)
+	// KeyVersion returns the version of a watched key. It differs from the
+	// one returned by Watch once the key was modified.
+	KeyVersion(db int, key string) uint64
+
+	// UsedMemory estimates the memory taken by the keys and their values.
+	UsedMemory() int64
+	// Evict removes keys picked according to policy, one of the
+	// maxmemory-policy values, until UsedMemory is at most maxMemory,
+	// comparing samples keys per eviction and raising "evicted" for each
+	// key removed. It reports false when no key is left to evict.
+	Evict(maxMemory int64, policy string, samples int) bool
+
+	// OnKeyEvent registers fn to receive the keyspace events raised by the
+	// store itself: "new" when a key is created, "expired" when an expired
+	// key is removed and "evicted" when a key is evicted. fn is called with
+	// store locks held and must not call back into the store.
+	OnKeyEvent(fn func(db int, event, key string))
 }
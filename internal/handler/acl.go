@@ -0,0 +1,1133 @@
+package handler
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/therahulbhati/go-redis-clone/internal/domain"
+	"github.com/therahulbhati/go-redis-clone/pkg/utils"
+)
+
+// aclCategories are the command categories, in the order ACL CAT lists them.
+var aclCategories = []string{
+	"keyspace", "read", "write", "set", "sortedset", "list", "hash", "string", "bitmap", "hyperloglog",
+	"geo", "stream", "pubsub", "admin", "fast", "slow", "blocking", "dangerous", "connection",
+	"transaction", "scripting",
+}
+
+// Reasons a request is denied, as reported by ACL LOG.
+const (
+	aclDeniedCommand = "command"
+	aclDeniedKey     = "key"
+	aclDeniedChannel = "channel"
+	aclDeniedAuth    = "auth"
+)
+
+// aclLogMaxLen bounds the entries kept by ACL LOG, like acllog-max-len.
+const aclLogMaxLen = 128
+
+// aclLogGrouping is how long similar denials are counted in one ACL LOG
+// entry instead of adding a new one.
+const aclLogGrouping = 60 * time.Second
+
+const wrongPassError = "WRONGPASS invalid username-password pair or user is disabled."
+
+var (
+	errACLSyntax           = errors.New("Syntax error")
+	errACLUnknownCommand   = errors.New("Unknown command or category name in ACL")
+	errACLPasswordHash     = errors.New("The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+	errACLNoSuchPassword   = errors.New("The password you are trying to remove from the user does not exist")
+	errACLKeysAfterAll     = errors.New("Adding a pattern after the * pattern (or the 'allkeys' flag) is not valid and does not have any effect. Try 'resetkeys' to start with an empty list of patterns")
+	errACLChannelsAfterAll = errors.New("Adding a pattern after the * pattern (or the 'allchannels' flag) is not valid and does not have any effect. Try 'resetchannels' to start with an empty list of channels")
+	errNoACLFile           = errors.New("This Redis instance is not configured to use an ACL file. You may want to specify users via the ACL SETUSER command and then issue a CONFIG REWRITE (assuming you have a Redis configuration file set) in order to store users in the Redis configuration.")
+)
+
+// keyPattern is a key pattern of a user and the access it grants.
+type keyPattern struct {
+	pattern     string
+	read, write bool
+}
+
+// String returns the pattern as written in ACL rules.
+func (p keyPattern) String() string {
+	switch {
+	case p.read && p.write:
+		return "~" + p.pattern
+	case p.read:
+		return "%R~" + p.pattern
+	}
+	return "%W~" + p.pattern
+}
+
+// aclUser is an ACL user. Users are never modified once published: ACL
+// SETUSER replaces them with an updated copy, so they are read without
+// locking.
+type aclUser struct {
+	name    string
+	enabled bool
+	nopass  bool
+	// passwords holds the hex encoded SHA-256 of the passwords.
+	passwords []string
+	// allowed holds the commands and subcommands the user may run, and
+	// commandRules the rules that selected them, as ACL LIST shows them.
+	allowed      map[*command]bool
+	commandRules []string
+	keys         []keyPattern
+	channels     []string
+}
+
+// newACLUser returns a user that is disabled and may do nothing.
+func newACLUser(name string) *aclUser {
+	return &aclUser{name: name, allowed: make(map[*command]bool), commandRules: []string{"-@all"}}
+}
+
+// newDefaultUser returns the user connections start authenticated as, which
+// may do anything until a password or rules are set.
+func newDefaultUser() *aclUser {
+	u := newACLUser("default")
+	for _, rule := range []string{"on", "nopass", "allkeys", "allchannels", "allcommands"} {
+		u.apply(rule)
+	}
+	return u
+}
+
+func (u *aclUser) clone() *aclUser {
+	c := *u
+	c.passwords = append([]string(nil), u.passwords...)
+	c.allowed = make(map[*command]bool, len(u.allowed))
+	for cmd := range u.allowed {
+		c.allowed[cmd] = true
+	}
+	c.commandRules = append([]string(nil), u.commandRules...)
+	c.keys = append([]keyPattern(nil), u.keys...)
+	c.channels = append([]string(nil), u.channels...)
+	return &c
+}
+
+// apply applies one ACL rule, like "on", ">password", "~key:*" or "+@read".
+func (u *aclUser) apply(rule string) error {
+	if rule == "" {
+		return errACLSyntax
+	}
+	switch strings.ToLower(rule) {
+	case "on":
+		u.enabled = true
+	case "off":
+		u.enabled = false
+	case "nopass":
+		u.nopass, u.passwords = true, nil
+	case "resetpass":
+		u.nopass, u.passwords = false, nil
+	case "allkeys":
+		return u.apply("~*")
+	case "resetkeys":
+		u.keys = nil
+	case "allchannels":
+		return u.apply("&*")
+	case "resetchannels":
+		u.channels = nil
+	case "allcommands":
+		return u.apply("+@all")
+	case "nocommands":
+		return u.apply("-@all")
+	case "reset":
+		for _, r := range []string{"resetpass", "resetkeys", "resetchannels", "off", "-@all"} {
+			u.apply(r)
+		}
+	default:
+		switch rule[0] {
+		case '>':
+			u.addPassword(hashPassword(rule[1:]))
+		case '#':
+			hash := rule[1:]
+			if !validPasswordHash(hash) {
+				return errACLPasswordHash
+			}
+			u.addPassword(hash)
+		case '<':
+			return u.removePassword(hashPassword(rule[1:]))
+		case '!':
+			hash := rule[1:]
+			if !validPasswordHash(hash) {
+				return errACLPasswordHash
+			}
+			return u.removePassword(hash)
+		case '~':
+			return u.addKeyPattern(keyPattern{pattern: rule[1:], read: true, write: true})
+		case '%':
+			perms, pattern, ok := strings.Cut(rule[1:], "~")
+			if !ok || perms == "" {
+				return errACLSyntax
+			}
+			p := keyPattern{pattern: pattern}
+			for _, c := range strings.ToUpper(perms) {
+				switch c {
+				case 'R':
+					p.read = true
+				case 'W':
+					p.write = true
+				default:
+					return errACLSyntax
+				}
+			}
+			return u.addKeyPattern(p)
+		case '&':
+			return u.addChannel(rule[1:])
+		case '+', '-':
+			return u.applyCommandRule(rule[0] == '+', strings.ToLower(rule[1:]))
+		default:
+			return errACLSyntax
+		}
+	}
+	return nil
+}
+
+func (u *aclUser) addPassword(hash string) {
+	u.nopass = false
+	for _, p := range u.passwords {
+		if p == hash {
+			return
+		}
+	}
+	u.passwords = append(u.passwords, hash)
+}
+
+func (u *aclUser) removePassword(hash string) error {
+	for i, p := range u.passwords {
+		if p == hash {
+			u.passwords = append(u.passwords[:i], u.passwords[i+1:]...)
+			return nil
+		}
+	}
+	return errACLNoSuchPassword
+}
+
+func (u *aclUser) addKeyPattern(p keyPattern) error {
+	if p.pattern == "*" && p.read && p.write {
+		u.keys = []keyPattern{p}
+		return nil
+	}
+	if u.allKeys() {
+		return errACLKeysAfterAll
+	}
+	for i, existing := range u.keys {
+		if existing.pattern == p.pattern {
+			u.keys[i].read = existing.read || p.read
+			u.keys[i].write = existing.write || p.write
+			return nil
+		}
+	}
+	u.keys = append(u.keys, p)
+	return nil
+}
+
+func (u *aclUser) addChannel(pattern string) error {
+	if pattern == "*" {
+		u.channels = []string{pattern}
+		return nil
+	}
+	if u.allChannels() {
+		return errACLChannelsAfterAll
+	}
+	for _, existing := range u.channels {
+		if existing == pattern {
+			return nil
+		}
+	}
+	u.channels = append(u.channels, pattern)
+	return nil
+}
+
+// applyCommandRule allows or denies a command, a subcommand written as
+// "parent|sub", or the commands of a category written as "@category".
+func (u *aclUser) applyCommandRule(allow bool, name string) error {
+	set := func(cmd *command) {
+		if allow {
+			u.allowed[cmd] = true
+		} else {
+			delete(u.allowed, cmd)
+		}
+	}
+
+	if category, ok := strings.CutPrefix(name, "@"); ok {
+		if category != "all" && !isACLCategory(category) {
+			return errACLUnknownCommand
+		}
+		for _, cmd := range commandTable {
+			for _, c := range append([]*command{cmd}, cmd.sortedSubcommands()...) {
+				if category == "all" || c.inCategory(category) {
+					set(c)
+				}
+			}
+		}
+		if category == "all" {
+			u.commandRules = nil
+		}
+	} else {
+		cmd := findCommand(name)
+		if cmd == nil {
+			return errACLUnknownCommand
+		}
+		set(cmd)
+		for _, sub := range cmd.subcommands {
+			set(sub)
+		}
+	}
+
+	sign := "-"
+	if allow {
+		sign = "+"
+	}
+	u.commandRules = append(u.commandRules, sign+name)
+	return nil
+}
+
+func (u *aclUser) allKeys() bool {
+	return len(u.keys) == 1 && u.keys[0] == keyPattern{pattern: "*", read: true, write: true}
+}
+
+func (u *aclUser) allChannels() bool {
+	return len(u.channels) == 1 && u.channels[0] == "*"
+}
+
+// authenticate reports whether password logs in as u.
+func (u *aclUser) authenticate(password string) bool {
+	if !u.enabled {
+		return false
+	}
+	if u.nopass {
+		return true
+	}
+	hash := []byte(hashPassword(password))
+	for _, p := range u.passwords {
+		if subtle.ConstantTimeCompare([]byte(p), hash) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns why u may not run cmd with the arguments parts, and the
+// command, key or channel denied. The reason is empty when it may.
+func (u *aclUser) check(cmd *command, parts []string) (string, string) {
+	if !u.allowed[cmd] {
+		return aclDeniedCommand, cmd.fullName()
+	}
+	// The keys of pub/sub commands are shard channels.
+	if !u.allKeys() && !cmd.hasFlag(flagPubSub) {
+		write := cmd.hasFlag(flagWrite)
+		read := !write
+		if cmd.numKeysArg > 0 {
+			// Scripts may do anything with their keys.
+			read, write = true, true
+		}
+		for _, pos := range cmd.keyPositions(parts) {
+			if !u.keyAllowed(parts[pos], read, write) {
+				return aclDeniedKey, parts[pos]
+			}
+		}
+	}
+	if !u.allChannels() {
+		channels, literal := commandChannels(cmd, parts)
+		for _, channel := range channels {
+			if !u.channelAllowed(channel, literal) {
+				return aclDeniedChannel, channel
+			}
+		}
+	}
+	return "", ""
+}
+
+// keyAllowed reports whether one of the key patterns grants the requested
+// access to key.
+func (u *aclUser) keyAllowed(key string, read, write bool) bool {
+	for _, p := range u.keys {
+		if (read && !p.read) || (write && !p.write) {
+			continue
+		}
+		if utils.GlobMatch(p.pattern, key, false) {
+			return true
+		}
+	}
+	return false
+}
+
+// channelAllowed reports whether channel matches a channel pattern. Patterns
+// subscribed to with PSUBSCRIBE must be listed literally instead.
+func (u *aclUser) channelAllowed(channel string, literal bool) bool {
+	for _, p := range u.channels {
+		if literal && p == channel || !literal && utils.GlobMatch(p, channel, false) {
+			return true
+		}
+	}
+	return false
+}
+
+// commandChannels returns the channels cmd subscribes or publishes to, and
+// whether they are patterns.
+func commandChannels(cmd *command, parts []string) ([]string, bool) {
+	if cmd.parent != nil {
+		return nil, false
+	}
+	switch cmd.name {
+	case "subscribe", "ssubscribe":
+		return parts[1:], false
+	case "psubscribe":
+		return parts[1:], true
+	case "publish", "spublish":
+		return parts[1:2], false
+	}
+	return nil, false
+}
+
+// flags returns the flags ACL GETUSER reports.
+func (u *aclUser) flags() []string {
+	flags := []string{"off"}
+	if u.enabled {
+		flags[0] = "on"
+	}
+	if u.nopass {
+		flags = append(flags, "nopass")
+	}
+	return flags
+}
+
+func (u *aclUser) keyRules() string {
+	rules := make([]string, len(u.keys))
+	for i, p := range u.keys {
+		rules[i] = p.String()
+	}
+	return strings.Join(rules, " ")
+}
+
+func (u *aclUser) channelRules() string {
+	rules := make([]string, len(u.channels))
+	for i, c := range u.channels {
+		rules[i] = "&" + c
+	}
+	return strings.Join(rules, " ")
+}
+
+// describe returns the rules recreating u, as listed by ACL LIST and saved
+// in the ACL file.
+func (u *aclUser) describe() string {
+	rules := append([]string{"user", u.name}, u.flags()...)
+	for _, p := range u.passwords {
+		rules = append(rules, "#"+p)
+	}
+	if len(u.keys) > 0 {
+		rules = append(rules, u.keyRules())
+	}
+	if !u.allChannels() {
+		rules = append(rules, "resetchannels")
+	}
+	if len(u.channels) > 0 {
+		rules = append(rules, u.channelRules())
+	}
+	rules = append(rules, u.commandRules...)
+	return strings.Join(rules, " ")
+}
+
+func hashPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+func validPasswordHash(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+	for i := 0; i < len(hash); i++ {
+		if !(hash[i] >= '0' && hash[i] <= '9' || hash[i] >= 'a' && hash[i] <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func isACLCategory(name string) bool {
+	for _, category := range aclCategories {
+		if category == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *command) inCategory(category string) bool {
+	for _, cat := range c.categories {
+		if cat[1:] == category {
+			return true
+		}
+	}
+	return false
+}
+
+// aclLogEntry is a denial reported by ACL LOG. Similar denials are counted
+// in one entry.
+type aclLogEntry struct {
+	id         int64
+	count      int
+	reason     string
+	context    string
+	object     string
+	username   string
+	clientInfo string
+	created    time.Time
+	updated    time.Time
+}
+
+// accessControl holds the ACL users and the log of denied requests.
+type accessControl struct {
+	// users maps the user names to the users. The map is replaced, never
+	// modified, so commands read it without locking; mu serializes the
+	// writers.
+	mu    sync.Mutex
+	users atomic.Pointer[map[string]*aclUser]
+	// file is the ACL file used by ACL LOAD and ACL SAVE, empty if none.
+	file string
+
+	logMu     sync.Mutex
+	log       []*aclLogEntry // newest first
+	nextLogID int64
+}
+
+func newAccessControl() *accessControl {
+	a := &accessControl{}
+	a.users.Store(&map[string]*aclUser{"default": newDefaultUser()})
+	return a
+}
+
+// user returns the user called name, nil if there is none.
+func (a *accessControl) user(name string) *aclUser {
+	return (*a.users.Load())[name]
+}
+
+// update replaces the users with the result of fn, which receives a copy of
+// them it may modify.
+func (a *accessControl) update(fn func(users map[string]*aclUser) error) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	current := *a.users.Load()
+	users := make(map[string]*aclUser, len(current))
+	for name, u := range current {
+		users[name] = u
+	}
+	if err := fn(users); err != nil {
+		return err
+	}
+	a.users.Store(&users)
+	return nil
+}
+
+// sortedUsers returns the users ordered by name.
+func (a *accessControl) sortedUsers() []*aclUser {
+	users := *a.users.Load()
+	sorted := make([]*aclUser, 0, len(users))
+	for _, u := range users {
+		sorted = append(sorted, u)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].name < sorted[j].name })
+	return sorted
+}
+
+// setUser applies rules to the user called name, creating it if needed. No
+// rule is applied unless all of them are valid.
+func (a *accessControl) setUser(name string, rules []string) error {
+	return a.update(func(users map[string]*aclUser) error {
+		u := newACLUser(name)
+		if existing, ok := users[name]; ok {
+			u = existing.clone()
+		}
+		for _, rule := range rules {
+			if err := u.apply(rule); err != nil {
+				return fmt.Errorf("Error in ACL SETUSER modifier '%s': %s", truncate(rule, 128), err)
+			}
+		}
+		users[name] = u
+		return nil
+	})
+}
+
+// readFile parses the ACL file, made of "user <name> <rules...>" lines. A
+// default user is created unless the file defines it.
+func (a *accessControl) readFile() (map[string]*aclUser, error) {
+	if a.file == "" {
+		return nil, errNoACLFile
+	}
+	f, err := os.Open(a.file)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading ACLs, opening file '%s': %s", a.file, err)
+	}
+	defer f.Close()
+
+	users := make(map[string]*aclUser)
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		args, err := utils.SplitArgs(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", a.file, lineNum, err)
+		}
+		if len(args) < 2 || args[0] != "user" {
+			return nil, fmt.Errorf("%s:%d: should start with user keyword", a.file, lineNum)
+		}
+		name := args[1]
+		if _, ok := users[name]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate user '%s' found", a.file, lineNum, name)
+		}
+		u := newACLUser(name)
+		for _, rule := range args[2:] {
+			if err := u.apply(rule); err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", a.file, lineNum, err)
+			}
+		}
+		users[name] = u
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if _, ok := users["default"]; !ok {
+		users["default"] = newDefaultUser()
+	}
+	return users, nil
+}
+
+// load replaces the users with the ones of the ACL file, and returns the
+// names of the users that no longer exist.
+func (a *accessControl) load() ([]string, error) {
+	users, err := a.readFile()
+	if err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var removed []string
+	for name := range *a.users.Load() {
+		if _, ok := users[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	a.users.Store(&users)
+	return removed, nil
+}
+
+// save writes the users to the ACL file, replacing it atomically.
+func (a *accessControl) save() error {
+	if a.file == "" {
+		return errNoACLFile
+	}
+	var sb strings.Builder
+	for _, u := range a.sortedUsers() {
+		sb.WriteString(u.describe())
+		sb.WriteByte('\n')
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(a.file), "temp-acl-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(sb.String()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), a.file)
+}
+
+// logDenial records a denied request in the ACL log. A similar denial
+// logged recently is counted instead of adding an entry.
+func (a *accessControl) logDenial(reason, context, object, username, clientInfo string) {
+	a.logMu.Lock()
+	defer a.logMu.Unlock()
+	now := time.Now()
+	for i, e := range a.log {
+		if e.reason == reason && e.context == context && e.object == object && e.username == username &&
+			now.Sub(e.created) < aclLogGrouping {
+			e.count++
+			e.updated = now
+			e.clientInfo = clientInfo
+			copy(a.log[1:i+1], a.log[:i])
+			a.log[0] = e
+			return
+		}
+	}
+	entry := &aclLogEntry{
+		id: a.nextLogID, count: 1, reason: reason, context: context, object: object,
+		username: username, clientInfo: clientInfo, created: now, updated: now,
+	}
+	a.nextLogID++
+	a.log = append([]*aclLogEntry{entry}, a.log...)
+	if len(a.log) > aclLogMaxLen {
+		a.log = a.log[:aclLogMaxLen]
+	}
+}
+
+// SetRequirePass sets the password of the default user, like requirepass.
+// An empty password lets connections in without authenticating.
+func (ch *CommandHandler) SetRequirePass(password string) {
+	rules := []string{"nopass"}
+	if password != "" {
+		rules = []string{"resetpass", ">" + password}
+	}
+	ch.acl.setUser("default", rules)
+}
+
+// SetACLFile selects the ACL file ACL LOAD and ACL SAVE use, and loads the
+// users from it.
+func (ch *CommandHandler) SetACLFile(path string) error {
+	ch.acl.mu.Lock()
+	ch.acl.file = path
+	ch.acl.mu.Unlock()
+	if path == "" {
+		return nil
+	}
+	_, err := ch.acl.load()
+	return err
+}
+
+// SetProtectedMode enables protected mode, where only loopback connections
+// are accepted while the default user has no password.
+func (ch *CommandHandler) SetProtectedMode(enabled bool) {
+	ch.protectedMode.Store(enabled)
+}
+
+// protectedModeError is sent to the connections refused by protected mode.
+const protectedModeError = "DENIED Redis is running in protected mode because protected mode is enabled and no password is set for the default user. " +
+	"In this mode connections are only accepted from the loopback interface. If you want to connect from external computers to Redis you may adopt one of the following solutions: " +
+	"1) Restart the server with the '--protected-mode no' option, however MAKE SURE Redis is not publicly accessible from internet if you do so. " +
+	"2) Set up an authentication password for the default user, with '--requirepass' or ACL SETUSER. " +
+	"NOTE: You only need to do one of the above things in order for the server to start accepting connections from the outside."
+
+// refusedByProtectedMode reports whether conn must be refused because of
+// protected mode.
+func (ch *CommandHandler) refusedByProtectedMode(conn net.Conn) bool {
+	if !ch.protectedMode.Load() || !ch.acl.user("default").nopass {
+		return false
+	}
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	return ok && !addr.IP.IsLoopback()
+}
+
+// tlsHandshakeTimeout bounds the TLS handshake of new connections.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// authenticateCertificate logs a TLS client in as the ACL user named by the
+// common name of its verified certificate, when tls-auth-clients-user is CN
+// and the user exists.
+func (ch *CommandHandler) authenticateCertificate(client *domain.Client) {
+	tlsConn, ok := client.Conn.(*tls.Conn)
+	if !ok || ch.tls == nil || !strings.EqualFold(ch.tls.Settings().AuthClientsUser, "cn") {
+		return
+	}
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 {
+		return
+	}
+	name := state.PeerCertificates[0].Subject.CommonName
+	if u := ch.acl.user(name); u != nil && u.enabled {
+		client.User = name
+		client.Authenticated = true
+	}
+}
+
+// authenticate logs client in as username, logging the failure in the ACL
+// log when the password is wrong or the user is disabled.
+func (ch *CommandHandler) authenticate(client *domain.Client, username, password string) bool {
+	u := ch.acl.user(username)
+	if u == nil || !u.authenticate(password) {
+		ch.acl.logDenial(aclDeniedAuth, "toplevel", "AUTH", username, ch.formatClient(client, ch.clientInfo(client)))
+		return false
+	}
+	client.User = username
+	client.Authenticated = true
+	return true
+}
+
+// authorize checks that client may run cmd before it's executed, replying
+// with the error when it may not.
+func (ch *CommandHandler) authorize(client *domain.Client, cmd *command, parts []string) bool {
+	// The leader's writes are applied whatever the user, and the commands
+	// authenticating are always allowed.
+	if client.Master || cmd.hasFlag(flagNoAuth) {
+		return true
+	}
+	if !client.Authenticated {
+		client.Writer.WriteRawError("NOAUTH Authentication required.")
+		return false
+	}
+	context := "toplevel"
+	if client.Tx != nil {
+		context = "multi"
+	}
+	if msg := ch.aclDenied(client, cmd, parts, context); msg != "" {
+		client.Writer.WriteRawError("NOPERM " + msg)
+		return false
+	}
+	return true
+}
+
+// aclDenied checks the permissions of the user of client to run cmd with
+// parts. When it may not, the denial is logged under context and its
+// description returned.
+func (ch *CommandHandler) aclDenied(client *domain.Client, cmd *command, parts []string, context string) string {
+	if client.Master {
+		return ""
+	}
+	var reason, object string
+	u := ch.acl.user(client.User)
+	if u == nil {
+		reason, object = aclDeniedCommand, cmd.fullName()
+	} else if reason, object = u.check(cmd, parts); reason == "" {
+		return ""
+	}
+	info := ch.clientInfo(client)
+	info.LastCommand = cmd.fullName()
+	ch.acl.logDenial(reason, context, object, client.User, ch.formatClient(client, info))
+	return aclMessage(reason, client.User, object)
+}
+
+func aclMessage(reason, username, object string) string {
+	switch reason {
+	case aclDeniedKey:
+		return "No permissions to access a key"
+	case aclDeniedChannel:
+		return "No permissions to access a channel"
+	}
+	return fmt.Sprintf("User %s has no permissions to run the '%s' command", username, object)
+}
+
+// handleAuth authenticates the connection: AUTH [username] password
+func (ch *CommandHandler) handleAuth(client *domain.Client, parts []string) {
+	w := client.Writer
+	if len(parts) > 3 {
+		w.WriteError("syntax error")
+		return
+	}
+	username, password := "default", parts[1]
+	if len(parts) == 3 {
+		username, password = parts[1], parts[2]
+	} else if ch.acl.user("default").nopass {
+		w.WriteError("AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+		return
+	}
+	if !ch.authenticate(client, username, password) {
+		w.WriteRawError(wrongPassError)
+		return
+	}
+	w.WriteSimpleString("OK")
+}
+
+func (ch *CommandHandler) handleACLSetUser(client *domain.Client, parts []string) {
+	name := parts[2]
+	if strings.ContainsAny(name, " \x00") {
+		client.Writer.WriteError("Usernames can't contain spaces or null characters")
+		return
+	}
+	if err := ch.acl.setUser(name, parts[3:]); err != nil {
+		client.Writer.WriteError(err.Error())
+		return
+	}
+	client.Writer.WriteSimpleString("OK")
+}
+
+func (ch *CommandHandler) handleACLGetUser(client *domain.Client, parts []string) {
+	w := client.Writer
+	u := ch.acl.user(parts[2])
+	if u == nil {
+		w.WriteNull()
+		return
+	}
+	w.WriteMapLen(6)
+	w.WriteBulkString("flags")
+	w.WriteStringArray(u.flags())
+	w.WriteBulkString("passwords")
+	w.WriteStringArray(u.passwords)
+	w.WriteBulkString("commands")
+	w.WriteBulkString(strings.Join(u.commandRules, " "))
+	w.WriteBulkString("keys")
+	w.WriteBulkString(u.keyRules())
+	w.WriteBulkString("channels")
+	w.WriteBulkString(u.channelRules())
+	w.WriteBulkString("selectors")
+	w.WriteArrayLen(0)
+}
+
+// handleACLDelUser deletes users and closes the connections authenticated
+// as them.
+func (ch *CommandHandler) handleACLDelUser(client *domain.Client, parts []string) {
+	deleted := make(map[string]bool)
+	err := ch.acl.update(func(users map[string]*aclUser) error {
+		for _, name := range parts[2:] {
+			if name == "default" {
+				return errors.New("The 'default' user cannot be removed")
+			}
+			if _, ok := users[name]; ok {
+				delete(users, name)
+				deleted[name] = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		client.Writer.WriteError(err.Error())
+		return
+	}
+	ch.killUserClients(deleted)
+	client.Writer.WriteInteger(int64(len(deleted)))
+}
+
+// killUserClients closes the connections authenticated as the given users.
+func (ch *CommandHandler) killUserClients(users map[string]bool) {
+	if len(users) == 0 {
+		return
+	}
+	for _, c := range ch.sortedClients() {
+		if !c.Master && users[c.Info().User] {
+			ch.killClient(c)
+		}
+	}
+}
+
+func (ch *CommandHandler) handleACLUsers(client *domain.Client, parts []string) {
+	users := ch.acl.sortedUsers()
+	names := make([]string, len(users))
+	for i, u := range users {
+		names[i] = u.name
+	}
+	client.Writer.WriteStringArray(names)
+}
+
+func (ch *CommandHandler) handleACLList(client *domain.Client, parts []string) {
+	users := ch.acl.sortedUsers()
+	lines := make([]string, len(users))
+	for i, u := range users {
+		lines[i] = u.describe()
+	}
+	client.Writer.WriteStringArray(lines)
+}
+
+func (ch *CommandHandler) handleACLWhoAmI(client *domain.Client, parts []string) {
+	client.Writer.WriteBulkString(client.User)
+}
+
+// handleACLCat lists the categories, or the commands of one category.
+func (ch *CommandHandler) handleACLCat(client *domain.Client, parts []string) {
+	w := client.Writer
+	if len(parts) == 2 {
+		w.WriteStringArray(aclCategories)
+		return
+	}
+	if len(parts) > 3 {
+		w.WriteError(fmt.Sprintf("wrong number of arguments for '%s' command", "acl|cat"))
+		return
+	}
+	category := strings.ToLower(parts[2])
+	if !isACLCategory(category) {
+		w.WriteError(fmt.Sprintf("Unknown category '%s'", truncate(parts[2], 128)))
+		return
+	}
+	names := []string{}
+	for _, cmd := range sortedCommands() {
+		for _, c := range append([]*command{cmd}, cmd.sortedSubcommands()...) {
+			if c.inCategory(category) {
+				names = append(names, c.fullName())
+			}
+		}
+	}
+	w.WriteStringArray(names)
+}
+
+// handleACLLog lists the recent denials, newest first: ACL LOG [count|RESET]
+func (ch *CommandHandler) handleACLLog(client *domain.Client, parts []string) {
+	w := client.Writer
+	count := aclLogMaxLen
+	if len(parts) > 3 {
+		w.WriteError(fmt.Sprintf("wrong number of arguments for '%s' command", "acl|log"))
+		return
+	}
+	if len(parts) == 3 {
+		if strings.ToUpper(parts[2]) == "RESET" {
+			ch.acl.logMu.Lock()
+			ch.acl.log = nil
+			ch.acl.logMu.Unlock()
+			w.WriteSimpleString("OK")
+			return
+		}
+		n, err := strconv.Atoi(parts[2])
+		if err != nil || n < 0 {
+			w.WriteError("value is out of range, must be positive")
+			return
+		}
+		count = n
+	}
+
+	ch.acl.logMu.Lock()
+	entries := ch.acl.log
+	if len(entries) > count {
+		entries = entries[:count]
+	}
+	entries = append([]*aclLogEntry(nil), entries...)
+	ch.acl.logMu.Unlock()
+
+	now := time.Now()
+	w.WriteArrayLen(len(entries))
+	for _, e := range entries {
+		w.WriteMapLen(10)
+		w.WriteBulkString("count")
+		w.WriteInteger(int64(e.count))
+		w.WriteBulkString("reason")
+		w.WriteBulkString(e.reason)
+		w.WriteBulkString("context")
+		w.WriteBulkString(e.context)
+		w.WriteBulkString("object")
+		w.WriteBulkString(e.object)
+		w.WriteBulkString("username")
+		w.WriteBulkString(e.username)
+		w.WriteBulkString("age-seconds")
+		w.WriteBulkString(strconv.FormatFloat(now.Sub(e.created).Seconds(), 'f', 3, 64))
+		w.WriteBulkString("client-info")
+		w.WriteBulkString(e.clientInfo)
+		w.WriteBulkString("entry-id")
+		w.WriteInteger(e.id)
+		w.WriteBulkString("timestamp-created")
+		w.WriteInteger(e.created.UnixMilli())
+		w.WriteBulkString("timestamp-last-updated")
+		w.WriteInteger(e.updated.UnixMilli())
+	}
+}
+
+func (ch *CommandHandler) handleACLSave(client *domain.Client, parts []string) {
+	if err := ch.acl.save(); err != nil {
+		client.Writer.WriteError(err.Error())
+		return
+	}
+	client.Writer.WriteSimpleString("OK")
+}
+
+// handleACLLoad replaces the users with the ones of the ACL file. Nothing
+// changes when the file has errors. Connections of users that are gone are
+// closed.
+func (ch *CommandHandler) handleACLLoad(client *domain.Client, parts []string) {
+	removed, err := ch.acl.load()
+	if err != nil {
+		client.Writer.WriteError(err.Error())
+		return
+	}
+	gone := make(map[string]bool, len(removed))
+	for _, name := range removed {
+		gone[name] = true
+	}
+	ch.killUserClients(gone)
+	client.Writer.WriteSimpleString("OK")
+}
+
+// handleACLGenPass returns a random password: ACL GENPASS [bits]
+func (ch *CommandHandler) handleACLGenPass(client *domain.Client, parts []string) {
+	w := client.Writer
+	bits := 256
+	if len(parts) > 3 {
+		w.WriteError(fmt.Sprintf("wrong number of arguments for '%s' command", "acl|genpass"))
+		return
+	}
+	if len(parts) == 3 {
+		n, err := strconv.Atoi(parts[2])
+		if err != nil || n <= 0 || n > 4096 {
+			w.WriteError("ACL GENPASS argument must be the number of bits for the output password, a positive number up to 4096")
+			return
+		}
+		bits = n
+	}
+	chars := (bits + 3) / 4
+	buf := make([]byte, (chars+1)/2)
+	if _, err := rand.Read(buf); err != nil {
+		w.WriteError(err.Error())
+		return
+	}
+	w.WriteBulkString(hex.EncodeToString(buf)[:chars])
+}
+
+// handleACLDryRun checks whether a user could run a command without running
+// it: ACL DRYRUN username command [arg ...]
+func (ch *CommandHandler) handleACLDryRun(client *domain.Client, parts []string) {
+	w := client.Writer
+	u := ch.acl.user(parts[2])
+	if u == nil {
+		w.WriteError(fmt.Sprintf("User '%s' not found", truncate(parts[2], 128)))
+		return
+	}
+	args := parts[3:]
+	if findCommand(args[0]) == nil {
+		w.WriteError(fmt.Sprintf("Command '%s' not found", truncate(args[0], 128)))
+		return
+	}
+	cmd, errMsg := lookupCommand(args)
+	if cmd == nil {
+		w.WriteError(errMsg)
+		return
+	}
+	if reason, object := u.check(cmd, args); reason != "" {
+		w.WriteBulkString(aclMessage(reason, u.name, object))
+		return
+	}
+	w.WriteSimpleString("OK")
+}
+
+func (ch *CommandHandler) handleACLHelp(client *domain.Client, parts []string) {
+	client.Writer.WriteStringArray([]string{
+		"ACL <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+		"CAT [<category>]",
+		"    List all commands that belong to <category>, or all command categories",
+		"    when no category is specified.",
+		"DELUSER <username> [<username> ...]",
+		"    Delete a list of users.",
+		"DRYRUN <username> <command> [<arg> ...]",
+		"    Returns whether the user can execute the given command without executing the command.",
+		"GETUSER <username>",
+		"    Get the user's details.",
+		"GENPASS [<bits>]",
+		"    Generate a secure 256-bit user password. The optional `bits` argument can",
+		"    be used to specify a different size.",
+		"LIST",
+		"    Show users details in config file format.",
+		"LOAD",
+		"    Reload users from the ACL file.",
+		"LOG [<count> | RESET]",
+		"    Show the ACL log entries.",
+		"SAVE",
+		"    Save the current config to the ACL file.",
+		"SETUSER <username> <attribute> [<attribute> ...]",
+		"    Create or modify a user with the specified attributes.",
+		"USERS",
+		"    List all the registered usernames.",
+		"WHOAMI",
+		"    Return the current connection username.",
+		"HELP",
+		"    Print this help.",
+	})
+}
@@ -0,0 +1,608 @@
+package handler
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/therahulbhati/go-redis-clone/internal/domain"
+	"github.com/therahulbhati/go-redis-clone/pkg/resp"
+)
+
+// clientPause is the state of CLIENT PAUSE. done is closed when the pause is
+// lifted or changed, waking the paused clients up to check again.
+type clientPause struct {
+	mu   sync.Mutex
+	end  time.Time
+	all  bool
+	done chan struct{}
+}
+
+// pause pauses clients until end, only their writes unless all is set. A
+// pause already in effect is only ever extended and made stricter.
+func (p *clientPause) pause(end time.Time, all bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.done != nil && time.Now().Before(p.end) {
+		if p.end.After(end) {
+			end = p.end
+		}
+		all = all || p.all
+		close(p.done)
+	}
+	p.end, p.all, p.done = end, all, make(chan struct{})
+}
+
+func (p *clientPause) unpause() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.done != nil {
+		close(p.done)
+		p.done = nil
+	}
+}
+
+// waitIfPaused blocks while cmd is paused for client. Followers and the link
+// to the leader are never paused, nor are the commands lifting the pause.
+func (ch *CommandHandler) waitIfPaused(client *domain.Client, cmd *command) {
+	if client.Master || client.Replica {
+		return
+	}
+	switch cmd.fullName() {
+	case "client|pause", "client|unpause":
+		return
+	}
+	p := &ch.pause
+	for {
+		p.mu.Lock()
+		done, end, all := p.done, p.end, p.all
+		p.mu.Unlock()
+		remaining := time.Until(end)
+		if done == nil || remaining <= 0 || !(all || pausedForWrites(client, cmd)) {
+			return
+		}
+		timer := time.NewTimer(remaining)
+		select {
+		case <-done:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// pausedForWrites reports whether CLIENT PAUSE WRITE holds cmd: commands
+// that may write or propagate anything, including EXEC of a transaction
+// holding one.
+func pausedForWrites(client *domain.Client, cmd *command) bool {
+	if cmd.hasFlag(flagWrite) || cmd.hasFlag(flagMayReplicate) {
+		return true
+	}
+	if cmd.name == "exec" && client.Tx != nil {
+		for _, queued := range client.Tx.Queued {
+			if c, _ := lookupCommand(queued); c != nil && (c.hasFlag(flagWrite) || c.hasFlag(flagMayReplicate)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// suppressReplies points the client writer to nowhere for one command, as
+// requested with CLIENT REPLY OFF or SKIP, and returns the function restoring
+// it.
+func suppressReplies(client *domain.Client) func() {
+	w := client.Writer
+	discard := resp.NewWriter(io.Discard)
+	discard.SetProtocol(w.Protocol())
+	client.Writer = discard
+	skip := client.ReplyMode == domain.ReplySkip
+	return func() {
+		// HELLO may have switched the protocol meanwhile.
+		w.SetProtocol(discard.Protocol())
+		client.Writer = w
+		if skip && client.ReplyMode == domain.ReplySkip {
+			client.ReplyMode = domain.ReplyOn
+		}
+	}
+}
+
+// publishInfo records the state of client after a command, for CLIENT LIST
+// and CLIENT KILL issued by other clients.
+func (ch *CommandHandler) publishInfo(client *domain.Client, cmd *command) {
+	info := ch.clientInfo(client)
+	if cmd != nil {
+		info.LastCommand = cmd.fullName()
+	} else {
+		info.LastCommand = client.Info().LastCommand
+	}
+	client.SetInfo(info)
+}
+
+// markBlocked records that client waits in a blocking command, which idle
+// clients aren't closed for.
+func (ch *CommandHandler) markBlocked(client *domain.Client) {
+	info := client.Info()
+	info.Blocked = true
+	info.LastInteraction = time.Now()
+	client.SetInfo(info)
+}
+
+// clientInfo reads the current state of client. It must be called by the
+// goroutine serving it.
+func (ch *CommandHandler) clientInfo(client *domain.Client) domain.ClientInfo {
+	multi := -1
+	if client.Tx != nil {
+		multi = len(client.Tx.Queued)
+	}
+	return domain.ClientInfo{
+		Name:            client.Name,
+		User:            client.User,
+		DB:              client.DB,
+		Channels:        len(client.Channels),
+		Patterns:        len(client.Patterns),
+		ShardChannels:   len(client.ShardChannels),
+		Multi:           multi,
+		QueryBuf:        client.QueryBuf,
+		LastInteraction: time.Now(),
+		Replica:         client.Replica,
+		NoEvict:         client.NoEvict,
+		Watched:         len(client.Watched),
+	}
+}
+
+// clientType returns the type used by CLIENT LIST TYPE and CLIENT KILL TYPE.
+func clientType(client *domain.Client, info domain.ClientInfo) string {
+	switch {
+	case client.Master:
+		return "master"
+	case info.Replica:
+		return "replica"
+	case info.Channels+info.Patterns+info.ShardChannels > 0:
+		return "pubsub"
+	}
+	return "normal"
+}
+
+// parseClientType accepts the client types of CLIENT LIST and CLIENT KILL,
+// including the slave alias of replica.
+func parseClientType(name string) (string, bool) {
+	switch name = strings.ToLower(name); name {
+	case "normal", "master", "replica", "pubsub":
+		return name, true
+	case "slave":
+		return "replica", true
+	}
+	return "", false
+}
+
+// connFD returns the file descriptor of conn, -1 when it has none.
+func connFD(conn net.Conn) int {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return -1
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return -1
+	}
+	fd := -1
+	raw.Control(func(f uintptr) { fd = int(f) })
+	return fd
+}
+
+// connAddrs returns the remote and local addresses of conn as CLIENT LIST
+// shows them. Unix socket connections are shown as "<socket path>:0".
+func connAddrs(conn net.Conn) (string, string) {
+	if conn == nil {
+		return "", ""
+	}
+	if local, ok := conn.LocalAddr().(*net.UnixAddr); ok {
+		return local.Name + ":0", local.Name + ":0"
+	}
+	return conn.RemoteAddr().String(), conn.LocalAddr().String()
+}
+
+// isUnixSocket reports whether client is connected to the Unix socket.
+func isUnixSocket(client *domain.Client) bool {
+	if client.Conn == nil {
+		return false
+	}
+	_, ok := client.Conn.LocalAddr().(*net.UnixAddr)
+	return ok
+}
+
+// formatClient formats client as a CLIENT LIST line, without the newline.
+func (ch *CommandHandler) formatClient(client *domain.Client, info domain.ClientInfo) string {
+	addr, laddr := connAddrs(client.Conn)
+	fd := -1
+	if client.Conn != nil {
+		fd = connFD(client.Conn)
+	}
+
+	var flags strings.Builder
+	switch clientType(client, info) {
+	case "master":
+		flags.WriteByte('M')
+	case "replica":
+		flags.WriteByte('S')
+	case "pubsub":
+		flags.WriteByte('P')
+	}
+	if info.Blocked {
+		flags.WriteByte('b')
+	}
+	if info.Multi >= 0 {
+		flags.WriteByte('x')
+	}
+	if info.NoEvict {
+		flags.WriteByte('e')
+	}
+	if isUnixSocket(client) {
+		flags.WriteByte('U')
+	}
+	redirect := int64(-1)
+	ch.tracking.mu.Lock()
+	if tc, ok := ch.tracking.clients[client.ID]; ok {
+		flags.WriteByte('t')
+		if tc.bcast {
+			flags.WriteByte('B')
+		}
+		redirect = tc.redirect
+	}
+	ch.tracking.mu.Unlock()
+	if redirect > 0 {
+		ch.mu.Lock()
+		_, alive := ch.clients[redirect]
+		ch.mu.Unlock()
+		if !alive {
+			flags.WriteByte('R')
+		}
+	}
+	if flags.Len() == 0 {
+		flags.WriteByte('N')
+	}
+
+	pending, pendingBytes := client.PendingPushes()
+	now := time.Now()
+	return fmt.Sprintf("id=%d addr=%s laddr=%s fd=%d name=%s age=%d idle=%d flags=%s db=%d sub=%d psub=%d ssub=%d multi=%d qbuf=%d obl=0 oll=%d omem=%d events=r cmd=%s user=%s redir=%d resp=%d",
+		client.ID, addr, laddr, fd, info.Name,
+		int64(now.Sub(client.CreatedAt).Seconds()), int64(now.Sub(info.LastInteraction).Seconds()),
+		flags.String(), info.DB, info.Channels, info.Patterns, info.ShardChannels, info.Multi,
+		info.QueryBuf, pending, pendingBytes,
+		info.LastCommand, info.User, redirect, client.PushProtocol())
+}
+
+// sortedClients returns the registered clients ordered by ID.
+func (ch *CommandHandler) sortedClients() []*domain.Client {
+	ch.mu.Lock()
+	clients := make([]*domain.Client, 0, len(ch.clients))
+	for _, client := range ch.clients {
+		clients = append(clients, client)
+	}
+	ch.mu.Unlock()
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ID < clients[j].ID })
+	return clients
+}
+
+// infoOf returns the state of other, read live when it's the calling client
+// since its published state predates the current command.
+func (ch *CommandHandler) infoOf(client, other *domain.Client, cmd string) domain.ClientInfo {
+	if other != client {
+		return other.Info()
+	}
+	info := ch.clientInfo(client)
+	info.LastCommand = cmd
+	return info
+}
+
+func (ch *CommandHandler) handleClientID(client *domain.Client, parts []string) {
+	client.Writer.WriteInteger(client.ID)
+}
+
+func (ch *CommandHandler) handleClientInfo(client *domain.Client, parts []string) {
+	info := ch.infoOf(client, client, "client|info")
+	client.Writer.WriteVerbatim("txt", ch.formatClient(client, info)+"\n")
+}
+
+// handleClientList lists the clients: CLIENT LIST [TYPE type] [ID id ...]
+func (ch *CommandHandler) handleClientList(client *domain.Client, parts []string) {
+	w := client.Writer
+	var typ string
+	var ids map[int64]bool
+	for i := 2; i < len(parts); i++ {
+		switch opt := strings.ToUpper(parts[i]); {
+		case opt == "TYPE" && i+1 < len(parts) && ids == nil:
+			var ok bool
+			if typ, ok = parseClientType(parts[i+1]); !ok {
+				w.WriteError(fmt.Sprintf("Unknown client type '%s'", parts[i+1]))
+				return
+			}
+			i++
+		case opt == "ID" && i+1 < len(parts) && typ == "":
+			ids = make(map[int64]bool)
+			for _, arg := range parts[i+1:] {
+				id, err := strconv.ParseInt(arg, 10, 64)
+				if err != nil || id <= 0 {
+					w.WriteError("Invalid client ID")
+					return
+				}
+				ids[id] = true
+			}
+			i = len(parts)
+		default:
+			w.WriteError("syntax error")
+			return
+		}
+	}
+
+	var out strings.Builder
+	for _, other := range ch.sortedClients() {
+		if ids != nil && !ids[other.ID] {
+			continue
+		}
+		info := ch.infoOf(client, other, "client|list")
+		if typ != "" && clientType(other, info) != typ {
+			continue
+		}
+		out.WriteString(ch.formatClient(other, info))
+		out.WriteByte('\n')
+	}
+	w.WriteVerbatim("txt", out.String())
+}
+
+// handleClientKill closes connections, either the one at an address
+// (CLIENT KILL addr) or every one matching the filters:
+// CLIENT KILL [ID id] [ADDR addr] [LADDR addr] [USER user] [TYPE type]
+// [SKIPME yes|no] [MAXAGE seconds]
+func (ch *CommandHandler) handleClientKill(client *domain.Client, parts []string) {
+	w := client.Writer
+	if len(parts) == 3 {
+		for _, other := range ch.sortedClients() {
+			if otherAddr, _ := connAddrs(other.Conn); other.Conn != nil && otherAddr == parts[2] {
+				ch.killClient(other)
+				w.WriteSimpleString("OK")
+				return
+			}
+		}
+		w.WriteError("No such client")
+		return
+	}
+	if len(parts)%2 != 0 {
+		w.WriteError("syntax error")
+		return
+	}
+
+	var (
+		id          int64
+		addr, laddr string
+		user, typ   string
+		hasUser     bool
+		maxAge      int64
+		skipMe      = true
+	)
+	for i := 2; i < len(parts); i += 2 {
+		value := parts[i+1]
+		switch strings.ToUpper(parts[i]) {
+		case "ID":
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n <= 0 {
+				w.WriteError("client-id should be greater than 0")
+				return
+			}
+			id = n
+		case "ADDR":
+			addr = value
+		case "LADDR":
+			laddr = value
+		case "USER":
+			user, hasUser = value, true
+		case "TYPE":
+			var ok bool
+			if typ, ok = parseClientType(value); !ok {
+				w.WriteError(fmt.Sprintf("Unknown client type '%s'", value))
+				return
+			}
+		case "SKIPME":
+			switch strings.ToLower(value) {
+			case "yes":
+				skipMe = true
+			case "no":
+				skipMe = false
+			default:
+				w.WriteError("syntax error")
+				return
+			}
+		case "MAXAGE":
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n <= 0 {
+				w.WriteError("value is not an integer or out of range")
+				return
+			}
+			maxAge = n
+		default:
+			w.WriteError("syntax error")
+			return
+		}
+	}
+
+	killed := 0
+	now := time.Now()
+	for _, other := range ch.sortedClients() {
+		if skipMe && other == client {
+			continue
+		}
+		otherAddr, otherLAddr := connAddrs(other.Conn)
+		info := ch.infoOf(client, other, "client|kill")
+		switch {
+		case id != 0 && other.ID != id,
+			addr != "" && (other.Conn == nil || otherAddr != addr),
+			laddr != "" && (other.Conn == nil || otherLAddr != laddr),
+			hasUser && info.User != user,
+			typ != "" && clientType(other, info) != typ,
+			maxAge != 0 && now.Sub(other.CreatedAt) < time.Duration(maxAge)*time.Second:
+			continue
+		}
+		ch.killClient(other)
+		killed++
+	}
+	w.WriteInteger(int64(killed))
+}
+
+// killClient closes the connection of client. Its goroutine notices and
+// cleans up, but the client disappears from CLIENT LIST right away.
+func (ch *CommandHandler) killClient(client *domain.Client) {
+	ch.mu.Lock()
+	delete(ch.clients, client.ID)
+	ch.mu.Unlock()
+	if client.Conn != nil {
+		client.Conn.Close()
+	}
+}
+
+func (ch *CommandHandler) handleClientSetName(client *domain.Client, parts []string) {
+	if !validClientName(parts[2]) {
+		client.Writer.WriteError("Client names cannot contain spaces, newlines or special characters.")
+		return
+	}
+	client.Name = parts[2]
+	client.Writer.WriteSimpleString("OK")
+}
+
+func (ch *CommandHandler) handleClientGetName(client *domain.Client, parts []string) {
+	if client.Name == "" {
+		client.Writer.WriteNull()
+		return
+	}
+	client.Writer.WriteBulkString(client.Name)
+}
+
+// handleClientPause pauses clients: CLIENT PAUSE timeout [WRITE|ALL]
+func (ch *CommandHandler) handleClientPause(client *domain.Client, parts []string) {
+	w := client.Writer
+	timeout, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		w.WriteError("timeout is not an integer or out of range")
+		return
+	}
+	if timeout < 0 {
+		w.WriteError("timeout is negative")
+		return
+	}
+	all := true
+	if len(parts) == 4 {
+		switch strings.ToUpper(parts[3]) {
+		case "WRITE":
+			all = false
+		case "ALL":
+		default:
+			w.WriteError("CLIENT PAUSE mode must be WRITE or ALL")
+			return
+		}
+	} else if len(parts) > 4 {
+		w.WriteError("syntax error")
+		return
+	}
+	ch.pause.pause(time.Now().Add(time.Duration(timeout)*time.Millisecond), all)
+	w.WriteSimpleString("OK")
+}
+
+func (ch *CommandHandler) handleClientUnpause(client *domain.Client, parts []string) {
+	ch.pause.unpause()
+	client.Writer.WriteSimpleString("OK")
+}
+
+func (ch *CommandHandler) handleClientNoEvict(client *domain.Client, parts []string) {
+	switch strings.ToLower(parts[2]) {
+	case "on":
+		client.NoEvict = true
+	case "off":
+		client.NoEvict = false
+	default:
+		client.Writer.WriteError("syntax error")
+		return
+	}
+	client.Writer.WriteSimpleString("OK")
+}
+
+// handleClientReply turns replies on or off, or skips the next one. Only ON
+// is answered.
+func (ch *CommandHandler) handleClientReply(client *domain.Client, parts []string) {
+	switch strings.ToLower(parts[2]) {
+	case "on":
+		client.ReplyMode = domain.ReplyOn
+		client.Writer.WriteSimpleString("OK")
+	case "off":
+		client.ReplyMode = domain.ReplyOff
+	case "skip":
+		if client.ReplyMode == domain.ReplyOn {
+			client.ReplyMode = domain.ReplySkip
+		}
+	default:
+		client.Writer.WriteError("syntax error")
+	}
+}
+
+func (ch *CommandHandler) handleClientHelp(client *domain.Client, parts []string) {
+	client.Writer.WriteStringArray([]string{
+		"CLIENT <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+		"CACHING (YES|NO)",
+		"    Enable/disable tracking of the keys for next command in OPTIN/OPTOUT modes.",
+		"GETREDIR",
+		"    Return the client ID we are redirecting to when tracking is enabled.",
+		"GETNAME",
+		"    Return the name of the current connection.",
+		"ID",
+		"    Return the ID of the current connection.",
+		"INFO",
+		"    Return information about the current client connection.",
+		"KILL <ip:port>",
+		"    Kill connection made from <ip:port>.",
+		"KILL <option> <value> [<option> <value> [...]]",
+		"    Kill connections. Options are:",
+		"    * ADDR (<ip:port>|<unixsocket>:0)",
+		"      Kill connections made from the specified address",
+		"    * LADDR (<ip:port>|<unixsocket>:0)",
+		"      Kill connections made to specified local address",
+		"    * TYPE (NORMAL|MASTER|REPLICA|PUBSUB)",
+		"      Kill connections by type.",
+		"    * USER <username>",
+		"      Kill connections authenticated by <username>.",
+		"    * SKIPME (YES|NO)",
+		"      Skip killing current connection (default: yes).",
+		"    * ID <client-id>",
+		"      Kill connections by client id.",
+		"    * MAXAGE <maxage>",
+		"      Kill connections older than the specified age.",
+		"LIST [options ...]",
+		"    Return information about client connections. Options:",
+		"    * TYPE (NORMAL|MASTER|REPLICA|PUBSUB)",
+		"      Return clients of specified type.",
+		"UNPAUSE",
+		"    Stop the current client pause, resuming traffic.",
+		"PAUSE <timeout> [WRITE|ALL]",
+		"    Suspend all, or just write, clients for <timeout> milliseconds.",
+		"REPLY (ON|OFF|SKIP)",
+		"    Control the replies sent to the current connection.",
+		"SETNAME <name>",
+		"    Assign the name <name> to the current connection.",
+		"NO-EVICT (ON|OFF)",
+		"    Protect current client connection from eviction.",
+		"TRACKING (ON|OFF) [REDIRECT <id>] [BCAST] [PREFIX <prefix> [...]]",
+		"         [OPTIN] [OPTOUT] [NOLOOP]",
+		"    Control server assisted client side caching.",
+		"TRACKINGINFO",
+		"    Report tracking status for the current connection.",
+		"HELP",
+		"    Print this help.",
+	})
+}
@@ -1,182 +1,698 @@
 package handler
 
 import (
-	"bufio"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/therahulbhati/go-redis-clone/config"
 	"github.com/therahulbhati/go-redis-clone/internal/domain"
+	"github.com/therahulbhati/go-redis-clone/internal/logging"
+	"github.com/therahulbhati/go-redis-clone/internal/tlsconfig"
 	"github.com/therahulbhati/go-redis-clone/pkg/resp"
 )
 
+// serverVersion is the Redis version the server reports to clients.
+const serverVersion = "7.2.0"
+
 type CommandHandler struct {
 	store     domain.Store
 	leaderMgr domain.LeaderManager
-	prevWrite bool
+	clients   map[int64]*domain.Client
+	mu        sync.Mutex
+	limits    resp.Limits
+	// execMu is held shared by every command and exclusively by EXEC and
+	// scripts, which makes them atomic.
+	execMu  sync.RWMutex
+	scripts *scriptEngine
+	// scriptCtx is the script being run and loadingLib the library being
+	// loaded, both only accessed with execMu held exclusively.
+	scriptCtx  *scriptContext
+	loadingLib *functionLibrary
+	functions  *functionRegistry
+	pubsub     *pubSub
+	tracking   *tracking
+	pause      clientPause
+	acl        *accessControl
+	// protectedMode refuses remote connections while the default user has
+	// no password.
+	protectedMode atomic.Bool
+	// tls is the TLS configuration, nil when TLS is disabled.
+	tls *tlsconfig.Config
+	// notifyFlags holds the keyspace notification classes selected with
+	// notify-keyspace-events.
+	notifyFlags atomic.Int32
+	// cfg is the current configuration. CONFIG SET replaces it, with
+	// configMu held, by a changed copy.
+	cfg      atomic.Pointer[config.Config]
+	configMu sync.Mutex
+	stats    serverStats
+	slowlog  slowlog
+	// dirty counts the writes since the last save and lastSave is the time
+	// of that save in seconds, which the save points go by.
+	dirty    atomic.Int64
+	lastSave atomic.Int64
+	bgsave   bgsaveState
+	// follower is the link to the leader, nil on the leader.
+	follower domain.FollowerManager
+	// runID identifies this run of the server in INFO.
+	runID     string
+	startTime time.Time
+
+	nextClientID int64
 }
 
 func debugLog(format string, v ...interface{}) {
-	fmt.Printf("[DEBUG] "+format+"\n", v...)
+	logging.Debugf(format, v...)
 }
 
-// NewCommandHandler creates a new command handler.
-func NewCommandHandler(store domain.Store, leaderMgr domain.LeaderManager) domain.CommandHandler {
-	return &CommandHandler{
+// NewCommandHandler creates a new command handler configured by cfg and
+// starts its background tasks: closing idle clients and saving the RDB file
+// at the save points.
+func NewCommandHandler(store domain.Store, leaderMgr domain.LeaderManager, cfg *config.Config) domain.CommandHandler {
+	limits := resp.DefaultLimits()
+	limits.MaxBulkLen = cfg.ProtoMaxBulkLen
+	ch := &CommandHandler{
 		store:     store,
 		leaderMgr: leaderMgr,
-		prevWrite: false,
+		clients:   make(map[int64]*domain.Client),
+		limits:    limits,
+		scripts:   newScriptEngine(),
+		functions: newFunctionRegistry(),
+		pubsub:    newPubSub(),
+		tracking:  newTracking(),
+		acl:       newAccessControl(),
+		runID:     newRunID(),
+		startTime: time.Now(),
+	}
+	ch.cfg.Store(cfg)
+	ch.bgsave.lastDuration.Store(-1)
+	ch.scripts.busyTime.Store(int64(time.Duration(cfg.BusyReplyThreshold) * time.Millisecond))
+	ch.lastSave.Store(time.Now().Unix())
+	store.OnKeyEvent(ch.storeEvent)
+	go ch.cron()
+	return ch
+}
+
+// NewClient registers a client for conn. Replies to master clients are
+// discarded, the leader doesn't expect any. Clients start authenticated as
+// the default user unless it has a password.
+func (ch *CommandHandler) NewClient(conn net.Conn, master bool) *domain.Client {
+	defaultUser := ch.acl.user("default")
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.nextClientID++
+	out := countingWriter{conn, &ch.stats.netOutputBytes}
+	client := &domain.Client{
+		ID:            ch.nextClientID,
+		Conn:          conn,
+		Out:           out,
+		CreatedAt:     time.Now(),
+		User:          "default",
+		Authenticated: defaultUser.nopass && defaultUser.enabled,
+		Writer:        resp.NewWriter(out),
+		Master:        master,
+	}
+	if master {
+		client.Writer = resp.NewWriter(io.Discard)
 	}
+	client.SetInfo(domain.ClientInfo{User: client.User, Multi: -1, LastInteraction: client.CreatedAt, LastCommand: "NULL"})
+	ch.clients[client.ID] = client
+	return client
+}
+
+// RemoveClient forgets a client whose connection is gone, dropping its
+// watched keys, subscriptions and tracking state.
+func (ch *CommandHandler) RemoveClient(client *domain.Client) {
+	ch.unwatchAll(client)
+	ch.unsubscribeAll(client)
+	ch.stopTracking(client)
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	delete(ch.clients, client.ID)
+}
+
+// propagate sends a write executed by client to the followers and records
+// the offset WAIT has to wait for. Writes of a transaction are collected and
+// sent together once EXEC completes.
+func (ch *CommandHandler) propagate(client *domain.Client, parts []string) {
+	if ch.leaderMgr == nil {
+		return
+	}
+	if client.Tx != nil && client.Tx.Executing {
+		client.Tx.Writes = append(client.Tx.Writes, domain.ReplicatedCommand{DB: client.DB, Args: parts})
+		return
+	}
+	client.LastWriteOffset = ch.leaderMgr.PropagateCommand(client.DB, parts)
 }
 
 func (ch *CommandHandler) HandleClient(conn net.Conn) {
 	//defer conn.Close()
-	reader := bufio.NewReader(conn)
+	if ch.refusedByProtectedMode(conn) {
+		logging.Verbosef("Connection from %s refused by protected mode", conn.RemoteAddr())
+		conn.Write([]byte("-" + protectedModeError + "\r\n"))
+		conn.Close()
+		return
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		// Complete the handshake now, the client certificate may
+		// authenticate the connection.
+		tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			logging.Verbosef("TLS handshake with %s failed: %s", conn.RemoteAddr(), err.Error())
+			conn.Close()
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+	}
+	ch.stats.connectionsReceived.Add(1)
+	reader := resp.NewReader(countingReader{conn, &ch.stats.netInputBytes}, ch.limits)
+	client := ch.NewClient(conn, false)
+	defer ch.RemoveClient(client)
+	ch.authenticateCertificate(client)
 
 	for {
-		request, err := resp.ParseRESP(reader)
+		request, err := reader.ReadCommand()
 		if err != nil {
 			if err == io.EOF {
-				fmt.Printf("Connection closed by client: %s\n", conn.RemoteAddr())
+				logging.Verbosef("Connection closed by client: %s", conn.RemoteAddr())
+			} else if resp.IsProtocolError(err) {
+				logging.Verbosef("Protocol error from %s: %s", conn.RemoteAddr(), err.Error())
+				client.BeginReply()
+				client.Writer.WriteError(err.Error())
+				client.EndReply()
+				conn.Close()
 			} else {
-				fmt.Printf("Error reading from %s: %s\n", conn.RemoteAddr(), err.Error())
+				logging.Verbosef("Error reading from %s: %s", conn.RemoteAddr(), err.Error())
 			}
 			return
 		}
 
-		ch.ProcessCommand(request, conn)
+		client.BeginReply()
+		client.QueryBuf = reader.Buffered()
+		ch.ProcessCommand(client, request)
+
+		// Only write once every pipelined command already received has
+		// been answered.
+		if reader.Buffered() == 0 {
+			if err := client.EndReply(); err != nil {
+				logging.Verbosef("Error writing to %s: %s", conn.RemoteAddr(), err.Error())
+				return
+			}
+		}
 	}
 }
 
-func (ch *CommandHandler) ProcessCommand(parts []string, conn net.Conn) {
+func (ch *CommandHandler) ProcessCommand(client *domain.Client, parts []string) {
 	if len(parts) == 0 {
-		conn.Write([]byte(resp.EncodeRESPError("empty command provided")))
+		client.Writer.WriteError("empty command provided")
+		return
+	}
+
+	cmd, errMsg := lookupCommand(parts)
+	if client.ReplyMode != domain.ReplyOn && (cmd == nil || (cmd.fullName() != "client|reply" && cmd.name != "reset")) {
+		defer suppressReplies(client)()
+	}
+	defer ch.publishInfo(client, cmd)
+
+	w := client.Writer
+	// Errors written outside call refused the command.
+	defer func() {
+		if n, last := w.TakeErrors(); n > 0 {
+			ch.stats.recordErrors(n, last)
+			if rejected := namedCommand(parts); rejected != nil {
+				rejected.stats.rejected.Add(1)
+			}
+		}
+	}()
+	if cmd != nil && !ch.authorize(client, cmd, parts) {
+		if client.Tx != nil {
+			client.Tx.Aborted = true
+		}
+		return
+	}
+	if cmd != nil && client.SubscriptionCount() > 0 && client.Protocol() == 2 && !allowedWhileSubscribed(cmd) {
+		w.WriteError(subscribedContextError(cmd))
+		return
+	}
+	if cmd != nil {
+		ch.waitIfPaused(client, cmd)
+	}
+	if client.Tx != nil && (cmd == nil || !runsInMulti(cmd)) {
+		ch.queue(client, cmd, errMsg, parts)
+		return
+	}
+	if cmd == nil {
+		w.WriteError(errMsg)
+		return
+	}
+	if !ch.checkMemory(client, cmd) {
 		return
 	}
-	switch strings.ToUpper(parts[0]) {
-	case "PING":
-		conn.Write([]byte(resp.EncodeRESPSimpleString("PONG")))
-	case "ECHO":
-		if len(parts) < 2 {
-			conn.Write([]byte(resp.EncodeRESPError("wrong number of arguments for 'echo' command")))
+
+	switch {
+	case cmd.exclusive:
+		// Takes execMu exclusively itself.
+	case cmd.hasFlag(flagAllowBusy):
+		// Served even while a script runs, and doesn't touch the keyspace.
+	case cmd.hasFlag(flagBlocking):
+		// Holding execMu while blocked would stall every EXEC.
+		ch.markBlocked(client)
+	default:
+		if !ch.lockExec(false) {
+			w.WriteRawError(busyError)
 			return
 		}
-		conn.Write([]byte(resp.EncodeRESPString(parts[1])))
-	case "SET":
-		if len(parts) < 3 {
-			conn.Write([]byte(resp.EncodeRESPError("wrong number of arguments for 'set' command")))
+		defer ch.execMu.RUnlock()
+	}
+	start := time.Now()
+	ch.call(client, cmd, parts)
+	ch.recordSlow(client, cmd, parts, start, time.Since(start))
+}
+
+// call executes cmd for client. It's the single path commands run through,
+// whether sent by the client, queued in a transaction or called by a script,
+// so it takes care of the client side caching bookkeeping.
+func (ch *CommandHandler) call(client *domain.Client, cmd *command, parts []string) {
+	w := client.Writer
+	start := time.Now()
+	cmd.handler(ch, client, parts)
+	elapsed := time.Since(start)
+	// The commands called by EXEC took their errors already.
+	failed, last := w.TakeErrors()
+	ch.stats.recordErrors(failed, last)
+	cmd.stats.record(elapsed, failed > 0)
+	ch.trackCommand(client, cmd, parts)
+	ch.stats.commandsProcessed.Add(1)
+	if cmd.hasFlag(flagWrite) {
+		ch.dirty.Add(1)
+	}
+}
+
+func (ch *CommandHandler) handlePing(client *domain.Client, parts []string) {
+	// Subscribed RESP2 connections can only receive arrays.
+	if client.SubscriptionCount() > 0 && client.Protocol() == 2 {
+		message := ""
+		if len(parts) > 1 {
+			message = parts[1]
+		}
+		client.Writer.WriteStringArray([]string{"pong", message})
+		return
+	}
+	if len(parts) > 1 {
+		client.Writer.WriteBulkString(parts[1])
+		return
+	}
+	client.Writer.WriteSimpleString("PONG")
+}
+
+// handleQuit replies and closes the connection once the reply is written,
+// which makes the next read fail and HandleClient clean up.
+func (ch *CommandHandler) handleQuit(client *domain.Client, parts []string) {
+	client.Writer.WriteSimpleString("OK")
+	client.Writer.Flush()
+	client.Conn.Close()
+}
+
+// handleReset brings the connection back to the state of a new one: it
+// leaves MULTI and pub/sub, forgets the watched keys, stops tracking, selects
+// database 0, speaks RESP2 and is authenticated as the default user only if
+// that needs no password.
+func (ch *CommandHandler) handleReset(client *domain.Client, parts []string) {
+	client.Tx = nil
+	ch.unwatchAll(client)
+	ch.unsubscribeAll(client)
+	ch.stopTracking(client)
+	client.DB = 0
+	client.Name = ""
+	client.ReplyMode = domain.ReplyOn
+	client.NoEvict = false
+	client.SetProtocol(2)
+	defaultUser := ch.acl.user("default")
+	client.User = "default"
+	client.Authenticated = defaultUser.nopass && defaultUser.enabled
+	client.Writer.WriteSimpleString("RESET")
+}
+
+func (ch *CommandHandler) handleEcho(client *domain.Client, parts []string) {
+	client.Writer.WriteBulkString(parts[1])
+}
+
+func (ch *CommandHandler) handleSet(client *domain.Client, parts []string) {
+	w := client.Writer
+	key, value := parts[1], parts[2]
+	expiration := time.Duration(-1)
+	if len(parts) == 5 && strings.ToUpper(parts[3]) == "PX" {
+		px, err := strconv.Atoi(parts[4])
+		if err != nil {
+			w.WriteError("invalid PX value")
 			return
 		}
-		key, value := parts[1], parts[2]
-		expiration := time.Duration(-1)
-		fmt.Println("parts", parts)
-		if len(parts) == 5 && strings.ToUpper(parts[3]) == "PX" {
-			px, err := strconv.Atoi(parts[4])
-			if err != nil {
-				conn.Write([]byte(resp.EncodeRESPError("invalid PX value")))
-				return
-			}
 
-			expiration = time.Duration(px) * time.Millisecond
+		expiration = time.Duration(px) * time.Millisecond
+	}
+	ch.store.Set(client.DB, key, value, expiration)
+	w.WriteSimpleString("OK")
+	ch.notifyKeyspaceEvent(notifyString, "set", key, client.DB)
+	if expiration > 0 {
+		ch.notifyKeyspaceEvent(notifyGeneric, "expire", key, client.DB)
+	}
+	ch.propagate(client, parts)
+}
+
+func (ch *CommandHandler) handleGet(client *domain.Client, parts []string) {
+	value, exists := ch.store.Get(client.DB, parts[1])
+	if !exists {
+		ch.stats.keyspaceMisses.Add(1)
+		ch.notifyKeyspaceEvent(notifyKeyMiss, "keymiss", parts[1], client.DB)
+		client.Writer.WriteNull()
+		return
+	}
+	ch.stats.keyspaceHits.Add(1)
+	client.Writer.WriteBulkString(value)
+}
+
+func (ch *CommandHandler) handleKeys(client *domain.Client, parts []string) {
+	client.Writer.WriteStringArray(ch.store.Keys(client.DB, parts[1]))
+}
+
+func (ch *CommandHandler) handleSelect(client *domain.Client, parts []string) {
+	db, ok := ch.parseDBIndex(parts[1], client.Writer)
+	if !ok {
+		return
+	}
+	client.DB = db
+	client.Writer.WriteSimpleString("OK")
+}
+
+func (ch *CommandHandler) handleMove(client *domain.Client, parts []string) {
+	w := client.Writer
+	db, ok := ch.parseDBIndex(parts[2], w)
+	if !ok {
+		return
+	}
+	if db == client.DB {
+		w.WriteError("source and destination objects are the same")
+		return
+	}
+	if !ch.store.Move(client.DB, db, parts[1]) {
+		w.WriteInteger(0)
+		return
+	}
+	w.WriteInteger(1)
+	ch.notifyKeyspaceEvent(notifyGeneric, "move_from", parts[1], client.DB)
+	ch.notifyKeyspaceEvent(notifyGeneric, "move_to", parts[1], db)
+	ch.propagate(client, parts)
+}
+
+func (ch *CommandHandler) handleSwapDB(client *domain.Client, parts []string) {
+	w := client.Writer
+	a, ok := ch.parseDBIndex(parts[1], w)
+	if !ok {
+		return
+	}
+	b, ok := ch.parseDBIndex(parts[2], w)
+	if !ok {
+		return
+	}
+	ch.store.SwapDB(a, b)
+	ch.invalidateAll()
+	w.WriteSimpleString("OK")
+	ch.propagate(client, parts)
+}
+
+func (ch *CommandHandler) handleFlushDB(client *domain.Client, parts []string) {
+	async, ok := parseFlushMode(parts, client.Writer)
+	if !ok {
+		return
+	}
+	ch.store.FlushDB(client.DB, async)
+	ch.invalidateAll()
+	client.Writer.WriteSimpleString("OK")
+	ch.propagate(client, parts)
+}
+
+func (ch *CommandHandler) handleFlushAll(client *domain.Client, parts []string) {
+	async, ok := parseFlushMode(parts, client.Writer)
+	if !ok {
+		return
+	}
+	ch.store.FlushAll(async)
+	ch.invalidateAll()
+	client.Writer.WriteSimpleString("OK")
+	ch.propagate(client, parts)
+}
+
+func (ch *CommandHandler) handleDBSize(client *domain.Client, parts []string) {
+	client.Writer.WriteInteger(int64(ch.store.DBSize(client.DB)))
+}
+
+func (ch *CommandHandler) handleReplconf(client *domain.Client, parts []string) {
+	if len(parts) > 1 && strings.ToUpper(parts[1]) == "ACK" {
+		return
+	}
+	if len(parts) == 3 && strings.ToLower(parts[1]) == "listening-port" {
+		port, err := strconv.Atoi(parts[2])
+		if err != nil || port < 0 || port > 65535 {
+			client.Writer.WriteError("value is not an integer or out of range")
+			return
 		}
-		debugLog("SET command received, key: %s, value: %s, expiration: %d", key, value, expiration)
-		ch.store.Set(key, value, expiration)
-		conn.Write([]byte(resp.EncodeRESPSimpleString("OK")))
-		if ch.leaderMgr != nil {
-			ch.leaderMgr.PropagateCommand(parts)
+		client.ListeningPort = port
+	}
+	client.Writer.WriteSimpleString("OK")
+}
+
+func (ch *CommandHandler) handlePSync(client *domain.Client, parts []string) {
+	w, conn := client.Writer, client.Conn
+	if ch.leaderMgr == nil {
+		w.WriteError("PSYNC only supported by leader")
+		return
+	}
+	// Nothing may be written, and propagated, between taking the snapshot
+	// and registering the follower, or it would miss the write.
+	ch.runExclusive(client, func() {
+		data, err := ch.snapshot()
+		if err != nil {
+			w.WriteError(err.Error())
+			return
 		}
-		ch.prevWrite = true
-		debugLog("SET command executed, prevWrite set to true")
-	case "GET":
-		if len(parts) != 2 {
-			conn.Write([]byte(resp.EncodeRESPError("wrong number of arguments for 'get' command")))
+		// The RDB transfer bypasses the writer, so send what's pending first.
+		w.Flush()
+		if err := ch.leaderMgr.SendFullResync(conn, data); err != nil {
+			w.WriteError(err.Error())
 			return
 		}
-		value, exists := ch.store.Get(parts[1])
-		if !exists {
-			conn.Write([]byte(resp.EncodeRESPNull()))
+		ch.leaderMgr.AddFollower(conn, client.ListeningPort)
+		client.Replica = true
+		ch.stats.syncFull.Add(1)
+	})
+}
+
+// handleHello switches the protocol version and replies with the server
+// properties, as a map when RESP3 is negotiated.
+func (ch *CommandHandler) handleHello(client *domain.Client, parts []string) {
+	w := client.Writer
+	proto := w.Protocol()
+	if len(parts) > 1 {
+		version, err := strconv.Atoi(parts[1])
+		if err != nil {
+			w.WriteError("Protocol version is not an integer or out of range")
 			return
 		}
-		conn.Write([]byte(resp.EncodeRESPString(value)))
-	case "INFO":
-		conn.Write([]byte(ch.handleInfo(parts)))
-	case "REPLCONF":
-		if parts[1] == "ACK" {
+		if version != 2 && version != 3 {
+			w.WriteRawError("NOPROTO unsupported protocol version")
 			return
 		}
-		conn.Write([]byte(resp.EncodeRESPSimpleString("OK")))
-	case "PSYNC":
-		ch.handlePSync(parts, conn)
-	case "WAIT":
-		ch.handleWait(parts, conn)
-	default:
-		conn.Write([]byte(resp.EncodeRESPError("unknown command '" + parts[0] + "'")))
+		proto = version
 	}
-}
 
-func (ch *CommandHandler) handlePSync(parts []string, conn net.Conn) {
-	if ch.leaderMgr == nil {
-		conn.Write([]byte(resp.EncodeRESPError("PSYNC only supported by leader")))
+	var user, password string
+	auth, name := false, client.Name
+	for i := 2; i < len(parts); i++ {
+		switch opt := strings.ToUpper(parts[i]); {
+		case opt == "AUTH" && i+2 < len(parts):
+			user, password = parts[i+1], parts[i+2]
+			auth = true
+			i += 2
+		case opt == "SETNAME" && i+1 < len(parts):
+			if !validClientName(parts[i+1]) {
+				w.WriteError("Client names cannot contain spaces, newlines or special characters.")
+				return
+			}
+			name = parts[i+1]
+			i++
+		default:
+			w.WriteError(fmt.Sprintf("Syntax error in HELLO option '%s'", parts[i]))
+			return
+		}
+	}
+
+	if auth && !ch.authenticate(client, user, password) {
+		w.WriteRawError(wrongPassError)
 		return
 	}
-	if err := ch.leaderMgr.SendFullResync(conn); err != nil {
-		conn.Write([]byte(resp.EncodeRESPError(err.Error())))
+	if !client.Authenticated {
+		w.WriteRawError("NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time")
 		return
 	}
-	ch.leaderMgr.AddFollower(conn)
+	client.Name = name
+	client.SetProtocol(proto)
 
+	role := "master"
+	if ch.leaderMgr == nil {
+		role = "replica"
+	}
+	w.WriteMapLen(7)
+	w.WriteBulkString("server")
+	w.WriteBulkString("redis")
+	w.WriteBulkString("version")
+	w.WriteBulkString(serverVersion)
+	w.WriteBulkString("proto")
+	w.WriteInteger(int64(proto))
+	w.WriteBulkString("id")
+	w.WriteInteger(client.ID)
+	w.WriteBulkString("mode")
+	w.WriteBulkString("standalone")
+	w.WriteBulkString("role")
+	w.WriteBulkString(role)
+	w.WriteBulkString("modules")
+	w.WriteArrayLen(0)
 }
 
-func (ch *CommandHandler) handleInfo(parts []string) string {
-	var info strings.Builder
-	if ch.leaderMgr != nil {
-		info.WriteString("role:leader\n")
-		info.WriteString(fmt.Sprintf("leader_replid:%s\n", ch.leaderMgr.GetLeaderReplID()))
-		info.WriteString(fmt.Sprintf("leader_repl_offset:%d\n", ch.leaderMgr.GetLeaderReplOffset()))
-	} else {
-		info.WriteString("role:follower\n")
+// validClientName reports whether name only holds printable characters
+// other than spaces, like Redis requires for client names.
+func validClientName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if name[i] < '!' || name[i] > '~' {
+			return false
+		}
 	}
-	return resp.EncodeRESPString(info.String())
+	return true
 }
 
-func (ch *CommandHandler) handleWait(parts []string, conn net.Conn) {
-	if ch.leaderMgr == nil {
-		conn.Write([]byte(resp.EncodeRESPError("WAIT only supported by leader")))
-		return
+// parseDBIndex validates a database index argument, replying with an error
+// when it is invalid.
+func (ch *CommandHandler) parseDBIndex(arg string, w *resp.Writer) (int, bool) {
+	db, err := strconv.Atoi(arg)
+	if err != nil {
+		w.WriteError("value is not an integer or out of range")
+		return 0, false
+	}
+	if db < 0 || db >= ch.store.DBCount() {
+		w.WriteError("DB index is out of range")
+		return 0, false
+	}
+	return db, true
+}
+
+func parseFlushMode(parts []string, w *resp.Writer) (bool, bool) {
+	if len(parts) > 2 {
+		w.WriteError("syntax error")
+		return false, false
 	}
+	if len(parts) == 1 {
+		return false, true
+	}
+	switch strings.ToUpper(parts[1]) {
+	case "ASYNC":
+		return true, true
+	case "SYNC":
+		return false, true
+	default:
+		w.WriteError("syntax error")
+		return false, false
+	}
+}
 
-	if !ch.prevWrite {
-		conn.Write([]byte(resp.EncodeRESPInteger(int64(ch.leaderMgr.GetFollowerCount()))))
+func (ch *CommandHandler) handleScan(client *domain.Client, parts []string) {
+	w := client.Writer
+	cursor, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		w.WriteError("invalid cursor")
 		return
 	}
 
-	if len(parts) < 3 {
-		conn.Write([]byte(resp.EncodeRESPError("wrong number of arguments for 'wait' command")))
+	match, keyType, count := "", "", 10
+	for i := 2; i < len(parts); i += 2 {
+		if i+1 >= len(parts) {
+			w.WriteError("syntax error")
+			return
+		}
+		switch strings.ToUpper(parts[i]) {
+		case "MATCH":
+			match = parts[i+1]
+			if match == "*" {
+				match = ""
+			}
+		case "COUNT":
+			count, err = strconv.Atoi(parts[i+1])
+			if err != nil {
+				w.WriteError("value is not an integer or out of range")
+				return
+			}
+			if count < 1 {
+				w.WriteError("syntax error")
+				return
+			}
+		case "TYPE":
+			keyType = strings.ToLower(parts[i+1])
+		default:
+			w.WriteError("syntax error")
+			return
+		}
+	}
+
+	next, keys := ch.store.Scan(client.DB, cursor, match, count, keyType)
+	w.WriteArrayLen(2)
+	w.WriteBulkString(strconv.FormatUint(next, 10))
+	w.WriteStringArray(keys)
+}
+
+// handleWait blocks until numreplicas followers acknowledged every write
+// the calling client propagated, or the timeout in milliseconds expires. A
+// timeout of 0 waits forever.
+func (ch *CommandHandler) handleWait(client *domain.Client, parts []string) {
+	w := client.Writer
+	if ch.leaderMgr == nil {
+		w.WriteError("WAIT only supported by leader")
 		return
 	}
 
 	numReplicas, err := strconv.Atoi(parts[1])
 	if err != nil {
-		conn.Write([]byte(resp.EncodeRESPError("invalid number of replicas")))
+		w.WriteError("value is not an integer or out of range")
 		return
 	}
 
 	timeout, err := strconv.Atoi(parts[2])
 	if err != nil {
-		conn.Write([]byte(resp.EncodeRESPError("invalid timeout")))
+		w.WriteError("timeout is not an integer or out of range")
+		return
+	}
+	if timeout < 0 {
+		w.WriteError("timeout is negative")
+		return
+	}
+
+	// Transactions must not block, so only report the current state.
+	if client.Tx != nil && client.Tx.Executing {
+		w.WriteInteger(int64(ch.leaderMgr.AckedReplicas(client.LastWriteOffset)))
 		return
 	}
 
-	acks, err := ch.leaderMgr.WaitForAcknowledgments(numReplicas, timeout)
+	// Replies still buffered would otherwise be held back while blocking.
+	w.Flush()
+	acks, err := ch.leaderMgr.WaitForAcknowledgments(numReplicas, client.LastWriteOffset, timeout)
 	if err != nil {
-		conn.Write([]byte(resp.EncodeRESPError(err.Error())))
+		w.WriteError(err.Error())
 		return
 	}
 
-	conn.Write([]byte(resp.EncodeRESPInteger(int64(acks))))
-	ch.prevWrite = false // Reset prevWrite after WAIT
-	debugLog("WAIT command completed, prevWrite reset to false")
+	w.WriteInteger(int64(acks))
 }
@@ -0,0 +1,834 @@
+package handler
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/therahulbhati/go-redis-clone/internal/domain"
+	"github.com/therahulbhati/go-redis-clone/pkg/resp"
+	"github.com/therahulbhati/go-redis-clone/pkg/utils"
+)
+
+// Command flags, as reported by COMMAND INFO.
+const (
+	flagWrite           = "write"
+	flagReadonly        = "readonly"
+	flagDenyOOM         = "denyoom"
+	flagAdmin           = "admin"
+	flagNoScript        = "noscript"
+	flagLoading         = "loading"
+	flagStale           = "stale"
+	flagFast            = "fast"
+	flagNoAuth          = "no_auth"
+	flagBlocking        = "blocking"
+	flagNoMulti         = "no_multi"
+	flagAllowBusy       = "allow_busy"
+	flagMayReplicate    = "may_replicate"
+	flagNoMandatoryKeys = "no_mandatory_keys"
+	flagPubSub          = "pubsub"
+)
+
+// command describes a command: how many arguments it takes, its flags,
+// where its keys are, its ACL categories and its documentation. The
+// dispatcher validates the arity before calling handler.
+type command struct {
+	name string
+	// arity is the exact number of arguments including the command name,
+	// or -N for at least N.
+	arity int
+	flags []string
+	// firstKey, lastKey and keyStep locate the key arguments. lastKey is
+	// negative when counted from the end, and firstKey is 0 for commands
+	// without keys.
+	firstKey int
+	lastKey  int
+	keyStep  int
+	// numKeysArg is the index of a numkeys argument followed by the keys,
+	// for commands like EVAL whose key count varies.
+	numKeysArg int
+	categories []string
+	// exclusive commands take execMu exclusively themselves instead of
+	// having the dispatcher take it shared.
+	exclusive bool
+
+	summary    string
+	since      string
+	group      string
+	complexity string
+
+	handler func(ch *CommandHandler, client *domain.Client, parts []string)
+
+	parent      *command
+	subcommands map[string]*command
+
+	stats commandStats
+}
+
+// fullName returns the name used in errors and COMMAND replies, which is
+// "parent|sub" for subcommands.
+func (c *command) fullName() string {
+	if c.parent != nil {
+		return c.parent.name + "|" + c.name
+	}
+	return c.name
+}
+
+func (c *command) hasFlag(flag string) bool {
+	for _, f := range c.flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *command) arityOK(n int) bool {
+	if c.arity >= 0 {
+		return n == c.arity
+	}
+	return n >= -c.arity
+}
+
+// keyPositions returns the indexes of the key arguments of parts.
+func (c *command) keyPositions(parts []string) []int {
+	if c.numKeysArg > 0 {
+		numKeys, err := strconv.Atoi(parts[c.numKeysArg])
+		if err != nil || numKeys < 0 || c.numKeysArg+numKeys >= len(parts) {
+			return nil
+		}
+		positions := make([]int, numKeys)
+		for i := range positions {
+			positions[i] = c.numKeysArg + 1 + i
+		}
+		return positions
+	}
+	if c.firstKey <= 0 {
+		return nil
+	}
+	last := c.lastKey
+	if last < 0 {
+		last = len(parts) + last
+	}
+	var positions []int
+	for i := c.firstKey; i <= last && i < len(parts); i += c.keyStep {
+		positions = append(positions, i)
+	}
+	return positions
+}
+
+var (
+	// commandTable maps lower case command names to their descriptors.
+	commandTable map[string]*command
+	// commandLookup also holds the upper case names, so the common spellings
+	// are found without allocating a lower cased copy.
+	commandLookup map[string]*command
+)
+
+func init() {
+	commands := []*command{
+		{name: "ping", arity: -1, flags: []string{flagFast}, categories: []string{"@fast", "@connection"},
+			summary: "Returns the server's liveliness response.", since: "1.0.0", group: "connection", complexity: "O(1)",
+			handler: (*CommandHandler).handlePing},
+		{name: "echo", arity: 2, flags: []string{flagFast}, categories: []string{"@fast", "@connection"},
+			summary: "Returns the given string.", since: "1.0.0", group: "connection", complexity: "O(1)",
+			handler: (*CommandHandler).handleEcho},
+		{name: "hello", arity: -1, flags: []string{flagNoScript, flagLoading, flagStale, flagFast, flagNoAuth, flagAllowBusy}, categories: []string{"@fast", "@connection"},
+			summary: "Handshakes with the Redis server.", since: "6.0.0", group: "connection", complexity: "O(1)",
+			handler: (*CommandHandler).handleHello},
+		{name: "select", arity: 2, flags: []string{flagLoading, flagStale, flagFast}, categories: []string{"@fast", "@connection"},
+			summary: "Changes the selected database.", since: "1.0.0", group: "connection", complexity: "O(1)",
+			handler: (*CommandHandler).handleSelect},
+		{name: "set", arity: -3, flags: []string{flagWrite, flagDenyOOM}, firstKey: 1, lastKey: 1, keyStep: 1, categories: []string{"@write", "@string", "@slow"},
+			summary: "Sets the string value of a key, ignoring its type. The key is created if it doesn't exist.", since: "1.0.0", group: "string", complexity: "O(1)",
+			handler: (*CommandHandler).handleSet},
+		{name: "get", arity: 2, flags: []string{flagReadonly, flagFast}, firstKey: 1, lastKey: 1, keyStep: 1, categories: []string{"@read", "@string", "@fast"},
+			summary: "Returns the string value of a key.", since: "1.0.0", group: "string", complexity: "O(1)",
+			handler: (*CommandHandler).handleGet},
+		{name: "keys", arity: 2, flags: []string{flagReadonly}, categories: []string{"@keyspace", "@read", "@slow", "@dangerous"},
+			summary: "Returns all key names that match a pattern.", since: "1.0.0", group: "generic", complexity: "O(N) with N being the number of keys in the database",
+			handler: (*CommandHandler).handleKeys},
+		{name: "scan", arity: -2, flags: []string{flagReadonly}, categories: []string{"@keyspace", "@read", "@slow"},
+			summary: "Iterates over the key names in the database.", since: "2.8.0", group: "generic", complexity: "O(1) for every call. O(N) for a complete iteration.",
+			handler: (*CommandHandler).handleScan},
+		{name: "move", arity: 3, flags: []string{flagWrite, flagFast}, firstKey: 1, lastKey: 1, keyStep: 1, categories: []string{"@keyspace", "@write", "@fast"},
+			summary: "Moves a key to another database.", since: "1.0.0", group: "generic", complexity: "O(1)",
+			handler: (*CommandHandler).handleMove},
+		{name: "swapdb", arity: 3, flags: []string{flagWrite, flagFast}, categories: []string{"@keyspace", "@write", "@fast", "@dangerous"},
+			summary: "Swaps two Redis databases.", since: "4.0.0", group: "server", complexity: "O(N) where N is the count of clients watching or blocking on keys from both databases.",
+			handler: (*CommandHandler).handleSwapDB},
+		{name: "flushdb", arity: -1, flags: []string{flagWrite}, categories: []string{"@keyspace", "@write", "@slow", "@dangerous"},
+			summary: "Remove all keys from the current database.", since: "1.0.0", group: "server", complexity: "O(N) where N is the number of keys in the selected database",
+			handler: (*CommandHandler).handleFlushDB},
+		{name: "flushall", arity: -1, flags: []string{flagWrite}, categories: []string{"@keyspace", "@write", "@slow", "@dangerous"},
+			summary: "Removes all keys from all databases.", since: "1.0.0", group: "server", complexity: "O(N) where N is the total number of keys in all databases",
+			handler: (*CommandHandler).handleFlushAll},
+		{name: "dbsize", arity: 1, flags: []string{flagReadonly, flagFast}, categories: []string{"@keyspace", "@read", "@fast"},
+			summary: "Returns the number of keys in the database.", since: "1.0.0", group: "server", complexity: "O(1)",
+			handler: (*CommandHandler).handleDBSize},
+		{name: "info", arity: -1, flags: []string{flagLoading, flagStale}, categories: []string{"@slow", "@dangerous"},
+			summary: "Returns information and statistics about the server.", since: "1.0.0", group: "server", complexity: "O(1)",
+			handler: (*CommandHandler).handleInfo},
+		{name: "replconf", arity: -1, flags: []string{flagAdmin, flagNoScript, flagLoading, flagStale}, categories: []string{"@admin", "@slow", "@dangerous"},
+			summary: "An internal command for configuring the replication stream.", since: "3.0.0", group: "server", complexity: "O(1)",
+			handler: (*CommandHandler).handleReplconf},
+		{name: "psync", arity: -3, flags: []string{flagAdmin, flagNoScript, flagNoMulti}, categories: []string{"@admin", "@slow", "@dangerous"},
+			summary: "An internal command used in replication.", since: "2.8.0", group: "server", complexity: "O(1)",
+			handler: (*CommandHandler).handlePSync, exclusive: true},
+		{name: "wait", arity: 3, flags: []string{flagNoScript, flagBlocking}, categories: []string{"@slow", "@connection"},
+			summary: "Blocks until the asynchronous replication of all preceding write commands sent by the connection is completed.", since: "3.0.0", group: "generic", complexity: "O(1)",
+			handler: (*CommandHandler).handleWait},
+		{name: "multi", arity: 1, flags: []string{flagNoScript, flagLoading, flagStale, flagFast, flagAllowBusy}, categories: []string{"@fast", "@transaction"},
+			summary: "Starts a transaction.", since: "1.2.0", group: "transactions", complexity: "O(1)",
+			handler: (*CommandHandler).handleMulti},
+		{name: "exec", arity: 1, flags: []string{flagNoScript, flagLoading, flagStale}, categories: []string{"@slow", "@transaction"},
+			summary: "Executes all commands in a transaction.", since: "1.2.0", group: "transactions", complexity: "Depends on commands in the transaction",
+			handler: (*CommandHandler).handleExec, exclusive: true},
+		{name: "discard", arity: 1, flags: []string{flagNoScript, flagLoading, flagStale, flagFast, flagAllowBusy}, categories: []string{"@fast", "@transaction"},
+			summary: "Discards a transaction.", since: "2.0.0", group: "transactions", complexity: "O(N), when N is the number of queued commands",
+			handler: (*CommandHandler).handleDiscard},
+		{name: "watch", arity: -2, flags: []string{flagNoScript, flagLoading, flagStale, flagFast}, firstKey: 1, lastKey: -1, keyStep: 1, categories: []string{"@fast", "@transaction"},
+			summary: "Monitors changes to keys to determine the execution of a transaction.", since: "2.2.0", group: "transactions", complexity: "O(1) for every key.",
+			handler: (*CommandHandler).handleWatch},
+		{name: "unwatch", arity: 1, flags: []string{flagNoScript, flagLoading, flagStale, flagFast}, categories: []string{"@fast", "@transaction"},
+			summary: "Forgets about watched keys of a transaction.", since: "2.2.0", group: "transactions", complexity: "O(1)",
+			handler: (*CommandHandler).handleUnwatch},
+		{name: "eval", arity: -3, flags: []string{flagNoScript, flagStale, flagMayReplicate, flagNoMandatoryKeys}, numKeysArg: 2, categories: []string{"@slow", "@scripting"},
+			summary: "Executes a server-side Lua script.", since: "2.6.0", group: "scripting", complexity: "Depends on the script that is executed.",
+			handler: (*CommandHandler).handleEval, exclusive: true},
+		{name: "evalsha", arity: -3, flags: []string{flagNoScript, flagStale, flagMayReplicate, flagNoMandatoryKeys}, numKeysArg: 2, categories: []string{"@slow", "@scripting"},
+			summary: "Executes a server-side Lua script by SHA1 digest.", since: "2.6.0", group: "scripting", complexity: "Depends on the script that is executed.",
+			handler: (*CommandHandler).handleEvalSha, exclusive: true},
+		{name: "script", arity: -2, categories: []string{"@slow"},
+			summary: "A container for Lua scripts management commands.", since: "2.6.0", group: "scripting", complexity: "Depends on subcommand.",
+			subcommands: subcommandMap(
+				&command{name: "exists", arity: -3, flags: []string{flagNoScript}, categories: []string{"@slow", "@scripting"},
+					summary: "Determines whether server-side Lua scripts exist in the script cache.", since: "2.6.0", group: "scripting", complexity: "O(N) with N being the number of scripts to check (so checking a single script is an O(1) operation).",
+					handler: (*CommandHandler).handleScriptExists},
+				&command{name: "flush", arity: -2, flags: []string{flagNoScript}, categories: []string{"@slow", "@scripting"},
+					summary: "Removes all server-side Lua scripts from the script cache.", since: "2.6.0", group: "scripting", complexity: "O(N) with N being the number of scripts in cache",
+					handler: (*CommandHandler).handleScriptFlush},
+				&command{name: "help", arity: 2, flags: []string{flagLoading, flagStale}, categories: []string{"@slow", "@scripting"},
+					summary: "Returns helpful text about the different subcommands.", since: "5.0.0", group: "scripting", complexity: "O(1)",
+					handler: (*CommandHandler).handleScriptHelp},
+				&command{name: "kill", arity: 2, flags: []string{flagNoScript, flagAllowBusy}, categories: []string{"@slow", "@scripting"},
+					summary: "Terminates a server-side Lua script during execution.", since: "2.6.0", group: "scripting", complexity: "O(1)",
+					handler: (*CommandHandler).handleScriptKill},
+				&command{name: "load", arity: 3, flags: []string{flagNoScript, flagStale}, categories: []string{"@slow", "@scripting"},
+					summary: "Loads a server-side Lua script to the script cache.", since: "2.6.0", group: "scripting", complexity: "O(N) with N being the length in bytes of the script body.",
+					handler: (*CommandHandler).handleScriptLoad},
+			)},
+		{name: "fcall", arity: -3, flags: []string{flagNoScript, flagStale, flagMayReplicate, flagNoMandatoryKeys}, numKeysArg: 2, categories: []string{"@slow", "@scripting"},
+			summary: "Invokes a function.", since: "7.0.0", group: "scripting", complexity: "Depends on the function that is executed.",
+			handler: (*CommandHandler).handleFCall, exclusive: true},
+		{name: "fcall_ro", arity: -3, flags: []string{flagNoScript, flagStale, flagNoMandatoryKeys}, numKeysArg: 2, categories: []string{"@slow", "@scripting"},
+			summary: "Invokes a read-only function.", since: "7.0.0", group: "scripting", complexity: "Depends on the function that is executed.",
+			handler: (*CommandHandler).handleFCallRO, exclusive: true},
+		{name: "function", arity: -2, categories: []string{"@slow"},
+			summary: "A container for function commands.", since: "7.0.0", group: "scripting", complexity: "Depends on subcommand.",
+			subcommands: subcommandMap(
+				&command{name: "delete", arity: 3, flags: []string{flagNoScript, flagWrite}, categories: []string{"@write", "@slow", "@scripting"},
+					summary: "Deletes a library and its functions.", since: "7.0.0", group: "scripting", complexity: "O(1)",
+					handler: (*CommandHandler).handleFunctionDelete, exclusive: true},
+				&command{name: "dump", arity: 2, flags: []string{flagNoScript}, categories: []string{"@slow", "@scripting"},
+					summary: "Dumps all libraries into a serialized binary payload.", since: "7.0.0", group: "scripting", complexity: "O(N) where N is the number of functions",
+					handler: (*CommandHandler).handleFunctionDump},
+				&command{name: "flush", arity: -2, flags: []string{flagNoScript, flagWrite}, categories: []string{"@write", "@slow", "@scripting"},
+					summary: "Deletes all libraries and functions.", since: "7.0.0", group: "scripting", complexity: "O(N) where N is the number of functions deleted",
+					handler: (*CommandHandler).handleFunctionFlush, exclusive: true},
+				&command{name: "help", arity: 2, flags: []string{flagLoading, flagStale}, categories: []string{"@slow", "@scripting"},
+					summary: "Returns helpful text about the different subcommands.", since: "7.0.0", group: "scripting", complexity: "O(1)",
+					handler: (*CommandHandler).handleFunctionHelp},
+				&command{name: "list", arity: -2, flags: []string{flagNoScript}, categories: []string{"@slow", "@scripting"},
+					summary: "Returns information about all libraries.", since: "7.0.0", group: "scripting", complexity: "O(N) where N is the number of functions",
+					handler: (*CommandHandler).handleFunctionList},
+				&command{name: "load", arity: -3, flags: []string{flagNoScript, flagWrite, flagDenyOOM}, categories: []string{"@write", "@slow", "@scripting"},
+					summary: "Creates a library.", since: "7.0.0", group: "scripting", complexity: "O(1) (considering compilation time is redundant)",
+					handler: (*CommandHandler).handleFunctionLoad, exclusive: true},
+				&command{name: "restore", arity: -3, flags: []string{flagNoScript, flagWrite, flagDenyOOM}, categories: []string{"@write", "@slow", "@scripting"},
+					summary: "Restores all libraries from a payload.", since: "7.0.0", group: "scripting", complexity: "O(N) where N is the number of functions on the payload",
+					handler: (*CommandHandler).handleFunctionRestore, exclusive: true},
+			)},
+		{name: "save", arity: 1, flags: []string{flagAdmin, flagNoScript, flagNoMulti}, categories: []string{"@admin", "@slow", "@dangerous"},
+			summary: "Synchronously saves the database(s) to disk.", since: "1.0.0", group: "server", complexity: "O(N) where N is the total number of keys in all databases",
+			handler: (*CommandHandler).handleSave, exclusive: true},
+		{name: "subscribe", arity: -2, flags: []string{flagPubSub, flagNoScript, flagLoading, flagStale}, categories: []string{"@pubsub", "@slow"},
+			summary: "Listens for messages published to channels.", since: "2.0.0", group: "pubsub", complexity: "O(N) where N is the number of channels to subscribe to.",
+			handler: (*CommandHandler).handleSubscribe},
+		{name: "unsubscribe", arity: -1, flags: []string{flagPubSub, flagNoScript, flagLoading, flagStale}, categories: []string{"@pubsub", "@slow"},
+			summary: "Stops listening to messages posted to channels.", since: "2.0.0", group: "pubsub", complexity: "O(N) where N is the number of channels to unsubscribe.",
+			handler: (*CommandHandler).handleUnsubscribe},
+		{name: "psubscribe", arity: -2, flags: []string{flagPubSub, flagNoScript, flagLoading, flagStale}, categories: []string{"@pubsub", "@slow"},
+			summary: "Listens for messages published to channels that match one or more patterns.", since: "2.0.0", group: "pubsub", complexity: "O(N) where N is the number of patterns to subscribe to.",
+			handler: (*CommandHandler).handlePSubscribe},
+		{name: "punsubscribe", arity: -1, flags: []string{flagPubSub, flagNoScript, flagLoading, flagStale}, categories: []string{"@pubsub", "@slow"},
+			summary: "Stops listening to messages published to channels that match one or more patterns.", since: "2.0.0", group: "pubsub", complexity: "O(N) where N is the number of patterns to unsubscribe.",
+			handler: (*CommandHandler).handlePUnsubscribe},
+		{name: "publish", arity: 3, flags: []string{flagPubSub, flagLoading, flagStale, flagFast, flagMayReplicate}, categories: []string{"@pubsub", "@fast"},
+			summary: "Posts a message to a channel.", since: "2.0.0", group: "pubsub", complexity: "O(N+M) where N is the number of clients subscribed to the receiving channel and M is the total number of subscribed patterns (by any client).",
+			handler: (*CommandHandler).handlePublish},
+		{name: "ssubscribe", arity: -2, flags: []string{flagPubSub, flagNoScript, flagLoading, flagStale}, firstKey: 1, lastKey: -1, keyStep: 1, categories: []string{"@pubsub", "@slow"},
+			summary: "Listens for messages published to shard channels.", since: "7.0.0", group: "pubsub", complexity: "O(N) where N is the number of shard channels to subscribe to.",
+			handler: (*CommandHandler).handleSSubscribe},
+		{name: "sunsubscribe", arity: -1, flags: []string{flagPubSub, flagNoScript, flagLoading, flagStale}, firstKey: 1, lastKey: -1, keyStep: 1, categories: []string{"@pubsub", "@slow"},
+			summary: "Stops listening to messages posted to shard channels.", since: "7.0.0", group: "pubsub", complexity: "O(N) where N is the number of shard channels to unsubscribe.",
+			handler: (*CommandHandler).handleSUnsubscribe},
+		{name: "spublish", arity: 3, flags: []string{flagPubSub, flagLoading, flagStale, flagFast, flagMayReplicate}, firstKey: 1, lastKey: 1, keyStep: 1, categories: []string{"@pubsub", "@fast"},
+			summary: "Post a message to a shard channel", since: "7.0.0", group: "pubsub", complexity: "O(N) where N is the number of clients subscribed to the receiving shard channel.",
+			handler: (*CommandHandler).handleSPublish},
+		{name: "pubsub", arity: -2, categories: []string{"@slow"},
+			summary: "A container for Pub/Sub commands.", since: "2.8.0", group: "pubsub", complexity: "Depends on subcommand.",
+			subcommands: subcommandMap(
+				&command{name: "channels", arity: -2, flags: []string{flagPubSub, flagLoading, flagStale}, categories: []string{"@pubsub", "@slow"},
+					summary: "Returns the active channels.", since: "2.8.0", group: "pubsub", complexity: "O(N) where N is the number of active channels, and assuming constant time pattern matching (relatively short channels and patterns)",
+					handler: (*CommandHandler).handlePubSubChannels},
+				&command{name: "help", arity: 2, flags: []string{flagLoading, flagStale}, categories: []string{"@slow"},
+					summary: "Returns helpful text about the different subcommands.", since: "6.2.0", group: "pubsub", complexity: "O(1)",
+					handler: (*CommandHandler).handlePubSubHelp},
+				&command{name: "numpat", arity: 2, flags: []string{flagPubSub, flagLoading, flagStale}, categories: []string{"@pubsub", "@slow"},
+					summary: "Returns a count of unique pattern subscriptions.", since: "2.8.0", group: "pubsub", complexity: "O(1)",
+					handler: (*CommandHandler).handlePubSubNumPat},
+				&command{name: "numsub", arity: -2, flags: []string{flagPubSub, flagLoading, flagStale}, categories: []string{"@pubsub", "@slow"},
+					summary: "Returns a count of subscribers to channels.", since: "2.8.0", group: "pubsub", complexity: "O(N) for the NUMSUB subcommand, where N is the number of requested channels",
+					handler: (*CommandHandler).handlePubSubNumSub},
+				&command{name: "shardchannels", arity: -2, flags: []string{flagPubSub, flagLoading, flagStale}, categories: []string{"@pubsub", "@slow"},
+					summary: "Returns the active shard channels.", since: "7.0.0", group: "pubsub", complexity: "O(N) where N is the number of active shard channels, and assuming constant time pattern matching (relatively short shard channels).",
+					handler: (*CommandHandler).handlePubSubShardChannels},
+				&command{name: "shardnumsub", arity: -2, flags: []string{flagPubSub, flagLoading, flagStale}, categories: []string{"@pubsub", "@slow"},
+					summary: "Returns the count of subscribers of shard channels.", since: "7.0.0", group: "pubsub", complexity: "O(N) for the SHARDNUMSUB subcommand, where N is the number of requested shard channels",
+					handler: (*CommandHandler).handlePubSubShardNumSub},
+			)},
+		{name: "quit", arity: -1, flags: []string{flagAllowBusy, flagNoAuth, flagNoScript, flagLoading, flagStale, flagFast}, categories: []string{"@fast", "@connection"},
+			summary: "Closes the connection.", since: "1.0.0", group: "connection", complexity: "O(1)",
+			handler: (*CommandHandler).handleQuit},
+		{name: "reset", arity: 1, flags: []string{flagNoScript, flagLoading, flagStale, flagFast, flagNoAuth, flagAllowBusy}, categories: []string{"@fast", "@connection"},
+			summary: "Resets the connection.", since: "6.2.0", group: "connection", complexity: "O(1)",
+			handler: (*CommandHandler).handleReset},
+		{name: "client", arity: -2, categories: []string{"@slow"},
+			summary: "A container for client connection commands.", since: "2.4.0", group: "connection", complexity: "Depends on subcommand.",
+			subcommands: subcommandMap(
+				&command{name: "caching", arity: 3, flags: []string{flagNoScript, flagLoading, flagStale}, categories: []string{"@slow", "@connection"},
+					summary: "Instructs the server whether to track the keys in the next request.", since: "6.0.0", group: "connection", complexity: "O(1)",
+					handler: (*CommandHandler).handleClientCaching},
+				&command{name: "getname", arity: 2, flags: []string{flagNoScript, flagLoading, flagStale}, categories: []string{"@slow", "@connection"},
+					summary: "Returns the name of the connection.", since: "2.6.9", group: "connection", complexity: "O(1)",
+					handler: (*CommandHandler).handleClientGetName},
+				&command{name: "getredir", arity: 2, flags: []string{flagNoScript, flagLoading, flagStale}, categories: []string{"@slow", "@connection"},
+					summary: "Returns the client ID to which the connection's tracking notifications are redirected.", since: "6.0.0", group: "connection", complexity: "O(1)",
+					handler: (*CommandHandler).handleClientGetRedir},
+				&command{name: "help", arity: 2, flags: []string{flagLoading, flagStale}, categories: []string{"@slow", "@connection"},
+					summary: "Returns helpful text about the different subcommands.", since: "5.0.0", group: "connection", complexity: "O(1)",
+					handler: (*CommandHandler).handleClientHelp},
+				&command{name: "id", arity: 2, flags: []string{flagNoScript, flagLoading, flagStale}, categories: []string{"@slow", "@connection"},
+					summary: "Returns the unique client ID of the connection.", since: "5.0.0", group: "connection", complexity: "O(1)",
+					handler: (*CommandHandler).handleClientID},
+				&command{name: "info", arity: 2, flags: []string{flagNoScript, flagLoading, flagStale}, categories: []string{"@slow", "@connection"},
+					summary: "Returns information about the connection.", since: "6.2.0", group: "connection", complexity: "O(1)",
+					handler: (*CommandHandler).handleClientInfo},
+				&command{name: "kill", arity: -3, flags: []string{flagAdmin, flagNoScript, flagLoading, flagStale}, categories: []string{"@admin", "@slow", "@dangerous", "@connection"},
+					summary: "Terminates open connections.", since: "2.4.0", group: "connection", complexity: "O(N) where N is the number of client connections",
+					handler: (*CommandHandler).handleClientKill},
+				&command{name: "list", arity: -2, flags: []string{flagAdmin, flagNoScript, flagLoading, flagStale}, categories: []string{"@admin", "@slow", "@dangerous", "@connection"},
+					summary: "Lists open connections.", since: "2.4.0", group: "connection", complexity: "O(N) where N is the number of client connections",
+					handler: (*CommandHandler).handleClientList},
+				&command{name: "no-evict", arity: 3, flags: []string{flagAdmin, flagNoScript, flagLoading, flagStale}, categories: []string{"@admin", "@slow", "@dangerous", "@connection"},
+					summary: "Sets the client eviction mode of the connection.", since: "7.0.0", group: "connection", complexity: "O(1)",
+					handler: (*CommandHandler).handleClientNoEvict},
+				&command{name: "pause", arity: -3, flags: []string{flagAdmin, flagNoScript, flagLoading, flagStale}, categories: []string{"@admin", "@slow", "@dangerous", "@connection"},
+					summary: "Suspends commands processing.", since: "3.0.0", group: "connection", complexity: "O(1)",
+					handler: (*CommandHandler).handleClientPause},
+				&command{name: "reply", arity: 3, flags: []string{flagNoScript, flagLoading, flagStale}, categories: []string{"@slow", "@connection"},
+					summary: "Instructs the server whether to reply to commands.", since: "3.2.0", group: "connection", complexity: "O(1)",
+					handler: (*CommandHandler).handleClientReply},
+				&command{name: "setname", arity: 3, flags: []string{flagNoScript, flagLoading, flagStale}, categories: []string{"@slow", "@connection"},
+					summary: "Sets the connection name.", since: "2.6.9", group: "connection", complexity: "O(1)",
+					handler: (*CommandHandler).handleClientSetName},
+				&command{name: "tracking", arity: -3, flags: []string{flagNoScript, flagLoading, flagStale}, categories: []string{"@slow", "@connection"},
+					summary: "Controls server-assisted client-side caching for the connection.", since: "6.0.0", group: "connection", complexity: "O(1). Some options may introduce additional complexity.",
+					handler: (*CommandHandler).handleClientTracking},
+				&command{name: "trackinginfo", arity: 2, flags: []string{flagNoScript, flagLoading, flagStale}, categories: []string{"@slow", "@connection"},
+					summary: "Returns information about server-assisted client-side caching for the connection.", since: "6.2.0", group: "connection", complexity: "O(1)",
+					handler: (*CommandHandler).handleClientTrackingInfo},
+				&command{name: "unpause", arity: 2, flags: []string{flagAdmin, flagNoScript, flagLoading, flagStale}, categories: []string{"@admin", "@slow", "@dangerous", "@connection"},
+					summary: "Resumes processing of clients that were paused.", since: "6.2.0", group: "connection", complexity: "O(N) Where N is the number of paused clients",
+					handler: (*CommandHandler).handleClientUnpause},
+			)},
+		{name: "auth", arity: -2, flags: []string{flagNoScript, flagLoading, flagStale, flagFast, flagNoAuth, flagAllowBusy}, categories: []string{"@fast", "@connection"},
+			summary: "Authenticates the connection.", since: "1.0.0", group: "connection", complexity: "O(N) where N is the number of passwords defined for the user",
+			handler: (*CommandHandler).handleAuth},
+		{name: "acl", arity: -2, categories: []string{"@slow"},
+			summary: "A container for Access List Control commands.", since: "6.0.0", group: "server", complexity: "Depends on subcommand.",
+			subcommands: subcommandMap(
+				&command{name: "cat", arity: -2, flags: []string{flagNoScript, flagLoading, flagStale}, categories: []string{"@slow"},
+					summary: "Lists the ACL categories, or the commands inside a category.", since: "6.0.0", group: "server", complexity: "O(1) since the categories and commands are a fixed set.",
+					handler: (*CommandHandler).handleACLCat},
+				&command{name: "deluser", arity: -3, flags: []string{flagAdmin, flagNoScript, flagLoading, flagStale}, categories: []string{"@admin", "@slow", "@dangerous"},
+					summary: "Deletes ACL users, and terminates their connections.", since: "6.0.0", group: "server", complexity: "O(1) amortized time considering the typical user.",
+					handler: (*CommandHandler).handleACLDelUser},
+				&command{name: "dryrun", arity: -4, flags: []string{flagAdmin, flagNoScript, flagLoading, flagStale}, categories: []string{"@admin", "@slow", "@dangerous"},
+					summary: "Simulates the execution of a command by a user, without executing the command.", since: "7.0.0", group: "server", complexity: "O(1).",
+					handler: (*CommandHandler).handleACLDryRun},
+				&command{name: "genpass", arity: -2, flags: []string{flagNoScript, flagLoading, flagStale}, categories: []string{"@slow"},
+					summary: "Generates a pseudorandom, secure password that can be used to identify ACL users.", since: "6.0.0", group: "server", complexity: "O(1)",
+					handler: (*CommandHandler).handleACLGenPass},
+				&command{name: "getuser", arity: 3, flags: []string{flagAdmin, flagNoScript, flagLoading, flagStale}, categories: []string{"@admin", "@slow", "@dangerous"},
+					summary: "Lists the ACL rules of a user.", since: "6.0.0", group: "server", complexity: "O(N). Where N is the number of password, command and pattern rules that the user has.",
+					handler: (*CommandHandler).handleACLGetUser},
+				&command{name: "help", arity: 2, flags: []string{flagLoading, flagStale}, categories: []string{"@slow"},
+					summary: "Returns helpful text about the different subcommands.", since: "6.0.0", group: "server", complexity: "O(1)",
+					handler: (*CommandHandler).handleACLHelp},
+				&command{name: "list", arity: 2, flags: []string{flagAdmin, flagNoScript, flagLoading, flagStale}, categories: []string{"@admin", "@slow", "@dangerous"},
+					summary: "Dumps the effective rules in ACL file format.", since: "6.0.0", group: "server", complexity: "O(N). Where N is the number of configured users.",
+					handler: (*CommandHandler).handleACLList},
+				&command{name: "load", arity: 2, flags: []string{flagAdmin, flagNoScript, flagLoading, flagStale}, categories: []string{"@admin", "@slow", "@dangerous"},
+					summary: "Reloads the rules from the configured ACL file.", since: "6.0.0", group: "server", complexity: "O(N). Where N is the number of configured users.",
+					handler: (*CommandHandler).handleACLLoad},
+				&command{name: "log", arity: -2, flags: []string{flagAdmin, flagNoScript, flagLoading, flagStale}, categories: []string{"@admin", "@slow", "@dangerous"},
+					summary: "Lists recent security events generated due to ACL rejections.", since: "6.0.0", group: "server", complexity: "O(N) with N being the number of entries shown.",
+					handler: (*CommandHandler).handleACLLog},
+				&command{name: "save", arity: 2, flags: []string{flagAdmin, flagNoScript, flagLoading, flagStale}, categories: []string{"@admin", "@slow", "@dangerous"},
+					summary: "Saves the effective ACL rules in the configured ACL file.", since: "6.0.0", group: "server", complexity: "O(N). Where N is the number of configured users.",
+					handler: (*CommandHandler).handleACLSave},
+				&command{name: "setuser", arity: -3, flags: []string{flagAdmin, flagNoScript, flagLoading, flagStale}, categories: []string{"@admin", "@slow", "@dangerous"},
+					summary: "Creates and modifies an ACL user and its rules.", since: "6.0.0", group: "server", complexity: "O(N). Where N is the number of rules provided.",
+					handler: (*CommandHandler).handleACLSetUser},
+				&command{name: "users", arity: 2, flags: []string{flagAdmin, flagNoScript, flagLoading, flagStale}, categories: []string{"@admin", "@slow", "@dangerous"},
+					summary: "Lists all ACL users.", since: "6.0.0", group: "server", complexity: "O(N). Where N is the number of configured users.",
+					handler: (*CommandHandler).handleACLUsers},
+				&command{name: "whoami", arity: 2, flags: []string{flagNoScript, flagLoading, flagStale}, categories: []string{"@slow"},
+					summary: "Returns the authenticated username of the current connection.", since: "6.0.0", group: "server", complexity: "O(1)",
+					handler: (*CommandHandler).handleACLWhoAmI},
+			)},
+		{name: "config", arity: -2, categories: []string{"@slow"},
+			summary: "A container for server configuration commands.", since: "2.0.0", group: "server", complexity: "Depends on subcommand.",
+			subcommands: subcommandMap(
+				&command{name: "get", arity: -3, flags: []string{flagAdmin, flagNoScript, flagLoading, flagStale}, categories: []string{"@admin", "@slow", "@dangerous"},
+					summary: "Returns the effective values of configuration parameters.", since: "2.0.0", group: "server", complexity: "O(N) when N is the number of configuration parameters provided",
+					handler: (*CommandHandler).handleConfigGet},
+				&command{name: "help", arity: 2, flags: []string{flagLoading, flagStale}, categories: []string{"@slow"},
+					summary: "Returns helpful text about the different subcommands.", since: "5.0.0", group: "server", complexity: "O(1)",
+					handler: (*CommandHandler).handleConfigHelp},
+				&command{name: "resetstat", arity: 2, flags: []string{flagAdmin, flagNoScript, flagLoading, flagStale}, categories: []string{"@admin", "@slow", "@dangerous"},
+					summary: "Resets the server's statistics.", since: "2.0.0", group: "server", complexity: "O(1)",
+					handler: (*CommandHandler).handleConfigResetStat},
+				&command{name: "rewrite", arity: 2, flags: []string{flagAdmin, flagNoScript, flagLoading, flagStale}, categories: []string{"@admin", "@slow", "@dangerous"},
+					summary: "Persists the effective configuration to file.", since: "2.8.0", group: "server", complexity: "O(1)",
+					handler: (*CommandHandler).handleConfigRewrite},
+				&command{name: "set", arity: -4, flags: []string{flagAdmin, flagNoScript, flagLoading, flagStale}, categories: []string{"@admin", "@slow", "@dangerous"},
+					summary: "Sets configuration parameters in-flight.", since: "2.0.0", group: "server", complexity: "O(N) when N is the number of configuration parameters provided",
+					handler: (*CommandHandler).handleConfigSet},
+			)},
+		{name: "command", arity: -1, flags: []string{flagLoading, flagStale}, categories: []string{"@slow", "@connection"},
+			summary: "Returns detailed information about all commands.", since: "2.8.13", group: "server", complexity: "O(N) where N is the total number of Redis commands",
+			handler: (*CommandHandler).handleCommand,
+			subcommands: subcommandMap(
+				&command{name: "count", arity: 2, flags: []string{flagLoading, flagStale}, categories: []string{"@slow", "@connection"},
+					summary: "Returns a count of commands.", since: "2.8.13", group: "server", complexity: "O(1)",
+					handler: (*CommandHandler).handleCommandCount},
+				&command{name: "docs", arity: -2, flags: []string{flagLoading, flagStale}, categories: []string{"@slow", "@connection"},
+					summary: "Returns documentary information about one, multiple or all commands.", since: "7.0.0", group: "server", complexity: "O(N) where N is the number of commands to look up",
+					handler: (*CommandHandler).handleCommandDocs},
+				&command{name: "getkeys", arity: -3, flags: []string{flagLoading, flagStale}, categories: []string{"@slow", "@connection"},
+					summary: "Extracts the key names from an arbitrary command.", since: "2.8.13", group: "server", complexity: "O(N) where N is the number of arguments to the command",
+					handler: (*CommandHandler).handleCommandGetKeys},
+				&command{name: "help", arity: 2, flags: []string{flagLoading, flagStale}, categories: []string{"@slow", "@connection"},
+					summary: "Returns helpful text about the different subcommands.", since: "5.0.0", group: "server", complexity: "O(1)",
+					handler: (*CommandHandler).handleCommandHelp},
+				&command{name: "info", arity: -2, flags: []string{flagLoading, flagStale}, categories: []string{"@slow", "@connection"},
+					summary: "Returns information about one, multiple or all commands.", since: "2.8.13", group: "server", complexity: "O(N) where N is the number of commands to look up",
+					handler: (*CommandHandler).handleCommandInfo},
+				&command{name: "list", arity: -2, flags: []string{flagLoading, flagStale}, categories: []string{"@slow", "@connection"},
+					summary: "Returns a list of command names.", since: "7.0.0", group: "server", complexity: "O(N) where N is the total number of Redis commands",
+					handler: (*CommandHandler).handleCommandList},
+			)},
+		{name: "slowlog", arity: -2, categories: []string{"@slow"},
+			summary: "A container for slow log commands.", since: "2.2.12", group: "server", complexity: "Depends on subcommand.",
+			subcommands: subcommandMap(
+				&command{name: "get", arity: -2, flags: []string{flagAdmin, flagLoading, flagStale}, categories: []string{"@admin", "@slow", "@dangerous"},
+					summary: "Returns the slow log's entries.", since: "2.2.12", group: "server", complexity: "O(N) where N is the number of entries returned",
+					handler: (*CommandHandler).handleSlowlogGet},
+				&command{name: "help", arity: 2, flags: []string{flagLoading, flagStale}, categories: []string{"@slow"},
+					summary: "Returns helpful text about the different subcommands.", since: "6.2.0", group: "server", complexity: "O(1)",
+					handler: (*CommandHandler).handleSlowlogHelp},
+				&command{name: "len", arity: 2, flags: []string{flagAdmin, flagLoading, flagStale}, categories: []string{"@admin", "@slow", "@dangerous"},
+					summary: "Returns the number of entries in the slow log.", since: "2.2.12", group: "server", complexity: "O(1)",
+					handler: (*CommandHandler).handleSlowlogLen},
+				&command{name: "reset", arity: 2, flags: []string{flagAdmin, flagLoading, flagStale}, categories: []string{"@admin", "@slow", "@dangerous"},
+					summary: "Clears all entries from the slow log.", since: "2.2.12", group: "server", complexity: "O(N) where N is the number of entries in the slowlog",
+					handler: (*CommandHandler).handleSlowlogReset},
+			)},
+	}
+
+	commandTable = make(map[string]*command)
+	commandLookup = make(map[string]*command)
+	for _, cmd := range commands {
+		registerCommand(cmd)
+	}
+}
+
+func registerCommand(cmd *command) {
+	for _, sub := range cmd.subcommands {
+		sub.parent = cmd
+	}
+	commandTable[cmd.name] = cmd
+	commandLookup[cmd.name] = cmd
+	commandLookup[strings.ToUpper(cmd.name)] = cmd
+}
+
+func subcommandMap(subs ...*command) map[string]*command {
+	m := make(map[string]*command, len(subs))
+	for _, sub := range subs {
+		m[sub.name] = sub
+	}
+	return m
+}
+
+// lookupCommand resolves the command, or subcommand, invoked by parts and
+// checks its arity. It returns the error to reply with when that fails.
+func lookupCommand(parts []string) (*command, string) {
+	cmd, ok := commandLookup[parts[0]]
+	if !ok {
+		cmd, ok = commandTable[strings.ToLower(parts[0])]
+	}
+	if !ok {
+		return nil, unknownCommandError(parts)
+	}
+
+	if cmd.subcommands != nil && len(parts) >= 2 {
+		sub, ok := cmd.subcommands[strings.ToLower(parts[1])]
+		if !ok {
+			return nil, fmt.Sprintf("unknown subcommand '%s'. Try %s HELP.", truncate(parts[1], 128), strings.ToUpper(cmd.name))
+		}
+		cmd = sub
+	}
+
+	if !cmd.arityOK(len(parts)) || cmd.handler == nil {
+		return nil, fmt.Sprintf("wrong number of arguments for '%s' command", cmd.fullName())
+	}
+	return cmd, ""
+}
+
+// namedCommand returns the command, or subcommand, parts names even when
+// its arguments are wrong, nil when there is none.
+func namedCommand(parts []string) *command {
+	cmd, ok := commandTable[strings.ToLower(parts[0])]
+	if !ok {
+		return nil
+	}
+	if cmd.subcommands != nil && len(parts) >= 2 {
+		return cmd.subcommands[strings.ToLower(parts[1])]
+	}
+	return cmd
+}
+
+func unknownCommandError(parts []string) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "unknown command '%s', with args beginning with: ", truncate(parts[0], 128))
+	for _, arg := range parts[1:] {
+		if sb.Len() >= 128 {
+			break
+		}
+		fmt.Fprintf(&sb, "'%s' ", truncate(arg, 128-sb.Len()))
+	}
+	return sb.String()
+}
+
+func truncate(s string, n int) string {
+	if n < 0 {
+		n = 0
+	}
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+// sortedCommands returns the top level commands ordered by name.
+func sortedCommands() []*command {
+	cmds := make([]*command, 0, len(commandTable))
+	for _, cmd := range commandTable {
+		cmds = append(cmds, cmd)
+	}
+	sort.Slice(cmds, func(i, j int) bool { return cmds[i].name < cmds[j].name })
+	return cmds
+}
+
+func (c *command) sortedSubcommands() []*command {
+	subs := make([]*command, 0, len(c.subcommands))
+	for _, sub := range c.subcommands {
+		subs = append(subs, sub)
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].name < subs[j].name })
+	return subs
+}
+
+func (ch *CommandHandler) handleCommand(client *domain.Client, parts []string) {
+	cmds := sortedCommands()
+	client.Writer.WriteArrayLen(len(cmds))
+	for _, cmd := range cmds {
+		writeCommandInfo(client.Writer, cmd)
+	}
+}
+
+func (ch *CommandHandler) handleCommandCount(client *domain.Client, parts []string) {
+	client.Writer.WriteInteger(int64(len(commandTable)))
+}
+
+func (ch *CommandHandler) handleCommandInfo(client *domain.Client, parts []string) {
+	if len(parts) == 2 {
+		ch.handleCommand(client, parts)
+		return
+	}
+	client.Writer.WriteArrayLen(len(parts) - 2)
+	for _, name := range parts[2:] {
+		cmd := findCommand(name)
+		if cmd == nil {
+			client.Writer.WriteNullArray()
+			continue
+		}
+		writeCommandInfo(client.Writer, cmd)
+	}
+}
+
+func (ch *CommandHandler) handleCommandDocs(client *domain.Client, parts []string) {
+	var cmds []*command
+	if len(parts) == 2 {
+		cmds = sortedCommands()
+	} else {
+		for _, name := range parts[2:] {
+			if cmd := findCommand(name); cmd != nil {
+				cmds = append(cmds, cmd)
+			}
+		}
+	}
+
+	client.Writer.WriteMapLen(len(cmds))
+	for _, cmd := range cmds {
+		client.Writer.WriteBulkString(cmd.fullName())
+		writeCommandDocs(client.Writer, cmd)
+	}
+}
+
+func (ch *CommandHandler) handleCommandList(client *domain.Client, parts []string) {
+	filter := func(*command) bool { return true }
+	if len(parts) > 2 {
+		if len(parts) != 5 || strings.ToUpper(parts[2]) != "FILTERBY" {
+			client.Writer.WriteError("syntax error")
+			return
+		}
+		arg := parts[4]
+		switch strings.ToUpper(parts[3]) {
+		case "MODULE":
+			// No modules can be loaded, so nothing matches.
+			filter = func(*command) bool { return false }
+		case "ACLCAT":
+			category := "@" + strings.ToLower(arg)
+			filter = func(c *command) bool {
+				for _, cat := range c.categories {
+					if cat == category {
+						return true
+					}
+				}
+				return false
+			}
+		case "PATTERN":
+			filter = func(c *command) bool { return utils.GlobMatch(arg, c.fullName(), true) }
+		default:
+			client.Writer.WriteError("syntax error")
+			return
+		}
+	}
+
+	var names []string
+	for _, cmd := range sortedCommands() {
+		if filter(cmd) {
+			names = append(names, cmd.fullName())
+		}
+		for _, sub := range cmd.sortedSubcommands() {
+			if filter(sub) {
+				names = append(names, sub.fullName())
+			}
+		}
+	}
+	client.Writer.WriteStringArray(names)
+}
+
+func (ch *CommandHandler) handleCommandGetKeys(client *domain.Client, parts []string) {
+	args := parts[2:]
+	cmd, ok := commandTable[strings.ToLower(args[0])]
+	if !ok {
+		client.Writer.WriteError("Invalid command specified")
+		return
+	}
+	if cmd.subcommands != nil && len(args) >= 2 {
+		if sub, ok := cmd.subcommands[strings.ToLower(args[1])]; ok {
+			cmd = sub
+		}
+	}
+	if !cmd.arityOK(len(args)) {
+		client.Writer.WriteError("Invalid number of arguments specified for command")
+		return
+	}
+
+	positions := cmd.keyPositions(args)
+	if len(positions) == 0 {
+		client.Writer.WriteError("The command has no key arguments")
+		return
+	}
+	keys := make([]string, len(positions))
+	for i, pos := range positions {
+		keys[i] = args[pos]
+	}
+	client.Writer.WriteStringArray(keys)
+}
+
+func (ch *CommandHandler) handleCommandHelp(client *domain.Client, parts []string) {
+	client.Writer.WriteStringArray([]string{
+		"COMMAND <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+		"(no subcommand)",
+		"    Return details about all Redis commands.",
+		"COUNT",
+		"    Return the total number of commands in this Redis server.",
+		"LIST [FILTERBY (MODULE <module-name>|ACLCAT <category>|PATTERN <pattern>)]",
+		"    Return a list of all commands in this Redis server.",
+		"INFO [<command-name> ...]",
+		"    Return details about multiple Redis commands.",
+		"    If no command names are given, documentation details for all",
+		"    commands are returned.",
+		"DOCS [<command-name> ...]",
+		"    Return documentation details about multiple Redis commands.",
+		"    If no command names are given, documentation details for all",
+		"    commands are returned.",
+		"GETKEYS <full-command>",
+		"    Return the keys from a full Redis command.",
+		"HELP",
+		"    Print this help.",
+	})
+}
+
+// findCommand resolves a name as used by COMMAND INFO and DOCS, where
+// subcommands are written as "parent|sub".
+func findCommand(name string) *command {
+	name = strings.ToLower(name)
+	parent, sub, isSub := strings.Cut(name, "|")
+	cmd, ok := commandTable[parent]
+	if !ok {
+		return nil
+	}
+	if isSub {
+		return cmd.subcommands[sub]
+	}
+	return cmd
+}
+
+// writeCommandInfo writes the COMMAND INFO entry of cmd.
+func writeCommandInfo(w *resp.Writer, cmd *command) {
+	w.WriteArrayLen(10)
+	w.WriteBulkString(cmd.fullName())
+	w.WriteInteger(int64(cmd.arity))
+	w.WriteSetLen(len(cmd.flags))
+	for _, flag := range cmd.flags {
+		w.WriteSimpleString(flag)
+	}
+	w.WriteInteger(int64(cmd.firstKey))
+	w.WriteInteger(int64(cmd.lastKey))
+	w.WriteInteger(int64(cmd.keyStep))
+	w.WriteSetLen(len(cmd.categories))
+	for _, cat := range cmd.categories {
+		w.WriteSimpleString(cat)
+	}
+	// Tips.
+	w.WriteArrayLen(0)
+
+	// Key specifications.
+	if cmd.firstKey <= 0 && cmd.numKeysArg <= 0 {
+		w.WriteArrayLen(0)
+	} else {
+		keyFlags := []string{"RO", "ACCESS"}
+		if cmd.hasFlag(flagWrite) {
+			keyFlags = []string{"RW", "UPDATE"}
+		}
+		begin := cmd.firstKey
+		if cmd.numKeysArg > 0 {
+			begin = cmd.numKeysArg
+			// Scripts may do anything with their keys.
+			keyFlags = []string{"RW", "ACCESS", "UPDATE"}
+		}
+		w.WriteArrayLen(1)
+		w.WriteMapLen(3)
+		w.WriteBulkString("flags")
+		w.WriteSetLen(len(keyFlags))
+		for _, flag := range keyFlags {
+			w.WriteSimpleString(flag)
+		}
+		w.WriteBulkString("begin_search")
+		w.WriteMapLen(2)
+		w.WriteBulkString("type")
+		w.WriteBulkString("index")
+		w.WriteBulkString("spec")
+		w.WriteMapLen(1)
+		w.WriteBulkString("index")
+		w.WriteInteger(int64(begin))
+		w.WriteBulkString("find_keys")
+		w.WriteMapLen(2)
+		w.WriteBulkString("type")
+		if cmd.numKeysArg > 0 {
+			w.WriteBulkString("keynum")
+			w.WriteBulkString("spec")
+			w.WriteMapLen(3)
+			w.WriteBulkString("keynumidx")
+			w.WriteInteger(0)
+			w.WriteBulkString("firstkey")
+			w.WriteInteger(1)
+			w.WriteBulkString("keystep")
+			w.WriteInteger(1)
+		} else {
+			lastKey := cmd.lastKey
+			if lastKey >= 0 {
+				lastKey -= cmd.firstKey
+			}
+			w.WriteBulkString("range")
+			w.WriteBulkString("spec")
+			w.WriteMapLen(3)
+			w.WriteBulkString("lastkey")
+			w.WriteInteger(int64(lastKey))
+			w.WriteBulkString("keystep")
+			w.WriteInteger(int64(cmd.keyStep))
+			w.WriteBulkString("limit")
+			w.WriteInteger(0)
+		}
+	}
+
+	subs := cmd.sortedSubcommands()
+	w.WriteArrayLen(len(subs))
+	for _, sub := range subs {
+		writeCommandInfo(w, sub)
+	}
+}
+
+// writeCommandDocs writes the COMMAND DOCS entry of cmd.
+func writeCommandDocs(w *resp.Writer, cmd *command) {
+	subs := cmd.sortedSubcommands()
+	fields := 4
+	if len(subs) > 0 {
+		fields++
+	}
+	w.WriteMapLen(fields)
+	w.WriteBulkString("summary")
+	w.WriteBulkString(cmd.summary)
+	w.WriteBulkString("since")
+	w.WriteBulkString(cmd.since)
+	w.WriteBulkString("group")
+	w.WriteBulkString(cmd.group)
+	w.WriteBulkString("complexity")
+	w.WriteBulkString(cmd.complexity)
+	if len(subs) > 0 {
+		w.WriteBulkString("subcommands")
+		w.WriteMapLen(len(subs))
+		for _, sub := range subs {
+			w.WriteBulkString(sub.fullName())
+			writeCommandDocs(w, sub)
+		}
+	}
+}
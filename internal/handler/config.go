@@ -0,0 +1,196 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/therahulbhati/go-redis-clone/config"
+	"github.com/therahulbhati/go-redis-clone/internal/domain"
+	"github.com/therahulbhati/go-redis-clone/internal/logging"
+	"github.com/therahulbhati/go-redis-clone/internal/tlsconfig"
+	"github.com/therahulbhati/go-redis-clone/pkg/utils"
+)
+
+var errTLSDisabled = errors.New("TLS is disabled, start the server with --tls-port or --tls-replication")
+
+// applyConfig applies the parameters changed from old to next to the
+// running server. Every check that may fail comes first, so nothing changes
+// when an error is returned.
+func (ch *CommandHandler) applyConfig(old, next *config.Config) error {
+	flags, err := parseKeyspaceEvents(next.NotifyKeyspaceEvents)
+	if err != nil {
+		return err
+	}
+	if next.Dir != old.Dir && next.Dir != "" {
+		if info, err := os.Stat(next.Dir); err != nil || !info.IsDir() {
+			return fmt.Errorf("No such directory '%s'", next.Dir)
+		}
+	}
+	if next.TLS != old.TLS {
+		if ch.tls == nil {
+			return errTLSDisabled
+		}
+		err := ch.tls.Update(func(s *tlsconfig.Settings) error {
+			*s = next.TLS
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("Unable to update TLS configuration: %s", err)
+		}
+	}
+
+	ch.notifyFlags.Store(int32(flags))
+	if next.RequirePass != old.RequirePass {
+		ch.SetRequirePass(next.RequirePass)
+	}
+	ch.protectedMode.Store(next.ProtectedMode)
+	ch.scripts.busyTime.Store(int64(time.Duration(next.BusyReplyThreshold) * time.Millisecond))
+	logging.SetLevel(next.LogLevel)
+	return nil
+}
+
+// Config returns the current configuration, which CONFIG SET replaces.
+func (ch *CommandHandler) Config() *config.Config {
+	return ch.cfg.Load()
+}
+
+// SetTLSConfig selects the TLS configuration CONFIG SET reloads and client
+// certificates are checked with, nil when TLS is disabled.
+func (ch *CommandHandler) SetTLSConfig(config *tlsconfig.Config) {
+	ch.tls = config
+}
+
+// configValue returns the value CONFIG GET shows for the parameter name.
+func (ch *CommandHandler) configValue(cfg *config.Config, name string) string {
+	if name == "notify-keyspace-events" {
+		return formatKeyspaceEvents(int(ch.notifyFlags.Load()))
+	}
+	return cfg.Get(name)
+}
+
+// handleConfigGet returns the parameters matching any of the glob patterns:
+// CONFIG GET parameter [parameter ...]
+func (ch *CommandHandler) handleConfigGet(client *domain.Client, parts []string) {
+	matched := make(map[string]bool)
+	for _, pattern := range parts[2:] {
+		pattern = strings.ToLower(pattern)
+		// An exact name may be an alias, which globs don't match.
+		if config.Exists(pattern) {
+			matched[pattern] = true
+			continue
+		}
+		for _, name := range config.Names() {
+			if utils.GlobMatch(pattern, name, true) {
+				matched[name] = true
+			}
+		}
+	}
+	names := make([]string, 0, len(matched))
+	for name := range matched {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	cfg := ch.cfg.Load()
+	w := client.Writer
+	w.WriteMapLen(len(names))
+	for _, name := range names {
+		w.WriteBulkString(name)
+		w.WriteBulkString(ch.configValue(cfg, name))
+	}
+}
+
+// handleConfigSet changes parameters at runtime, all of them or none:
+// CONFIG SET parameter value [parameter value ...]
+func (ch *CommandHandler) handleConfigSet(client *domain.Client, parts []string) {
+	w := client.Writer
+	if len(parts)%2 != 0 {
+		w.WriteError("wrong number of arguments for 'config|set' command")
+		return
+	}
+
+	ch.configMu.Lock()
+	defer ch.configMu.Unlock()
+	old := ch.cfg.Load()
+	next := old.Clone()
+	seen := make(map[string]bool)
+	for i := 2; i < len(parts); i += 2 {
+		name := strings.ToLower(parts[i])
+		if !config.Exists(name) {
+			w.WriteError(fmt.Sprintf("Unknown option or number of arguments for CONFIG SET - '%s'", truncate(parts[i], 128)))
+			return
+		}
+		if name == "appendfsync" {
+			w.WriteError("CONFIG SET failed (possibly related to argument 'appendfsync') - AOF is not supported")
+			return
+		}
+		if !config.Mutable(name) {
+			w.WriteError(fmt.Sprintf("CONFIG SET failed (possibly related to argument '%s') - can't set immutable config", name))
+			return
+		}
+		if seen[name] {
+			w.WriteError(fmt.Sprintf("CONFIG SET failed (possibly related to argument '%s') - duplicate parameter", name))
+			return
+		}
+		seen[name] = true
+		if err := next.Set(name, []string{parts[i+1]}); err != nil {
+			w.WriteError(fmt.Sprintf("CONFIG SET failed (possibly related to argument '%s') - %s", name, err))
+			return
+		}
+	}
+	if err := ch.applyConfig(old, next); err != nil {
+		w.WriteError(fmt.Sprintf("CONFIG SET failed (possibly related to argument '%s') - %s", strings.ToLower(parts[2]), err))
+		return
+	}
+	ch.cfg.Store(next)
+	// A lower maxmemory takes effect right away.
+	if next.MaxMemory > 0 && (old.MaxMemory == 0 || next.MaxMemory < old.MaxMemory) {
+		ch.store.Evict(next.MaxMemory, next.MaxMemoryPolicy, next.MaxMemorySamples)
+	}
+	w.WriteSimpleString("OK")
+}
+
+// handleConfigResetStat resets the statistics reported by INFO:
+// CONFIG RESETSTAT
+func (ch *CommandHandler) handleConfigResetStat(client *domain.Client, parts []string) {
+	ch.stats.reset()
+	client.Writer.WriteSimpleString("OK")
+}
+
+// handleConfigRewrite writes the current configuration back to the file the
+// server was started with: CONFIG REWRITE
+func (ch *CommandHandler) handleConfigRewrite(client *domain.Client, parts []string) {
+	ch.configMu.Lock()
+	defer ch.configMu.Unlock()
+	if err := ch.cfg.Load().Rewrite(); err != nil {
+		if errors.Is(err, config.ErrNoFile) {
+			client.Writer.WriteError(err.Error())
+			return
+		}
+		logging.Warningf("CONFIG REWRITE failed: %v", err)
+		client.Writer.WriteError(fmt.Sprintf("Rewriting config file: %s", err))
+		return
+	}
+	logging.Noticef("CONFIG REWRITE executed with success.")
+	client.Writer.WriteSimpleString("OK")
+}
+
+func (ch *CommandHandler) handleConfigHelp(client *domain.Client, parts []string) {
+	client.Writer.WriteStringArray([]string{
+		"CONFIG <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+		"GET <pattern>",
+		"    Return parameters matching the glob-like <pattern> and their values.",
+		"SET <directive> <value>",
+		"    Set the configuration <directive> to <value>.",
+		"RESETSTAT",
+		"    Reset statistics reported by the INFO command.",
+		"REWRITE",
+		"    Rewrite the configuration file.",
+		"HELP",
+		"    Print this help.",
+	})
+}
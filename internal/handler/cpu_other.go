@@ -0,0 +1,8 @@
+//go:build !unix
+
+package handler
+
+// cpuTimes reports no CPU time where getrusage isn't available.
+func cpuTimes() (sys, user, sysChildren, userChildren float64) {
+	return 0, 0, 0, 0
+}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package handler
+
+import "syscall"
+
+// cpuTimes returns the system and user CPU time used by the server and by
+// its terminated children, in seconds.
+func cpuTimes() (sys, user, sysChildren, userChildren float64) {
+	var self, children syscall.Rusage
+	syscall.Getrusage(syscall.RUSAGE_SELF, &self)
+	syscall.Getrusage(syscall.RUSAGE_CHILDREN, &children)
+	return seconds(self.Stime), seconds(self.Utime), seconds(children.Stime), seconds(children.Utime)
+}
+
+func seconds(tv syscall.Timeval) float64 {
+	return float64(tv.Sec) + float64(tv.Usec)/1e6
+}
@@ -0,0 +1,132 @@
+package handler
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/therahulbhati/go-redis-clone/internal/domain"
+	"github.com/therahulbhati/go-redis-clone/internal/logging"
+	"github.com/therahulbhati/go-redis-clone/internal/rdb"
+)
+
+// cronInterval is how often the background tasks run, like the default hz
+// of Redis.
+const cronInterval = 100 * time.Millisecond
+
+// saveRetryDelay is how long to wait before trying a save point again after
+// a failed save.
+const saveRetryDelay = 5 * time.Second
+
+// cron runs the background tasks for the lifetime of the server.
+func (ch *CommandHandler) cron() {
+	ticker := time.NewTicker(cronInterval)
+	defer ticker.Stop()
+	var lastFailure time.Time
+	for now := range ticker.C {
+		ch.stats.sampleMetrics(now, ch.store.UsedMemory())
+		ch.closeIdleClients(now)
+		if now.Sub(lastFailure) >= saveRetryDelay && !ch.saveIfNeeded(now) {
+			lastFailure = now
+		}
+	}
+}
+
+// closeIdleClients closes the connections idle for longer than timeout.
+// Followers, the leader, subscribers and clients blocked in a command are
+// left alone, like in Redis.
+func (ch *CommandHandler) closeIdleClients(now time.Time) {
+	timeout := time.Duration(ch.cfg.Load().Timeout) * time.Second
+	if timeout == 0 {
+		return
+	}
+	ch.mu.Lock()
+	var idle []*domain.Client
+	for _, client := range ch.clients {
+		info := client.Info()
+		if client.Master || info.Replica || info.Blocked || info.Channels+info.Patterns+info.ShardChannels > 0 {
+			continue
+		}
+		if now.Sub(info.LastInteraction) > timeout {
+			idle = append(idle, client)
+		}
+	}
+	ch.mu.Unlock()
+
+	for _, client := range idle {
+		logging.Verbosef("Closing idle client %s", client.Conn.RemoteAddr())
+		client.Conn.Close()
+	}
+}
+
+// saveIfNeeded saves the RDB file when a save point is reached: the dataset
+// changed at least Changes times and the last save is at least Seconds old.
+// It reports false when the save failed.
+func (ch *CommandHandler) saveIfNeeded(now time.Time) bool {
+	cfg := ch.cfg.Load()
+	path := cfg.RDBPath()
+	dirty := ch.dirty.Load()
+	if path == "" || dirty == 0 {
+		return true
+	}
+	elapsed := now.Unix() - ch.lastSave.Load()
+	for _, point := range cfg.Save {
+		if dirty < int64(point.Changes) || elapsed < int64(point.Seconds) {
+			continue
+		}
+		logging.Noticef("%d changes in %d seconds. Saving...", point.Changes, point.Seconds)
+		if err := ch.backgroundSave(path); err != nil {
+			logging.Warningf("Error saving RDB file: %v", err)
+			return false
+		}
+		logging.Noticef("DB saved on disk")
+		return true
+	}
+	return true
+}
+
+// bgsaveState describes the background saves for INFO persistence.
+type bgsaveState struct {
+	// started is the time the save in progress started in nanoseconds, 0
+	// when there is none.
+	started atomic.Int64
+	// failed is set when the last save failed, and lastDuration is how
+	// long it took in seconds, -1 before the first one.
+	failed       atomic.Bool
+	lastDuration atomic.Int64
+	// saves counts the saves since the server started.
+	saves atomic.Int64
+}
+
+// backgroundSave encodes the snapshot with the other commands blocked, then
+// writes it to path while they run again.
+func (ch *CommandHandler) backgroundSave(path string) (err error) {
+	start := time.Now()
+	ch.bgsave.started.Store(start.UnixNano())
+	defer func() {
+		ch.bgsave.started.Store(0)
+		ch.bgsave.failed.Store(err != nil)
+		ch.bgsave.lastDuration.Store(int64(time.Since(start).Seconds()))
+	}()
+	if !ch.lockExec(true) {
+		return errors.New("a busy script is running")
+	}
+	data, err := ch.snapshot()
+	dirty := ch.dirty.Load()
+	ch.execMu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := rdb.WriteFile(path, data); err != nil {
+		return err
+	}
+	ch.saved(dirty)
+	return nil
+}
+
+// saved records a save of the dataset as it was after dirty writes.
+func (ch *CommandHandler) saved(dirty int64) {
+	ch.dirty.Add(-dirty)
+	ch.lastSave.Store(time.Now().Unix())
+	ch.bgsave.saves.Add(1)
+}
@@ -0,0 +1,543 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/therahulbhati/go-redis-clone/internal/domain"
+	"github.com/therahulbhati/go-redis-clone/internal/rdb"
+	"github.com/therahulbhati/go-redis-clone/pkg/utils"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// functionLoadTimeout bounds the time a library may take to register its
+// functions.
+const functionLoadTimeout = 500 * time.Millisecond
+
+// functionFlags are the flags register_function accepts.
+var functionFlags = map[string]bool{
+	"no-writes":             true,
+	"allow-oom":             true,
+	"allow-stale":           true,
+	"no-cluster":            true,
+	"allow-cross-slot-keys": true,
+}
+
+// functionRegistry holds the libraries loaded with FUNCTION LOAD and the
+// functions they registered. It is only accessed with execMu held, and
+// exclusively to modify it.
+type functionRegistry struct {
+	libraries map[string]*functionLibrary
+	functions map[string]*luaFunction
+}
+
+type functionLibrary struct {
+	name      string
+	code      string
+	functions map[string]*luaFunction
+}
+
+type luaFunction struct {
+	name        string
+	library     *functionLibrary
+	callback    *lua.LFunction
+	flags       []string
+	description string
+}
+
+func newFunctionRegistry() *functionRegistry {
+	return &functionRegistry{
+		libraries: make(map[string]*functionLibrary),
+		functions: make(map[string]*luaFunction),
+	}
+}
+
+func (r *functionRegistry) clone() *functionRegistry {
+	c := newFunctionRegistry()
+	for name, lib := range r.libraries {
+		c.libraries[name] = lib
+	}
+	for name, fn := range r.functions {
+		c.functions[name] = fn
+	}
+	return c
+}
+
+// add registers lib, replacing a library of the same name if replace is
+// set.
+func (r *functionRegistry) add(lib *functionLibrary, replace bool) error {
+	old, exists := r.libraries[lib.name]
+	if exists && !replace {
+		return fmt.Errorf("Library '%s' already exists", lib.name)
+	}
+	for name := range lib.functions {
+		if fn, ok := r.functions[name]; ok && fn.library != old {
+			return fmt.Errorf("Function %s already exists", name)
+		}
+	}
+	if exists {
+		r.remove(old)
+	}
+	r.libraries[lib.name] = lib
+	for name, fn := range lib.functions {
+		r.functions[name] = fn
+	}
+	return nil
+}
+
+func (r *functionRegistry) remove(lib *functionLibrary) {
+	delete(r.libraries, lib.name)
+	for name := range lib.functions {
+		delete(r.functions, name)
+	}
+}
+
+// sortedLibraries returns the libraries ordered by name.
+func (r *functionRegistry) sortedLibraries() []*functionLibrary {
+	libs := make([]*functionLibrary, 0, len(r.libraries))
+	for _, lib := range r.libraries {
+		libs = append(libs, lib)
+	}
+	sort.Slice(libs, func(i, j int) bool { return libs[i].name < libs[j].name })
+	return libs
+}
+
+func (r *functionRegistry) codes() []string {
+	libs := r.sortedLibraries()
+	codes := make([]string, len(libs))
+	for i, lib := range libs {
+		codes[i] = lib.code
+	}
+	return codes
+}
+
+// validFunctionName reports whether name is a valid library or function
+// name: letters, digits and underscores only.
+func validFunctionName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// parseLibraryHeader parses the "#!lua name=<library>" first line of a
+// library and returns the library name and the code with the header
+// blanked, so line numbers in errors stay right.
+func parseLibraryHeader(code string) (string, string, error) {
+	if !strings.HasPrefix(code, "#!") {
+		return "", "", errors.New("Missing library metadata")
+	}
+	header, body, _ := strings.Cut(code, "\n")
+	fields := strings.Fields(header[2:])
+	if len(fields) == 0 {
+		return "", "", errors.New("Missing library metadata")
+	}
+	if !strings.EqualFold(fields[0], "lua") {
+		return "", "", fmt.Errorf("Engine '%s' not found", fields[0])
+	}
+
+	name := ""
+	for _, field := range fields[1:] {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok || key != "name" {
+			return "", "", fmt.Errorf("Invalid metadata value given: %s", field)
+		}
+		name = value
+	}
+	if name == "" {
+		return "", "", errors.New("Library name was not given")
+	}
+	if !validFunctionName(name) {
+		return "", "", errors.New("Library names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+	}
+	return name, "\n" + body, nil
+}
+
+// loadLibrary runs the code of a library, collecting the functions it
+// registers. It must be called with execMu held exclusively.
+func (ch *CommandHandler) loadLibrary(code string) (*functionLibrary, error) {
+	name, body, err := parseLibraryHeader(code)
+	if err != nil {
+		return nil, err
+	}
+	chunk, err := parse.Parse(strings.NewReader(body), "user_function")
+	if err != nil {
+		return nil, fmt.Errorf("Error compiling function: %v", err)
+	}
+	proto, err := lua.Compile(chunk, "user_function")
+	if err != nil {
+		return nil, fmt.Errorf("Error compiling function: %v", err)
+	}
+
+	L := ch.scripts.state(ch)
+	lib := &functionLibrary{name: name, code: code, functions: make(map[string]*luaFunction)}
+
+	// The library gets its own environment, whose redis table adds
+	// register_function to the global one.
+	redis := L.NewTable()
+	redis.RawSetString("register_function", L.NewFunction(func(L *lua.LState) int {
+		return ch.luaRegisterFunction(L, lib)
+	}))
+	redisMeta := L.NewTable()
+	redisMeta.RawSetString("__index", L.GetGlobal("redis"))
+	L.SetMetatable(redis, redisMeta)
+	env := L.NewTable()
+	env.RawSetString("redis", redis)
+	meta := L.NewTable()
+	meta.RawSetString("__index", L.Get(lua.GlobalsIndex))
+	L.SetMetatable(env, meta)
+
+	fn := L.NewFunctionFromProto(proto)
+	fn.Env = env
+
+	ctx, cancel := context.WithTimeout(context.Background(), functionLoadTimeout)
+	defer cancel()
+	ch.loadingLib = lib
+	L.SetContext(ctx)
+	L.Push(fn)
+	err = L.PCall(0, 0, nil)
+	L.RemoveContext()
+	ch.loadingLib = nil
+
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, errors.New("FUNCTION LOAD timeout")
+		}
+		if apiErr, ok := err.(*lua.ApiError); ok {
+			if t, ok := apiErr.Object.(*lua.LTable); ok {
+				if msg, ok := t.RawGetString("err").(lua.LString); ok {
+					return nil, fmt.Errorf("Error registering functions: %s", msg)
+				}
+			}
+			return nil, fmt.Errorf("Error registering functions: %s", apiErr.Object.String())
+		}
+		return nil, err
+	}
+	if len(lib.functions) == 0 {
+		return nil, errors.New("No functions registered")
+	}
+	return lib, nil
+}
+
+// luaRegisterFunction implements redis.register_function, called either as
+// register_function(name, callback) or with a table of named arguments.
+func (ch *CommandHandler) luaRegisterFunction(L *lua.LState, lib *functionLibrary) int {
+	if ch.loadingLib != lib {
+		L.RaiseError("redis.register_function can only be called on FUNCTION LOAD command")
+		return 0
+	}
+
+	fn := &luaFunction{library: lib}
+	if t, ok := L.Get(1).(*lua.LTable); ok && L.GetTop() == 1 {
+		var bad string
+		t.ForEach(func(k, v lua.LValue) {
+			switch k.String() {
+			case "function_name":
+				fn.name = v.String()
+			case "callback":
+				fn.callback, _ = v.(*lua.LFunction)
+			case "description":
+				fn.description = v.String()
+			case "flags":
+				flags, ok := v.(*lua.LTable)
+				if !ok {
+					bad = "flags argument to redis.register_function must be a table representing function flags"
+					return
+				}
+				flags.ForEach(func(_, flag lua.LValue) {
+					if !functionFlags[flag.String()] {
+						bad = "unknown flag given"
+						return
+					}
+					fn.flags = append(fn.flags, flag.String())
+				})
+			default:
+				bad = "unknown argument given to redis.register_function"
+			}
+		})
+		if bad != "" {
+			L.RaiseError("%s", bad)
+			return 0
+		}
+	} else {
+		if L.GetTop() != 2 {
+			L.RaiseError("wrong number of arguments to redis.register_function")
+			return 0
+		}
+		fn.name = L.CheckString(1)
+		fn.callback = L.CheckFunction(2)
+	}
+
+	switch {
+	case fn.callback == nil:
+		L.RaiseError("redis.register_function must get a callback argument")
+	case !validFunctionName(fn.name):
+		L.RaiseError("Function names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+	case lib.functions[fn.name] != nil:
+		L.RaiseError("Function already exists in the library")
+	default:
+		lib.functions[fn.name] = fn
+	}
+	return 0
+}
+
+func (f *luaFunction) hasFlag(flag string) bool {
+	for _, fl := range f.flags {
+		if fl == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// restoreLibraries loads libraries from their code. The policy is FLUSH,
+// APPEND or REPLACE, like FUNCTION RESTORE's. Nothing changes if any of
+// them fails to load. It must be called with execMu held exclusively.
+func (ch *CommandHandler) restoreLibraries(codes []string, policy string) error {
+	registry := ch.functions.clone()
+	if policy == "FLUSH" {
+		registry = newFunctionRegistry()
+	}
+	for _, code := range codes {
+		lib, err := ch.loadLibrary(code)
+		if err != nil {
+			return err
+		}
+		if err := registry.add(lib, policy == "REPLACE"); err != nil {
+			return err
+		}
+	}
+	ch.functions = registry
+	return nil
+}
+
+func (ch *CommandHandler) handleFunctionLoad(client *domain.Client, parts []string) {
+	replace := false
+	code := parts[2]
+	if len(parts) == 4 {
+		if !strings.EqualFold(parts[2], "REPLACE") {
+			client.Writer.WriteError(fmt.Sprintf("Unknown option given: %s", parts[2]))
+			return
+		}
+		replace, code = true, parts[3]
+	}
+
+	ch.runExclusive(client, func() {
+		lib, err := ch.loadLibrary(code)
+		if err != nil {
+			client.Writer.WriteError(err.Error())
+			return
+		}
+		registry := ch.functions.clone()
+		if err := registry.add(lib, replace); err != nil {
+			client.Writer.WriteError(err.Error())
+			return
+		}
+		ch.functions = registry
+		client.Writer.WriteBulkString(lib.name)
+		ch.propagate(client, parts)
+	})
+}
+
+func (ch *CommandHandler) handleFunctionDelete(client *domain.Client, parts []string) {
+	ch.runExclusive(client, func() {
+		lib, ok := ch.functions.libraries[parts[2]]
+		if !ok {
+			client.Writer.WriteError("Library not found")
+			return
+		}
+		registry := ch.functions.clone()
+		registry.remove(lib)
+		ch.functions = registry
+		client.Writer.WriteSimpleString("OK")
+		ch.propagate(client, parts)
+	})
+}
+
+func (ch *CommandHandler) handleFunctionFlush(client *domain.Client, parts []string) {
+	if _, ok := parseFlushMode(parts[1:], client.Writer); !ok {
+		return
+	}
+	ch.runExclusive(client, func() {
+		ch.functions = newFunctionRegistry()
+		client.Writer.WriteSimpleString("OK")
+		ch.propagate(client, parts)
+	})
+}
+
+func (ch *CommandHandler) handleFunctionList(client *domain.Client, parts []string) {
+	w := client.Writer
+	withCode, pattern := false, ""
+	for i := 2; i < len(parts); i++ {
+		switch strings.ToUpper(parts[i]) {
+		case "WITHCODE":
+			withCode = true
+		case "LIBRARYNAME":
+			if i+1 >= len(parts) {
+				w.WriteError("library name argument was not given")
+				return
+			}
+			pattern = parts[i+1]
+			i++
+		default:
+			w.WriteError(fmt.Sprintf("Unknown argument %s", parts[i]))
+			return
+		}
+	}
+
+	var libs []*functionLibrary
+	for _, lib := range ch.functions.sortedLibraries() {
+		if pattern == "" || utils.GlobMatch(pattern, lib.name, false) {
+			libs = append(libs, lib)
+		}
+	}
+
+	w.WriteArrayLen(len(libs))
+	for _, lib := range libs {
+		fields := 3
+		if withCode {
+			fields++
+		}
+		w.WriteMapLen(fields)
+		w.WriteBulkString("library_name")
+		w.WriteBulkString(lib.name)
+		w.WriteBulkString("engine")
+		w.WriteBulkString("LUA")
+		w.WriteBulkString("functions")
+
+		names := make([]string, 0, len(lib.functions))
+		for name := range lib.functions {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		w.WriteArrayLen(len(names))
+		for _, name := range names {
+			fn := lib.functions[name]
+			w.WriteMapLen(3)
+			w.WriteBulkString("name")
+			w.WriteBulkString(fn.name)
+			w.WriteBulkString("description")
+			if fn.description == "" {
+				w.WriteNull()
+			} else {
+				w.WriteBulkString(fn.description)
+			}
+			w.WriteBulkString("flags")
+			w.WriteSetLen(len(fn.flags))
+			for _, flag := range fn.flags {
+				w.WriteBulkString(flag)
+			}
+		}
+		if withCode {
+			w.WriteBulkString("library_code")
+			w.WriteBulkString(lib.code)
+		}
+	}
+}
+
+func (ch *CommandHandler) handleFunctionDump(client *domain.Client, parts []string) {
+	client.Writer.WriteBulkString(string(rdb.DumpFunctions(ch.functions.codes())))
+}
+
+func (ch *CommandHandler) handleFunctionRestore(client *domain.Client, parts []string) {
+	policy := "APPEND"
+	if len(parts) > 4 {
+		client.Writer.WriteError("syntax error")
+		return
+	}
+	if len(parts) == 4 {
+		policy = strings.ToUpper(parts[3])
+		if policy != "FLUSH" && policy != "APPEND" && policy != "REPLACE" {
+			client.Writer.WriteError("Wrong restore policy given, value should be either FLUSH, APPEND or REPLACE.")
+			return
+		}
+	}
+	codes, err := rdb.RestoreFunctions([]byte(parts[2]))
+	if err != nil {
+		client.Writer.WriteError(err.Error())
+		return
+	}
+
+	ch.runExclusive(client, func() {
+		if err := ch.restoreLibraries(codes, policy); err != nil {
+			client.Writer.WriteError(err.Error())
+			return
+		}
+		client.Writer.WriteSimpleString("OK")
+		ch.propagate(client, parts)
+	})
+}
+
+func (ch *CommandHandler) handleFunctionHelp(client *domain.Client, parts []string) {
+	client.Writer.WriteStringArray([]string{
+		"FUNCTION <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+		"LOAD [REPLACE] <FUNCTION CODE>",
+		"    Create a new library with the given library name and code.",
+		"DELETE <LIBRARY NAME>",
+		"    Delete the given library.",
+		"LIST [LIBRARYNAME PATTERN] [WITHCODE]",
+		"    Return general information on all the libraries:",
+		"    * Library name",
+		"    * The engine used to run the Library",
+		"    * Library functions",
+		"    * Library code (if WITHCODE is given)",
+		"    It also possible to get only function that matches a pattern using LIBRARYNAME argument.",
+		"DUMP",
+		"    Return a serialized payload representing the current libraries, can be restored using FUNCTION RESTORE command",
+		"RESTORE <PAYLOAD> [FLUSH|APPEND|REPLACE]",
+		"    Restore the libraries represented by the given payload, it is possible to give a restore policy to",
+		"    control how to handle existing libraries (default APPEND):",
+		"    * FLUSH: delete all existing libraries.",
+		"    * APPEND: appends the restored libraries to the existing libraries. On collision, abort.",
+		"    * REPLACE: appends the restored libraries to the existing libraries, On collision, replace the old",
+		"      libraries with the new libraries (notice that even on this option there is a chance of failure",
+		"      in case of functions name collision with another library).",
+		"FLUSH [ASYNC|SYNC]",
+		"    Delete all the libraries.",
+		"HELP",
+		"    Print this help.",
+	})
+}
+
+func (ch *CommandHandler) handleFCall(client *domain.Client, parts []string) {
+	ch.fcall(client, parts, false)
+}
+
+func (ch *CommandHandler) handleFCallRO(client *domain.Client, parts []string) {
+	ch.fcall(client, parts, true)
+}
+
+// fcall runs a registered function with the keys and arguments as its two
+// parameters. Functions flagged no-writes run read-only.
+func (ch *CommandHandler) fcall(client *domain.Client, parts []string, readOnly bool) {
+	keys, args, ok := parseNumKeys(parts, 2, client.Writer)
+	if !ok {
+		return
+	}
+	ch.runExclusive(client, func() {
+		fn, ok := ch.functions.functions[parts[1]]
+		if !ok {
+			client.Writer.WriteError("Function not found")
+			return
+		}
+		noWrites := fn.hasFlag("no-writes")
+		if readOnly && !noWrites {
+			client.Writer.WriteError("Can not execute a script with write flag using *_ro command.")
+			return
+		}
+		L := ch.scripts.state(ch)
+		ch.runLua(client, "script: "+fn.name+", on @user_function.", fn.callback,
+			[]lua.LValue{stringsTable(L, keys), stringsTable(L, args)}, noWrites)
+	})
+}
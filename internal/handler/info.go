@@ -0,0 +1,423 @@
+package handler
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/therahulbhati/go-redis-clone/internal/domain"
+)
+
+// infoSection is a section of INFO. The default ones are sent when INFO
+// has no argument.
+type infoSection struct {
+	name   string
+	header string
+	dflt   bool
+	write  func(ch *CommandHandler, w *infoWriter)
+}
+
+// infoSections lists the sections in the order INFO sends them, which is
+// the order of Redis.
+var infoSections = []infoSection{
+	{name: "server", header: "Server", dflt: true, write: (*CommandHandler).infoServer},
+	{name: "clients", header: "Clients", dflt: true, write: (*CommandHandler).infoClients},
+	{name: "memory", header: "Memory", dflt: true, write: (*CommandHandler).infoMemory},
+	{name: "persistence", header: "Persistence", dflt: true, write: (*CommandHandler).infoPersistence},
+	{name: "stats", header: "Stats", dflt: true, write: (*CommandHandler).infoStats},
+	{name: "replication", header: "Replication", dflt: true, write: (*CommandHandler).infoReplication},
+	{name: "cpu", header: "CPU", dflt: true, write: (*CommandHandler).infoCPU},
+	{name: "commandstats", header: "Commandstats", write: (*CommandHandler).infoCommandStats},
+	{name: "errorstats", header: "Errorstats", dflt: true, write: (*CommandHandler).infoErrorStats},
+	{name: "latencystats", header: "Latencystats", write: (*CommandHandler).infoLatencyStats},
+	{name: "cluster", header: "Cluster", dflt: true, write: (*CommandHandler).infoCluster},
+	{name: "keyspace", header: "Keyspace", dflt: true, write: (*CommandHandler).infoKeyspace},
+}
+
+// latencyPercentiles are the percentiles INFO latencystats reports.
+var latencyPercentiles = []float64{50, 99, 99.9}
+
+// infoWriter formats the "name:value" lines of INFO.
+type infoWriter struct {
+	b strings.Builder
+}
+
+func (w *infoWriter) section(header string) {
+	if w.b.Len() > 0 {
+		w.b.WriteString("\r\n")
+	}
+	w.b.WriteString("# " + header + "\r\n")
+}
+
+func (w *infoWriter) field(name string, value any) {
+	fmt.Fprintf(&w.b, "%s:%v\r\n", name, value)
+}
+
+// handleInfo returns the sections selected by the arguments, which may also
+// be "default", "all" or "everything": INFO [section [section ...]]
+func (ch *CommandHandler) handleInfo(client *domain.Client, parts []string) {
+	selected := make(map[string]bool)
+	all, dflt := false, len(parts) == 1
+	for _, arg := range parts[1:] {
+		switch name := strings.ToLower(arg); name {
+		case "all", "everything":
+			all = true
+		case "default":
+			dflt = true
+		default:
+			selected[name] = true
+		}
+	}
+
+	var w infoWriter
+	for _, section := range infoSections {
+		if all || (dflt && section.dflt) || selected[section.name] {
+			w.section(section.header)
+			section.write(ch, &w)
+		}
+	}
+	client.Writer.WriteVerbatim("txt", w.b.String())
+}
+
+// SetFollower selects the follower manager INFO reports the link to the
+// leader of.
+func (ch *CommandHandler) SetFollower(follower domain.FollowerManager) {
+	ch.follower = follower
+}
+
+// newRunID returns a random identifier for run_id.
+func newRunID() string {
+	id := make([]byte, 20)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func (ch *CommandHandler) infoServer(w *infoWriter) {
+	cfg := ch.cfg.Load()
+	uptime := time.Since(ch.startTime)
+	executable, _ := os.Executable()
+	w.field("redis_version", serverVersion)
+	w.field("redis_git_sha1", "00000000")
+	w.field("redis_git_dirty", 0)
+	w.field("redis_mode", "standalone")
+	w.field("os", runtime.GOOS+" "+runtime.GOARCH)
+	w.field("arch_bits", strconv.IntSize)
+	w.field("go_version", runtime.Version())
+	w.field("process_id", os.Getpid())
+	w.field("run_id", ch.runID)
+	w.field("tcp_port", cfg.Port)
+	w.field("server_time_usec", time.Now().UnixMicro())
+	w.field("uptime_in_seconds", int64(uptime.Seconds()))
+	w.field("uptime_in_days", int64(uptime.Hours()/24))
+	w.field("hz", int(time.Second/cronInterval))
+	w.field("configured_hz", int(time.Second/cronInterval))
+	w.field("executable", executable)
+	w.field("config_file", cfg.File)
+}
+
+// clientCounts are the numbers of clients reported by INFO clients and the
+// metrics, followers excluded.
+type clientCounts struct {
+	connected, blocked, tracking, pubsub, watching int
+	maxQueryBuf                                    int
+}
+
+func (ch *CommandHandler) countClients() clientCounts {
+	var counts clientCounts
+	ch.mu.Lock()
+	for _, client := range ch.clients {
+		info := client.Info()
+		if info.Replica {
+			continue
+		}
+		counts.connected++
+		if info.Blocked {
+			counts.blocked++
+		}
+		if info.Channels+info.Patterns+info.ShardChannels > 0 {
+			counts.pubsub++
+		}
+		if info.Watched > 0 {
+			counts.watching++
+		}
+		counts.maxQueryBuf = max(counts.maxQueryBuf, info.QueryBuf)
+	}
+	ch.mu.Unlock()
+	ch.tracking.mu.Lock()
+	counts.tracking = len(ch.tracking.clients)
+	ch.tracking.mu.Unlock()
+	return counts
+}
+
+func (ch *CommandHandler) infoClients(w *infoWriter) {
+	counts := ch.countClients()
+	w.field("connected_clients", counts.connected)
+	w.field("cluster_connections", 0)
+	w.field("client_recent_max_input_buffer", counts.maxQueryBuf)
+	w.field("blocked_clients", counts.blocked)
+	w.field("tracking_clients", counts.tracking)
+	w.field("pubsub_clients", counts.pubsub)
+	w.field("watching_clients", counts.watching)
+}
+
+func (ch *CommandHandler) infoMemory(w *infoWriter) {
+	cfg := ch.cfg.Load()
+	used := ch.store.UsedMemory()
+	ch.stats.updatePeakMemory(used)
+	peak := ch.stats.peakMemory.Load()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	rss := int64(m.Sys - m.HeapReleased)
+
+	w.field("used_memory", used)
+	w.field("used_memory_human", humanBytes(used))
+	w.field("used_memory_rss", rss)
+	w.field("used_memory_rss_human", humanBytes(rss))
+	w.field("used_memory_peak", peak)
+	w.field("used_memory_peak_human", humanBytes(peak))
+	w.field("used_memory_peak_perc", fmt.Sprintf("%.2f%%", percent(used, peak)))
+	w.field("used_memory_dataset", used)
+	w.field("used_memory_heap", m.HeapAlloc)
+	w.field("maxmemory", cfg.MaxMemory)
+	w.field("maxmemory_human", humanBytes(cfg.MaxMemory))
+	w.field("maxmemory_policy", cfg.MaxMemoryPolicy)
+	// The heap spans in use over the live objects they hold.
+	w.field("mem_fragmentation_ratio", fmt.Sprintf("%.2f", ratio(int64(m.HeapInuse), int64(m.HeapAlloc))))
+	w.field("mem_allocator", "go")
+}
+
+func (ch *CommandHandler) infoPersistence(w *infoWriter) {
+	inProgress, current := 0, int64(-1)
+	if started := ch.bgsave.started.Load(); started != 0 {
+		inProgress = 1
+		current = int64(time.Since(time.Unix(0, started)).Seconds())
+	}
+	status := "ok"
+	if ch.bgsave.failed.Load() {
+		status = "err"
+	}
+	w.field("loading", 0)
+	w.field("async_loading", 0)
+	w.field("rdb_changes_since_last_save", ch.dirty.Load())
+	w.field("rdb_bgsave_in_progress", inProgress)
+	w.field("rdb_last_save_time", ch.lastSave.Load())
+	w.field("rdb_last_bgsave_status", status)
+	w.field("rdb_last_bgsave_time_sec", ch.bgsave.lastDuration.Load())
+	w.field("rdb_current_bgsave_time_sec", current)
+	w.field("rdb_saves", ch.bgsave.saves.Load())
+	// There is no append only file.
+	w.field("aof_enabled", 0)
+	w.field("aof_rewrite_in_progress", 0)
+	w.field("aof_rewrite_scheduled", 0)
+	w.field("aof_last_rewrite_time_sec", -1)
+	w.field("aof_current_rewrite_time_sec", -1)
+	w.field("aof_last_bgrewrite_status", "ok")
+	w.field("aof_last_write_status", "ok")
+}
+
+func (ch *CommandHandler) infoStats(w *infoWriter) {
+	s := &ch.stats
+	ops, input, output := s.rates()
+	ch.pubsub.mu.RLock()
+	channels, patterns, shardChannels := len(ch.pubsub.channels), len(ch.pubsub.patterns), len(ch.pubsub.shardChannels)
+	ch.pubsub.mu.RUnlock()
+	ch.tracking.mu.Lock()
+	trackedKeys := len(ch.tracking.keys)
+	ch.tracking.mu.Unlock()
+
+	w.field("total_connections_received", s.connectionsReceived.Load())
+	w.field("total_commands_processed", s.commandsProcessed.Load())
+	w.field("instantaneous_ops_per_sec", int64(ops))
+	w.field("total_net_input_bytes", s.netInputBytes.Load())
+	w.field("total_net_output_bytes", s.netOutputBytes.Load())
+	w.field("instantaneous_input_kbps", fmt.Sprintf("%.2f", input/1024))
+	w.field("instantaneous_output_kbps", fmt.Sprintf("%.2f", output/1024))
+	w.field("rejected_connections", 0)
+	w.field("sync_full", s.syncFull.Load())
+	w.field("sync_partial_ok", 0)
+	w.field("sync_partial_err", 0)
+	w.field("expired_keys", s.expiredKeys.Load())
+	w.field("evicted_keys", s.evictedKeys.Load())
+	w.field("keyspace_hits", s.keyspaceHits.Load())
+	w.field("keyspace_misses", s.keyspaceMisses.Load())
+	w.field("pubsub_channels", channels)
+	w.field("pubsub_patterns", patterns)
+	w.field("pubsub_shardchannels", shardChannels)
+	w.field("tracking_total_keys", trackedKeys)
+	w.field("total_error_replies", s.errorReplies.Load())
+}
+
+// zeroReplID is reported as the replication ID when there is none.
+const zeroReplID = "0000000000000000000000000000000000000000"
+
+func (ch *CommandHandler) infoReplication(w *infoWriter) {
+	replID, offset := zeroReplID, int64(0)
+	if ch.leaderMgr != nil {
+		replID, offset = ch.leaderMgr.GetLeaderReplID(), ch.leaderMgr.GetLeaderReplOffset()
+		followers := ch.leaderMgr.Followers()
+		w.field("role", "master")
+		w.field("connected_slaves", len(followers))
+		for i, f := range followers {
+			w.field(fmt.Sprintf("slave%d", i), fmt.Sprintf("ip=%s,port=%d,state=online,offset=%d,lag=%d",
+				f.IP, f.Port, f.AckOffset, int64(time.Since(f.LastAck).Seconds())))
+		}
+	} else {
+		w.field("role", "slave")
+		var status domain.LeaderLinkStatus
+		if ch.follower != nil {
+			status = ch.follower.Status()
+		}
+		link, lastIO, syncing := "down", int64(-1), 0
+		if status.Up {
+			link = "up"
+			lastIO = int64(time.Since(status.LastIO).Seconds())
+		}
+		if status.Syncing {
+			syncing = 1
+		}
+		if status.ReplID != "" {
+			replID, offset = status.ReplID, status.Offset
+		}
+		w.field("master_host", status.Host)
+		w.field("master_port", status.Port)
+		w.field("master_link_status", link)
+		w.field("master_last_io_seconds_ago", lastIO)
+		w.field("master_sync_in_progress", syncing)
+		w.field("slave_read_repl_offset", status.Offset)
+		w.field("slave_repl_offset", status.Offset)
+		w.field("slave_priority", 100)
+		w.field("slave_read_only", 0)
+		w.field("replica_announced", 1)
+		w.field("connected_slaves", 0)
+	}
+	w.field("master_failover_state", "no-failover")
+	w.field("master_replid", replID)
+	w.field("master_replid2", zeroReplID)
+	w.field("master_repl_offset", offset)
+	w.field("second_repl_offset", -1)
+	// The followers always resynchronize fully, there is no backlog.
+	w.field("repl_backlog_active", 0)
+	w.field("repl_backlog_size", 0)
+	w.field("repl_backlog_first_byte_offset", 0)
+	w.field("repl_backlog_histlen", 0)
+}
+
+func (ch *CommandHandler) infoCPU(w *infoWriter) {
+	sys, user, sysChildren, userChildren := cpuTimes()
+	w.field("used_cpu_sys", fmt.Sprintf("%.6f", sys))
+	w.field("used_cpu_user", fmt.Sprintf("%.6f", user))
+	w.field("used_cpu_sys_children", fmt.Sprintf("%.6f", sysChildren))
+	w.field("used_cpu_user_children", fmt.Sprintf("%.6f", userChildren))
+}
+
+// calledCommands returns the commands, and subcommands, called or rejected
+// at least once, sorted by name.
+func calledCommands() []*command {
+	var cmds []*command
+	add := func(cmd *command) {
+		if cmd.stats.calls.Load() > 0 || cmd.stats.rejected.Load() > 0 {
+			cmds = append(cmds, cmd)
+		}
+	}
+	for _, cmd := range commandTable {
+		add(cmd)
+		for _, sub := range cmd.subcommands {
+			add(sub)
+		}
+	}
+	sort.Slice(cmds, func(i, j int) bool { return cmds[i].fullName() < cmds[j].fullName() })
+	return cmds
+}
+
+func (ch *CommandHandler) infoCommandStats(w *infoWriter) {
+	for _, cmd := range calledCommands() {
+		s := &cmd.stats
+		calls, usec := s.calls.Load(), s.usec.Load()
+		perCall := 0.0
+		if calls > 0 {
+			perCall = float64(usec) / float64(calls)
+		}
+		w.field("cmdstat_"+cmd.fullName(), fmt.Sprintf("calls=%d,usec=%d,usec_per_call=%.2f,rejected_calls=%d,failed_calls=%d",
+			calls, usec, perCall, s.rejected.Load(), s.failed.Load()))
+	}
+}
+
+func (ch *CommandHandler) infoErrorStats(w *infoWriter) {
+	counts := ch.stats.errorCounts()
+	for _, code := range sortedKeys(counts) {
+		w.field("errorstat_"+code, fmt.Sprintf("count=%d", counts[code]))
+	}
+}
+
+func (ch *CommandHandler) infoLatencyStats(w *infoWriter) {
+	for _, cmd := range calledCommands() {
+		h := cmd.stats.latency.Load()
+		if h == nil {
+			continue
+		}
+		values := h.percentiles(latencyPercentiles)
+		fields := make([]string, len(values))
+		for i, ns := range values {
+			p := strconv.FormatFloat(latencyPercentiles[i], 'f', -1, 64)
+			fields[i] = fmt.Sprintf("p%s=%.3f", p, float64(ns)/1000)
+		}
+		w.field("latency_percentiles_usec_"+cmd.fullName(), strings.Join(fields, ","))
+	}
+}
+
+func (ch *CommandHandler) infoCluster(w *infoWriter) {
+	w.field("cluster_enabled", 0)
+}
+
+func (ch *CommandHandler) infoKeyspace(w *infoWriter) {
+	for db := 0; db < ch.store.DBCount(); db++ {
+		keys, expires, avgTTL := ch.store.KeyspaceStats(db)
+		if keys == 0 {
+			continue
+		}
+		w.field(fmt.Sprintf("db%d", db), fmt.Sprintf("keys=%d,expires=%d,avg_ttl=%d", keys, expires, avgTTL.Milliseconds()))
+	}
+}
+
+// humanBytes formats n like the *_human fields of Redis: 1.50K, 2.00M.
+func humanBytes(n int64) string {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return fmt.Sprintf("%dB", n)
+	}
+	value, unit := float64(n)/1024, 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.2f%c", value, units[unit])
+}
+
+func percent(part, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(part) * 100 / float64(total)
+}
+
+func ratio(a, b int64) float64 {
+	if b == 0 {
+		return 0
+	}
+	return float64(a) / float64(b)
+}
+
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
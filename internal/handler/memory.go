@@ -0,0 +1,31 @@
+package handler
+
+import "github.com/therahulbhati/go-redis-clone/internal/domain"
+
+// oomError is returned to the commands that would grow the dataset while
+// it's over maxmemory and nothing can be evicted.
+const oomError = "OOM command not allowed when used memory > 'maxmemory'."
+
+// checkMemory evicts keys, according to maxmemory-policy, while the dataset
+// uses more than maxmemory. When it can't get under the limit, commands that
+// may grow the dataset are refused with OOM and false is returned. The
+// commands streamed by the leader are never refused, evictions aren't
+// replicated so followers evict on their own.
+func (ch *CommandHandler) checkMemory(client *domain.Client, cmd *command) bool {
+	cfg := ch.cfg.Load()
+	if cfg.MaxMemory == 0 || ch.store.UsedMemory() <= cfg.MaxMemory {
+		return true
+	}
+	evicted := false
+	// Evict while holding execMu, so keys don't disappear in the middle of
+	// a transaction or a script.
+	if ch.lockExec(false) {
+		evicted = ch.store.Evict(cfg.MaxMemory, cfg.MaxMemoryPolicy, cfg.MaxMemorySamples)
+		ch.execMu.RUnlock()
+	}
+	if evicted || client.Master || !cmd.hasFlag(flagDenyOOM) {
+		return true
+	}
+	client.Writer.WriteRawError(oomError)
+	return false
+}
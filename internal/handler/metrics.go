@@ -0,0 +1,250 @@
+package handler
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// durationBuckets are the upper bounds in seconds of the buckets of the
+// command duration histograms, from 10µs to 10s.
+var durationBuckets = []float64{
+	0.00001, 0.000025, 0.00005, 0.0001, 0.00025, 0.0005,
+	0.001, 0.0025, 0.005, 0.01, 0.025, 0.05,
+	0.1, 0.25, 0.5, 1, 2.5, 5, 10,
+}
+
+// metricsWriter writes metrics in the Prometheus text exposition format.
+type metricsWriter struct {
+	w *bufio.Writer
+}
+
+// family starts the metric family name of type typ.
+func (m *metricsWriter) family(name, typ, help string) {
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes a sample of the current family, labels alternating names
+// and values.
+func (m *metricsWriter) sample(name string, value float64, labels ...string) {
+	m.w.WriteString(name)
+	if len(labels) > 0 {
+		m.w.WriteByte('{')
+		for i := 0; i < len(labels); i += 2 {
+			if i > 0 {
+				m.w.WriteByte(',')
+			}
+			fmt.Fprintf(m.w, "%s=\"%s\"", labels[i], escapeLabel(labels[i+1]))
+		}
+		m.w.WriteByte('}')
+	}
+	m.w.WriteByte(' ')
+	m.w.WriteString(formatMetricValue(value))
+	m.w.WriteByte('\n')
+}
+
+// metric writes a family with a single sample.
+func (m *metricsWriter) metric(name, typ, help string, value float64) {
+	m.family(name, typ, help)
+	m.sample(name, value)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+func formatMetricValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func boolMetric(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// WriteMetrics writes the server metrics to w in the Prometheus text format.
+// Metrics the Redis exporter also has keep its names, so its dashboards can
+// be reused.
+func (ch *CommandHandler) WriteMetrics(w io.Writer) error {
+	m := &metricsWriter{w: bufio.NewWriter(w)}
+	ch.serverMetrics(m)
+	ch.clientMetrics(m)
+	ch.memoryMetrics(m)
+	ch.persistenceMetrics(m)
+	ch.statsMetrics(m)
+	ch.replicationMetrics(m)
+	ch.commandMetrics(m)
+	ch.keyspaceMetrics(m)
+	return m.w.Flush()
+}
+
+func (ch *CommandHandler) serverMetrics(m *metricsWriter) {
+	role := "master"
+	if ch.leaderMgr == nil {
+		role = "slave"
+	}
+	m.family("redis_instance_info", "gauge", "Information about the server.")
+	m.sample("redis_instance_info", 1, "redis_version", serverVersion, "role", role, "run_id", ch.runID)
+	m.metric("redis_start_time_seconds", "gauge", "Start time of the server since the epoch in seconds.", float64(ch.startTime.Unix()))
+	m.metric("redis_uptime_in_seconds", "gauge", "Time since the server started in seconds.", time.Since(ch.startTime).Seconds())
+	sys, user, _, _ := cpuTimes()
+	m.metric("redis_cpu_sys_seconds_total", "counter", "System CPU time used by the server in seconds.", sys)
+	m.metric("redis_cpu_user_seconds_total", "counter", "User CPU time used by the server in seconds.", user)
+}
+
+func (ch *CommandHandler) clientMetrics(m *metricsWriter) {
+	counts := ch.countClients()
+	m.metric("redis_connected_clients", "gauge", "Number of client connections, followers excluded.", float64(counts.connected))
+	m.metric("redis_blocked_clients", "gauge", "Number of clients waiting in a blocking command.", float64(counts.blocked))
+	m.metric("redis_tracking_clients", "gauge", "Number of clients with client side caching enabled.", float64(counts.tracking))
+	m.metric("redis_pubsub_clients", "gauge", "Number of clients subscribed to channels or patterns.", float64(counts.pubsub))
+	m.metric("redis_watching_clients", "gauge", "Number of clients watching keys.", float64(counts.watching))
+}
+
+func (ch *CommandHandler) memoryMetrics(m *metricsWriter) {
+	used := ch.store.UsedMemory()
+	ch.stats.updatePeakMemory(used)
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	m.metric("redis_memory_used_bytes", "gauge", "Memory used by the dataset, as compared with maxmemory.", float64(used))
+	m.metric("redis_memory_used_peak_bytes", "gauge", "Peak of redis_memory_used_bytes.", float64(ch.stats.peakMemory.Load()))
+	m.metric("redis_memory_used_rss_bytes", "gauge", "Memory obtained from the operating system.", float64(mem.Sys-mem.HeapReleased))
+	m.metric("redis_memory_max_bytes", "gauge", "The maxmemory limit, 0 for none.", float64(ch.cfg.Load().MaxMemory))
+}
+
+func (ch *CommandHandler) persistenceMetrics(m *metricsWriter) {
+	m.metric("redis_rdb_changes_since_last_save", "gauge", "Number of writes since the last save.", float64(ch.dirty.Load()))
+	m.metric("redis_rdb_bgsave_in_progress", "gauge", "Whether a background save is in progress.", boolMetric(ch.bgsave.started.Load() != 0))
+	m.metric("redis_rdb_last_bgsave_status", "gauge", "Whether the last background save succeeded.", boolMetric(!ch.bgsave.failed.Load()))
+	m.metric("redis_rdb_last_bgsave_duration_sec", "gauge", "Duration of the last background save in seconds, -1 before the first one.", float64(ch.bgsave.lastDuration.Load()))
+	m.metric("redis_rdb_last_save_timestamp_seconds", "gauge", "Time of the last successful save since the epoch in seconds.", float64(ch.lastSave.Load()))
+	m.metric("redis_rdb_saves_total", "counter", "Number of saves since the server started.", float64(ch.bgsave.saves.Load()))
+}
+
+func (ch *CommandHandler) statsMetrics(m *metricsWriter) {
+	s := &ch.stats
+	m.metric("redis_connections_received_total", "counter", "Number of connections accepted.", float64(s.connectionsReceived.Load()))
+	m.metric("redis_commands_processed_total", "counter", "Number of commands processed.", float64(s.commandsProcessed.Load()))
+	m.metric("redis_net_input_bytes_total", "counter", "Bytes read from the clients.", float64(s.netInputBytes.Load()))
+	m.metric("redis_net_output_bytes_total", "counter", "Bytes written to the clients.", float64(s.netOutputBytes.Load()))
+	m.metric("redis_expired_keys_total", "counter", "Number of keys removed because they expired.", float64(s.expiredKeys.Load()))
+	m.metric("redis_evicted_keys_total", "counter", "Number of keys evicted because of maxmemory.", float64(s.evictedKeys.Load()))
+	m.metric("redis_keyspace_hits_total", "counter", "Number of successful key lookups.", float64(s.keyspaceHits.Load()))
+	m.metric("redis_keyspace_misses_total", "counter", "Number of failed key lookups.", float64(s.keyspaceMisses.Load()))
+	m.metric("redis_sync_full_total", "counter", "Number of full resynchronizations with followers.", float64(s.syncFull.Load()))
+
+	counts := s.errorCounts()
+	m.family("redis_errors_total", "counter", "Number of error replies by error code.")
+	for _, code := range sortedKeys(counts) {
+		m.sample("redis_errors_total", float64(counts[code]), "err", code)
+	}
+}
+
+func (ch *CommandHandler) replicationMetrics(m *metricsWriter) {
+	if ch.leaderMgr != nil {
+		followers := ch.leaderMgr.Followers()
+		m.metric("redis_master_repl_offset", "gauge", "Replication offset of the leader.", float64(ch.leaderMgr.GetLeaderReplOffset()))
+		m.metric("redis_connected_slaves", "gauge", "Number of connected followers.", float64(len(followers)))
+		m.family("redis_connected_slave_offset_bytes", "gauge", "Replication offset last acknowledged by each follower.")
+		for _, f := range followers {
+			m.sample("redis_connected_slave_offset_bytes", float64(f.AckOffset), "slave_ip", f.IP, "slave_port", strconv.Itoa(f.Port), "slave_state", "online")
+		}
+		m.family("redis_connected_slave_lag_seconds", "gauge", "Time since each follower last acknowledged its offset in seconds.")
+		for _, f := range followers {
+			m.sample("redis_connected_slave_lag_seconds", time.Since(f.LastAck).Seconds(), "slave_ip", f.IP, "slave_port", strconv.Itoa(f.Port), "slave_state", "online")
+		}
+		return
+	}
+	if ch.follower == nil {
+		return
+	}
+	status := ch.follower.Status()
+	lastIO := -1.0
+	if status.Up {
+		lastIO = time.Since(status.LastIO).Seconds()
+	}
+	m.metric("redis_master_link_up", "gauge", "Whether the link to the leader is up.", boolMetric(status.Up))
+	m.metric("redis_master_sync_in_progress", "gauge", "Whether the snapshot of the leader is being loaded.", boolMetric(status.Syncing))
+	m.metric("redis_master_last_io_seconds_ago", "gauge", "Time since the leader was last heard from in seconds, -1 while the link is down.", lastIO)
+	m.metric("redis_slave_repl_offset", "gauge", "Replication offset processed by the follower.", float64(status.Offset))
+}
+
+func (ch *CommandHandler) commandMetrics(m *metricsWriter) {
+	cmds := calledCommands()
+	m.family("redis_commands_total", "counter", "Number of calls by command.")
+	for _, cmd := range cmds {
+		m.sample("redis_commands_total", float64(cmd.stats.calls.Load()), "cmd", cmd.fullName())
+	}
+	m.family("redis_commands_duration_seconds_total", "counter", "Time spent in the calls by command in seconds.")
+	for _, cmd := range cmds {
+		m.sample("redis_commands_duration_seconds_total", float64(cmd.stats.usec.Load())/1e6, "cmd", cmd.fullName())
+	}
+	m.family("redis_commands_rejected_calls_total", "counter", "Number of calls refused before running by command.")
+	for _, cmd := range cmds {
+		m.sample("redis_commands_rejected_calls_total", float64(cmd.stats.rejected.Load()), "cmd", cmd.fullName())
+	}
+	m.family("redis_commands_failed_calls_total", "counter", "Number of calls that replied with an error by command.")
+	for _, cmd := range cmds {
+		m.sample("redis_commands_failed_calls_total", float64(cmd.stats.failed.Load()), "cmd", cmd.fullName())
+	}
+
+	m.family("redis_command_duration_seconds", "histogram", "Duration of the calls by command.")
+	for _, cmd := range cmds {
+		h := cmd.stats.latency.Load()
+		if h == nil {
+			continue
+		}
+		name := cmd.fullName()
+		counts, total := h.cumulative(durationBuckets)
+		for i, bound := range durationBuckets {
+			m.sample("redis_command_duration_seconds_bucket", float64(counts[i]), "cmd", name, "le", formatMetricValue(bound))
+		}
+		m.sample("redis_command_duration_seconds_bucket", float64(total), "cmd", name, "le", "+Inf")
+		m.sample("redis_command_duration_seconds_sum", float64(cmd.stats.usec.Load())/1e6, "cmd", name)
+		m.sample("redis_command_duration_seconds_count", float64(total), "cmd", name)
+	}
+}
+
+func (ch *CommandHandler) keyspaceMetrics(m *metricsWriter) {
+	type dbStats struct {
+		db            string
+		keys, expires int
+		avgTTL        time.Duration
+	}
+	var dbs []dbStats
+	for db := 0; db < ch.store.DBCount(); db++ {
+		keys, expires, avgTTL := ch.store.KeyspaceStats(db)
+		if keys > 0 {
+			dbs = append(dbs, dbStats{"db" + strconv.Itoa(db), keys, expires, avgTTL})
+		}
+	}
+	m.family("redis_db_keys", "gauge", "Number of keys by database.")
+	for _, s := range dbs {
+		m.sample("redis_db_keys", float64(s.keys), "db", s.db)
+	}
+	m.family("redis_db_keys_expiring", "gauge", "Number of keys with an expiration by database.")
+	for _, s := range dbs {
+		m.sample("redis_db_keys_expiring", float64(s.expires), "db", s.db)
+	}
+	m.family("redis_db_avg_ttl_seconds", "gauge", "Average time to live of the keys with an expiration by database.")
+	for _, s := range dbs {
+		m.sample("redis_db_avg_ttl_seconds", s.avgTTL.Seconds(), "db", s.db)
+	}
+}
@@ -0,0 +1,151 @@
+package handler
+
+import (
+	"github.com/therahulbhati/go-redis-clone/internal/domain"
+)
+
+// runsInMulti reports whether cmd is executed right away inside MULTI
+// instead of being queued.
+func runsInMulti(cmd *command) bool {
+	switch cmd.name {
+	case "exec", "discard", "multi", "watch", "reset":
+		return true
+	}
+	return false
+}
+
+// queue adds a command to the client's transaction. Commands that can't be
+// queued flag the transaction, so EXEC fails with EXECABORT.
+func (ch *CommandHandler) queue(client *domain.Client, cmd *command, errMsg string, parts []string) {
+	tx := client.Tx
+	if cmd == nil {
+		client.Writer.WriteError(errMsg)
+		tx.Aborted = true
+		return
+	}
+	if cmd.hasFlag(flagNoMulti) {
+		client.Writer.WriteError("Command not allowed inside a transaction")
+		tx.Aborted = true
+		return
+	}
+	// parts is reused by the reader for the next command.
+	tx.Queued = append(tx.Queued, append([]string(nil), parts...))
+	client.Writer.WriteSimpleString("QUEUED")
+}
+
+func (ch *CommandHandler) handleMulti(client *domain.Client, parts []string) {
+	if client.Tx != nil {
+		client.Writer.WriteError("MULTI calls can not be nested")
+		return
+	}
+	client.Tx = &domain.Transaction{}
+	client.Writer.WriteSimpleString("OK")
+}
+
+func (ch *CommandHandler) handleDiscard(client *domain.Client, parts []string) {
+	if client.Tx == nil {
+		client.Writer.WriteError("DISCARD without MULTI")
+		return
+	}
+	client.Tx = nil
+	ch.unwatchAll(client)
+	client.Writer.WriteSimpleString("OK")
+}
+
+// handleExec runs the queued commands while holding execMu exclusively, so
+// no other command observes or modifies the keyspace halfway through.
+func (ch *CommandHandler) handleExec(client *domain.Client, parts []string) {
+	w := client.Writer
+	tx := client.Tx
+	if tx == nil {
+		w.WriteError("EXEC without MULTI")
+		return
+	}
+	if tx.Aborted {
+		client.Tx = nil
+		ch.unwatchAll(client)
+		w.WriteRawError("EXECABORT Transaction discarded because of previous errors.")
+		return
+	}
+
+	if !ch.lockExec(true) {
+		w.WriteRawError(busyError)
+		return
+	}
+	defer ch.execMu.Unlock()
+	defer ch.unwatchAll(client)
+
+	if !ch.watchedUnchanged(client) {
+		client.Tx = nil
+		w.WriteNullArray()
+		return
+	}
+
+	tx.Executing = true
+	w.WriteArrayLen(len(tx.Queued))
+	for _, queued := range tx.Queued {
+		// Queued commands were looked up successfully when queued.
+		cmd, _ := lookupCommand(queued)
+		// Permissions may have changed since the command was queued.
+		if msg := ch.aclDenied(client, cmd, queued, "multi"); msg != "" {
+			w.WriteRawError("NOPERM " + msg)
+			continue
+		}
+		ch.call(client, cmd, queued)
+	}
+	client.Tx = nil
+
+	if ch.leaderMgr != nil && len(tx.Writes) > 0 {
+		client.LastWriteOffset = ch.leaderMgr.PropagateTransaction(tx.Writes)
+	}
+}
+
+func (ch *CommandHandler) handleWatch(client *domain.Client, parts []string) {
+	if client.Tx != nil {
+		client.Writer.WriteError("WATCH inside MULTI is not allowed")
+		return
+	}
+	for _, key := range parts[1:] {
+		if isWatching(client, client.DB, key) {
+			continue
+		}
+		client.Watched = append(client.Watched, domain.WatchedKey{
+			DB:      client.DB,
+			Key:     key,
+			Version: ch.store.Watch(client.DB, key),
+		})
+	}
+	client.Writer.WriteSimpleString("OK")
+}
+
+func (ch *CommandHandler) handleUnwatch(client *domain.Client, parts []string) {
+	ch.unwatchAll(client)
+	client.Writer.WriteSimpleString("OK")
+}
+
+func isWatching(client *domain.Client, db int, key string) bool {
+	for _, watched := range client.Watched {
+		if watched.DB == db && watched.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// watchedUnchanged reports whether none of the keys watched by client was
+// modified, or expired, since it started watching them.
+func (ch *CommandHandler) watchedUnchanged(client *domain.Client) bool {
+	for _, watched := range client.Watched {
+		if ch.store.KeyVersion(watched.DB, watched.Key) != watched.Version {
+			return false
+		}
+	}
+	return true
+}
+
+func (ch *CommandHandler) unwatchAll(client *domain.Client) {
+	for _, watched := range client.Watched {
+		ch.store.Unwatch(watched.DB, watched.Key)
+	}
+	client.Watched = nil
+}
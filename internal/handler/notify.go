@@ -0,0 +1,125 @@
+package handler
+
+import (
+	"errors"
+	"strconv"
+)
+
+// Keyspace notification classes, selected with notify-keyspace-events.
+const (
+	notifyKeyspace = 1 << iota // K: __keyspace@<db>__:<key> channels
+	notifyKeyevent             // E: __keyevent@<db>__:<event> channels
+	notifyGeneric              // g: generic commands like MOVE
+	notifyString               // $: string commands
+	notifyList                 // l: list commands
+	notifySet                  // s: set commands
+	notifyHash                 // h: hash commands
+	notifyZSet                 // z: sorted set commands
+	notifyExpired              // x: keys expiring
+	notifyEvicted              // e: keys evicted for maxmemory
+	notifyStream               // t: stream commands
+	notifyKeyMiss              // m: lookups of missing keys
+	notifyNew                  // n: keys being created
+
+	// notifyAll is the "A" alias. Key misses and new keys are excluded, as
+	// they are too noisy for most listeners.
+	notifyAll = notifyGeneric | notifyString | notifyList | notifySet | notifyHash | notifyZSet | notifyExpired | notifyEvicted | notifyStream
+)
+
+var errInvalidKeyspaceEvents = errors.New("Invalid event class character. Use 'Ag$lshzxeKEtmn'.")
+
+// notifyClasses maps the notify-keyspace-events characters to classes.
+var notifyClasses = map[byte]int{
+	'A': notifyAll,
+	'g': notifyGeneric,
+	'$': notifyString,
+	'l': notifyList,
+	's': notifySet,
+	'h': notifyHash,
+	'z': notifyZSet,
+	'x': notifyExpired,
+	'e': notifyEvicted,
+	'K': notifyKeyspace,
+	'E': notifyKeyevent,
+	't': notifyStream,
+	'm': notifyKeyMiss,
+	'n': notifyNew,
+}
+
+// parseKeyspaceEvents converts a notify-keyspace-events value to classes.
+func parseKeyspaceEvents(classes string) (int, error) {
+	flags := 0
+	for i := 0; i < len(classes); i++ {
+		class, ok := notifyClasses[classes[i]]
+		if !ok {
+			return 0, errInvalidKeyspaceEvents
+		}
+		flags |= class
+	}
+	return flags, nil
+}
+
+// formatKeyspaceEvents converts classes back to the notify-keyspace-events
+// syntax, in the canonical order Redis uses.
+func formatKeyspaceEvents(flags int) string {
+	var b []byte
+	if flags&notifyAll == notifyAll {
+		b = append(b, 'A')
+	} else {
+		for _, c := range []byte("g$lshzxet") {
+			if flags&notifyClasses[c] != 0 {
+				b = append(b, c)
+			}
+		}
+	}
+	for _, c := range []byte("KEmn") {
+		if flags&notifyClasses[c] != 0 {
+			b = append(b, c)
+		}
+	}
+	return string(b)
+}
+
+// SetNotifyKeyspaceEvents selects the keyspace notifications published, in
+// the notify-keyspace-events syntax.
+func (ch *CommandHandler) SetNotifyKeyspaceEvents(classes string) error {
+	flags, err := parseKeyspaceEvents(classes)
+	if err != nil {
+		return err
+	}
+	ch.notifyFlags.Store(int32(flags))
+	return nil
+}
+
+// notifyKeyspaceEvent publishes event for key on the keyspace and keyevent
+// channels, when its class was selected.
+func (ch *CommandHandler) notifyKeyspaceEvent(class int, event, key string, db int) {
+	flags := int(ch.notifyFlags.Load())
+	if flags&class == 0 || flags&(notifyKeyspace|notifyKeyevent) == 0 {
+		return
+	}
+	prefix := strconv.Itoa(db) + "__:"
+	if flags&notifyKeyspace != 0 {
+		ch.pubsub.publish("__keyspace@"+prefix+key, event)
+	}
+	if flags&notifyKeyevent != 0 {
+		ch.pubsub.publish("__keyevent@"+prefix+event, key)
+	}
+}
+
+// storeEvent forwards the events raised by the store itself. Expired and
+// evicted keys are gone, so clients caching them are told too.
+func (ch *CommandHandler) storeEvent(db int, event, key string) {
+	switch event {
+	case "expired":
+		ch.stats.expiredKeys.Add(1)
+		ch.notifyKeyspaceEvent(notifyExpired, event, key, db)
+		ch.invalidateKey(key, 0)
+	case "evicted":
+		ch.stats.evictedKeys.Add(1)
+		ch.notifyKeyspaceEvent(notifyEvicted, event, key, db)
+		ch.invalidateKey(key, 0)
+	case "new":
+		ch.notifyKeyspaceEvent(notifyNew, event, key, db)
+	}
+}
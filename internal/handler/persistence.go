@@ -0,0 +1,116 @@
+package handler
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/therahulbhati/go-redis-clone/internal/domain"
+	"github.com/therahulbhati/go-redis-clone/internal/rdb"
+)
+
+var errNoRDBFile = errors.New("no RDB file configured, start the server with --dir and --dbfilename")
+
+// LoadSnapshot replaces the dataset and the function libraries with the RDB
+// file read from r. The file is parsed completely before anything is
+// replaced, so a truncated or corrupt one leaves the current data alone.
+func (ch *CommandHandler) LoadSnapshot(r io.Reader) error {
+	snapshot := &snapshotKeys{dbs: ch.store.DBCount()}
+	libraries, err := rdb.Load(r, snapshot)
+	if err != nil {
+		return err
+	}
+
+	ch.execMu.Lock()
+	defer ch.execMu.Unlock()
+	if err := ch.restoreLibraries(libraries, "FLUSH"); err != nil {
+		return err
+	}
+	ch.store.FlushAll(false)
+	now := time.Now()
+	for _, key := range snapshot.keys {
+		expiration := time.Duration(-1)
+		if !key.expiresAt.IsZero() {
+			if expiration = key.expiresAt.Sub(now); expiration <= 0 {
+				continue
+			}
+		}
+		ch.store.Set(key.db, key.key, key.value, expiration)
+	}
+	return nil
+}
+
+// snapshotKeys collects the keys of an RDB file until it was read
+// completely.
+type snapshotKeys struct {
+	dbs  int
+	keys []snapshotKey
+}
+
+type snapshotKey struct {
+	db         int
+	key, value string
+	// expiresAt is zero for keys without expiration.
+	expiresAt time.Time
+}
+
+func (s *snapshotKeys) Set(db int, key, value string, expiration time.Duration) {
+	k := snapshotKey{db: db, key: key, value: value}
+	if expiration >= 0 {
+		k.expiresAt = time.Now().Add(expiration)
+	}
+	s.keys = append(s.keys, k)
+}
+
+func (s *snapshotKeys) DBCount() int {
+	return s.dbs
+}
+
+// Save writes the dataset and the function libraries to the RDB file. It
+// blocks every other command, so the file is a point in time snapshot.
+func (ch *CommandHandler) Save() error {
+	path := ch.cfg.Load().RDBPath()
+	if path == "" {
+		return errNoRDBFile
+	}
+	ch.execMu.Lock()
+	defer ch.execMu.Unlock()
+	return ch.saveLocked(path)
+}
+
+// saveLocked writes the RDB file at path. It must be called with execMu held
+// exclusively.
+func (ch *CommandHandler) saveLocked(path string) error {
+	dirty := ch.dirty.Load()
+	if err := rdb.SaveRDBFile(path, ch.store, ch.functions.codes()); err != nil {
+		return err
+	}
+	ch.saved(dirty)
+	return nil
+}
+
+// snapshot encodes the dataset and the function libraries as an RDB file.
+// It must be called with execMu held exclusively.
+func (ch *CommandHandler) snapshot() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := rdb.Write(&buf, ch.store, ch.functions.codes()); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (ch *CommandHandler) handleSave(client *domain.Client, parts []string) {
+	path := ch.cfg.Load().RDBPath()
+	if path == "" {
+		client.Writer.WriteError(errNoRDBFile.Error())
+		return
+	}
+	ch.runExclusive(client, func() {
+		if err := ch.saveLocked(path); err != nil {
+			client.Writer.WriteError(err.Error())
+			return
+		}
+		client.Writer.WriteSimpleString("OK")
+	})
+}
@@ -0,0 +1,374 @@
+package handler
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/therahulbhati/go-redis-clone/internal/domain"
+	"github.com/therahulbhati/go-redis-clone/pkg/resp"
+	"github.com/therahulbhati/go-redis-clone/pkg/utils"
+)
+
+// pubSub maps channels, patterns and shard channels to the clients
+// subscribed to them. Clients keep their own subscriptions in
+// Client.Channels, Client.Patterns and Client.ShardChannels, which only their
+// goroutine touches.
+//
+// Shard channels are routed by hash slot like keys, so a message published
+// with SPUBLISH only reaches the leader/follower group owning the slot of
+// its channel. A standalone server owns every slot.
+type pubSub struct {
+	mu            sync.RWMutex
+	channels      map[string]map[*domain.Client]struct{}
+	patterns      map[string]map[*domain.Client]struct{}
+	shardChannels map[string]map[*domain.Client]struct{}
+}
+
+func newPubSub() *pubSub {
+	return &pubSub{
+		channels:      make(map[string]map[*domain.Client]struct{}),
+		patterns:      make(map[string]map[*domain.Client]struct{}),
+		shardChannels: make(map[string]map[*domain.Client]struct{}),
+	}
+}
+
+// subscription is one kind of subscription, to channels, patterns or shard
+// channels, along with the names of its confirmations.
+type subscription struct {
+	subscribe   string
+	unsubscribe string
+	// table returns the registry side and set returns the client side.
+	table func(ps *pubSub) map[string]map[*domain.Client]struct{}
+	set   func(client *domain.Client) *map[string]struct{}
+	// count returns the number of subscriptions reported in confirmations.
+	count func(client *domain.Client) int
+}
+
+// channelCount counts the subscriptions of SUBSCRIBE and PSUBSCRIBE, which
+// are reported separately from the shard channels.
+func channelCount(client *domain.Client) int {
+	return len(client.Channels) + len(client.Patterns)
+}
+
+var (
+	channelSubscription = &subscription{
+		subscribe:   "subscribe",
+		unsubscribe: "unsubscribe",
+		table:       func(ps *pubSub) map[string]map[*domain.Client]struct{} { return ps.channels },
+		set:         func(client *domain.Client) *map[string]struct{} { return &client.Channels },
+		count:       channelCount,
+	}
+	patternSubscription = &subscription{
+		subscribe:   "psubscribe",
+		unsubscribe: "punsubscribe",
+		table:       func(ps *pubSub) map[string]map[*domain.Client]struct{} { return ps.patterns },
+		set:         func(client *domain.Client) *map[string]struct{} { return &client.Patterns },
+		count:       channelCount,
+	}
+	shardSubscription = &subscription{
+		subscribe:   "ssubscribe",
+		unsubscribe: "sunsubscribe",
+		table:       func(ps *pubSub) map[string]map[*domain.Client]struct{} { return ps.shardChannels },
+		set:         func(client *domain.Client) *map[string]struct{} { return &client.ShardChannels },
+		count:       func(client *domain.Client) int { return len(client.ShardChannels) },
+	}
+)
+
+func (ps *pubSub) add(kind *subscription, client *domain.Client, name string) {
+	set := kind.set(client)
+	if _, ok := (*set)[name]; ok {
+		return
+	}
+	if *set == nil {
+		*set = make(map[string]struct{})
+	}
+	(*set)[name] = struct{}{}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	table := kind.table(ps)
+	subscribers := table[name]
+	if subscribers == nil {
+		subscribers = make(map[*domain.Client]struct{})
+		table[name] = subscribers
+	}
+	subscribers[client] = struct{}{}
+}
+
+func (ps *pubSub) remove(kind *subscription, client *domain.Client, name string) {
+	set := kind.set(client)
+	if _, ok := (*set)[name]; !ok {
+		return
+	}
+	delete(*set, name)
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	table := kind.table(ps)
+	delete(table[name], client)
+	if len(table[name]) == 0 {
+		delete(table, name)
+	}
+}
+
+// isSubscribed reports whether client is subscribed to channel.
+func (ps *pubSub) isSubscribed(client *domain.Client, channel string) bool {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	_, ok := ps.channels[channel][client]
+	return ok
+}
+
+// publish pushes message to the subscribers of channel and of the patterns
+// matching it, and returns how many messages were delivered.
+func (ps *pubSub) publish(channel, message string) int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	receivers := 0
+	if subscribers := ps.channels[channel]; len(subscribers) > 0 {
+		msg := pushMessage("message", channel, message)
+		for client := range subscribers {
+			client.Push(msg)
+			receivers++
+		}
+	}
+	for pattern, subscribers := range ps.patterns {
+		if !utils.GlobMatch(pattern, channel, false) {
+			continue
+		}
+		msg := pushMessage("pmessage", pattern, channel, message)
+		for client := range subscribers {
+			client.Push(msg)
+			receivers++
+		}
+	}
+	return receivers
+}
+
+// publishShard pushes message to the subscribers of the shard channel and
+// returns how many messages were delivered.
+func (ps *pubSub) publishShard(channel, message string) int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	subscribers := ps.shardChannels[channel]
+	if len(subscribers) == 0 {
+		return 0
+	}
+	msg := pushMessage("smessage", channel, message)
+	for client := range subscribers {
+		client.Push(msg)
+	}
+	return len(subscribers)
+}
+
+// pushMessage builds a push message made of bulk strings.
+func pushMessage(elements ...string) resp.Value {
+	msg := resp.Value{Type: resp.TypePush, Array: make([]resp.Value, len(elements))}
+	for i, elem := range elements {
+		msg.Array[i] = resp.Value{Type: resp.TypeBulkString, Str: elem}
+	}
+	return msg
+}
+
+// allowedWhileSubscribed reports whether cmd may run on a RESP2 connection
+// subscribed to something, which otherwise only receives messages.
+func allowedWhileSubscribed(cmd *command) bool {
+	switch cmd.name {
+	case "subscribe", "unsubscribe", "psubscribe", "punsubscribe", "ssubscribe", "sunsubscribe", "ping", "quit", "reset":
+		return true
+	}
+	return false
+}
+
+func subscribedContextError(cmd *command) string {
+	return fmt.Sprintf("Can't execute '%s': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context", cmd.fullName())
+}
+
+// writeSubscription writes the confirmation of a subscription change, which
+// carries the number of subscriptions of that kind the client is left with.
+func writeSubscription(client *domain.Client, kind *subscription, confirmation string, name *string) {
+	w := client.Writer
+	w.WritePushLen(3)
+	w.WriteBulkString(confirmation)
+	if name == nil {
+		w.WriteNull()
+	} else {
+		w.WriteBulkString(*name)
+	}
+	w.WriteInteger(int64(kind.count(client)))
+}
+
+func (ch *CommandHandler) subscribe(kind *subscription, client *domain.Client, names []string) {
+	for i := range names {
+		ch.pubsub.add(kind, client, names[i])
+		writeSubscription(client, kind, kind.subscribe, &names[i])
+	}
+}
+
+// unsubscribe removes the given subscriptions, or all of them when names is
+// empty.
+func (ch *CommandHandler) unsubscribe(kind *subscription, client *domain.Client, names []string) {
+	if len(names) == 0 {
+		names = sortedNames(*kind.set(client))
+		if len(names) == 0 {
+			writeSubscription(client, kind, kind.unsubscribe, nil)
+			return
+		}
+	}
+	for i := range names {
+		ch.pubsub.remove(kind, client, names[i])
+		writeSubscription(client, kind, kind.unsubscribe, &names[i])
+	}
+}
+
+// unsubscribeAll drops every subscription of a disconnecting client.
+func (ch *CommandHandler) unsubscribeAll(client *domain.Client) {
+	for _, kind := range []*subscription{channelSubscription, patternSubscription, shardSubscription} {
+		for name := range *kind.set(client) {
+			ch.pubsub.remove(kind, client, name)
+		}
+	}
+}
+
+func sortedNames(set map[string]struct{}) []string {
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (ch *CommandHandler) handleSubscribe(client *domain.Client, parts []string) {
+	ch.subscribe(channelSubscription, client, parts[1:])
+}
+
+func (ch *CommandHandler) handleUnsubscribe(client *domain.Client, parts []string) {
+	ch.unsubscribe(channelSubscription, client, parts[1:])
+}
+
+func (ch *CommandHandler) handlePSubscribe(client *domain.Client, parts []string) {
+	ch.subscribe(patternSubscription, client, parts[1:])
+}
+
+func (ch *CommandHandler) handlePUnsubscribe(client *domain.Client, parts []string) {
+	ch.unsubscribe(patternSubscription, client, parts[1:])
+}
+
+// handlePublish delivers the message locally and propagates it, so the
+// subscribers connected to followers receive it too.
+func (ch *CommandHandler) handlePublish(client *domain.Client, parts []string) {
+	receivers := ch.pubsub.publish(parts[1], parts[2])
+	client.Writer.WriteInteger(int64(receivers))
+	ch.propagate(client, parts)
+}
+
+// sameSlot checks that every shard channel of a command hashes to the same
+// slot, since they must all be served by the group owning it.
+func sameSlot(client *domain.Client, channels []string) bool {
+	for _, channel := range channels[1:] {
+		if utils.KeyHashSlot(channel) != utils.KeyHashSlot(channels[0]) {
+			client.Writer.WriteRawError("CROSSSLOT Keys in request don't hash to the same slot")
+			return false
+		}
+	}
+	return true
+}
+
+func (ch *CommandHandler) handleSSubscribe(client *domain.Client, parts []string) {
+	if !sameSlot(client, parts[1:]) {
+		return
+	}
+	ch.subscribe(shardSubscription, client, parts[1:])
+}
+
+func (ch *CommandHandler) handleSUnsubscribe(client *domain.Client, parts []string) {
+	if len(parts) > 1 && !sameSlot(client, parts[1:]) {
+		return
+	}
+	ch.unsubscribe(shardSubscription, client, parts[1:])
+}
+
+// handleSPublish delivers the message to the shard channel subscribers and
+// propagates it to the followers of this group only.
+func (ch *CommandHandler) handleSPublish(client *domain.Client, parts []string) {
+	receivers := ch.pubsub.publishShard(parts[1], parts[2])
+	client.Writer.WriteInteger(int64(receivers))
+	ch.propagate(client, parts)
+}
+
+// writeActiveChannels writes the channels of table matching the optional
+// pattern in parts[2].
+func (ch *CommandHandler) writeActiveChannels(client *domain.Client, parts []string, table map[string]map[*domain.Client]struct{}) {
+	pattern := ""
+	if len(parts) > 2 {
+		pattern = parts[2]
+	}
+	ch.pubsub.mu.RLock()
+	channels := make([]string, 0, len(table))
+	for channel := range table {
+		if pattern == "" || utils.GlobMatch(pattern, channel, false) {
+			channels = append(channels, channel)
+		}
+	}
+	ch.pubsub.mu.RUnlock()
+	sort.Strings(channels)
+	client.Writer.WriteStringArray(channels)
+}
+
+// writeSubscriberCounts writes the number of subscribers in table of each
+// channel in parts[2:].
+func (ch *CommandHandler) writeSubscriberCounts(client *domain.Client, parts []string, table map[string]map[*domain.Client]struct{}) {
+	w := client.Writer
+	ch.pubsub.mu.RLock()
+	defer ch.pubsub.mu.RUnlock()
+	w.WriteMapLen(len(parts) - 2)
+	for _, channel := range parts[2:] {
+		w.WriteBulkString(channel)
+		w.WriteInteger(int64(len(table[channel])))
+	}
+}
+
+func (ch *CommandHandler) handlePubSubChannels(client *domain.Client, parts []string) {
+	ch.writeActiveChannels(client, parts, ch.pubsub.channels)
+}
+
+func (ch *CommandHandler) handlePubSubNumSub(client *domain.Client, parts []string) {
+	ch.writeSubscriberCounts(client, parts, ch.pubsub.channels)
+}
+
+func (ch *CommandHandler) handlePubSubShardChannels(client *domain.Client, parts []string) {
+	ch.writeActiveChannels(client, parts, ch.pubsub.shardChannels)
+}
+
+func (ch *CommandHandler) handlePubSubShardNumSub(client *domain.Client, parts []string) {
+	ch.writeSubscriberCounts(client, parts, ch.pubsub.shardChannels)
+}
+
+func (ch *CommandHandler) handlePubSubNumPat(client *domain.Client, parts []string) {
+	ch.pubsub.mu.RLock()
+	defer ch.pubsub.mu.RUnlock()
+	client.Writer.WriteInteger(int64(len(ch.pubsub.patterns)))
+}
+
+func (ch *CommandHandler) handlePubSubHelp(client *domain.Client, parts []string) {
+	client.Writer.WriteStringArray([]string{
+		"PUBSUB <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+		"CHANNELS [<pattern>]",
+		"    Return the currently active channels matching a <pattern> (default: '*').",
+		"NUMPAT",
+		"    Return number of subscriptions to patterns.",
+		"NUMSUB [<channel> ...]",
+		"    Return the number of subscribers for the specified channels, excluding",
+		"    pattern subscriptions(default: no channels).",
+		"SHARDCHANNELS [<pattern>]",
+		"    Return the currently active shard level channels matching a <pattern> (default: '*').",
+		"SHARDNUMSUB [<shardchannel> ...]",
+		"    Return the number of subscribers for the specified shard level channel(s)",
+		"HELP",
+		"    Print this help.",
+	})
+}
@@ -0,0 +1,598 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/therahulbhati/go-redis-clone/internal/domain"
+	"github.com/therahulbhati/go-redis-clone/pkg/resp"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+const (
+	busyError       = "BUSY Redis is busy running a script. You can only call SCRIPT KILL or SHUTDOWN NOSCRIPT."
+	noScriptError   = "NOSCRIPT No matching script. Please use EVAL."
+	unkillableError = "UNKILLABLE Sorry the script already executed write commands against the dataset. You can either wait the script termination or kill the server in a hard way using the SHUTDOWN NOSAVE command."
+)
+
+// scriptEngine runs Lua scripts on a single interpreter. Scripts run while
+// execMu is held exclusively, which serializes access to the interpreter and
+// makes every script atomic.
+type scriptEngine struct {
+	L *lua.LState
+
+	mu sync.Mutex
+	// cache maps the SHA1 of every script loaded or evaluated to its
+	// compiled form.
+	cache   map[string]*lua.FunctionProto
+	running *scriptRun
+	// busyTime is the threshold after which other commands get BUSY, set
+	// with busy-reply-threshold. 0 disables it.
+	busyTime atomic.Int64
+}
+
+// scriptRun is a script in execution.
+type scriptRun struct {
+	start  time.Time
+	cancel context.CancelFunc
+	done   chan struct{}
+	// wrote is set once the script called a write command, after which it
+	// can't be killed anymore. killed is set by SCRIPT KILL.
+	wrote  bool
+	killed bool
+}
+
+func newScriptEngine() *scriptEngine {
+	return &scriptEngine{
+		cache: make(map[string]*lua.FunctionProto),
+	}
+}
+
+// newLuaState creates an interpreter with only the libraries scripts may
+// use: no io, os or module loading.
+func newLuaState(ch *CommandHandler) *lua.LState {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile", "print"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+
+	redis := L.NewTable()
+	L.SetFuncs(redis, map[string]lua.LGFunction{
+		"call":  func(L *lua.LState) int { return ch.luaCall(L, true) },
+		"pcall": func(L *lua.LState) int { return ch.luaCall(L, false) },
+		"error_reply": func(L *lua.LState) int {
+			L.Push(errorTable(L, L.CheckString(1)))
+			return 1
+		},
+		"status_reply": func(L *lua.LState) int {
+			t := L.NewTable()
+			t.RawSetString("ok", lua.LString(L.CheckString(1)))
+			L.Push(t)
+			return 1
+		},
+		"sha1hex": func(L *lua.LState) int {
+			L.Push(lua.LString(sha1Hex(L.CheckString(1))))
+			return 1
+		},
+	})
+	L.SetGlobal("redis", redis)
+	return L
+}
+
+func sha1Hex(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func errorTable(L *lua.LState, msg string) *lua.LTable {
+	t := L.NewTable()
+	t.RawSetString("err", lua.LString(msg))
+	return t
+}
+
+// load compiles body and caches it, returning its SHA1.
+func (e *scriptEngine) load(body string) (string, error) {
+	sha := sha1Hex(body)
+	e.mu.Lock()
+	_, ok := e.cache[sha]
+	e.mu.Unlock()
+	if ok {
+		return sha, nil
+	}
+
+	chunk, err := parse.Parse(strings.NewReader(body), "user_script")
+	if err != nil {
+		return "", fmt.Errorf("Error compiling script (new function): %v", err)
+	}
+	proto, err := lua.Compile(chunk, "user_script")
+	if err != nil {
+		return "", fmt.Errorf("Error compiling script (new function): %v", err)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.cache[sha] = proto
+	return sha, nil
+}
+
+func (e *scriptEngine) lookup(sha string) *lua.FunctionProto {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.cache[strings.ToLower(sha)]
+}
+
+func (e *scriptEngine) current() *scriptRun {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.running
+}
+
+// waitNotBusy waits for run to end, giving up with false once it has been
+// running for longer than the busy threshold.
+func (e *scriptEngine) waitNotBusy(run *scriptRun) bool {
+	busyTime := time.Duration(e.busyTime.Load())
+	if busyTime == 0 {
+		<-run.done
+		return true
+	}
+	remaining := time.Until(run.start.Add(busyTime))
+	if remaining <= 0 {
+		return false
+	}
+	timer := time.NewTimer(remaining)
+	defer timer.Stop()
+	select {
+	case <-run.done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// lockExec takes execMu, shared or exclusively. While a script has been
+// running past the busy threshold it gives up and returns false, so the
+// caller replies BUSY instead of queueing behind the script.
+func (ch *CommandHandler) lockExec(exclusive bool) bool {
+	try, lock := ch.execMu.TryRLock, ch.execMu.RLock
+	if exclusive {
+		try, lock = ch.execMu.TryLock, ch.execMu.Lock
+	}
+	for !try() {
+		run := ch.scripts.current()
+		if run == nil {
+			lock()
+			return true
+		}
+		if !ch.scripts.waitNotBusy(run) {
+			return false
+		}
+	}
+	return true
+}
+
+// runExclusive runs fn with execMu held exclusively, unless the client is
+// executing a transaction, which already holds it.
+func (ch *CommandHandler) runExclusive(client *domain.Client, fn func()) {
+	if client.Tx != nil && client.Tx.Executing {
+		fn()
+		return
+	}
+	if !ch.lockExec(true) {
+		client.Writer.WriteRawError(busyError)
+		return
+	}
+	defer ch.execMu.Unlock()
+	fn()
+}
+
+// parseNumKeys splits the arguments following the numkeys argument at
+// parts[idx] into keys and arguments.
+func parseNumKeys(parts []string, idx int, w *resp.Writer) ([]string, []string, bool) {
+	numKeys, err := strconv.Atoi(parts[idx])
+	if err != nil {
+		w.WriteError("value is not an integer or out of range")
+		return nil, nil, false
+	}
+	if numKeys < 0 {
+		w.WriteError("Number of keys can't be negative")
+		return nil, nil, false
+	}
+	if numKeys > len(parts)-idx-1 {
+		w.WriteError("Number of keys can't be greater than number of args")
+		return nil, nil, false
+	}
+	return parts[idx+1 : idx+1+numKeys], parts[idx+1+numKeys:], true
+}
+
+func (ch *CommandHandler) handleEval(client *domain.Client, parts []string) {
+	keys, args, ok := parseNumKeys(parts, 2, client.Writer)
+	if !ok {
+		return
+	}
+	sha, err := ch.scripts.load(parts[1])
+	if err != nil {
+		client.Writer.WriteError(err.Error())
+		return
+	}
+	ch.runExclusive(client, func() {
+		ch.runScript(client, sha, ch.scripts.lookup(sha), keys, args)
+	})
+}
+
+func (ch *CommandHandler) handleEvalSha(client *domain.Client, parts []string) {
+	keys, args, ok := parseNumKeys(parts, 2, client.Writer)
+	if !ok {
+		return
+	}
+	proto := ch.scripts.lookup(parts[1])
+	if proto == nil {
+		client.Writer.WriteRawError(noScriptError)
+		return
+	}
+	ch.runExclusive(client, func() {
+		ch.runScript(client, strings.ToLower(parts[1]), proto, keys, args)
+	})
+}
+
+// runScript runs a compiled EVAL script with KEYS and ARGV set.
+func (ch *CommandHandler) runScript(client *domain.Client, sha string, proto *lua.FunctionProto, keys, args []string) {
+	L := ch.scripts.state(ch)
+	// Globals the script defines go to a per-call environment, so they
+	// don't leak into the next script.
+	env := L.NewTable()
+	meta := L.NewTable()
+	meta.RawSetString("__index", L.Get(lua.GlobalsIndex))
+	L.SetMetatable(env, meta)
+	env.RawSetString("KEYS", stringsTable(L, keys))
+	env.RawSetString("ARGV", stringsTable(L, args))
+	fn := L.NewFunctionFromProto(proto)
+	fn.Env = env
+
+	ch.runLua(client, "script: "+sha+", on @user_script.", fn, nil, false)
+}
+
+// state returns the interpreter, creating it on first use.
+func (e *scriptEngine) state(ch *CommandHandler) *lua.LState {
+	if e.L == nil {
+		e.L = newLuaState(ch)
+	}
+	return e.L
+}
+
+// runLua calls fn with args on behalf of client, with execMu held
+// exclusively, and writes its result. where locates errors raised by the
+// code. Read-only runs reject write commands. The writes performed are
+// replicated as effects, wrapped in MULTI/EXEC.
+func (ch *CommandHandler) runLua(client *domain.Client, where string, fn *lua.LFunction, args []lua.LValue, readOnly bool) {
+	e := ch.scripts
+	L := e.state(ch)
+
+	var out bytes.Buffer
+	scriptClient := &domain.Client{
+		ID:     client.ID,
+		DB:     client.DB,
+		User:   client.User,
+		Writer: resp.NewWriter(&out),
+		Tx:     &domain.Transaction{Executing: true},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	run := &scriptRun{start: time.Now(), cancel: cancel, done: make(chan struct{})}
+	e.mu.Lock()
+	e.running = run
+	e.mu.Unlock()
+	ch.scriptCtx = &scriptContext{client: scriptClient, out: &out, run: run, readOnly: readOnly}
+	defer func() {
+		ch.scriptCtx = nil
+		e.mu.Lock()
+		e.running = nil
+		e.mu.Unlock()
+		cancel()
+		close(run.done)
+	}()
+
+	L.SetContext(ctx)
+	L.Push(fn)
+	for _, arg := range args {
+		L.Push(arg)
+	}
+	err := L.PCall(len(args), 1, nil)
+	L.RemoveContext()
+
+	if writes := scriptClient.Tx.Writes; len(writes) > 0 {
+		if client.Tx != nil && client.Tx.Executing {
+			client.Tx.Writes = append(client.Tx.Writes, writes...)
+		} else if ch.leaderMgr != nil {
+			client.LastWriteOffset = ch.leaderMgr.PropagateTransaction(writes)
+		}
+	}
+
+	w := client.Writer
+	if err != nil {
+		e.mu.Lock()
+		killed := run.killed
+		e.mu.Unlock()
+		if killed {
+			w.WriteError("Script killed by user with SCRIPT KILL...")
+			return
+		}
+		writeLuaError(w, err, where)
+		return
+	}
+
+	ret := L.Get(-1)
+	L.Pop(1)
+	writeLuaValue(w, ret)
+}
+
+// writeLuaError replies with an error raised by Lua code. Error tables, as
+// raised by redis.call, are sent as is.
+func writeLuaError(w *resp.Writer, err error, where string) {
+	apiErr, ok := err.(*lua.ApiError)
+	if !ok {
+		w.WriteError(err.Error())
+		return
+	}
+	if t, ok := apiErr.Object.(*lua.LTable); ok {
+		if msg, ok := t.RawGetString("err").(lua.LString); ok {
+			w.WriteRawError(string(msg))
+			return
+		}
+	}
+	w.WriteError(fmt.Sprintf("%s %s", apiErr.Object.String(), where))
+}
+
+// scriptContext is the state of the script being run, used by redis.call.
+type scriptContext struct {
+	client   *domain.Client
+	out      *bytes.Buffer
+	run      *scriptRun
+	readOnly bool
+}
+
+// luaCall implements redis.call and redis.pcall. Errors are raised by the
+// former and returned as an error table by the latter.
+func (ch *CommandHandler) luaCall(L *lua.LState, raise bool) int {
+	fail := func(msg string) int {
+		t := errorTable(L, msg)
+		if raise {
+			L.Error(t, 1)
+			return 0
+		}
+		L.Push(t)
+		return 1
+	}
+
+	sc := ch.scriptCtx
+	if sc == nil {
+		return fail("ERR redis.call can only be called inside a script invocation")
+	}
+	n := L.GetTop()
+	if n == 0 {
+		return fail("ERR Please specify at least one argument for this redis lib call")
+	}
+	parts := make([]string, n)
+	for i := 1; i <= n; i++ {
+		switch v := L.Get(i).(type) {
+		case lua.LString:
+			parts[i-1] = string(v)
+		case lua.LNumber:
+			parts[i-1] = v.String()
+		default:
+			return fail("ERR Lua redis lib command arguments must be strings or integers")
+		}
+	}
+
+	cmd := findCommand(parts[0])
+	if cmd != nil && cmd.subcommands != nil && len(parts) > 1 {
+		cmd = cmd.subcommands[strings.ToLower(parts[1])]
+	}
+	switch {
+	case cmd == nil || cmd.handler == nil:
+		return fail("ERR Unknown Redis command called from script")
+	case cmd.hasFlag(flagNoScript):
+		return fail("ERR This Redis command is not allowed from script")
+	case !cmd.arityOK(len(parts)):
+		return fail("ERR Wrong number of args calling Redis command from script")
+	}
+	if msg := ch.aclDenied(sc.client, cmd, parts, "lua"); msg != "" {
+		return fail("ERR ACL failure in script: " + msg)
+	}
+
+	if cmd.hasFlag(flagWrite) {
+		if sc.readOnly {
+			return fail("ERR Write commands are not allowed from read-only scripts.")
+		}
+		ch.scripts.mu.Lock()
+		sc.run.wrote = true
+		ch.scripts.mu.Unlock()
+	}
+	ch.call(sc.client, cmd, parts)
+	sc.client.Writer.Flush()
+
+	reply, err := resp.NewReader(bytes.NewReader(sc.out.Bytes()), resp.DefaultLimits()).ReadValue()
+	sc.out.Reset()
+	if err != nil {
+		return fail("ERR " + err.Error())
+	}
+	if reply.Type == resp.TypeError {
+		return fail(reply.Str)
+	}
+	L.Push(respToLua(L, reply))
+	return 1
+}
+
+func stringsTable(L *lua.LState, values []string) *lua.LTable {
+	t := L.CreateTable(len(values), 0)
+	for i, v := range values {
+		t.RawSetInt(i+1, lua.LString(v))
+	}
+	return t
+}
+
+// respToLua converts a command reply following the Redis conversion rules:
+// nulls become false and status and error replies tables with an ok or err
+// field.
+func respToLua(L *lua.LState, v resp.Value) lua.LValue {
+	if v.Null {
+		return lua.LFalse
+	}
+	switch v.Type {
+	case resp.TypeInteger:
+		return lua.LNumber(v.Int)
+	case resp.TypeBulkString, resp.TypeVerbatim, resp.TypeBigNumber:
+		return lua.LString(v.Str)
+	case resp.TypeSimpleString:
+		t := L.NewTable()
+		t.RawSetString("ok", lua.LString(v.Str))
+		return t
+	case resp.TypeError, resp.TypeBlobError:
+		return errorTable(L, v.Str)
+	case resp.TypeBoolean:
+		return lua.LBool(v.Int != 0)
+	case resp.TypeDouble:
+		t := L.NewTable()
+		t.RawSetString("double", lua.LNumber(v.Float))
+		return t
+	case resp.TypeNull:
+		return lua.LFalse
+	default:
+		t := L.CreateTable(len(v.Array), 0)
+		for i, elem := range v.Array {
+			t.RawSetInt(i+1, respToLua(L, elem))
+		}
+		return t
+	}
+}
+
+// writeLuaValue writes a script's return value: numbers are truncated to
+// integers, false and nil become null, tables with an ok or err field
+// status and error replies and other tables arrays, up to the first nil.
+func writeLuaValue(w *resp.Writer, v lua.LValue) {
+	switch v := v.(type) {
+	case lua.LString:
+		w.WriteBulkString(string(v))
+	case lua.LNumber:
+		w.WriteInteger(int64(v))
+	case lua.LBool:
+		if v {
+			w.WriteInteger(1)
+		} else {
+			w.WriteNull()
+		}
+	case *lua.LTable:
+		if msg, ok := v.RawGetString("err").(lua.LString); ok {
+			w.WriteRawError(string(msg))
+			return
+		}
+		if msg, ok := v.RawGetString("ok").(lua.LString); ok {
+			w.WriteSimpleString(string(msg))
+			return
+		}
+		var elems []lua.LValue
+		for i := 1; ; i++ {
+			elem := v.RawGetInt(i)
+			if elem == lua.LNil {
+				break
+			}
+			elems = append(elems, elem)
+		}
+		w.WriteArrayLen(len(elems))
+		for _, elem := range elems {
+			writeLuaValue(w, elem)
+		}
+	default:
+		w.WriteNull()
+	}
+}
+
+func (ch *CommandHandler) handleScriptLoad(client *domain.Client, parts []string) {
+	sha, err := ch.scripts.load(parts[2])
+	if err != nil {
+		client.Writer.WriteError(err.Error())
+		return
+	}
+	client.Writer.WriteBulkString(sha)
+}
+
+func (ch *CommandHandler) handleScriptExists(client *domain.Client, parts []string) {
+	client.Writer.WriteArrayLen(len(parts) - 2)
+	for _, sha := range parts[2:] {
+		if ch.scripts.lookup(sha) != nil {
+			client.Writer.WriteInteger(1)
+		} else {
+			client.Writer.WriteInteger(0)
+		}
+	}
+}
+
+func (ch *CommandHandler) handleScriptFlush(client *domain.Client, parts []string) {
+	if _, ok := parseFlushMode(parts[1:], client.Writer); !ok {
+		return
+	}
+	ch.scripts.mu.Lock()
+	ch.scripts.cache = make(map[string]*lua.FunctionProto)
+	ch.scripts.mu.Unlock()
+	client.Writer.WriteSimpleString("OK")
+}
+
+// handleScriptKill interrupts the running script, unless it already wrote
+// to the dataset.
+func (ch *CommandHandler) handleScriptKill(client *domain.Client, parts []string) {
+	e := ch.scripts
+	e.mu.Lock()
+	run := e.running
+	switch {
+	case run == nil:
+		e.mu.Unlock()
+		client.Writer.WriteRawError("NOTBUSY No scripts in execution right now.")
+		return
+	case run.wrote:
+		e.mu.Unlock()
+		client.Writer.WriteRawError(unkillableError)
+		return
+	}
+	run.killed = true
+	run.cancel()
+	e.mu.Unlock()
+
+	<-run.done
+	client.Writer.WriteSimpleString("OK")
+}
+
+func (ch *CommandHandler) handleScriptHelp(client *domain.Client, parts []string) {
+	client.Writer.WriteStringArray([]string{
+		"SCRIPT <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+		"EXISTS <sha1> [<sha1> ...]",
+		"    Return information about the existence of the scripts in the script cache.",
+		"FLUSH [ASYNC|SYNC]",
+		"    Flush the Lua scripts cache. Very dangerous on replicas.",
+		"KILL",
+		"    Kill the currently executing Lua script.",
+		"LOAD <script>",
+		"    Load a script into the scripts cache without executing it.",
+		"HELP",
+		"    Print this help.",
+	})
+}
@@ -0,0 +1,220 @@
+package handler
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/therahulbhati/go-redis-clone/internal/domain"
+)
+
+// slowlogMaxArgs and slowlogMaxArgLen bound how much of the arguments an
+// entry keeps, like Redis.
+const (
+	slowlogMaxArgs   = 32
+	slowlogMaxArgLen = 128
+)
+
+// slowlogEntry is a command that ran for longer than slowlog-log-slower-than.
+type slowlogEntry struct {
+	id       int64
+	time     time.Time
+	duration time.Duration
+	args     []string
+	addr     string
+	name     string
+}
+
+// slowlog keeps the latest slow commands in a ring buffer of
+// slowlog-max-len entries.
+type slowlog struct {
+	mu sync.Mutex
+	// ring holds the entries, the oldest at head once it's full.
+	ring   []slowlogEntry
+	head   int
+	nextID int64
+}
+
+// add records entry, dropping the oldest ones beyond maxLen.
+func (l *slowlog) add(entry slowlogEntry, maxLen int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry.id = l.nextID
+	l.nextID++
+	l.resize(maxLen)
+	switch {
+	case maxLen == 0:
+	case len(l.ring) < maxLen:
+		l.ring = append(l.ring, entry)
+	default:
+		l.ring[l.head] = entry
+		l.head = (l.head + 1) % len(l.ring)
+	}
+}
+
+// resize adapts the ring to slowlog-max-len having changed to maxLen, laying
+// the entries kept out from the oldest. The caller must hold l.mu.
+func (l *slowlog) resize(maxLen int) {
+	if len(l.ring) <= maxLen && (l.head == 0 || len(l.ring) == maxLen) {
+		return
+	}
+	entries := l.latest(min(len(l.ring), maxLen))
+	slices.Reverse(entries)
+	l.ring, l.head = entries, 0
+}
+
+// latest returns up to n entries, the most recent first. The caller must
+// hold l.mu.
+func (l *slowlog) latest(n int) []slowlogEntry {
+	n = min(n, len(l.ring))
+	entries := make([]slowlogEntry, n)
+	for i := range entries {
+		entries[i] = l.ring[(l.head-1-i+2*len(l.ring))%len(l.ring)]
+	}
+	return entries
+}
+
+// recordSlow adds the command run by client to the slow log when it took
+// longer than slowlog-log-slower-than. Blocking commands are left out, their
+// duration is mostly spent waiting.
+func (ch *CommandHandler) recordSlow(client *domain.Client, cmd *command, parts []string, start time.Time, duration time.Duration) {
+	cfg := ch.cfg.Load()
+	if cfg.SlowlogLogSlowerThan < 0 || duration < time.Duration(cfg.SlowlogLogSlowerThan)*time.Microsecond || cmd.hasFlag(flagBlocking) {
+		return
+	}
+	addr, _ := connAddrs(client.Conn)
+	ch.slowlog.add(slowlogEntry{
+		time:     start,
+		duration: duration,
+		args:     slowlogArgs(cmd, parts),
+		addr:     addr,
+		name:     client.Name,
+	}, cfg.SlowlogMaxLen)
+}
+
+// slowlogArgs returns the arguments of a slow log entry: at most
+// slowlogMaxArgs of them, truncated to slowlogMaxArgLen bytes, with
+// passwords redacted.
+func slowlogArgs(cmd *command, parts []string) []string {
+	n := min(len(parts), slowlogMaxArgs)
+	args := make([]string, n)
+	for i := range args {
+		arg := parts[i]
+		if len(arg) > slowlogMaxArgLen {
+			arg = fmt.Sprintf("%s... (%d more bytes)", arg[:slowlogMaxArgLen], len(arg)-slowlogMaxArgLen)
+		}
+		args[i] = arg
+	}
+	if len(parts) > slowlogMaxArgs {
+		args[n-1] = fmt.Sprintf("... (%d more arguments)", len(parts)-slowlogMaxArgs+1)
+	}
+	for _, i := range secretArgs(cmd, parts) {
+		if i < n {
+			args[i] = "(redacted)"
+		}
+	}
+	return args
+}
+
+// secretArgs returns the indexes of the arguments of parts holding
+// passwords.
+func secretArgs(cmd *command, parts []string) []int {
+	var secrets []int
+	switch cmd.fullName() {
+	case "auth", "acl|setuser":
+		from := 1
+		if cmd.name == "setuser" {
+			from = 3
+		}
+		for i := from; i < len(parts); i++ {
+			secrets = append(secrets, i)
+		}
+	case "hello":
+		for i := 2; i+2 < len(parts); i++ {
+			if strings.EqualFold(parts[i], "AUTH") {
+				secrets = append(secrets, i+2)
+			}
+		}
+	case "config|set":
+		for i := 2; i+1 < len(parts); i += 2 {
+			switch strings.ToLower(parts[i]) {
+			case "requirepass", "masterauth":
+				secrets = append(secrets, i+1)
+			}
+		}
+	}
+	return secrets
+}
+
+// handleSlowlogGet returns the count most recent entries, 10 by default and
+// all of them with -1: SLOWLOG GET [count]
+func (ch *CommandHandler) handleSlowlogGet(client *domain.Client, parts []string) {
+	w := client.Writer
+	if len(parts) > 3 {
+		w.WriteError("wrong number of arguments for 'slowlog|get' command")
+		return
+	}
+	count := 10
+	if len(parts) == 3 {
+		n, err := strconv.Atoi(parts[2])
+		if err != nil || n < -1 {
+			w.WriteError("count should be greater than or equal to -1")
+			return
+		}
+		count = n
+	}
+
+	ch.slowlog.mu.Lock()
+	if count == -1 {
+		count = len(ch.slowlog.ring)
+	}
+	entries := ch.slowlog.latest(count)
+	ch.slowlog.mu.Unlock()
+
+	w.WriteArrayLen(len(entries))
+	for _, entry := range entries {
+		w.WriteArrayLen(6)
+		w.WriteInteger(entry.id)
+		w.WriteInteger(entry.time.Unix())
+		w.WriteInteger(entry.duration.Microseconds())
+		w.WriteStringArray(entry.args)
+		w.WriteBulkString(entry.addr)
+		w.WriteBulkString(entry.name)
+	}
+}
+
+// handleSlowlogLen returns the number of entries: SLOWLOG LEN
+func (ch *CommandHandler) handleSlowlogLen(client *domain.Client, parts []string) {
+	ch.slowlog.mu.Lock()
+	n := len(ch.slowlog.ring)
+	ch.slowlog.mu.Unlock()
+	client.Writer.WriteInteger(int64(n))
+}
+
+// handleSlowlogReset removes every entry: SLOWLOG RESET
+func (ch *CommandHandler) handleSlowlogReset(client *domain.Client, parts []string) {
+	ch.slowlog.mu.Lock()
+	ch.slowlog.ring, ch.slowlog.head = nil, 0
+	ch.slowlog.mu.Unlock()
+	client.Writer.WriteSimpleString("OK")
+}
+
+func (ch *CommandHandler) handleSlowlogHelp(client *domain.Client, parts []string) {
+	client.Writer.WriteStringArray([]string{
+		"SLOWLOG <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+		"GET [<count>]",
+		"    Return top <count> entries from the slowlog (default: 10, -1 mean all).",
+		"    Entries are made of:",
+		"    id, timestamp, time in microseconds, arguments array, client IP and port,",
+		"    client name",
+		"LEN",
+		"    Return the length of the slowlog.",
+		"RESET",
+		"    Reset the slowlog.",
+		"HELP",
+		"    Print this help.",
+	})
+}
@@ -0,0 +1,299 @@
+package handler
+
+import (
+	"io"
+	"math"
+	"math/bits"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxErrorCodes bounds the error codes tracked for INFO errorstats, like
+// Redis does, so clients can't grow the table without limit. Errors with
+// other codes still count in total_error_replies.
+const maxErrorCodes = 128
+
+// metricSamples is how many cron ticks the instantaneous rates average.
+const metricSamples = 16
+
+// serverStats are the counters of the server activity, reset by CONFIG
+// RESETSTAT.
+type serverStats struct {
+	connectionsReceived atomic.Int64
+	commandsProcessed   atomic.Int64
+	expiredKeys         atomic.Int64
+	evictedKeys         atomic.Int64
+	keyspaceHits        atomic.Int64
+	keyspaceMisses      atomic.Int64
+	netInputBytes       atomic.Int64
+	netOutputBytes      atomic.Int64
+	syncFull            atomic.Int64
+	errorReplies        atomic.Int64
+	peakMemory          atomic.Int64
+
+	// errorsMu guards errorCodes, the number of error replies by error code.
+	errorsMu   sync.Mutex
+	errorCodes map[string]int64
+
+	// metricsMu guards the instantaneous rates, sampled by the cron.
+	metricsMu sync.Mutex
+	opsRate   instantMetric
+	inputRate instantMetric
+	outRate   instantMetric
+}
+
+// reset sets every counter back to 0, including the ones of each command.
+func (s *serverStats) reset() {
+	for _, counter := range []*atomic.Int64{
+		&s.connectionsReceived, &s.commandsProcessed, &s.expiredKeys,
+		&s.evictedKeys, &s.keyspaceHits, &s.keyspaceMisses,
+		&s.netInputBytes, &s.netOutputBytes, &s.syncFull,
+		&s.errorReplies, &s.peakMemory,
+	} {
+		counter.Store(0)
+	}
+	s.errorsMu.Lock()
+	s.errorCodes = nil
+	s.errorsMu.Unlock()
+	s.metricsMu.Lock()
+	s.opsRate, s.inputRate, s.outRate = instantMetric{}, instantMetric{}, instantMetric{}
+	s.metricsMu.Unlock()
+	for _, cmd := range commandTable {
+		cmd.stats.reset()
+		for _, sub := range cmd.subcommands {
+			sub.stats.reset()
+		}
+	}
+}
+
+// recordErrors counts n error replies, the last of which is last.
+func (s *serverStats) recordErrors(n int, last string) {
+	if n == 0 {
+		return
+	}
+	s.errorReplies.Add(int64(n))
+	code, _, _ := strings.Cut(last, " ")
+	s.errorsMu.Lock()
+	defer s.errorsMu.Unlock()
+	if s.errorCodes == nil {
+		s.errorCodes = make(map[string]int64)
+	}
+	if _, ok := s.errorCodes[code]; ok || len(s.errorCodes) < maxErrorCodes {
+		s.errorCodes[code] += int64(n)
+	}
+}
+
+// errorCounts returns a copy of the number of error replies by code.
+func (s *serverStats) errorCounts() map[string]int64 {
+	s.errorsMu.Lock()
+	defer s.errorsMu.Unlock()
+	counts := make(map[string]int64, len(s.errorCodes))
+	for code, n := range s.errorCodes {
+		counts[code] = n
+	}
+	return counts
+}
+
+// sampleMetrics records the progress of the counters behind the
+// instantaneous rates and the memory peak.
+func (s *serverStats) sampleMetrics(now time.Time, usedMemory int64) {
+	s.metricsMu.Lock()
+	s.opsRate.sample(now, s.commandsProcessed.Load())
+	s.inputRate.sample(now, s.netInputBytes.Load())
+	s.outRate.sample(now, s.netOutputBytes.Load())
+	s.metricsMu.Unlock()
+	s.updatePeakMemory(usedMemory)
+}
+
+// rates returns the instantaneous operations per second and the input and
+// output rates in bytes per second.
+func (s *serverStats) rates() (ops, input, output float64) {
+	s.metricsMu.Lock()
+	defer s.metricsMu.Unlock()
+	return s.opsRate.rate(), s.inputRate.rate(), s.outRate.rate()
+}
+
+func (s *serverStats) updatePeakMemory(used int64) {
+	for {
+		peak := s.peakMemory.Load()
+		if used <= peak || s.peakMemory.CompareAndSwap(peak, used) {
+			return
+		}
+	}
+}
+
+// instantMetric averages the rate of a counter over its last metricSamples
+// samples.
+type instantMetric struct {
+	lastTime  time.Time
+	lastValue int64
+	samples   [metricSamples]float64
+	taken     int
+}
+
+func (m *instantMetric) sample(now time.Time, value int64) {
+	if elapsed := now.Sub(m.lastTime).Seconds(); !m.lastTime.IsZero() && elapsed > 0 {
+		// The counters may have been reset meanwhile.
+		m.samples[m.taken%metricSamples] = float64(max(value-m.lastValue, 0)) / elapsed
+		m.taken++
+	}
+	m.lastTime, m.lastValue = now, value
+}
+
+func (m *instantMetric) rate() float64 {
+	n := min(m.taken, metricSamples)
+	if n == 0 {
+		return 0
+	}
+	var sum float64
+	for _, sample := range m.samples[:n] {
+		sum += sample
+	}
+	return sum / float64(n)
+}
+
+// commandStats are the counters of a command reported by INFO
+// commandstats and latencystats. Calls that were refused before running,
+// like with a wrong number of arguments, are rejected; calls that replied
+// with an error are failed.
+type commandStats struct {
+	calls    atomic.Int64
+	usec     atomic.Int64
+	rejected atomic.Int64
+	failed   atomic.Int64
+	// latency is allocated by the first call, most commands are never
+	// called.
+	latency atomic.Pointer[latencyHistogram]
+}
+
+// record counts a call that took elapsed.
+func (s *commandStats) record(elapsed time.Duration, failed bool) {
+	usec := elapsed.Microseconds()
+	s.calls.Add(1)
+	s.usec.Add(usec)
+	if failed {
+		s.failed.Add(1)
+	}
+	h := s.latency.Load()
+	if h == nil {
+		s.latency.CompareAndSwap(nil, new(latencyHistogram))
+		h = s.latency.Load()
+	}
+	h.record(elapsed.Nanoseconds())
+}
+
+func (s *commandStats) reset() {
+	s.calls.Store(0)
+	s.usec.Store(0)
+	s.rejected.Store(0)
+	s.failed.Store(0)
+	s.latency.Store(nil)
+}
+
+// Every power of two of the latency histogram is split in latencySubBuckets
+// buckets, which keeps the percentiles within 12.5% of the actual latency.
+const (
+	latencySubBits    = 3
+	latencySubBuckets = 1 << latencySubBits
+	latencyBuckets    = latencySubBuckets * 48
+)
+
+// latencyHistogram counts latencies in nanoseconds in buckets whose width
+// grows with the latency, like a HDR histogram with 1 significant digit.
+type latencyHistogram struct {
+	counts [latencyBuckets]atomic.Int64
+}
+
+func latencyBucket(ns int64) int {
+	if ns < latencySubBuckets {
+		return int(max(ns, 0))
+	}
+	shift := bits.Len64(uint64(ns)) - latencySubBits - 1
+	bucket := latencySubBuckets*(shift+1) + int(ns>>shift) - latencySubBuckets
+	return min(bucket, latencyBuckets-1)
+}
+
+// latencyBucketMax returns the highest latency counted in bucket.
+func latencyBucketMax(bucket int) int64 {
+	if bucket < latencySubBuckets {
+		return int64(bucket)
+	}
+	shift := bucket/latencySubBuckets - 1
+	sub := int64(bucket%latencySubBuckets + latencySubBuckets)
+	return (sub+1)<<shift - 1
+}
+
+func (h *latencyHistogram) record(ns int64) {
+	h.counts[latencyBucket(ns)].Add(1)
+}
+
+// percentiles returns the latencies below which each of the percentiles of
+// the calls completed, 0 for all of them when nothing was recorded.
+func (h *latencyHistogram) percentiles(percentiles []float64) []int64 {
+	var counts [latencyBuckets]int64
+	var total int64
+	for i := range h.counts {
+		counts[i] = h.counts[i].Load()
+		total += counts[i]
+	}
+	values := make([]int64, len(percentiles))
+	if total == 0 {
+		return values
+	}
+	for i, p := range percentiles {
+		rank := max(int64(math.Ceil(p/100*float64(total))), 1)
+		var seen int64
+		for bucket, n := range counts {
+			seen += n
+			if seen >= rank {
+				values[i] = latencyBucketMax(bucket)
+				break
+			}
+		}
+	}
+	return values
+}
+
+// cumulative returns how many calls completed within each of the bounds in
+// seconds, and the total number of calls.
+func (h *latencyHistogram) cumulative(bounds []float64) ([]int64, int64) {
+	counts := make([]int64, len(bounds))
+	var total int64
+	for bucket := range h.counts {
+		n := h.counts[bucket].Load()
+		total += n
+		seconds := float64(latencyBucketMax(bucket)) / 1e9
+		for i, bound := range bounds {
+			if seconds <= bound {
+				counts[i] += n
+			}
+		}
+	}
+	return counts, total
+}
+
+// countingReader and countingWriter count the bytes going through into
+// total_net_input_bytes and total_net_output_bytes.
+type countingReader struct {
+	r     io.Reader
+	total *atomic.Int64
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.total.Add(int64(n))
+	return n, err
+}
+
+type countingWriter struct {
+	w     io.Writer
+	total *atomic.Int64
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.total.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,440 @@
+package handler
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/therahulbhati/go-redis-clone/internal/domain"
+	"github.com/therahulbhati/go-redis-clone/pkg/resp"
+)
+
+// invalidateChannel is the channel RESP2 clients subscribe to in order to
+// receive the invalidation messages redirected to them.
+const invalidateChannel = "__redis__:invalidate"
+
+// tracking implements client side caching. In the default mode it remembers
+// which clients read which keys and tells them once a key they read is
+// modified, forgetting the key until it's read again. In BCAST mode clients
+// are told about every modified key matching the prefixes they registered.
+//
+// Clients are referred to by ID, so a script's reads and writes count as its
+// caller's.
+type tracking struct {
+	mu sync.Mutex
+	// clients holds the options of the clients with tracking enabled.
+	clients map[int64]*trackedClient
+	// keys maps the keys read in default mode to the clients that read them.
+	keys map[string]map[int64]struct{}
+	// active counts the clients in clients, so commands skip the
+	// bookkeeping without locking while nobody tracks anything.
+	active atomic.Int32
+}
+
+// trackedClient holds the CLIENT TRACKING options of a client.
+type trackedClient struct {
+	client *domain.Client
+	// redirect is the ID of the client receiving the invalidation messages
+	// instead, 0 for none.
+	redirect int64
+	bcast    bool
+	prefixes []string
+	optIn    bool
+	optOut   bool
+	noLoop   bool
+	// caching is the answer of the last CLIENT CACHING, which applies to the
+	// next command only: "yes", "no" or empty.
+	caching string
+}
+
+func newTracking() *tracking {
+	return &tracking{
+		clients: make(map[int64]*trackedClient),
+		keys:    make(map[string]map[int64]struct{}),
+	}
+}
+
+// tracksReads reports whether the keys read by the next command are
+// remembered for tc.
+func (tc *trackedClient) tracksReads() bool {
+	switch {
+	case tc.bcast:
+		return false
+	case tc.optIn:
+		return tc.caching == "yes"
+	case tc.optOut:
+		return tc.caching != "no"
+	}
+	return true
+}
+
+func (tc *trackedClient) matchesPrefix(key string) bool {
+	if len(tc.prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range tc.prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// trackCommand remembers the keys read by a command and invalidates the
+// ones it wrote.
+func (ch *CommandHandler) trackCommand(client *domain.Client, cmd *command, parts []string) {
+	t := ch.tracking
+	if t.active.Load() == 0 {
+		return
+	}
+
+	switch {
+	case cmd.hasFlag(flagWrite):
+		for _, i := range cmd.keyPositions(parts) {
+			ch.invalidateKey(parts[i], client.ID)
+		}
+	case cmd.hasFlag(flagReadonly):
+		t.mu.Lock()
+		if tc, ok := t.clients[client.ID]; ok && tc.tracksReads() {
+			for _, i := range cmd.keyPositions(parts) {
+				readers := t.keys[parts[i]]
+				if readers == nil {
+					readers = make(map[int64]struct{})
+					t.keys[parts[i]] = readers
+				}
+				readers[client.ID] = struct{}{}
+			}
+		}
+		t.mu.Unlock()
+	}
+
+	// CLIENT CACHING applies to the next command, or to all the commands of
+	// the transaction or script that follows.
+	if client.Tx == nil && cmd.fullName() != "client|caching" {
+		t.mu.Lock()
+		if tc, ok := t.clients[client.ID]; ok {
+			tc.caching = ""
+		}
+		t.mu.Unlock()
+	}
+}
+
+// invalidateKey tells the clients tracking key that it was modified by the
+// client with ID modifier, 0 when the store expired or evicted it.
+func (ch *CommandHandler) invalidateKey(key string, modifier int64) {
+	t := ch.tracking
+	if t.active.Load() == 0 {
+		return
+	}
+
+	var targets []*trackedClient
+	t.mu.Lock()
+	for id := range t.keys[key] {
+		if tc, ok := t.clients[id]; ok && !(tc.noLoop && id == modifier) {
+			targets = append(targets, tc)
+		}
+	}
+	delete(t.keys, key)
+	for id, tc := range t.clients {
+		if tc.bcast && tc.matchesPrefix(key) && !(tc.noLoop && id == modifier) {
+			targets = append(targets, tc)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, tc := range targets {
+		ch.sendInvalidation(tc, []string{key})
+	}
+}
+
+// invalidateAll tells every tracking client that all keys changed, after
+// FLUSHDB, FLUSHALL or SWAPDB.
+func (ch *CommandHandler) invalidateAll() {
+	t := ch.tracking
+	if t.active.Load() == 0 {
+		return
+	}
+
+	t.mu.Lock()
+	targets := make([]*trackedClient, 0, len(t.clients))
+	for _, tc := range t.clients {
+		targets = append(targets, tc)
+	}
+	clear(t.keys)
+	t.mu.Unlock()
+
+	for _, tc := range targets {
+		ch.sendInvalidation(tc, nil)
+	}
+}
+
+// sendInvalidation pushes an invalidation message for keys, or for every key
+// when keys is nil, to tc or the client it redirects to. RESP3 clients get
+// an "invalidate" push message, while RESP2 clients only get messages
+// redirected to them and only when subscribed to __redis__:invalidate.
+func (ch *CommandHandler) sendInvalidation(tc *trackedClient, keys []string) {
+	target := tc.client
+	if tc.redirect != 0 {
+		ch.mu.Lock()
+		target = ch.clients[tc.redirect]
+		ch.mu.Unlock()
+		if target == nil {
+			if tc.client.PushProtocol() >= 3 {
+				tc.client.Push(resp.Value{Type: resp.TypePush, Array: []resp.Value{
+					{Type: resp.TypeBulkString, Str: "tracking-redir-broken"},
+					{Type: resp.TypeInteger, Int: tc.redirect},
+				}})
+			}
+			return
+		}
+	}
+
+	keysValue := resp.Value{Type: resp.TypeArray, Null: keys == nil, Array: make([]resp.Value, len(keys))}
+	for i, key := range keys {
+		keysValue.Array[i] = resp.Value{Type: resp.TypeBulkString, Str: key}
+	}
+	switch {
+	case target.PushProtocol() >= 3:
+		target.Push(resp.Value{Type: resp.TypePush, Array: []resp.Value{
+			{Type: resp.TypeBulkString, Str: "invalidate"},
+			keysValue,
+		}})
+	case tc.redirect != 0 && ch.pubsub.isSubscribed(target, invalidateChannel):
+		target.Push(resp.Value{Type: resp.TypePush, Array: []resp.Value{
+			{Type: resp.TypeBulkString, Str: "message"},
+			{Type: resp.TypeBulkString, Str: invalidateChannel},
+			keysValue,
+		}})
+	}
+}
+
+// stopTracking disables tracking for a client. The keys it read are
+// forgotten lazily, when they are invalidated.
+func (ch *CommandHandler) stopTracking(client *domain.Client) {
+	t := ch.tracking
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.clients[client.ID]; ok {
+		delete(t.clients, client.ID)
+		t.active.Add(-1)
+	}
+}
+
+// handleClientTracking enables or disables tracking:
+// CLIENT TRACKING ON|OFF [REDIRECT id] [PREFIX prefix ...] [BCAST] [OPTIN] [OPTOUT] [NOLOOP]
+func (ch *CommandHandler) handleClientTracking(client *domain.Client, parts []string) {
+	w := client.Writer
+	opts := trackedClient{client: client}
+	for i := 3; i < len(parts); i++ {
+		switch opt := strings.ToUpper(parts[i]); {
+		case opt == "REDIRECT" && i+1 < len(parts):
+			if opts.redirect != 0 {
+				w.WriteError("A client can only redirect to a single other client")
+				return
+			}
+			id, err := strconv.ParseInt(parts[i+1], 10, 64)
+			if err != nil {
+				w.WriteError("value is not an integer or out of range")
+				return
+			}
+			if id == client.ID {
+				// Redirecting to itself is the same as not redirecting.
+				id = 0
+			} else {
+				ch.mu.Lock()
+				_, ok := ch.clients[id]
+				ch.mu.Unlock()
+				if !ok {
+					w.WriteError("The client ID you want redirect to does not exist")
+					return
+				}
+			}
+			opts.redirect = id
+			i++
+		case opt == "PREFIX" && i+1 < len(parts):
+			opts.prefixes = append(opts.prefixes, parts[i+1])
+			i++
+		case opt == "BCAST":
+			opts.bcast = true
+		case opt == "OPTIN":
+			opts.optIn = true
+		case opt == "OPTOUT":
+			opts.optOut = true
+		case opt == "NOLOOP":
+			opts.noLoop = true
+		default:
+			w.WriteError("syntax error")
+			return
+		}
+	}
+
+	switch strings.ToUpper(parts[2]) {
+	case "ON":
+	case "OFF":
+		ch.stopTracking(client)
+		w.WriteSimpleString("OK")
+		return
+	default:
+		w.WriteError("syntax error")
+		return
+	}
+
+	if len(opts.prefixes) > 0 && !opts.bcast {
+		w.WriteError("PREFIX option requires BCAST mode to be enabled")
+		return
+	}
+	if opts.optIn && opts.optOut {
+		w.WriteError("You can't use both OPTIN and OPTOUT")
+		return
+	}
+	if opts.bcast && (opts.optIn || opts.optOut) {
+		w.WriteError("OPTIN and OPTOUT are not compatible with BCAST")
+		return
+	}
+
+	t := ch.tracking
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	current, enabled := t.clients[client.ID]
+	if enabled {
+		if current.bcast != opts.bcast {
+			w.WriteError("You can't switch BCAST mode on/off before disabling tracking for this client, and then re-enabling it with a different mode.")
+			return
+		}
+		if current.optIn != opts.optIn || current.optOut != opts.optOut {
+			w.WriteError("You can't switch OPTIN/OPTOUT mode before disabling tracking for this client, and then re-enabling it with a different mode.")
+			return
+		}
+		// Enabling tracking again adds prefixes to the ones registered.
+		opts.prefixes = append(append([]string(nil), current.prefixes...), opts.prefixes...)
+	}
+	if err := checkPrefixes(opts.prefixes); err != nil {
+		w.WriteError(err.Error())
+		return
+	}
+
+	if !enabled {
+		t.active.Add(1)
+	}
+	t.clients[client.ID] = &opts
+	w.WriteSimpleString("OK")
+}
+
+// checkPrefixes rejects duplicated prefixes and prefixes of one another,
+// which would report the same key twice.
+func checkPrefixes(prefixes []string) error {
+	for i, a := range prefixes {
+		for _, b := range prefixes[i+1:] {
+			if strings.HasPrefix(a, b) || strings.HasPrefix(b, a) {
+				return fmt.Errorf("Prefix '%s' overlaps with another provided prefix '%s'. Prefixes for a single client must not overlap.", b, a)
+			}
+		}
+	}
+	return nil
+}
+
+// handleClientCaching sets whether the keys read by the next command are
+// tracked, for clients in OPTIN or OPTOUT mode.
+func (ch *CommandHandler) handleClientCaching(client *domain.Client, parts []string) {
+	w := client.Writer
+	t := ch.tracking
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tc, ok := t.clients[client.ID]
+	if !ok || (!tc.optIn && !tc.optOut) {
+		w.WriteError("CLIENT CACHING can be called only when the client is in tracking mode with OPTIN or OPTOUT mode enabled")
+		return
+	}
+
+	switch answer := strings.ToLower(parts[2]); {
+	case answer == "yes" && tc.optIn, answer == "no" && tc.optOut:
+		tc.caching = answer
+	case answer == "yes":
+		w.WriteError("CLIENT CACHING YES is only valid when tracking is enabled in OPTIN mode.")
+		return
+	case answer == "no":
+		w.WriteError("CLIENT CACHING NO is only valid when tracking is enabled in OPTOUT mode.")
+		return
+	default:
+		w.WriteError("syntax error")
+		return
+	}
+	w.WriteSimpleString("OK")
+}
+
+// handleClientGetRedir returns the client invalidation messages are
+// redirected to, 0 when not redirected and -1 when tracking is off.
+func (ch *CommandHandler) handleClientGetRedir(client *domain.Client, parts []string) {
+	t := ch.tracking
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tc, ok := t.clients[client.ID]
+	if !ok {
+		client.Writer.WriteInteger(-1)
+		return
+	}
+	client.Writer.WriteInteger(tc.redirect)
+}
+
+func (ch *CommandHandler) handleClientTrackingInfo(client *domain.Client, parts []string) {
+	w := client.Writer
+	t := ch.tracking
+	t.mu.Lock()
+	tc, ok := t.clients[client.ID]
+	var opts trackedClient
+	if ok {
+		opts = *tc
+	}
+	t.mu.Unlock()
+
+	var flags []string
+	redirect := int64(-1)
+	if !ok {
+		flags = append(flags, "off")
+	} else {
+		flags = append(flags, "on")
+		redirect = opts.redirect
+		if opts.bcast {
+			flags = append(flags, "bcast")
+		}
+		if opts.optIn {
+			flags = append(flags, "optin")
+			if opts.caching == "yes" {
+				flags = append(flags, "caching-yes")
+			}
+		}
+		if opts.optOut {
+			flags = append(flags, "optout")
+			if opts.caching == "no" {
+				flags = append(flags, "caching-no")
+			}
+		}
+		if opts.noLoop {
+			flags = append(flags, "noloop")
+		}
+		if opts.redirect != 0 {
+			ch.mu.Lock()
+			_, alive := ch.clients[opts.redirect]
+			ch.mu.Unlock()
+			if !alive {
+				flags = append(flags, "broken_redirect")
+			}
+		}
+	}
+	prefixes := append([]string(nil), opts.prefixes...)
+	sort.Strings(prefixes)
+
+	w.WriteMapLen(3)
+	w.WriteBulkString("flags")
+	w.WriteSetLen(len(flags))
+	for _, flag := range flags {
+		w.WriteBulkString(flag)
+	}
+	w.WriteBulkString("redirect")
+	w.WriteInteger(redirect)
+	w.WriteBulkString("prefixes")
+	w.WriteStringArray(prefixes)
+}
@@ -0,0 +1,76 @@
+// Package logging writes the server log, filtered by the level selected with
+// loglevel.
+package logging
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Level is the verbosity of the log, messages below it being dropped.
+type Level int32
+
+const (
+	Debug Level = iota
+	Verbose
+	Notice
+	Warning
+	// Nothing silences the log.
+	Nothing
+)
+
+// levels maps the loglevel values to the levels.
+var levels = map[string]Level{
+	"debug":   Debug,
+	"verbose": Verbose,
+	"notice":  Notice,
+	"warning": Warning,
+	"nothing": Nothing,
+}
+
+var level atomic.Int32
+
+func init() {
+	level.Store(int32(Notice))
+}
+
+// SetLevel selects the level by its loglevel name.
+func SetLevel(name string) error {
+	l, ok := levels[name]
+	if !ok {
+		return fmt.Errorf("invalid log level '%s'", name)
+	}
+	level.Store(int32(l))
+	return nil
+}
+
+// Enabled reports whether messages of level l are written.
+func Enabled(l Level) bool {
+	return l >= Level(level.Load())
+}
+
+func logf(l Level, prefix, format string, v ...interface{}) {
+	if Enabled(l) {
+		fmt.Printf(prefix+format+"\n", v...)
+	}
+}
+
+// Debugf logs information useful when developing or troubleshooting.
+func Debugf(format string, v ...interface{}) {
+	logf(Debug, "[DEBUG] ", format, v...)
+}
+
+// Verbosef logs events happening for every connection.
+func Verbosef(format string, v ...interface{}) {
+	logf(Verbose, "", format, v...)
+}
+
+// Noticef logs the events worth keeping in production.
+func Noticef(format string, v ...interface{}) {
+	logf(Notice, "", format, v...)
+}
+
+// Warningf logs the errors needing attention.
+func Warningf(format string, v ...interface{}) {
+	logf(Warning, "", format, v...)
+}
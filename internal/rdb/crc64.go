@@ -0,0 +1,28 @@
+package rdb
+
+// crc64Table is the table of the reflected Jones polynomial, the CRC Redis
+// appends to RDB files and DUMP payloads.
+var crc64Table = func() [256]uint64 {
+	var table [256]uint64
+	for i := range table {
+		crc := uint64(i)
+		for j := 0; j < 8; j++ {
+			if crc&1 == 1 {
+				crc = crc>>1 ^ 0x95ac9329ac4bc9b5
+			} else {
+				crc >>= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// crc64 continues crc over data. Unlike hash/crc64 there is no inversion
+// before and after, matching Redis.
+func crc64(crc uint64, data []byte) uint64 {
+	for _, b := range data {
+		crc = crc64Table[byte(crc)^b] ^ crc>>8
+	}
+	return crc
+}
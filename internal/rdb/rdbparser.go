@@ -1,75 +1,158 @@
 package rdb
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"github.com/therahulbhati/go-redis-clone/internal/domain"
 	"io"
 	"os"
+	"strconv"
 	"time"
 )
 
-func LoadRDBFile(filePath string, store domain.Store) error {
+// functionAuxKey is the aux field holding the code of a function library,
+// repeated once per library.
+const functionAuxKey = "function-library"
+
+// Target receives the keys read from an RDB file. domain.Store is one.
+type Target interface {
+	Set(db int, key, value string, expiration time.Duration)
+	DBCount() int
+}
+
+// LoadRDBFile loads the RDB file at filePath into store and returns the
+// code of the function libraries it holds.
+func LoadRDBFile(filePath string, store Target) ([]string, error) {
 	file, err := os.Open(filePath)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer file.Close()
+	return Load(file, store)
+}
+
+// Load reads an RDB file from r into store and returns the code of the
+// function libraries it holds.
+func Load(r io.Reader, store Target) ([]string, error) {
+	buffered := bufio.NewReader(r)
+	checked := &checksumReader{r: buffered}
+	libraries, err := load(checked, store)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyChecksum(buffered, checked.crc); err != nil {
+		return nil, err
+	}
+	return libraries, nil
+}
+
+// load reads the RDB file up to and including its end of file marker.
+func load(r io.Reader, store Target) ([]string, error) {
 
 	// Read and validate the header
 	header := make([]byte, 9)
-	if _, err := io.ReadFull(file, header); err != nil {
-		return err
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
 	}
 	if !bytes.HasPrefix(header, []byte("REDIS")) {
-		return errors.New("invalid RDB file format")
+		return nil, errors.New("invalid RDB file format")
 	}
 
-	// Skip Metadata and parse database section
+	var libraries []string
 	for {
 		var b byte
-		if err := binary.Read(file, binary.BigEndian, &b); err != nil {
-			return err
+		if err := binary.Read(r, binary.BigEndian, &b); err != nil {
+			return nil, err
 		}
 
 		switch b {
-		case 0xFE:
-			_, err := readSize(file) // Read the database index (size encoded)
+		case 0xFA: // Auxiliary field
+			key, err := readString(r)
 			if err != nil {
-				return err
+				return nil, err
 			}
-			if err := parseDatabaseSection(file, store); err != nil {
-				return err
+			value, err := readString(r)
+			if err != nil {
+				return nil, err
+			}
+			if key == functionAuxKey {
+				libraries = append(libraries, value)
+			}
+		case 0xF5: // Function library, as written by Redis itself
+			code, err := readString(r)
+			if err != nil {
+				return nil, err
+			}
+			libraries = append(libraries, code)
+		case 0xFE:
+			db, err := readDBIndex(r, store)
+			if err != nil {
+				return nil, err
 			}
+			// The database section runs until the end of file marker.
+			return libraries, parseDatabaseSection(r, store, db)
 		case 0xFF: // End of file section
+			return libraries, nil
+		default:
+			return nil, fmt.Errorf("unsupported opcode: 0x%x", b)
+		}
+	}
+}
+
+// checksumReader computes the checksum of the bytes read through it.
+type checksumReader struct {
+	r   io.Reader
+	crc uint64
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.crc = crc64(c.crc, p[:n])
+	return n, err
+}
+
+// verifyChecksum reads the checksum following the end of file marker and
+// compares it with crc, the checksum of everything before it. Files written
+// without checksum, which end at the marker or have a zero checksum like
+// Redis writes with rdbchecksum disabled, are accepted.
+func verifyChecksum(r io.Reader, crc uint64) error {
+	var checksum [8]byte
+	if _, err := io.ReadFull(r, checksum[:]); err != nil {
+		if err == io.EOF {
 			return nil
 		}
+		return fmt.Errorf("failed to read the RDB checksum: %w", err)
+	}
+	expected := binary.LittleEndian.Uint64(checksum[:])
+	if expected != 0 && expected != crc {
+		return fmt.Errorf("wrong RDB checksum expected: (%x) got: (%x)", expected, crc)
 	}
+	return nil
 }
 
-func parseDatabaseSection(file *os.File, store domain.Store) error {
+func parseDatabaseSection(r io.Reader, store Target, db int) error {
 	var currentExpiration *time.Time
 
 	for {
 		var b byte
-		if err := binary.Read(file, binary.BigEndian, &b); err != nil {
+		if err := binary.Read(r, binary.BigEndian, &b); err != nil {
 			return err
 		}
 
 		switch b {
 		case 0xFB: // Resizedb field, indicates hash table size information
 			// Skip the sizes of the hash table and the expire hash table
-			if _, err := readSize(file); err != nil {
+			if _, err := readSize(r); err != nil {
 				return err
 			}
-			if _, err := readSize(file); err != nil {
+			if _, err := readSize(r); err != nil {
 				return err
 			}
 
 		case 0xFD: // Expiry time in seconds
-			expiryTime, err := readUint32(file)
+			expiryTime, err := readUint32(r)
 			if err != nil {
 				return err
 			}
@@ -77,7 +160,7 @@ func parseDatabaseSection(file *os.File, store domain.Store) error {
 			currentExpiration = &exp
 
 		case 0xFC: // Expiry time in milliseconds
-			expiryTime, err := readUint64(file)
+			expiryTime, err := readUint64(r)
 			if err != nil {
 				return err
 			}
@@ -85,11 +168,11 @@ func parseDatabaseSection(file *os.File, store domain.Store) error {
 			currentExpiration = &exp
 
 		case 0x00: // Value type is string (assuming only string types for simplicity)
-			key, err := readString(file)
+			key, err := readString(r)
 			if err != nil {
 				return err
 			}
-			value, err := readString(file)
+			value, err := readString(r)
 			if err != nil {
 				return err
 			}
@@ -104,9 +187,16 @@ func parseDatabaseSection(file *os.File, store domain.Store) error {
 				}
 			}
 
-			store.Set(key, value, expiration)
+			store.Set(db, key, value, expiration)
 			currentExpiration = nil // Reset expiration for the next key
 
+		case 0xFE: // Start of the next database
+			next, err := readDBIndex(r, store)
+			if err != nil {
+				return err
+			}
+			db = next
+
 		case 0xFF: // End of database section or file
 			return nil
 
@@ -116,54 +206,179 @@ func parseDatabaseSection(file *os.File, store domain.Store) error {
 	}
 }
 
-func readSize(file *os.File) (uint64, error) {
-	var b byte
-	if err := binary.Read(file, binary.BigEndian, &b); err != nil {
+func readDBIndex(r io.Reader, store Target) (int, error) {
+	dbIndex, err := readSize(r) // Read the database index (size encoded)
+	if err != nil {
+		return 0, err
+	}
+	if dbIndex >= uint64(store.DBCount()) {
+		return 0, fmt.Errorf("database index %d out of range, only %d databases configured", dbIndex, store.DBCount())
+	}
+	return int(dbIndex), nil
+}
+
+func readSize(r io.Reader) (uint64, error) {
+	size, encoded, err := readLength(r)
+	if err != nil {
 		return 0, err
 	}
+	if encoded {
+		return 0, fmt.Errorf("unexpected special string encoding 0x%x", size)
+	}
+	return size, nil
+}
+
+// readLength reads a size encoded length. When encoded is true the value
+// isn't a length but the format of a specially encoded string.
+func readLength(r io.Reader) (uint64, bool, error) {
+	var b byte
+	if err := binary.Read(r, binary.BigEndian, &b); err != nil {
+		return 0, false, err
+	}
 
 	switch b >> 6 {
 	case 0x00:
-		return uint64(b & 0x3F), nil
+		return uint64(b & 0x3F), false, nil
 	case 0x01:
 		var b2 byte
-		if err := binary.Read(file, binary.BigEndian, &b2); err != nil {
-			return 0, err
+		if err := binary.Read(r, binary.BigEndian, &b2); err != nil {
+			return 0, false, err
 		}
-		return uint64(b&0x3F)<<8 | uint64(b2), nil
+		return uint64(b&0x3F)<<8 | uint64(b2), false, nil
 	case 0x02:
-		var size uint32
-		if err := binary.Read(file, binary.BigEndian, &size); err != nil {
-			return uint64(size), nil
+		switch b {
+		case 0x80:
+			var size uint32
+			if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+				return 0, false, err
+			}
+			return uint64(size), false, nil
+		case 0x81:
+			var size uint64
+			if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+				return 0, false, err
+			}
+			return size, false, nil
 		}
+		return 0, false, errors.New(fmt.Sprintf("invalid size encoding 0x%x", b))
 	default:
-		return 0, errors.New(fmt.Sprintf("invalid size encoding 0x%x", b))
+		return uint64(b & 0x3F), true, nil
 	}
-	return 0, nil
 }
 
-func readString(file *os.File) (string, error) {
-	size, err := readSize(file)
+// readString reads a string, which may be stored as raw bytes, as an
+// integer or LZF compressed. The bytes are returned untouched.
+func readString(r io.Reader) (string, error) {
+	size, encoded, err := readLength(r)
 	if err != nil {
 		return "", err
 	}
 
+	if encoded {
+		switch size {
+		case 0: // 8 bit integer
+			var v int8
+			err := binary.Read(r, binary.LittleEndian, &v)
+			return strconv.FormatInt(int64(v), 10), err
+		case 1: // 16 bit integer
+			var v int16
+			err := binary.Read(r, binary.LittleEndian, &v)
+			return strconv.FormatInt(int64(v), 10), err
+		case 2: // 32 bit integer
+			var v int32
+			err := binary.Read(r, binary.LittleEndian, &v)
+			return strconv.FormatInt(int64(v), 10), err
+		case 3:
+			return readLZFString(r)
+		default:
+			return "", fmt.Errorf("unknown string encoding %d", size)
+		}
+	}
+
 	data := make([]byte, size)
-	if _, err := io.ReadFull(file, data); err != nil {
+	if _, err := io.ReadFull(r, data); err != nil {
 		return "", err
 	}
 
 	return string(data), nil
 }
 
-func readUint64(file *os.File) (uint64, error) {
+func readLZFString(r io.Reader) (string, error) {
+	compressedLen, err := readSize(r)
+	if err != nil {
+		return "", err
+	}
+	length, err := readSize(r)
+	if err != nil {
+		return "", err
+	}
+
+	compressed := make([]byte, compressedLen)
+	if _, err := io.ReadFull(r, compressed); err != nil {
+		return "", err
+	}
+	data, err := lzfDecompress(compressed, int(length))
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// lzfDecompress expands LZF data, the compression Redis uses for strings
+// in RDB files, into a buffer of exactly length bytes.
+func lzfDecompress(in []byte, length int) ([]byte, error) {
+	out := make([]byte, 0, length)
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+		if ctrl < 32 {
+			// Literal run of ctrl+1 bytes.
+			n := ctrl + 1
+			if i+n > len(in) || len(out)+n > length {
+				return nil, errors.New("corrupt LZF literal run")
+			}
+			out = append(out, in[i:i+n]...)
+			i += n
+			continue
+		}
+
+		// Back reference of n bytes, ref bytes behind the end of out.
+		n := ctrl >> 5
+		if n == 7 {
+			if i >= len(in) {
+				return nil, errors.New("corrupt LZF back reference")
+			}
+			n += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return nil, errors.New("corrupt LZF back reference")
+		}
+		ref := len(out) - (ctrl&0x1f)<<8 - int(in[i]) - 1
+		i++
+		n += 2
+		if ref < 0 || len(out)+n > length {
+			return nil, errors.New("corrupt LZF back reference")
+		}
+		// Byte by byte, the reference may overlap the bytes being written.
+		for k := 0; k < n; k++ {
+			out = append(out, out[ref+k])
+		}
+	}
+	if len(out) != length {
+		return nil, errors.New("LZF length mismatch")
+	}
+	return out, nil
+}
+
+func readUint64(r io.Reader) (uint64, error) {
 	var v uint64
-	err := binary.Read(file, binary.LittleEndian, &v)
+	err := binary.Read(r, binary.LittleEndian, &v)
 	return v, err
 }
 
-func readUint32(file *os.File) (uint32, error) {
+func readUint32(r io.Reader) (uint32, error) {
 	var v uint32
-	err := binary.Read(file, binary.LittleEndian, &v)
+	err := binary.Read(r, binary.LittleEndian, &v)
 	return v, err
 }
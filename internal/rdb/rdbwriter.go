@@ -0,0 +1,206 @@
+package rdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/therahulbhati/go-redis-clone/internal/domain"
+)
+
+// rdbVersion is the RDB format version written, the one of Redis 7.2.
+const rdbVersion = 11
+
+// opcodeFunction precedes the code of a function library in DUMP payloads.
+const opcodeFunction = 0xF5
+
+// encoder writes RDB encoded values, keeping the running checksum. The first
+// error is kept and reported by Flush.
+type encoder struct {
+	w   *bufio.Writer
+	crc uint64
+	err error
+}
+
+func (e *encoder) write(p []byte) {
+	if e.err != nil {
+		return
+	}
+	e.crc = crc64(e.crc, p)
+	_, e.err = e.w.Write(p)
+}
+
+func (e *encoder) byte(b byte) {
+	e.write([]byte{b})
+}
+
+// length writes a size encoded length.
+func (e *encoder) length(n uint64) {
+	switch {
+	case n < 1<<6:
+		e.byte(byte(n))
+	case n < 1<<14:
+		e.write([]byte{byte(n>>8) | 0x40, byte(n)})
+	case n <= 0xFFFFFFFF:
+		var buf [5]byte
+		buf[0] = 0x80
+		binary.BigEndian.PutUint32(buf[1:], uint32(n))
+		e.write(buf[:])
+	default:
+		var buf [9]byte
+		buf[0] = 0x81
+		binary.BigEndian.PutUint64(buf[1:], n)
+		e.write(buf[:])
+	}
+}
+
+// string writes a length prefixed string. Strings are always stored raw,
+// without integer or LZF encoding.
+func (e *encoder) string(s string) {
+	e.length(uint64(len(s)))
+	e.write([]byte(s))
+}
+
+func (e *encoder) aux(key, value string) {
+	e.byte(0xFA)
+	e.string(key)
+	e.string(value)
+}
+
+// Write writes the contents of store, and the code of the given function
+// libraries as aux fields, to w as an RDB file.
+func Write(w io.Writer, store domain.Store, libraries []string) error {
+	e := &encoder{w: bufio.NewWriter(w)}
+	e.write([]byte(fmt.Sprintf("REDIS%04d", rdbVersion)))
+	e.aux("redis-ver", "7.2.0")
+	e.aux("redis-bits", strconv.Itoa(strconv.IntSize))
+	e.aux("ctime", strconv.FormatInt(time.Now().Unix(), 10))
+	for _, code := range libraries {
+		e.aux(functionAuxKey, code)
+	}
+
+	for db := 0; db < store.DBCount(); db++ {
+		if store.DBSize(db) == 0 {
+			continue
+		}
+		e.byte(0xFE)
+		e.length(uint64(db))
+		store.ForEach(db, func(key, value string, expiresAt time.Time) {
+			if !expiresAt.IsZero() {
+				var buf [9]byte
+				buf[0] = 0xFC
+				binary.LittleEndian.PutUint64(buf[1:], uint64(expiresAt.UnixMilli()))
+				e.write(buf[:])
+			}
+			e.byte(0x00) // String value
+			e.string(key)
+			e.string(value)
+		})
+	}
+	e.byte(0xFF)
+
+	var checksum [8]byte
+	binary.LittleEndian.PutUint64(checksum[:], e.crc)
+	e.write(checksum[:])
+	if e.err != nil {
+		return e.err
+	}
+	return e.w.Flush()
+}
+
+// SaveRDBFile writes an RDB file to a temporary file next to filePath and
+// renames it into place, so a crash never leaves a truncated file behind.
+func SaveRDBFile(filePath string, store domain.Store, libraries []string) error {
+	return writeFile(filePath, func(w io.Writer) error {
+		return Write(w, store, libraries)
+	})
+}
+
+// WriteFile writes an RDB file already encoded, like a snapshot, to
+// filePath the same way SaveRDBFile does.
+func WriteFile(filePath string, data []byte) error {
+	return writeFile(filePath, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+func writeFile(filePath string, write func(w io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), "temp-*.rdb")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filePath)
+}
+
+// DumpFunctions serializes function libraries in the format of FUNCTION
+// DUMP: the libraries followed by the RDB version and a CRC64 checksum.
+func DumpFunctions(libraries []string) []byte {
+	var buf bytes.Buffer
+	e := &encoder{w: bufio.NewWriter(&buf)}
+	for _, code := range libraries {
+		e.byte(opcodeFunction)
+		e.string(code)
+	}
+	var footer [2]byte
+	binary.LittleEndian.PutUint16(footer[:], rdbVersion)
+	e.write(footer[:])
+	var checksum [8]byte
+	binary.LittleEndian.PutUint64(checksum[:], e.crc)
+	e.write(checksum[:])
+	e.w.Flush()
+	return buf.Bytes()
+}
+
+// ErrBadPayload is returned for FUNCTION RESTORE payloads that weren't
+// produced by a compatible FUNCTION DUMP.
+var ErrBadPayload = errors.New("payload version or checksum are wrong")
+
+// RestoreFunctions parses a payload produced by DumpFunctions and returns
+// the code of the libraries it holds.
+func RestoreFunctions(payload []byte) ([]string, error) {
+	if len(payload) < 10 {
+		return nil, ErrBadPayload
+	}
+	body := payload[:len(payload)-10]
+	version := binary.LittleEndian.Uint16(payload[len(payload)-10:])
+	checksum := binary.LittleEndian.Uint64(payload[len(payload)-8:])
+	if version > rdbVersion || crc64(0, payload[:len(payload)-8]) != checksum {
+		return nil, ErrBadPayload
+	}
+
+	r := bytes.NewReader(body)
+	var libraries []string
+	for r.Len() > 0 {
+		opcode, _ := r.ReadByte()
+		if opcode != opcodeFunction {
+			return nil, fmt.Errorf("given type is not a function")
+		}
+		code, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		libraries = append(libraries, code)
+	}
+	return libraries, nil
+}
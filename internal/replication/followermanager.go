@@ -2,8 +2,11 @@ package replication
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
+	"github.com/therahulbhati/go-redis-clone/config"
 	"github.com/therahulbhati/go-redis-clone/internal/domain"
+	"github.com/therahulbhati/go-redis-clone/internal/tlsconfig"
 	"github.com/therahulbhati/go-redis-clone/pkg/resp"
 	"io"
 	"log"
@@ -15,36 +18,96 @@ import (
 )
 
 type Follower struct {
-	conn           net.Conn
-	port           string
-	store          domain.Store
-	reader         *bufio.Reader
-	replID         string
-	replOffset     int64
-	leaderHost     string
-	leaderPort     string
+	conn       net.Conn
+	port       string
+	store      domain.Store
+	reader     *bufio.Reader
+	respReader *resp.Reader
+	replID     string
+	replOffset int64
+	leaderHost string
+	leaderPort string
+	// masterUser and masterAuth are the credentials the follower
+	// authenticates to the leader with, like masteruser and masterauth.
+	masterUser string
+	masterAuth string
+	// tls secures the link to the leader, nil for a plain connection.
+	tls            *tlsconfig.Config
 	mu             sync.Mutex
 	commandHandler domain.CommandHandler
+	// client applies the commands streamed by the leader.
+	client *domain.Client
+
+	// statusMu guards status, which INFO reads while commands are applied.
+	statusMu sync.Mutex
+	status   domain.LeaderLinkStatus
 }
 
-// NewFollower creates a new follower manager.
-func NewFollower(store domain.Store, port, leaderHost, leaderPort string, commandHandler domain.CommandHandler) domain.FollowerManager {
+// ackInterval is how often the follower acknowledges its offset unasked,
+// which tells the leader it's alive.
+const ackInterval = time.Second
+
+// NewFollower creates a new follower manager replicating the leader of
+// cfg.ReplicaOfHost and cfg.ReplicaOfPort. It authenticates with
+// cfg.MasterAuth, as cfg.MasterUser or the default user when it's empty; no
+// authentication happens without a password. The leader is reached over TLS
+// when tlsConfig isn't nil.
+func NewFollower(store domain.Store, cfg *config.Config, tlsConfig *tlsconfig.Config, commandHandler domain.CommandHandler) domain.FollowerManager {
 	return &Follower{
-		port:           port,
+		port:           strconv.Itoa(cfg.Port),
 		store:          store,
-		leaderHost:     leaderHost,
-		leaderPort:     leaderPort,
+		leaderHost:     cfg.ReplicaOfHost,
+		leaderPort:     strconv.Itoa(cfg.ReplicaOfPort),
+		masterUser:     cfg.MasterUser,
+		masterAuth:     cfg.MasterAuth,
+		tls:            tlsConfig,
 		commandHandler: commandHandler,
+		status: domain.LeaderLinkStatus{
+			Host:   cfg.ReplicaOfHost,
+			Port:   cfg.ReplicaOfPort,
+			Offset: -1,
+		},
 	}
 }
 
+func (f *Follower) Status() domain.LeaderLinkStatus {
+	f.statusMu.Lock()
+	defer f.statusMu.Unlock()
+	return f.status
+}
+
+// setStatus updates the status under statusMu.
+func (f *Follower) setStatus(update func(status *domain.LeaderLinkStatus)) {
+	f.statusMu.Lock()
+	defer f.statusMu.Unlock()
+	update(&f.status)
+}
+
+// ConnectToLeader connects to the leader and loads its snapshot. It holds
+// f.mu, so no acknowledgment is sent in the middle of the handshake.
 func (f *Follower) ConnectToLeader() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.setStatus(func(status *domain.LeaderLinkStatus) {
+		status.Up, status.Syncing = false, true
+	})
+	defer f.setStatus(func(status *domain.LeaderLinkStatus) {
+		status.Syncing = false
+	})
+
 	var err error
-	f.conn, err = net.Dial("tcp", f.leaderHost+":"+f.leaderPort)
+	addr := net.JoinHostPort(f.leaderHost, f.leaderPort)
+	if f.tls != nil {
+		f.conn, err = f.tls.Dial(addr, f.leaderHost)
+	} else {
+		f.conn, err = net.Dial("tcp", addr)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to connect to leader: %w", err)
 	}
 	f.reader = bufio.NewReader(f.conn)
+	f.respReader = resp.NewReader(f.reader, resp.DefaultLimits())
+	f.client = f.commandHandler.NewClient(f.conn, true)
 
 	// Initiate the replication handshake
 	if err := f.initiateReplication(); err != nil {
@@ -59,38 +122,53 @@ func (f *Follower) initiateReplication() error {
 		return fmt.Errorf("connection is nil in initiateReplication")
 	}
 
+	// Authenticate first, a leader requiring a password refuses anything
+	// else.
+	if f.masterAuth != "" {
+		authCmd := []string{"AUTH", f.masterAuth}
+		if f.masterUser != "" {
+			authCmd = []string{"AUTH", f.masterUser, f.masterAuth}
+		}
+		if _, err := f.conn.Write([]byte(resp.EncodeRESPArray(authCmd))); err != nil {
+			return fmt.Errorf("failed to send AUTH: %w", err)
+		}
+		if _, err := f.readReply("AUTH"); err != nil {
+			return err
+		}
+	}
+
 	// Send PING command
 	pingCmd := resp.EncodeRESPArray([]string{"PING"})
 	if _, err := f.conn.Write([]byte(pingCmd)); err != nil {
 		return fmt.Errorf("failed to send PING: %w", err)
 	}
-	response, err := f.reader.ReadString('\n')
+	response, err := f.readReply("PING")
 	if err != nil {
-		return fmt.Errorf("failed to read PING response: %w", err)
+		return err
 	}
-	debugLog("Received response from leader: %s", response)
+	debugLog("Received response from leader: %s", response.Str)
 
 	// Send REPLCONF listening-port
 	replconfCmd := resp.EncodeRESPArray([]string{"REPLCONF", "listening-port", f.port})
 	if _, err := f.conn.Write([]byte(replconfCmd)); err != nil {
 		return fmt.Errorf("failed to send REPLCONF listening-port: %w", err)
 	}
-	response, err = f.reader.ReadString('\n')
+	response, err = f.readReply("REPLCONF listening-port")
 	if err != nil {
-		return fmt.Errorf("failed to read REPLCONF listening-port response: %w", err)
+		return err
 	}
-	debugLog("Received response from leader: %s", response)
+	debugLog("Received response from leader: %s", response.Str)
 
 	// Send REPLCONF capa psync2
 	replconfCapaCmd := resp.EncodeRESPArray([]string{"REPLCONF", "capa", "psync2"})
 	if _, err := f.conn.Write([]byte(replconfCapaCmd)); err != nil {
 		return fmt.Errorf("failed to send REPLCONF capa: %w", err)
 	}
-	response, err = f.reader.ReadString('\n')
+	response, err = f.readReply("REPLCONF capa")
 	if err != nil {
-		return fmt.Errorf("failed to read REPLCONF capa response: %w", err)
+		return err
 	}
-	debugLog("Received response from leader: %s", response)
+	debugLog("Received response from leader: %s", response.Str)
 
 	// Send PSYNC command
 	psyncCmd := resp.EncodeRESPArray([]string{"PSYNC", "?", "-1"})
@@ -99,15 +177,15 @@ func (f *Follower) initiateReplication() error {
 	}
 
 	// Read FULLRESYNC response
-	response, err = f.reader.ReadString('\n')
+	response, err = f.readReply("FULLRESYNC")
 	if err != nil {
-		return fmt.Errorf("failed to read FULLRESYNC response: %w", err)
+		return err
 	}
-	debugLog("Received response from leader: %s", response)
+	debugLog("Received response from leader: %s", response.Str)
 
-	parts := strings.Fields(strings.TrimSpace(response))
-	if len(parts) != 3 || parts[0] != "+FULLRESYNC" {
-		return fmt.Errorf("unexpected PSYNC response: %s", response)
+	parts := strings.Fields(response.Str)
+	if response.Type != resp.TypeSimpleString || len(parts) != 3 || parts[0] != "FULLRESYNC" {
+		return fmt.Errorf("unexpected PSYNC response: %s", response.Str)
 	}
 
 	f.replID = parts[1]
@@ -138,38 +216,92 @@ func (f *Follower) initiateReplication() error {
 	}
 
 	log.Printf("Successfully read RDB file of %d bytes", rdbSize)
+	if err := f.commandHandler.LoadSnapshot(bytes.NewReader(rdbContent)); err != nil {
+		return fmt.Errorf("failed to load RDB content: %w", err)
+	}
+	f.setStatus(func(status *domain.LeaderLinkStatus) {
+		status.Up = true
+		status.LastIO = time.Now()
+		status.ReplID = f.replID
+		status.Offset = f.replOffset
+	})
 
 	return nil
 }
 
+// readReply reads the leader's reply to a handshake step, turning error
+// replies into errors.
+func (f *Follower) readReply(step string) (resp.Value, error) {
+	reply, err := f.respReader.ReadValue()
+	if err != nil {
+		return resp.Value{}, fmt.Errorf("failed to read %s response: %w", step, err)
+	}
+	if reply.Type == resp.TypeError {
+		return resp.Value{}, fmt.Errorf("leader rejected %s: %s", step, reply.Str)
+	}
+	return reply, nil
+}
+
+// ReceiveAndProcessCommands applies the commands streamed by the leader. Any
+// read error breaks the stream, so the link is re-established, as it is when
+// the first connection attempt failed.
 func (f *Follower) ReceiveAndProcessCommands() {
 	debugLog("ReceiveAndProcessCommands started")
+	go f.acknowledge()
+	// The first attempt may have failed before or during the handshake.
+	if !f.Status().Up {
+		log.Println("Not connected to leader. Attempting to reconnect...")
+		f.reconnectToLeader()
+	}
 	for {
-		command, err := resp.ParseRESP(f.reader)
+		command, err := f.respReader.ReadCommand()
 		if err != nil {
-			if err == io.EOF {
+			f.setStatus(func(status *domain.LeaderLinkStatus) {
+				status.Up = false
+			})
+			if err == io.EOF || resp.IsProtocolError(err) {
 				log.Println("Connection to leader closed. Attempting to reconnect...")
-				f.reconnectToLeader()
-				continue
+			} else {
+				log.Printf("Error reading from leader: %v. Attempting to reconnect...", err)
 			}
-			log.Printf("Error parsing RESP: %v", err)
+			f.reconnectToLeader()
 			continue
 		}
-		debugLog("ReceiveAndProcessCommands: Follower processing command: %v", command)
+		debugLog("ReceiveAndProcessCommands: Follower processing command: %q", command)
 		f.ProcessReplicationCommand(command)
-		debugLog("ReceiveAndProcessCommands: Follower processed command: %v", command)
+		debugLog("ReceiveAndProcessCommands: Follower processed command: %q", command)
 	}
 }
 
+// Reconnection attempts are spaced by a delay doubling from
+// minReconnectDelay up to maxReconnectDelay, so an unreachable or flapping
+// leader isn't hammered.
+const (
+	minReconnectDelay = time.Second
+	maxReconnectDelay = 30 * time.Second
+)
+
+// reconnectToLeader drops the broken link and connects again, waiting
+// before every attempt until one succeeds.
 func (f *Follower) reconnectToLeader() {
+	delay := minReconnectDelay
 	for {
+		// Failed attempts may leave a connection behind too.
+		if f.client != nil {
+			f.commandHandler.RemoveClient(f.client)
+			f.client = nil
+		}
+		if f.conn != nil {
+			f.conn.Close()
+		}
+		time.Sleep(delay)
 		err := f.ConnectToLeader()
 		if err == nil {
 			log.Println("Reconnected to leader successfully")
 			return
 		}
-		log.Printf("Failed to reconnect to leader: %v. Retrying in 5 seconds...", err)
-		time.Sleep(5 * time.Second)
+		delay = min(delay*2, maxReconnectDelay)
+		log.Printf("Failed to reconnect to leader: %v. Retrying in %s...", err, delay)
 	}
 }
 
@@ -177,7 +309,7 @@ func (f *Follower) ProcessReplicationCommand(parts []string) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	debugLog("Follower processing command: %v", parts)
+	debugLog("Follower processing command: %q", parts)
 
 	switch strings.ToUpper(parts[0]) {
 
@@ -187,9 +319,27 @@ func (f *Follower) ProcessReplicationCommand(parts []string) {
 			f.sendAck()
 		}
 	default:
-		f.commandHandler.ProcessCommand(parts, f.conn)
+		f.commandHandler.ProcessCommand(f.client, parts)
 	}
 	f.replOffset += int64(len(resp.EncodeRESPArray(parts)))
+	f.setStatus(func(status *domain.LeaderLinkStatus) {
+		status.LastIO = time.Now()
+		status.Offset = f.replOffset
+	})
+}
+
+// acknowledge sends the offset to the leader every ackInterval while the
+// link is up, so it can report the follower's lag.
+func (f *Follower) acknowledge() {
+	ticker := time.NewTicker(ackInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		f.mu.Lock()
+		if f.Status().Up {
+			f.sendAck()
+		}
+		f.mu.Unlock()
+	}
 }
 
 func (f *Follower) sendAck() {
@@ -1,10 +1,9 @@
 package replication
 
 import (
-	"bufio"
-	"encoding/base64"
 	"fmt"
 	"github.com/therahulbhati/go-redis-clone/internal/domain"
+	"github.com/therahulbhati/go-redis-clone/internal/logging"
 	"github.com/therahulbhati/go-redis-clone/pkg/resp"
 	"io"
 	"net"
@@ -17,14 +16,25 @@ import (
 type Leader struct {
 	leaderReplID     string
 	leaderReplOffset int64
-	followers        []net.Conn
+	followers        []*followerLink
 	mu               sync.Mutex
-	ackChan          chan int64
-	lastWrite        int64
+	// ackSignal is closed and replaced whenever a follower acknowledges an
+	// offset, waking up every WAIT in progress.
+	ackSignal  chan struct{}
+	selectedDB int
+}
+
+// followerLink is a connected follower and the replication offset it last
+// acknowledged.
+type followerLink struct {
+	conn          net.Conn
+	listeningPort int
+	ackOffset     int64
+	lastAck       time.Time
 }
 
 func debugLog(format string, v ...interface{}) {
-	fmt.Printf("[DEBUG] "+format+"\n", v...)
+	logging.Debugf(format, v...)
 }
 
 // NewLeader creates a new leader manager.
@@ -32,9 +42,9 @@ func NewLeader() domain.LeaderManager {
 	return &Leader{
 		leaderReplID:     "8371b4fb1155b71f4a04d3e1bc3e18c4a990aeeb",
 		leaderReplOffset: 0,
-		followers:        make([]net.Conn, 0),
-		ackChan:          make(chan int64, 100),
-		lastWrite:        0,
+		followers:        make([]*followerLink, 0),
+		ackSignal:        make(chan struct{}),
+		selectedDB:       -1,
 	}
 }
 
@@ -43,34 +53,33 @@ func (l *Leader) GetLeaderReplID() string {
 }
 
 func (l *Leader) GetLeaderReplOffset() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 	return l.leaderReplOffset
 }
 
-func (l *Leader) SendFullResync(conn net.Conn) error {
+func (l *Leader) SendFullResync(conn net.Conn, rdbData []byte) error {
 	if conn == nil {
 		return fmt.Errorf("nil connection passed to SendFullResync")
 	}
 
 	// Send FULLRESYNC response
+	l.mu.Lock()
+	offset := l.leaderReplOffset
+	l.mu.Unlock()
 	fullResyncResponse := resp.EncodeRESPSimpleString(
-		fmt.Sprintf("FULLRESYNC %s %d", l.leaderReplID, l.leaderReplOffset))
+		fmt.Sprintf("FULLRESYNC %s %d", l.leaderReplID, offset))
 	_, err := conn.Write([]byte(fullResyncResponse))
 	if err != nil {
 		return fmt.Errorf("failed to send FULLRESYNC response: %w", err)
 	}
 
-	// Base64 representation of the empty RDB file
-	rdbBase64 := "UkVESVMwMDEx+glyZWRpcy12ZXIFNy4yLjD6CnJlZGlzLWJpdHPAQPoFY3RpbWXCbQi8ZfoIdXNlZC1tZW3CsMQQAPoIYW9mLWJhc2XAAP/wbjv+wP9aog=="
-
-	// Decode the Base64 string to binary
-	rdbData, err := base64.StdEncoding.DecodeString(rdbBase64)
-	if err != nil {
-		return fmt.Errorf("failed to decode base64 RDB data: %w", err)
-	}
-
-	data := strings.TrimRight(resp.EncodeRESPString(string(rdbData)), "\r\n")
+	// The payload is sent as "$<len>\r\n<bytes>" without a trailing CRLF.
+	// It is written verbatim, trimming anything would corrupt RDB files
+	// whose last bytes happen to be '\r' or '\n'.
+	data := append(resp.AppendPrefix(nil, resp.TypeBulkString, int64(len(rdbData))), rdbData...)
 	// Send the binary contents
-	_, err = conn.Write([]byte(data))
+	_, err = conn.Write(data)
 	if err != nil {
 		return fmt.Errorf("failed to send RDB contents: %w", err)
 	}
@@ -78,11 +87,15 @@ func (l *Leader) SendFullResync(conn net.Conn) error {
 	return nil
 }
 
-func (l *Leader) AddFollower(conn net.Conn) {
+func (l *Leader) AddFollower(conn net.Conn, listeningPort int) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	l.followers = append(l.followers, conn)
-	go l.readAcks(conn)
+	link := &followerLink{conn: conn, listeningPort: listeningPort, lastAck: time.Now()}
+	l.followers = append(l.followers, link)
+	// The new follower starts from an empty RDB on database 0, so force a
+	// SELECT before the next propagated command.
+	l.selectedDB = -1
+	go l.readAcks(link)
 	debugLog("Added new follower: %s", conn.RemoteAddr())
 }
 
@@ -92,106 +105,199 @@ func (l *Leader) GetFollowerCount() int {
 	return len(l.followers)
 }
 
-func (l *Leader) PropagateCommand(cmd []string) {
+func (l *Leader) Followers() []domain.FollowerInfo {
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	debugLog("Propagating command: %v", cmd)
-	encodedCmd := resp.EncodeRESPArray(cmd)
+	followers := make([]domain.FollowerInfo, 0, len(l.followers))
 	for _, follower := range l.followers {
-		_, err := follower.Write([]byte(encodedCmd))
-		if err != nil {
-			debugLog("Error propagating command to follower: %v", err)
+		ip := follower.conn.RemoteAddr().String()
+		if host, _, err := net.SplitHostPort(ip); err == nil {
+			ip = host
 		}
+		followers = append(followers, domain.FollowerInfo{
+			IP:        ip,
+			Port:      follower.listeningPort,
+			AckOffset: follower.ackOffset,
+			LastAck:   follower.lastAck,
+		})
 	}
-	l.leaderReplOffset += int64(len(encodedCmd))
-	l.lastWrite = l.leaderReplOffset
+	return followers
+}
+
+func (l *Leader) PropagateCommand(db int, cmd []string) int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	debugLog("Propagating command: %q", cmd)
+	l.writeToFollowers(l.appendCommand(nil, db, cmd))
 	debugLog("New leader replication offset: %d", l.leaderReplOffset)
+	return l.leaderReplOffset
 }
 
-func (l *Leader) sendReplconfGetack(conn net.Conn) error {
-	debugLog("Sending REPLCONF GETACK to follower %s", conn.RemoteAddr())
-	getackCmd := resp.EncodeRESPArray([]string{"REPLCONF", "GETACK", "*"})
-	_, err := conn.Write([]byte(getackCmd))
-	if err != nil {
-		debugLog("Error sending REPLCONF GETACK: %v", err)
-		return err
+func (l *Leader) PropagateTransaction(cmds []domain.ReplicatedCommand) int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(cmds) == 0 {
+		return l.leaderReplOffset
 	}
-	debugLog("REPLCONF GETACK sent successfully to %s", conn.RemoteAddr())
-	return nil
+	debugLog("Propagating transaction of %d commands", len(cmds))
+	// MULTI goes to the database of the first write, so the SELECT it
+	// needs is sent ahead of the block.
+	data := l.appendCommand(nil, cmds[0].DB, []string{"MULTI"})
+	for _, cmd := range cmds {
+		data = l.appendCommand(data, cmd.DB, cmd.Args)
+	}
+	data = resp.AppendStringArray(data, []string{"EXEC"})
+	l.writeToFollowers(data)
+	return l.leaderReplOffset
 }
 
-func (l *Leader) WaitForAcknowledgments(numReplicas int, timeout int) (int, error) {
-	debugLog("WaitForAcknowledgments called with numReplicas: %d, timeout: %d", numReplicas, timeout)
-	debugLog("Current follower count: %d", len(l.followers))
+// appendCommand encodes cmd, preceded by a SELECT when the followers have
+// another database selected. The caller must hold l.mu.
+func (l *Leader) appendCommand(dst []byte, db int, cmd []string) []byte {
+	if db != l.selectedDB {
+		dst = resp.AppendStringArray(dst, []string{"SELECT", strconv.Itoa(db)})
+		l.selectedDB = db
+	}
+	return resp.AppendStringArray(dst, cmd)
+}
 
+func (l *Leader) AckedReplicas(offset int64) int {
 	l.mu.Lock()
-	currentOffset := l.lastWrite
-	followers := l.followers
-	l.mu.Unlock()
+	defer l.mu.Unlock()
+	return l.countAcked(offset)
+}
+
+// writeToFollowers sends data to every follower and advances the
+// replication offset. The caller must hold l.mu, so that the stream and the
+// offset stay in step.
+func (l *Leader) writeToFollowers(data []byte) {
+	for _, follower := range l.followers {
+		if _, err := follower.conn.Write(data); err != nil {
+			debugLog("Error propagating command to follower: %v", err)
+		}
+	}
+	l.leaderReplOffset += int64(len(data))
+}
 
-	for _, follower := range followers {
-		if err := l.sendReplconfGetack(follower); err != nil {
-			debugLog("Failed to send GETACK to follower %s: %v", follower.RemoteAddr(), err)
+// countAcked returns how many followers acknowledged offset. The caller must
+// hold l.mu.
+func (l *Leader) countAcked(offset int64) int {
+	n := 0
+	for _, follower := range l.followers {
+		if follower.ackOffset >= offset {
+			n++
 		}
 	}
+	return n
+}
 
-	acks := 0
-	timeoutChan := time.After(time.Duration(timeout) * time.Millisecond)
-	debugLog("Waiting for ACKs, current offset: %d", currentOffset)
+// WaitForAcknowledgments waits until numReplicas followers acknowledged
+// offset or timeout milliseconds passed, and returns how many did. A timeout
+// of 0 waits forever.
+func (l *Leader) WaitForAcknowledgments(numReplicas int, offset int64, timeout int) (int, error) {
+	debugLog("WaitForAcknowledgments called with numReplicas: %d, offset: %d, timeout: %d", numReplicas, offset, timeout)
+
+	l.mu.Lock()
+	acked := l.countAcked(offset)
+	if acked >= numReplicas {
+		l.mu.Unlock()
+		return acked, nil
+	}
+	// GETACK travels through the replication stream like any command, so
+	// it is counted in the offset too.
+	debugLog("Sending REPLCONF GETACK to %d followers", len(l.followers))
+	l.writeToFollowers(resp.AppendStringArray(nil, []string{"REPLCONF", "GETACK", "*"}))
+	signal := l.ackSignal
+	l.mu.Unlock()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(time.Duration(timeout) * time.Millisecond)
+		defer timer.Stop()
+		expired = timer.C
+	}
 
 	for {
 		select {
-		case offset := <-l.ackChan:
-			debugLog("Received ACK with offset %d, current offset is %d", offset, currentOffset)
-			if offset >= currentOffset {
-				acks++
-				debugLog("Valid ACK received. Total: %d/%d", acks, numReplicas)
-				if acks >= numReplicas {
-					debugLog("Received all required ACKs")
-					return acks, nil
-				}
-			}
-		case <-timeoutChan:
-			debugLog("Timeout reached. Received %d/%d ACKs", acks, numReplicas)
-			return acks, nil
+		case <-signal:
+		case <-expired:
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			acked = l.countAcked(offset)
+			debugLog("Timeout reached. Received %d/%d ACKs", acked, numReplicas)
+			return acked, nil
+		}
+
+		l.mu.Lock()
+		acked = l.countAcked(offset)
+		signal = l.ackSignal
+		l.mu.Unlock()
+		debugLog("ACKs for offset %d: %d/%d", offset, acked, numReplicas)
+		if acked >= numReplicas {
+			return acked, nil
 		}
 	}
 }
 
-func (l *Leader) readAcks(conn net.Conn) {
-	reader := bufio.NewReader(conn)
+// recordAck stores the offset a follower acknowledged and wakes up waiters.
+func (l *Leader) recordAck(link *followerLink, offset int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if offset > link.ackOffset {
+		link.ackOffset = offset
+	}
+	link.lastAck = time.Now()
+	close(l.ackSignal)
+	l.ackSignal = make(chan struct{})
+}
+
+// removeFollower forgets a follower whose link was closed.
+func (l *Leader) removeFollower(link *followerLink) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, follower := range l.followers {
+		if follower == link {
+			l.followers = append(l.followers[:i], l.followers[i+1:]...)
+			break
+		}
+	}
+	close(l.ackSignal)
+	l.ackSignal = make(chan struct{})
+}
+
+func (l *Leader) readAcks(link *followerLink) {
+	conn := link.conn
+	defer l.removeFollower(link)
+	reader := resp.NewReader(conn, resp.DefaultLimits())
 	for {
 		if err := conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond)); err != nil {
 			debugLog("Error setting read deadline: %v", err)
 			return
 		}
 
-		response, err := resp.ParseRESP(reader)
-		debugLog("Received response from follower %s: %v", conn.RemoteAddr(), response)
+		response, err := reader.ReadCommand()
 		if err != nil {
-			if err == io.EOF {
-				debugLog("Connection closed for follower %s", conn.RemoteAddr())
+			if err == io.EOF || resp.IsProtocolError(err) {
+				debugLog("Connection closed for follower %s: %v", conn.RemoteAddr(), err)
 				return
 			}
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				continue
+			}
 			debugLog("Error reading from follower %s: %v", conn.RemoteAddr(), err)
-			continue
+			return
 		}
 
-		debugLog("Received response from follower %s: %v", conn.RemoteAddr(), response)
+		debugLog("Received response from follower %s: %q", conn.RemoteAddr(), response)
 
-		if len(response) == 3 && response[0] == "REPLCONF" && response[1] == "ACK" {
+		if len(response) == 3 && strings.EqualFold(response[0], "REPLCONF") && strings.EqualFold(response[1], "ACK") {
 			offset, err := strconv.ParseInt(response[2], 10, 64)
 			if err != nil {
 				debugLog("Invalid ACK offset from follower %s: %v", conn.RemoteAddr(), err)
 				continue
 			}
 			debugLog("Valid ACK received from follower %s with offset %d", conn.RemoteAddr(), offset)
-			select {
-			case l.ackChan <- offset:
-				debugLog("ACK sent to channel for follower %s", conn.RemoteAddr())
-			default:
-				debugLog("ACK channel full, discarding ACK from follower %s", conn.RemoteAddr())
-			}
+			l.recordAck(link, offset)
 		}
 	}
 }
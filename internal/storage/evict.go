@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"math"
+	"math/rand/v2"
+	"strings"
+	"time"
+)
+
+// entryOverhead approximates the memory a key takes besides its name and
+// value: the map slot, the index bucket slot and the entry header.
+const entryOverhead = 64
+
+// entrySize estimates the memory taken by key and its entry.
+func entrySize(key string, entry Entry) int64 {
+	size := int64(len(key) + len(entry.Value) + entryOverhead)
+	if entry.Expiration != nil {
+		size += 24
+	}
+	return size
+}
+
+// account adds, with sign 1, or removes, with sign -1, the entry of key
+// from the memory and volatile key counts.
+func (sh *shard) account(key string, entry Entry, sign int) {
+	size := int64(sign) * entrySize(key, entry)
+	sh.bytes += size
+	sh.used.Add(size)
+	if entry.Expiration != nil {
+		sh.volatile += sign
+	}
+}
+
+func (s *inMemoryStore) UsedMemory() int64 {
+	return s.used.Load()
+}
+
+// Evict samples keys like Redis does rather than keeping them ordered:
+// every eviction compares samples keys picked at random among the
+// candidates of policy and removes the best one.
+func (s *inMemoryStore) Evict(maxMemory int64, policy string, samples int) bool {
+	if policy == "noeviction" {
+		return s.used.Load() <= maxMemory
+	}
+	volatileOnly := strings.HasPrefix(policy, "volatile-")
+	for s.used.Load() > maxMemory {
+		sh, key, ok := s.sample(policy, volatileOnly, samples)
+		if !ok {
+			return false
+		}
+		sh.mu.Lock()
+		if _, exists := sh.data[key]; exists {
+			sh.delete(key)
+			sh.notify("evicted", key)
+		}
+		sh.mu.Unlock()
+	}
+	return true
+}
+
+// sample picks up to samples candidates, starting from a random shard, and
+// returns the one to evict first according to policy. It reports false
+// when there is no candidate at all.
+func (s *inMemoryStore) sample(policy string, volatileOnly bool, samples int) (*shard, string, bool) {
+	if strings.HasSuffix(policy, "-random") {
+		samples = 1
+	}
+	shardsPerDB := 1 << s.shardBits
+	total := len(s.dbs) * shardsPerDB
+	start := rand.IntN(total)
+	now := time.Now()
+
+	var best *shard
+	var bestKey string
+	bestScore := int64(math.MinInt64)
+	found := 0
+	for i := 0; i < total && found < samples; i++ {
+		n := (start + i) % total
+		sh := s.dbs[n/shardsPerDB].shards[n%shardsPerDB]
+		sh.mu.Lock()
+		if volatileOnly && sh.volatile == 0 {
+			sh.mu.Unlock()
+			continue
+		}
+		// Map iteration starts at a random position.
+		for key, entry := range sh.data {
+			if volatileOnly && entry.Expiration == nil {
+				continue
+			}
+			if score := evictionScore(policy, entry, now); best == nil || score > bestScore {
+				best, bestKey, bestScore = sh, key, score
+			}
+			found++
+			if found >= samples {
+				break
+			}
+		}
+		sh.mu.Unlock()
+	}
+	return best, bestKey, best != nil
+}
+
+// evictionScore ranks entry for policy, the highest score being evicted
+// first: the longest idle for LRU, the least read for LFU and the closest
+// to expire for volatile-ttl.
+func evictionScore(policy string, entry Entry, now time.Time) int64 {
+	switch {
+	case strings.HasSuffix(policy, "-lru"):
+		return now.UnixNano() - entry.accessed
+	case strings.HasSuffix(policy, "-lfu"):
+		return -int64(entry.hits)
+	case policy == "volatile-ttl":
+		return -entry.Expiration.UnixNano()
+	default:
+		return 0
+	}
+}
@@ -1,56 +1,421 @@
 package storage
 
 import (
-	"fmt"
+	"math/bits"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/therahulbhati/go-redis-clone/internal/domain"
+	"github.com/therahulbhati/go-redis-clone/pkg/utils"
 )
 
+// inMemoryStore splits every logical database into a power-of-two number of
+// independently locked shards, picked by the key hash. Single-key commands
+// only ever take the lock of the shard owning their key. Operations spanning
+// several shards (MOVE, SWAPDB, FLUSHDB, FLUSHALL) take every lock they need
+// up front, always in ascending shard id order, so they can't deadlock with
+// each other.
 type inMemoryStore struct {
-	data map[string]Entry
-	mu   sync.Mutex
+	dbs       []*database
+	shardBits uint
+	events    *keyEvents
+	// used is the memory taken by the keys of every shard, as estimated by
+	// entrySize.
+	used atomic.Int64
+}
+
+// database is one logical database selected with SELECT.
+type database struct {
+	shards []*shard
+}
+
+type shard struct {
+	// id orders the shard across the whole store for lockShards.
+	id    int
+	db    int
+	data  map[string]Entry
+	index *keyIndex
+	// events forwards the keyspace events raised by the store.
+	events *keyEvents
+	// watched tracks the keys of this shard watched with WATCH.
+	watched map[string]*watchedKey
+	// bytes is the memory taken by the keys of the shard and volatile the
+	// number of them with an expiration. used is the total of the store.
+	bytes    int64
+	volatile int
+	used     *atomic.Int64
+	mu       sync.Mutex
+}
+
+// watchedKey counts the clients watching a key and how often it changed
+// since the first of them started.
+type watchedKey struct {
+	refs    int
+	version uint64
 }
 
 type Entry struct {
 	Value      string
 	Expiration *time.Time
+	// accessed is the time of the last access in nanoseconds and hits the
+	// number of reads, which the LRU and LFU eviction policies go by.
+	accessed int64
+	hits     uint32
+}
+
+// Type returns the Redis type name of the entry.
+func (e Entry) Type() string {
+	return "string"
+}
+
+func (e Entry) expired(now time.Time) bool {
+	return e.Expiration != nil && now.After(*e.Expiration)
 }
 
-// NewInMemoryStore creates a new in-memory store.
-func NewInMemoryStore() domain.Store {
-	return &inMemoryStore{
-		data: make(map[string]Entry),
+// NewInMemoryStore creates a new in-memory store with the given number of
+// logical databases, each split into shards shards. shards is rounded up to
+// a power of two.
+func NewInMemoryStore(databases, shards int) domain.Store {
+	shardBits := uint(0)
+	if shards > 1 {
+		shardBits = uint(bits.Len(uint(shards - 1)))
+	}
+
+	s := &inMemoryStore{
+		dbs:       make([]*database, databases),
+		shardBits: shardBits,
+		events:    &keyEvents{},
 	}
+	n := 1 << shardBits
+	for i := range s.dbs {
+		d := &database{shards: make([]*shard, n)}
+		for j := range d.shards {
+			d.shards[j] = &shard{
+				id:     i*n + j,
+				db:     i,
+				data:   make(map[string]Entry),
+				index:  newKeyIndex(),
+				events: s.events,
+				used:   &s.used,
+			}
+		}
+		s.dbs[i] = d
+	}
+	return s
+}
+
+// shardFor picks the shard from the high bits of the hash, leaving the low
+// bits for the bucket index inside the shard.
+func (s *inMemoryStore) shardFor(db int, key string) *shard {
+	if s.shardBits == 0 {
+		return s.dbs[db].shards[0]
+	}
+	return s.dbs[db].shards[hashKey(key)>>(64-s.shardBits)]
+}
+
+func (s *inMemoryStore) DBCount() int {
+	return len(s.dbs)
 }
 
-func (s *inMemoryStore) Set(key, value string, px time.Duration) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+func (s *inMemoryStore) Set(db int, key, value string, px time.Duration) {
 	var expirationPtr *time.Time
 	if px > 0 {
 		expiration := time.Now().Add(px)
 		expirationPtr = &expiration
 	}
-	fmt.Println("expirationPtr: ", expirationPtr)
-	s.data[key] = Entry{Value: value, Expiration: expirationPtr}
 
+	sh := s.shardFor(db, key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	// An expired key is gone before being replaced, like in Redis.
+	now := time.Now()
+	sh.expireIfNeeded(key, now)
+	sh.put(key, Entry{Value: value, Expiration: expirationPtr, accessed: now.UnixNano()})
 }
 
-func (s *inMemoryStore) Get(key string) (string, bool) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+func (s *inMemoryStore) Get(db int, key string) (string, bool) {
+	sh := s.shardFor(db, key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
 
-	entry, exists := s.data[key]
+	entry, exists := sh.data[key]
 	if !exists {
 		return "", false
 	}
 
-	if entry.Expiration != nil && time.Now().After(*entry.Expiration) {
-		delete(s.data, key)
+	now := time.Now()
+	if entry.expired(now) {
+		sh.expire(key)
 		return "", false
 	}
 
+	entry.accessed = now.UnixNano()
+	entry.hits++
+	sh.data[key] = entry
 	return entry.Value, true
 }
+
+// Keys visits one shard at a time so it never holds more than a single
+// shard lock.
+func (s *inMemoryStore) Keys(db int, pattern string) []string {
+	now := time.Now()
+	matchAll := pattern == "*"
+	keys := make([]string, 0)
+	for _, sh := range s.dbs[db].shards {
+		sh.mu.Lock()
+		for key, entry := range sh.data {
+			if entry.expired(now) {
+				continue
+			}
+			if matchAll || utils.GlobMatch(pattern, key, false) {
+				keys = append(keys, key)
+			}
+		}
+		sh.mu.Unlock()
+	}
+	return keys
+}
+
+// Scan walks the shards in order. The low shardBits of the cursor hold the
+// shard being visited and the remaining bits the bucket cursor inside it.
+func (s *inMemoryStore) Scan(db int, cursor uint64, match string, count int, keyType string) (uint64, []string) {
+	shards := s.dbs[db].shards
+	shardMask := uint64(len(shards) - 1)
+	shardIdx := cursor & shardMask
+	bucketCursor := cursor >> s.shardBits
+
+	now := time.Now()
+	keys := make([]string, 0, count)
+	// Bound the work done on sparse tables, like Redis does.
+	maxIterations := count * 10
+	for {
+		sh := shards[shardIdx]
+		sh.mu.Lock()
+		var expired []string
+		if sh.index.size == 0 {
+			// Empty shards are skipped without counting against the budget.
+			bucketCursor = 0
+		}
+		for bucketCursor != 0 || sh.index.size > 0 {
+			bucketCursor = sh.index.scan(bucketCursor, func(key string) {
+				entry := sh.data[key]
+				if entry.expired(now) {
+					expired = append(expired, key)
+					return
+				}
+				if match != "" && !utils.GlobMatch(match, key, false) {
+					return
+				}
+				if keyType != "" && entry.Type() != keyType {
+					return
+				}
+				keys = append(keys, key)
+			})
+			maxIterations--
+			if bucketCursor == 0 || len(keys) >= count || maxIterations <= 0 {
+				break
+			}
+		}
+		for _, key := range expired {
+			sh.expire(key)
+		}
+		sh.mu.Unlock()
+
+		if bucketCursor == 0 {
+			shardIdx++
+			if shardIdx > shardMask {
+				return 0, keys
+			}
+		}
+		if len(keys) >= count || maxIterations <= 0 {
+			return bucketCursor<<s.shardBits | shardIdx, keys
+		}
+	}
+}
+
+func (s *inMemoryStore) Move(src, dst int, key string) bool {
+	if src == dst {
+		return false
+	}
+	from, to := s.shardFor(src, key), s.shardFor(dst, key)
+	unlock := lockShards([]*shard{from, to})
+	defer unlock()
+
+	now := time.Now()
+	entry, exists := from.data[key]
+	if !exists {
+		return false
+	}
+	if entry.expired(now) {
+		from.expire(key)
+		return false
+	}
+	if existing, exists := to.data[key]; exists {
+		if !existing.expired(now) {
+			return false
+		}
+		to.expire(key)
+	}
+
+	from.delete(key)
+	to.put(key, entry)
+	return true
+}
+
+// SwapDB swaps the contents of every shard pair. Both databases use the same
+// shard layout, so each key keeps living in the shard its hash points to.
+func (s *inMemoryStore) SwapDB(a, b int) {
+	if a == b {
+		return
+	}
+	first, second := s.dbs[a].shards, s.dbs[b].shards
+	unlock := lockShards(append(append([]*shard{}, first...), second...))
+	defer unlock()
+
+	for i := range first {
+		first[i].data, second[i].data = second[i].data, first[i].data
+		first[i].index, second[i].index = second[i].index, first[i].index
+		first[i].bytes, second[i].bytes = second[i].bytes, first[i].bytes
+		first[i].volatile, second[i].volatile = second[i].volatile, first[i].volatile
+		// Watched keys stay with their database, so a key present on
+		// either side just changed.
+		first[i].touchWatched(first[i].data, second[i].data)
+		second[i].touchWatched(first[i].data, second[i].data)
+	}
+}
+
+// FlushDB and FlushAll only drop the references to the old tables, which the
+// garbage collector frees in the background. That is the ASYNC behaviour
+// already, the caller never pays for the teardown, so async changes nothing.
+func (s *inMemoryStore) FlushDB(db int, async bool) {
+	s.flush(s.dbs[db].shards)
+}
+
+func (s *inMemoryStore) FlushAll(async bool) {
+	var shards []*shard
+	for _, d := range s.dbs {
+		shards = append(shards, d.shards...)
+	}
+	s.flush(shards)
+}
+
+func (s *inMemoryStore) flush(shards []*shard) {
+	unlock := lockShards(shards)
+	defer unlock()
+	for _, sh := range shards {
+		sh.touchWatched(sh.data)
+		sh.data = make(map[string]Entry)
+		sh.index = newKeyIndex()
+		sh.used.Add(-sh.bytes)
+		sh.bytes, sh.volatile = 0, 0
+	}
+}
+
+// ForEach visits one shard at a time, holding its lock while calling fn.
+func (s *inMemoryStore) ForEach(db int, fn func(key, value string, expiresAt time.Time)) {
+	now := time.Now()
+	for _, sh := range s.dbs[db].shards {
+		sh.mu.Lock()
+		for key, entry := range sh.data {
+			if entry.expired(now) {
+				continue
+			}
+			var expiresAt time.Time
+			if entry.Expiration != nil {
+				expiresAt = *entry.Expiration
+			}
+			fn(key, entry.Value, expiresAt)
+		}
+		sh.mu.Unlock()
+	}
+}
+
+func (s *inMemoryStore) DBSize(db int) int {
+	size := 0
+	for _, sh := range s.dbs[db].shards {
+		sh.mu.Lock()
+		size += len(sh.data)
+		sh.mu.Unlock()
+	}
+	return size
+}
+
+// avgTTLSamples is how many keys with an expiration per shard KeyspaceStats
+// averages the time to live of.
+const avgTTLSamples = 16
+
+func (s *inMemoryStore) KeyspaceStats(db int) (keys, expires int, avgTTL time.Duration) {
+	now := time.Now()
+	var total time.Duration
+	sampled := 0
+	for _, sh := range s.dbs[db].shards {
+		sh.mu.Lock()
+		keys += len(sh.data)
+		expires += sh.volatile
+		n := 0
+		for _, entry := range sh.data {
+			if sh.volatile == 0 || n == avgTTLSamples {
+				break
+			}
+			if entry.Expiration == nil || !entry.Expiration.After(now) {
+				continue
+			}
+			total += entry.Expiration.Sub(now)
+			n++
+		}
+		sampled += n
+		sh.mu.Unlock()
+	}
+	if sampled > 0 {
+		avgTTL = total / time.Duration(sampled)
+	}
+	return keys, expires, avgTTL
+}
+
+// lockShards locks the given shards in ascending id order, skipping
+// duplicates, and returns a function releasing them.
+func lockShards(shards []*shard) func() {
+	sorted := make([]*shard, 0, len(shards))
+	sorted = append(sorted, shards...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].id < sorted[j].id })
+
+	locked := sorted[:0]
+	for _, sh := range sorted {
+		if len(locked) > 0 && locked[len(locked)-1] == sh {
+			continue
+		}
+		sh.mu.Lock()
+		locked = append(locked, sh)
+	}
+	return func() {
+		for i := len(locked) - 1; i >= 0; i-- {
+			locked[i].mu.Unlock()
+		}
+	}
+}
+
+func (sh *shard) put(key string, entry Entry) {
+	old, exists := sh.data[key]
+	if exists {
+		sh.account(key, old, -1)
+	} else {
+		sh.index.add(key)
+	}
+	sh.data[key] = entry
+	sh.account(key, entry, 1)
+	sh.touch(key)
+	if !exists {
+		sh.notify("new", key)
+	}
+}
+
+func (sh *shard) delete(key string) {
+	if entry, exists := sh.data[key]; exists {
+		sh.account(key, entry, -1)
+	}
+	delete(sh.data, key)
+	sh.index.remove(key)
+	sh.touch(key)
+}
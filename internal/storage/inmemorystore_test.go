@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+// BenchmarkStoreParallel measures the throughput of a GET/SET mix from many
+// concurrent clients at several shard counts. A single shard takes one lock
+// for the whole database, like the store did before it was sharded, so
+// shards=1 is the baseline the other counts are compared to:
+//
+//	go test ./internal/storage -run XXX -bench StoreParallel -cpu 1,8,32
+func BenchmarkStoreParallel(b *testing.B) {
+	const keys = 100000
+	names := make([]string, keys)
+	for i := range names {
+		names[i] = "key:" + strconv.Itoa(i)
+	}
+
+	for _, shards := range []int{1, 4, 16, 64} {
+		for _, writes := range []int{0, 20, 50} {
+			b.Run(fmt.Sprintf("shards=%d/writes=%d%%", shards, writes), func(b *testing.B) {
+				store := NewInMemoryStore(1, shards)
+				for _, name := range names {
+					store.Set(0, name, "value", -1)
+				}
+				// Several clients per CPU, as a busy server has.
+				b.SetParallelism(4)
+				var seeds atomic.Uint64
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					seed := seeds.Add(1)*0x9E3779B97F4A7C15 + 1
+					for pb.Next() {
+						// xorshift keeps the key choice cheap and free of
+						// shared state.
+						seed ^= seed << 13
+						seed ^= seed >> 7
+						seed ^= seed << 17
+						key := names[seed%keys]
+						if int(seed>>32%100) < writes {
+							store.Set(0, key, "value", -1)
+						} else {
+							store.Get(0, key)
+						}
+					}
+				})
+			})
+		}
+	}
+}
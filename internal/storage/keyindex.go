@@ -0,0 +1,85 @@
+package storage
+
+import "math/bits"
+
+const minIndexBuckets = 4
+
+// keyIndex mirrors the keys of the store in a power-of-two bucket table so
+// SCAN can walk it with a reverse-binary cursor. Go maps give no stable
+// iteration order, whereas this cursor keeps visiting every key that stays in
+// the table for the whole iteration, even when the table grows or shrinks
+// between calls.
+type keyIndex struct {
+	buckets [][]string
+	size    int
+}
+
+func newKeyIndex() *keyIndex {
+	return &keyIndex{buckets: make([][]string, minIndexBuckets)}
+}
+
+// hashKey is an inlined 64-bit FNV-1a so hashing doesn't allocate.
+func hashKey(key string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= 1099511628211
+	}
+	return h
+}
+
+func (ix *keyIndex) add(key string) {
+	i := hashKey(key) & uint64(len(ix.buckets)-1)
+	ix.buckets[i] = append(ix.buckets[i], key)
+	ix.size++
+	if ix.size > len(ix.buckets) {
+		ix.resize(len(ix.buckets) * 2)
+	}
+}
+
+func (ix *keyIndex) remove(key string) {
+	i := hashKey(key) & uint64(len(ix.buckets)-1)
+	bucket := ix.buckets[i]
+	for j, k := range bucket {
+		if k == key {
+			last := len(bucket) - 1
+			bucket[j] = bucket[last]
+			bucket[last] = ""
+			ix.buckets[i] = bucket[:last]
+			ix.size--
+			break
+		}
+	}
+	if len(ix.buckets) > minIndexBuckets && ix.size*8 < len(ix.buckets) {
+		ix.resize(len(ix.buckets) / 2)
+	}
+}
+
+func (ix *keyIndex) resize(n int) {
+	buckets := make([][]string, n)
+	mask := uint64(n - 1)
+	for _, bucket := range ix.buckets {
+		for _, key := range bucket {
+			i := hashKey(key) & mask
+			buckets[i] = append(buckets[i], key)
+		}
+	}
+	ix.buckets = buckets
+}
+
+// scan calls fn for every key in the bucket addressed by cursor and returns
+// the next cursor, or 0 once the whole table has been visited. fn must not
+// modify the index.
+func (ix *keyIndex) scan(cursor uint64, fn func(key string)) uint64 {
+	mask := uint64(len(ix.buckets) - 1)
+	for _, key := range ix.buckets[cursor&mask] {
+		fn(key)
+	}
+
+	// Increment the masked bits starting from the most significant one, so
+	// buckets that split or merge on resize are never skipped.
+	cursor |= ^mask
+	cursor = bits.Reverse64(cursor)
+	cursor++
+	return bits.Reverse64(cursor)
+}
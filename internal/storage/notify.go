@@ -0,0 +1,41 @@
+package storage
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// keyEventListener receives the keyspace events raised by the store itself
+// rather than by a command: "new", "expired" and "evicted".
+type keyEventListener func(db int, event, key string)
+
+// keyEvents holds the listener registered with OnKeyEvent. It's shared by
+// every shard and may be replaced while the store is in use.
+type keyEvents struct {
+	listener atomic.Pointer[keyEventListener]
+}
+
+func (s *inMemoryStore) OnKeyEvent(fn func(db int, event, key string)) {
+	listener := keyEventListener(fn)
+	s.events.listener.Store(&listener)
+}
+
+// notify raises event for key. It's called with the shard lock held, so the
+// listener must not call back into the store.
+func (sh *shard) notify(event, key string) {
+	if listener := sh.events.listener.Load(); listener != nil {
+		(*listener)(sh.db, event, key)
+	}
+}
+
+// expire removes a key past its expiration.
+func (sh *shard) expire(key string) {
+	sh.delete(key)
+	sh.notify("expired", key)
+}
+
+func (sh *shard) expireIfNeeded(key string, now time.Time) {
+	if entry, ok := sh.data[key]; ok && entry.expired(now) {
+		sh.expire(key)
+	}
+}
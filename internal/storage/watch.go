@@ -0,0 +1,75 @@
+package storage
+
+import "time"
+
+// Watch starts tracking key for WATCH. Keys already past their expiration
+// are removed first, so a key expiring later counts as a modification.
+func (s *inMemoryStore) Watch(db int, key string) uint64 {
+	sh := s.shardFor(db, key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	sh.expireIfNeeded(key, time.Now())
+	if sh.watched == nil {
+		sh.watched = make(map[string]*watchedKey)
+	}
+	w, ok := sh.watched[key]
+	if !ok {
+		w = &watchedKey{}
+		sh.watched[key] = w
+	}
+	w.refs++
+	return w.version
+}
+
+func (s *inMemoryStore) Unwatch(db int, key string) {
+	sh := s.shardFor(db, key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	w, ok := sh.watched[key]
+	if !ok {
+		return
+	}
+	w.refs--
+	if w.refs == 0 {
+		delete(sh.watched, key)
+	}
+}
+
+// KeyVersion expires key if its time has come, which bumps the version like
+// any other modification, and returns the version.
+func (s *inMemoryStore) KeyVersion(db int, key string) uint64 {
+	sh := s.shardFor(db, key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	sh.expireIfNeeded(key, time.Now())
+	if w, ok := sh.watched[key]; ok {
+		return w.version
+	}
+	return 0
+}
+
+// touch records a modification of key for its watchers.
+func (sh *shard) touch(key string) {
+	if len(sh.watched) == 0 {
+		return
+	}
+	if w, ok := sh.watched[key]; ok {
+		w.version++
+	}
+}
+
+// touchWatched touches every watched key present in any of tables, for
+// operations replacing a whole table.
+func (sh *shard) touchWatched(tables ...map[string]Entry) {
+	for key, w := range sh.watched {
+		for _, data := range tables {
+			if _, ok := data[key]; ok {
+				w.version++
+				break
+			}
+		}
+	}
+}
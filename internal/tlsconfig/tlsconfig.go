@@ -0,0 +1,208 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Settings are the files and options TLS is configured with, named after
+// the tls-* parameters of Redis.
+type Settings struct {
+	CertFile string
+	KeyFile  string
+	// ClientCertFile and ClientKeyFile are presented to the leader by
+	// followers. CertFile and KeyFile are used when they are empty.
+	ClientCertFile string
+	ClientKeyFile  string
+	// CACertFile and CACertDir hold the CA certificates peers are verified
+	// against.
+	CACertFile string
+	CACertDir  string
+	// AuthClients is "yes" to require a client certificate, "optional" to
+	// verify it only when one is sent, or "no".
+	AuthClients string
+	// AuthClientsUser is "CN" to authenticate clients as the ACL user named
+	// by the common name of their certificate, or "off".
+	AuthClientsUser string
+}
+
+// DefaultSettings returns the defaults of Redis: client certificates are
+// required, but don't authenticate.
+func DefaultSettings() Settings {
+	return Settings{AuthClients: "yes", AuthClientsUser: "off"}
+}
+
+// Config is the TLS configuration of the listeners and of the link to the
+// leader. Reloading it swaps the certificates for new connections without
+// touching the established ones.
+type Config struct {
+	// mu serializes updates, which replace settings, server and client.
+	mu       sync.Mutex
+	settings Settings
+	server   atomic.Pointer[tls.Config]
+	client   atomic.Pointer[tls.Config]
+}
+
+// New loads the certificates selected by s.
+func New(s Settings) (*Config, error) {
+	c := &Config{}
+	if err := c.Update(func(current *Settings) error {
+		*current = s
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Settings returns the current settings.
+func (c *Config) Settings() Settings {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.settings
+}
+
+// Update changes the settings with fn and reloads the certificates. Nothing
+// changes when fn or the loading fails.
+func (c *Config) Update(fn func(s *Settings) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.settings
+	if err := fn(&s); err != nil {
+		return err
+	}
+	server, client, err := build(s)
+	if err != nil {
+		return err
+	}
+	c.settings = s
+	c.server.Store(server)
+	c.client.Store(client)
+	return nil
+}
+
+// Reload reads the certificate files again, for instance after they were
+// renewed.
+func (c *Config) Reload() error {
+	return c.Update(func(*Settings) error { return nil })
+}
+
+// build loads the certificates of s and returns the configurations of the
+// server and client sides.
+func build(s Settings) (*tls.Config, *tls.Config, error) {
+	if s.CertFile == "" || s.KeyFile == "" {
+		return nil, nil, errors.New("tls-cert-file and tls-key-file must be set")
+	}
+	cert, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load the certificate: %w", err)
+	}
+	clientCert := cert
+	if s.ClientCertFile != "" || s.ClientKeyFile != "" {
+		clientCert, err = tls.LoadX509KeyPair(s.ClientCertFile, s.ClientKeyFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load the client certificate: %w", err)
+		}
+	}
+	cas, err := loadCAs(s.CACertFile, s.CACertDir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	server := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    cas,
+		MinVersion:   tls.VersionTLS12,
+	}
+	switch strings.ToLower(s.AuthClients) {
+	case "yes":
+		server.ClientAuth = tls.RequireAndVerifyClientCert
+	case "optional":
+		server.ClientAuth = tls.VerifyClientCertIfGiven
+	case "no":
+		server.ClientAuth = tls.NoClientCert
+	default:
+		return nil, nil, fmt.Errorf("invalid tls-auth-clients value '%s'", s.AuthClients)
+	}
+	switch strings.ToLower(s.AuthClientsUser) {
+	case "cn", "off":
+	default:
+		return nil, nil, fmt.Errorf("invalid tls-auth-clients-user value '%s'", s.AuthClientsUser)
+	}
+
+	client := &tls.Config{
+		Certificates: []tls.Certificate{clientCert},
+		RootCAs:      cas,
+		MinVersion:   tls.VersionTLS12,
+	}
+	return server, client, nil
+}
+
+// loadCAs reads the PEM certificates of file and of the files in dir.
+func loadCAs(file, dir string) (*x509.CertPool, error) {
+	if file == "" && dir == "" {
+		return nil, errors.New("either tls-ca-cert-file or tls-ca-cert-dir must be set")
+	}
+	pool := x509.NewCertPool()
+	var files []string
+	if file != "" {
+		files = append(files, file)
+	}
+	if dir != "" {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tls-ca-cert-dir: %w", err)
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				files = append(files, filepath.Join(dir, entry.Name()))
+			}
+		}
+	}
+	loaded := false
+	for _, name := range files {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the CA certificates: %w", err)
+		}
+		if pool.AppendCertsFromPEM(data) {
+			loaded = true
+		}
+	}
+	if !loaded {
+		return nil, errors.New("no CA certificate found")
+	}
+	return pool, nil
+}
+
+// Listen listens on addr and serves TLS with the configuration current at
+// the time of each handshake.
+func (c *Config) Listen(network, addr string) (net.Listener, error) {
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(l, &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return c.server.Load(), nil
+		},
+	}), nil
+}
+
+// Dial connects to addr and completes the handshake, verifying the server
+// certificate is issued for host by one of the CAs.
+func (c *Config) Dial(addr, host string) (net.Conn, error) {
+	config := c.client.Load().Clone()
+	config.ServerName = host
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	return tls.DialWithDialer(dialer, "tcp", addr, config)
+}
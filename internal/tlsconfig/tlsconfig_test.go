@@ -0,0 +1,337 @@
+package tlsconfig_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/therahulbhati/go-redis-clone/config"
+	"github.com/therahulbhati/go-redis-clone/internal/domain"
+	"github.com/therahulbhati/go-redis-clone/internal/handler"
+	"github.com/therahulbhati/go-redis-clone/internal/replication"
+	"github.com/therahulbhati/go-redis-clone/internal/storage"
+	"github.com/therahulbhati/go-redis-clone/internal/tlsconfig"
+	"github.com/therahulbhati/go-redis-clone/pkg/resp"
+)
+
+// authority is a CA generated for a test, which issues certificates written
+// as PEM files to dir.
+type authority struct {
+	t    *testing.T
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	// certFile holds the PEM certificate of the CA.
+	certFile string
+	serial   int64
+}
+
+func newAuthority(t *testing.T, name string) *authority {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &authority{t: t, dir: t.TempDir(), cert: cert, key: key, serial: 1}
+	ca.certFile = ca.writePEM(name+"-ca.crt", "CERTIFICATE", der)
+	return ca
+}
+
+// issue creates a certificate for commonName valid for both servers and
+// clients on localhost, and returns the paths of its certificate and key.
+func (ca *authority) issue(commonName string) (certFile, keyFile string) {
+	ca.t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	ca.serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	name := commonName + "-" + strconv.FormatInt(ca.serial, 10)
+	return ca.writePEM(name+".crt", "CERTIFICATE", der), ca.writePEM(name+".key", "PRIVATE KEY", keyDER)
+}
+
+func (ca *authority) writePEM(name, blockType string, der []byte) string {
+	ca.t.Helper()
+	path := filepath.Join(ca.dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		ca.t.Fatal(err)
+	}
+	return path
+}
+
+// pool returns a pool trusting the CA.
+func (ca *authority) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// clientConfig returns the configuration of a client trusting ca, presenting
+// the certificate of certFile and keyFile unless they are empty.
+func clientConfig(t *testing.T, ca *authority, certFile, keyFile string) *tls.Config {
+	t.Helper()
+	config := &tls.Config{RootCAs: ca.pool(), ServerName: "localhost"}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config
+}
+
+// serverSettings returns the settings of a server presenting a certificate
+// issued by ca and verifying clients against ca.
+func serverSettings(ca *authority, authClients string) tlsconfig.Settings {
+	s := tlsconfig.DefaultSettings()
+	s.CertFile, s.KeyFile = ca.issue("server")
+	s.CACertFile = ca.certFile
+	s.AuthClients = authClients
+	return s
+}
+
+func listen(t *testing.T, c *tlsconfig.Config) net.Listener {
+	t.Helper()
+	l, err := c.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+// handshake connects to l with config and returns the error of the server
+// side of the handshake, which is where client certificates are checked.
+func handshake(t *testing.T, l net.Listener, config *tls.Config) error {
+	t.Helper()
+	serverErr := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		defer conn.Close()
+		serverErr <- conn.(*tls.Conn).Handshake()
+	}()
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), config)
+	if err == nil {
+		// With TLS 1.3 the client is done before the server checked its
+		// certificate, reading waits for the verdict.
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+	select {
+	case err := <-serverErr:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("handshake timed out")
+		return nil
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	ca := newAuthority(t, "test")
+	c, err := tlsconfig.New(serverSettings(ca, "no"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := listen(t, c)
+	if err := handshake(t, l, clientConfig(t, ca, "", "")); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newAuthority(t, "test")
+	untrusted := newAuthority(t, "untrusted")
+	c, err := tlsconfig.New(serverSettings(ca, "yes"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := listen(t, c)
+
+	if err := handshake(t, l, clientConfig(t, ca, "", "")); err == nil {
+		t.Error("client without certificate was accepted")
+	}
+	certFile, keyFile := untrusted.issue("client")
+	if err := handshake(t, l, clientConfig(t, ca, certFile, keyFile)); err == nil {
+		t.Error("client with untrusted certificate was accepted")
+	}
+	certFile, keyFile = ca.issue("client")
+	if err := handshake(t, l, clientConfig(t, ca, certFile, keyFile)); err != nil {
+		t.Errorf("client with trusted certificate was rejected: %v", err)
+	}
+}
+
+// startServer serves handler on l like the server does.
+func startServer(l net.Listener, h domain.CommandHandler) {
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go h.HandleClient(conn)
+		}
+	}()
+}
+
+// send runs a command on conn and returns the reply.
+func send(t *testing.T, conn net.Conn, args ...string) resp.Value {
+	t.Helper()
+	if _, err := conn.Write([]byte(resp.EncodeRESPArray(args))); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply, err := resp.NewReader(conn, resp.DefaultLimits()).ReadValue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
+
+func TestFollowerOverTLS(t *testing.T) {
+	ca := newAuthority(t, "test")
+	leaderTLS, err := tlsconfig.New(serverSettings(ca, "yes"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaderCfg := config.Default()
+	leaderCfg.TLS = leaderTLS.Settings()
+	leader := handler.NewCommandHandler(storage.NewInMemoryStore(leaderCfg.Databases, leaderCfg.Shards), replication.NewLeader(), leaderCfg)
+	leader.SetTLSConfig(leaderTLS)
+	l := listen(t, leaderTLS)
+	startServer(l, leader)
+
+	followerSettings := serverSettings(ca, "yes")
+	followerSettings.ClientCertFile, followerSettings.ClientKeyFile = ca.issue("follower")
+	followerTLS, err := tlsconfig.New(followerSettings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	followerCfg := config.Default()
+	followerCfg.ReplicaOfHost = "127.0.0.1"
+	followerCfg.ReplicaOfPort = l.Addr().(*net.TCPAddr).Port
+	followerStore := storage.NewInMemoryStore(followerCfg.Databases, followerCfg.Shards)
+	followerHandler := handler.NewCommandHandler(followerStore, nil, followerCfg)
+	follower := replication.NewFollower(followerStore, followerCfg, followerTLS, followerHandler)
+	if err := follower.ConnectToLeader(); err != nil {
+		t.Fatalf("ConnectToLeader: %v", err)
+	}
+	go follower.ReceiveAndProcessCommands()
+
+	certFile, keyFile := ca.issue("client")
+	conn, err := tls.Dial("tcp", l.Addr().String(), clientConfig(t, ca, certFile, keyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if reply := send(t, conn, "SET", "key", "value"); reply.Str != "OK" {
+		t.Fatalf("SET replied %+v", reply)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if value, ok := followerStore.Get(0, "key"); ok {
+			if value != "value" {
+				t.Fatalf("follower has %q, want %q", value, "value")
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the write didn't reach the follower")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestConfigSetReload swaps the certificate with CONFIG SET and checks new
+// connections to the same listener get the new one.
+func TestConfigSetReload(t *testing.T) {
+	ca := newAuthority(t, "test")
+	c, err := tlsconfig.New(serverSettings(ca, "no"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.Default()
+	cfg.TLS = c.Settings()
+	h := handler.NewCommandHandler(storage.NewInMemoryStore(cfg.Databases, cfg.Shards), replication.NewLeader(), cfg)
+	h.SetTLSConfig(c)
+	l := listen(t, c)
+	startServer(l, h)
+
+	serial := func(conn *tls.Conn) int64 {
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	}
+	conn, err := tls.Dial("tcp", l.Addr().String(), clientConfig(t, ca, "", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	before := serial(conn)
+
+	certFile, keyFile := ca.issue("renewed")
+	if reply := send(t, conn, "CONFIG", "SET", "tls-cert-file", certFile, "tls-key-file", keyFile); reply.Str != "OK" {
+		t.Fatalf("CONFIG SET replied %+v", reply)
+	}
+	renewed, err := tls.Dial("tcp", l.Addr().String(), clientConfig(t, ca, "", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer renewed.Close()
+	if after := serial(renewed); after == before {
+		t.Fatalf("the certificate wasn't swapped, serial %d", after)
+	}
+	if reply := send(t, conn, "PING"); reply.Str != "PONG" {
+		t.Fatalf("the established connection replied %+v", reply)
+	}
+}
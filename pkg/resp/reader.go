@@ -0,0 +1,349 @@
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"slices"
+	"strconv"
+
+	"github.com/therahulbhati/go-redis-clone/pkg/utils"
+)
+
+// Limits bounds what a Reader accepts before rejecting the input as a
+// protocol error, so hostile peers can't make the server allocate huge
+// buffers.
+type Limits struct {
+	// MaxBulkLen is the largest accepted bulk string (proto-max-bulk-len).
+	MaxBulkLen int64
+	// MaxMultiBulkLen is the largest accepted number of array elements.
+	MaxMultiBulkLen int64
+	// MaxInlineLen is the longest accepted inline command or header line.
+	MaxInlineLen int
+	// MaxDepth is the deepest accepted nesting of aggregate replies.
+	MaxDepth int
+}
+
+// DefaultLimits returns the limits Redis uses out of the box.
+func DefaultLimits() Limits {
+	return Limits{
+		MaxBulkLen:      512 * 1024 * 1024,
+		MaxMultiBulkLen: 1024 * 1024,
+		MaxInlineLen:    64 * 1024,
+		MaxDepth:        128,
+	}
+}
+
+// bulkPreallocLimit is the largest bulk string that is allocated in one go.
+// Bigger payloads grow their buffer as data actually arrives.
+const bulkPreallocLimit = 64 * 1024
+
+// maxRetainedArena is the largest command buffer kept between commands.
+const maxRetainedArena = 1024 * 1024
+
+// ProtocolError reports input that violates RESP. The connection can't be
+// resynchronized after one, so it should be closed.
+type ProtocolError struct {
+	msg string
+}
+
+func (e *ProtocolError) Error() string {
+	return "Protocol error: " + e.msg
+}
+
+func protocolError(msg string) error {
+	return &ProtocolError{msg: msg}
+}
+
+// IsProtocolError reports whether err is a ProtocolError.
+func IsProtocolError(err error) bool {
+	var perr *ProtocolError
+	return errors.As(err, &perr)
+}
+
+// Reader reads commands and RESP2 or RESP3 replies.
+type Reader struct {
+	rd     *bufio.Reader
+	limits Limits
+	line   []byte
+
+	// Scratch space reused by ReadCommand: the payloads of the command's
+	// arguments, where each one ends, and the arguments themselves.
+	arena []byte
+	ends  []int
+	args  []string
+}
+
+// NewReader creates a Reader on top of r. When r is already a
+// *bufio.Reader it is used directly, so callers can keep reading raw bytes
+// from it between RESP values.
+func NewReader(r io.Reader, limits Limits) *Reader {
+	return &Reader{rd: bufio.NewReader(r), limits: limits}
+}
+
+// Buffered returns the number of bytes that can be read without blocking.
+func (r *Reader) Buffered() int {
+	return r.rd.Buffered()
+}
+
+// ReadCommand reads the next command, either as an array of bulk strings or
+// as an inline command. Empty inline lines and empty arrays are skipped.
+//
+// The payloads are read into a reusable buffer and turned into strings with
+// a single conversion per command. The returned slice is reused by the next
+// call, so callers keeping the arguments around must copy the slice; the
+// strings themselves stay valid.
+func (r *Reader) ReadCommand() ([]string, error) {
+	for {
+		line, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 {
+			continue
+		}
+
+		if line[0] != '*' {
+			args, err := utils.SplitArgs(string(line))
+			if err != nil {
+				return nil, protocolError("unbalanced quotes in request")
+			}
+			if len(args) == 0 {
+				continue
+			}
+			return args, nil
+		}
+
+		n, err := r.parseLength(line[1:], r.limits.MaxMultiBulkLen, "invalid multibulk length")
+		if err != nil {
+			return nil, err
+		}
+		if n <= 0 {
+			continue
+		}
+
+		r.arena, r.ends = r.arena[:0], r.ends[:0]
+		for i := int64(0); i < n; i++ {
+			line, err := r.readLine()
+			if err != nil {
+				return nil, err
+			}
+			if len(line) == 0 || line[0] != '$' {
+				got := "EOL"
+				if len(line) > 0 {
+					got = strconv.QuoteRune(rune(line[0]))
+				}
+				return nil, protocolError("expected '$', got " + got)
+			}
+			r.arena, err = r.appendBulk(r.arena, line[1:])
+			if err != nil {
+				return nil, err
+			}
+			r.ends = append(r.ends, len(r.arena))
+		}
+		return r.splitArena(), nil
+	}
+}
+
+// splitArena converts the arena to one string and slices the arguments out
+// of it.
+func (r *Reader) splitArena() []string {
+	all := string(r.arena)
+	r.args = r.args[:0]
+	start := 0
+	for _, end := range r.ends {
+		r.args = append(r.args, all[start:end])
+		start = end
+	}
+	if cap(r.arena) > maxRetainedArena {
+		r.arena = nil
+	}
+	return r.args
+}
+
+// ReadValue reads the next value of any RESP2 or RESP3 type. Attributes
+// are read and dropped.
+func (r *Reader) ReadValue() (Value, error) {
+	return r.readValue(0)
+}
+
+func (r *Reader) readValue(depth int) (Value, error) {
+	if depth > r.limits.MaxDepth {
+		return Value{}, protocolError("nesting too deep")
+	}
+
+	line, err := r.readLine()
+	if err != nil {
+		return Value{}, err
+	}
+	if len(line) == 0 {
+		return Value{}, protocolError("empty type prefix")
+	}
+
+	switch line[0] {
+	case TypeSimpleString, TypeError:
+		return Value{Type: line[0], Str: string(line[1:])}, nil
+	case TypeInteger:
+		n, err := strconv.ParseInt(string(line[1:]), 10, 64)
+		if err != nil {
+			return Value{}, protocolError("invalid integer")
+		}
+		return Value{Type: TypeInteger, Int: n}, nil
+	case TypeBulkString:
+		if string(line[1:]) == "-1" {
+			return Value{Type: TypeBulkString, Null: true}, nil
+		}
+		data, err := r.readBulk(line[1:])
+		if err != nil {
+			return Value{}, err
+		}
+		return Value{Type: TypeBulkString, Str: string(data)}, nil
+	case TypeBlobError, TypeVerbatim:
+		data, err := r.readBulk(line[1:])
+		if err != nil {
+			return Value{}, err
+		}
+		if line[0] == TypeVerbatim {
+			if len(data) < 4 || data[3] != ':' {
+				return Value{}, protocolError("invalid verbatim string")
+			}
+			data = data[4:]
+		}
+		return Value{Type: line[0], Str: string(data)}, nil
+	case TypeNull:
+		return Value{Type: TypeNull, Null: true}, nil
+	case TypeDouble:
+		f, err := strconv.ParseFloat(string(line[1:]), 64)
+		if err != nil {
+			return Value{}, protocolError("invalid double")
+		}
+		return Value{Type: TypeDouble, Float: f}, nil
+	case TypeBoolean:
+		switch string(line[1:]) {
+		case "t":
+			return Value{Type: TypeBoolean, Int: 1}, nil
+		case "f":
+			return Value{Type: TypeBoolean}, nil
+		}
+		return Value{}, protocolError("invalid boolean")
+	case TypeBigNumber:
+		return Value{Type: TypeBigNumber, Str: string(line[1:])}, nil
+	case TypeArray, TypeSet, TypePush, TypeMap, TypeAttribute:
+		if line[0] == TypeArray && string(line[1:]) == "-1" {
+			return Value{Type: TypeArray, Null: true}, nil
+		}
+		typ := line[0]
+		n, err := r.parseLength(line[1:], r.limits.MaxMultiBulkLen, "invalid multibulk length")
+		if err != nil {
+			return Value{}, err
+		}
+		if typ == TypeMap || typ == TypeAttribute {
+			n *= 2
+		}
+		elems := make([]Value, 0, min(n, 1024))
+		for i := int64(0); i < n; i++ {
+			elem, err := r.readValue(depth + 1)
+			if err != nil {
+				return Value{}, err
+			}
+			elems = append(elems, elem)
+		}
+		if typ == TypeAttribute {
+			return r.readValue(depth)
+		}
+		return Value{Type: typ, Array: elems}, nil
+	default:
+		return Value{}, protocolError("unknown type prefix " + strconv.QuoteRune(rune(line[0])))
+	}
+}
+
+// readLine returns the next line without its terminator. The returned slice
+// is only valid until the next read.
+func (r *Reader) readLine() ([]byte, error) {
+	line, err := r.rd.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		// Longer than the bufio buffer, accumulate up to the inline limit.
+		r.line = append(r.line[:0], line...)
+		for err == bufio.ErrBufferFull {
+			if len(r.line) > r.limits.MaxInlineLen {
+				return nil, protocolError("too big inline request")
+			}
+			line, err = r.rd.ReadSlice('\n')
+			r.line = append(r.line, line...)
+		}
+		line = r.line
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(line) > r.limits.MaxInlineLen {
+		return nil, protocolError("too big inline request")
+	}
+
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	return line, nil
+}
+
+// parseLength parses a non-negative decimal length header, also accepting
+// -1 and 0, and rejects anything above max.
+func (r *Reader) parseLength(b []byte, max int64, msg string) (int64, error) {
+	n, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil || n > max || n < -1 {
+		return 0, protocolError(msg)
+	}
+	return n, nil
+}
+
+// readBulk reads the payload of a bulk string whose header was b, including
+// the trailing CRLF.
+func (r *Reader) readBulk(b []byte) ([]byte, error) {
+	return r.appendBulk(nil, b)
+}
+
+// appendBulk reads the payload of a bulk string whose header was b and
+// appends it to dst, checking and dropping the trailing CRLF.
+func (r *Reader) appendBulk(dst []byte, b []byte) ([]byte, error) {
+	n, err := r.parseLength(b, r.limits.MaxBulkLen, "invalid bulk length")
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		return nil, protocolError("invalid bulk length")
+	}
+
+	// Don't trust the announced length for the allocation: past
+	// bulkPreallocLimit the buffer only grows as the peer actually sends
+	// data.
+	for remaining := int(n); remaining > 0; {
+		chunk := min(remaining, bulkPreallocLimit)
+		start := len(dst)
+		dst = slices.Grow(dst, chunk)[:start+chunk]
+		if _, err := io.ReadFull(r.rd, dst[start:]); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		remaining -= chunk
+	}
+
+	cr, err := r.rd.ReadByte()
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	lf, err := r.rd.ReadByte()
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if cr != '\r' || lf != '\n' {
+		return nil, protocolError("bulk string not terminated by CRLF")
+	}
+	return dst, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
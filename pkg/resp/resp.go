@@ -1,86 +1,141 @@
 package resp
 
 import (
-	"bufio"
-	"fmt"
-	"io"
 	"strconv"
-	"strings"
 )
 
+// RESP2 type prefixes.
+const (
+	TypeSimpleString = '+'
+	TypeError        = '-'
+	TypeInteger      = ':'
+	TypeBulkString   = '$'
+	TypeArray        = '*'
+)
+
+// RESP3 type prefixes.
+const (
+	TypeNull      = '_'
+	TypeDouble    = ','
+	TypeBoolean   = '#'
+	TypeBigNumber = '('
+	TypeBlobError = '!'
+	TypeVerbatim  = '='
+	TypeMap       = '%'
+	TypeSet       = '~'
+	TypePush      = '>'
+	TypeAttribute = '|'
+)
+
+// Value is a decoded RESP value. Str holds simple strings, errors, bulk
+// strings, big numbers and verbatim strings, Int integers and booleans,
+// Float doubles and Array the elements of arrays, sets and push messages.
+// Maps store their keys and values alternately in Array. Null marks the
+// null bulk string, the null array and the RESP3 null.
+type Value struct {
+	Type  byte
+	Str   string
+	Int   int64
+	Float float64
+	Array []Value
+	Null  bool
+}
+
 func EncodeRESPString(s string) string {
-	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+	return string(AppendBulkString(nil, s))
 }
 
 func EncodeRESPArray(elements []string) string {
-	var sb strings.Builder
-	sb.WriteString(fmt.Sprintf("*%d\r\n", len(elements)))
-	for _, elem := range elements {
-		sb.WriteString(EncodeRESPString(elem))
-	}
-	return sb.String()
+	return string(AppendStringArray(nil, elements))
 }
 
 func EncodeRESPInteger(i int64) string {
-	return fmt.Sprintf(":%d\r\n", i)
+	return string(AppendInteger(nil, i))
 }
 
 func EncodeRESPSimpleString(s string) string {
-	return fmt.Sprintf("+%s\r\n", s)
+	return string(AppendSimpleString(nil, s))
 }
 
 func EncodeRESPNull() string {
 	return "$-1\r\n"
 }
 
+func EncodeRESPNullArray() string {
+	return "*-1\r\n"
+}
+
 func EncodeRESPError(err string) string {
-	return fmt.Sprintf("-ERR %s\r\n", err)
+	return string(AppendError(nil, err))
 }
 
-func ParseRESP(reader *bufio.Reader) ([]string, error) {
-	line, err := reader.ReadString('\n')
-	if err != nil {
-		return nil, err
-	}
+// EncodeRESPRawError encodes an error that already starts with its code,
+// like "WRONGTYPE ..." or "EXECABORT ...".
+func EncodeRESPRawError(err string) string {
+	return string(AppendRawError(nil, err))
+}
 
-	line = strings.TrimSpace(line)
-	if line == "" {
-		return nil, nil
-	}
+// The Append functions append the encoding of a value to dst and return the
+// extended buffer, so replies can be built without intermediate strings.
 
-	if !strings.HasPrefix(line, "*") {
-		return nil, fmt.Errorf("invalid RESP command: %s", line)
-	}
+// AppendBulkString appends a length-prefixed bulk string. The payload is
+// copied verbatim, so it may contain any byte including CR, LF and NUL.
+func AppendBulkString(dst []byte, s string) []byte {
+	dst = AppendPrefix(dst, TypeBulkString, int64(len(s)))
+	dst = append(dst, s...)
+	return append(dst, '\r', '\n')
+}
 
-	numElements, err := strconv.Atoi(line[1:])
-	if err != nil {
-		return nil, fmt.Errorf("invalid number of elements")
+func AppendStringArray(dst []byte, elements []string) []byte {
+	dst = AppendPrefix(dst, TypeArray, int64(len(elements)))
+	for _, elem := range elements {
+		dst = AppendBulkString(dst, elem)
 	}
+	return dst
+}
 
-	var result []string
-	for i := 0; i < numElements; i++ {
-		line, err := reader.ReadString('\n')
-		if err != nil {
-			return nil, err
-		}
-		line = strings.TrimSpace(line)
-		if !strings.HasPrefix(line, "$") {
-			return nil, fmt.Errorf("invalid RESP bulk string")
-		}
+func AppendInteger(dst []byte, i int64) []byte {
+	return AppendPrefix(dst, TypeInteger, i)
+}
 
-		length, err := strconv.Atoi(line[1:])
-		if err != nil {
-			return nil, fmt.Errorf("invalid bulk string length")
-		}
+// AppendSimpleString appends a simple string. Simple strings can't carry
+// CR or LF, so those are replaced with spaces like Redis does; binary data
+// must be sent as bulk strings.
+func AppendSimpleString(dst []byte, s string) []byte {
+	dst = append(dst, TypeSimpleString)
+	dst = appendLine(dst, s)
+	return append(dst, '\r', '\n')
+}
 
-		buf := make([]byte, length+2)
-		_, err = io.ReadFull(reader, buf)
-		if err != nil {
-			return nil, err
-		}
+func AppendError(dst []byte, err string) []byte {
+	dst = append(dst, "-ERR "...)
+	dst = appendLine(dst, err)
+	return append(dst, '\r', '\n')
+}
 
-		result = append(result, string(buf[:length]))
+func AppendRawError(dst []byte, err string) []byte {
+	dst = append(dst, TypeError)
+	dst = appendLine(dst, err)
+	return append(dst, '\r', '\n')
+}
+
+// appendLine appends s with CR and LF replaced by spaces, so user supplied
+// text echoed in a status or error reply can't inject extra replies.
+func appendLine(dst []byte, s string) []byte {
+	start := len(dst)
+	dst = append(dst, s...)
+	for i := start; i < len(dst); i++ {
+		if dst[i] == '\r' || dst[i] == '\n' {
+			dst[i] = ' '
+		}
 	}
+	return dst
+}
 
-	return result, nil
+// AppendPrefix appends a type prefix followed by a number and CRLF, the
+// header shared by integers, bulk strings and aggregates.
+func AppendPrefix(dst []byte, prefix byte, n int64) []byte {
+	dst = append(dst, prefix)
+	dst = strconv.AppendInt(dst, n, 10)
+	return append(dst, '\r', '\n')
 }
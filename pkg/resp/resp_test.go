@@ -0,0 +1,242 @@
+package resp
+
+import (
+	"bytes"
+	"io"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// FuzzBulkRoundTrip checks that arbitrary payloads, including CR, LF and NUL
+// bytes, come back unchanged through the encoders and the reader.
+func FuzzBulkRoundTrip(f *testing.F) {
+	for _, seed := range []string{"", "\r\n", "\r", "\n", "\x00", "a\x00b\r\nc", "*1\r\n$3\r\nfoo\r\n", "\xff\xfe"} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		s := string(payload)
+
+		// A command of bulk strings, as clients send them.
+		encoded := AppendStringArray(nil, []string{"SET", s, s})
+		src := bytes.NewReader(encoded)
+		r := NewReader(src, DefaultLimits())
+		args, err := r.ReadCommand()
+		if err != nil {
+			t.Fatalf("ReadCommand(%q): %v", encoded, err)
+		}
+		if len(args) != 3 || args[0] != "SET" || args[1] != s || args[2] != s {
+			t.Fatalf("ReadCommand(%q) = %q, want [SET %q %q]", encoded, args, s, s)
+		}
+		if left := src.Len() + r.Buffered(); left != 0 {
+			t.Fatalf("ReadCommand(%q) left %d bytes unread", encoded, left)
+		}
+
+		// A bulk string reply, through AppendBulkString and the Writer.
+		var buf bytes.Buffer
+		w := NewWriter(&buf)
+		w.WriteBulkString(s)
+		if err := w.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+		if appended := AppendBulkString(nil, s); !bytes.Equal(buf.Bytes(), appended) {
+			t.Fatalf("WriteBulkString wrote %q, AppendBulkString %q", buf.Bytes(), appended)
+		}
+		encoded = buf.Bytes()
+		src = bytes.NewReader(encoded)
+		r = NewReader(src, DefaultLimits())
+		v, err := r.ReadValue()
+		if err != nil {
+			t.Fatalf("ReadValue(%q): %v", encoded, err)
+		}
+		if v.Type != TypeBulkString || v.Null || v.Str != s {
+			t.Fatalf("ReadValue(%q) = %+v, want bulk string %q", encoded, v, s)
+		}
+		if left := src.Len() + r.Buffered(); left != 0 {
+			t.Fatalf("ReadValue(%q) left %d bytes unread", encoded, left)
+		}
+	})
+}
+
+// allocated returns the bytes allocated while fn ran.
+func allocated(fn func()) uint64 {
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	fn()
+	runtime.ReadMemStats(&after)
+	return after.TotalAlloc - before.TotalAlloc
+}
+
+// maxAllocated bounds what reading a hostile input may allocate, far below
+// the sizes the inputs announce.
+const maxAllocated = 1 << 20
+
+func TestReaderRejectsHostileInput(t *testing.T) {
+	limits := Limits{MaxBulkLen: 1024, MaxMultiBulkLen: 16, MaxInlineLen: 64, MaxDepth: 4}
+	tests := []struct {
+		name  string
+		input string
+		// value reads with ReadValue instead of ReadCommand.
+		value bool
+	}{
+		{name: "bulk over MaxBulkLen", input: "*1\r\n$1025\r\nxxx\r\n"},
+		{name: "huge bulk", input: "*1\r\n$1099511627776\r\nxxx\r\n"},
+		{name: "reply bulk over MaxBulkLen", input: "$1099511627776\r\nxxx\r\n", value: true},
+		{name: "array over MaxMultiBulkLen", input: "*17\r\n$1\r\nx\r\n"},
+		{name: "huge array", input: "*1099511627776\r\n"},
+		{name: "reply array over MaxMultiBulkLen", input: "*1099511627776\r\n", value: true},
+		{name: "reply map over MaxMultiBulkLen", input: "%1099511627776\r\n", value: true},
+		{name: "nesting over MaxDepth", input: strings.Repeat("*1\r\n", 6) + ":1\r\n", value: true},
+		{name: "inline over MaxInlineLen", input: "SET key " + strings.Repeat("x", 100) + "\r\n"},
+		{name: "inline without newline", input: strings.Repeat("x", 10000)},
+		{name: "header over MaxInlineLen", input: "*1\r\n$" + strings.Repeat("1", 100) + "\r\n"},
+		{name: "unbalanced double quotes", input: "SET \"key value\r\n"},
+		{name: "unbalanced single quotes", input: "SET 'key value\r\n"},
+		{name: "negative bulk length", input: "*1\r\n$-2\r\n"},
+		{name: "null bulk in command", input: "*1\r\n$-1\r\n"},
+		{name: "negative array length", input: "*-2\r\n"},
+		{name: "reply negative bulk length", input: "$-5\r\n", value: true},
+		{name: "reply negative array length", input: "*-2\r\n", value: true},
+		{name: "non numeric length", input: "*1\r\n$abc\r\n"},
+		{name: "missing bulk prefix", input: "*1\r\n:1\r\n"},
+		{name: "bulk without CRLF", input: "*1\r\n$3\r\nfooXX"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewReader(strings.NewReader(tt.input), limits)
+			var err error
+			n := allocated(func() {
+				if tt.value {
+					_, err = r.ReadValue()
+				} else {
+					_, err = r.ReadCommand()
+				}
+			})
+			if !IsProtocolError(err) {
+				t.Errorf("got error %v, want a protocol error", err)
+			}
+			if n > maxAllocated {
+				t.Errorf("allocated %d bytes", n)
+			}
+		})
+	}
+}
+
+// TestReaderDoesNotTrustLengths checks that a length within the limits isn't
+// allocated up front when the data never comes.
+func TestReaderDoesNotTrustLengths(t *testing.T) {
+	for _, input := range []string{"*1\r\n$536870912\r\nxxx", "$536870912\r\nxxx"} {
+		r := NewReader(strings.NewReader(input), DefaultLimits())
+		var err error
+		n := allocated(func() {
+			if input[0] == '$' {
+				_, err = r.ReadValue()
+			} else {
+				_, err = r.ReadCommand()
+			}
+		})
+		if err != io.ErrUnexpectedEOF {
+			t.Errorf("%q: got error %v, want %v", input, err, io.ErrUnexpectedEOF)
+		}
+		if n > maxAllocated {
+			t.Errorf("%q: allocated %d bytes", input, n)
+		}
+	}
+}
+
+// repeatReader returns data over and over, so benchmarks read an endless
+// pipeline without allocating.
+type repeatReader struct {
+	data []byte
+	off  int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		c := copy(p[n:], r.data[r.off:])
+		n += c
+		r.off = (r.off + c) % len(r.data)
+	}
+	return n, nil
+}
+
+// pipeline returns n copies of the encoded command args.
+func pipeline(n int, args ...string) []byte {
+	var buf []byte
+	for i := 0; i < n; i++ {
+		buf = AppendStringArray(buf, args)
+	}
+	return buf
+}
+
+func benchmarkReadCommand(b *testing.B, input []byte, commands int) {
+	r := NewReader(&repeatReader{data: input}, DefaultLimits())
+	b.SetBytes(int64(len(input) / commands))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := r.ReadCommand(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReaderCommandSet(b *testing.B) {
+	benchmarkReadCommand(b, pipeline(16, "SET", "key:000123", "value"), 16)
+}
+
+func BenchmarkReaderCommandLargeValue(b *testing.B) {
+	benchmarkReadCommand(b, pipeline(16, "SET", "key:000123", strings.Repeat("x", 16*1024)), 16)
+}
+
+func BenchmarkReaderCommandInline(b *testing.B) {
+	benchmarkReadCommand(b, bytes.Repeat([]byte("SET key:000123 value\r\n"), 16), 16)
+}
+
+func BenchmarkReaderValueArray(b *testing.B) {
+	input := pipeline(16, "key:1", "key:2", "key:3", "key:4")
+	r := NewReader(&repeatReader{data: input}, DefaultLimits())
+	b.SetBytes(int64(len(input) / 16))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := r.ReadValue(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchmarkWriter writes a reply with write for every op, flushing once per
+// pipeline of 16 replies like the server does.
+func benchmarkWriter(b *testing.B, write func(w *Writer)) {
+	w := NewWriter(io.Discard)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		write(w)
+		if i%16 == 15 {
+			if err := w.Flush(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkWriterSimpleString(b *testing.B) {
+	benchmarkWriter(b, func(w *Writer) { w.WriteSimpleString("OK") })
+}
+
+func BenchmarkWriterBulkString(b *testing.B) {
+	value := strings.Repeat("x", 64)
+	benchmarkWriter(b, func(w *Writer) { w.WriteBulkString(value) })
+}
+
+func BenchmarkWriterInteger(b *testing.B) {
+	benchmarkWriter(b, func(w *Writer) { w.WriteInteger(123456789) })
+}
+
+func BenchmarkWriterStringArray(b *testing.B) {
+	elements := []string{"key:1", "key:2", "key:3", "key:4"}
+	benchmarkWriter(b, func(w *Writer) { w.WriteStringArray(elements) })
+}
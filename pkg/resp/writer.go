@@ -0,0 +1,296 @@
+package resp
+
+import (
+	"io"
+	"math"
+	"strconv"
+)
+
+const (
+	// flushThreshold makes the Writer flush on its own once this many bytes
+	// are pending, so large pipelines don't buffer every reply.
+	flushThreshold = 64 * 1024
+	// maxRetainedBuffer is the largest buffer kept around after a flush.
+	maxRetainedBuffer = 1024 * 1024
+)
+
+// Writer encodes replies for one connection in the protocol version the
+// client negotiated with HELLO. RESP3 only types degrade to their RESP2
+// equivalents when the client speaks RESP2: maps and sets become flat
+// arrays, doubles, big numbers and verbatim strings become bulk strings and
+// booleans become integers.
+//
+// Replies are appended to a reusable buffer and only reach the connection on
+// Flush, so a pipeline of commands is answered with a single write.
+type Writer struct {
+	w     io.Writer
+	buf   []byte
+	proto int
+	err   error
+	// errors counts the error replies written since the last TakeErrors,
+	// and lastError is the most recent of them.
+	errors    int
+	lastError string
+}
+
+// NewWriter creates a Writer speaking RESP2 until SetProtocol is called.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w, buf: make([]byte, 0, 4096), proto: 2}
+}
+
+func (w *Writer) Protocol() int {
+	return w.proto
+}
+
+func (w *Writer) SetProtocol(proto int) {
+	w.proto = proto
+}
+
+// Err returns the first error returned by the underlying writer.
+func (w *Writer) Err() error {
+	return w.err
+}
+
+// Buffered returns the number of bytes waiting to be flushed.
+func (w *Writer) Buffered() int {
+	return len(w.buf)
+}
+
+// Flush writes the pending replies to the underlying writer.
+func (w *Writer) Flush() error {
+	if len(w.buf) == 0 || w.err != nil {
+		w.buf = w.buf[:0]
+		return w.err
+	}
+	_, w.err = w.w.Write(w.buf)
+	if cap(w.buf) > maxRetainedBuffer {
+		w.buf = make([]byte, 0, 4096)
+	} else {
+		w.buf = w.buf[:0]
+	}
+	return w.err
+}
+
+func (w *Writer) grown() {
+	if len(w.buf) >= flushThreshold {
+		w.Flush()
+	}
+}
+
+func (w *Writer) WriteSimpleString(s string) {
+	w.buf = AppendSimpleString(w.buf, s)
+	w.grown()
+}
+
+// WriteError writes a generic error, prefixed with the ERR code.
+func (w *Writer) WriteError(msg string) {
+	w.buf = AppendError(w.buf, msg)
+	w.errors++
+	w.lastError = "ERR " + msg
+	w.grown()
+}
+
+// WriteRawError writes an error that already starts with its code.
+func (w *Writer) WriteRawError(msg string) {
+	w.buf = AppendRawError(w.buf, msg)
+	w.errors++
+	w.lastError = msg
+	w.grown()
+}
+
+// TakeErrors returns the number of error replies written since the previous
+// call and the last of them, and starts counting again.
+func (w *Writer) TakeErrors() (int, string) {
+	n, last := w.errors, w.lastError
+	w.errors, w.lastError = 0, ""
+	return n, last
+}
+
+func (w *Writer) WriteInteger(n int64) {
+	w.buf = AppendInteger(w.buf, n)
+	w.grown()
+}
+
+func (w *Writer) WriteBulkString(s string) {
+	w.buf = AppendBulkString(w.buf, s)
+	w.grown()
+}
+
+// WriteNull writes the null reply, a null bulk string in RESP2.
+func (w *Writer) WriteNull() {
+	if w.proto >= 3 {
+		w.buf = append(w.buf, "_\r\n"...)
+		return
+	}
+	w.buf = append(w.buf, "$-1\r\n"...)
+}
+
+// WriteNullArray writes the null reply, a null array in RESP2.
+func (w *Writer) WriteNullArray() {
+	if w.proto >= 3 {
+		w.buf = append(w.buf, "_\r\n"...)
+		return
+	}
+	w.buf = append(w.buf, "*-1\r\n"...)
+}
+
+// WriteArrayLen starts an array of n elements, written by the next calls.
+func (w *Writer) WriteArrayLen(n int) {
+	w.buf = AppendPrefix(w.buf, TypeArray, int64(n))
+}
+
+// WriteMapLen starts a map of n key/value pairs.
+func (w *Writer) WriteMapLen(n int) {
+	if w.proto >= 3 {
+		w.buf = AppendPrefix(w.buf, TypeMap, int64(n))
+		return
+	}
+	w.WriteArrayLen(n * 2)
+}
+
+// WriteSetLen starts a set of n elements.
+func (w *Writer) WriteSetLen(n int) {
+	if w.proto >= 3 {
+		w.buf = AppendPrefix(w.buf, TypeSet, int64(n))
+		return
+	}
+	w.WriteArrayLen(n)
+}
+
+// WritePushLen starts an out of band push message of n elements.
+func (w *Writer) WritePushLen(n int) {
+	if w.proto >= 3 {
+		w.buf = AppendPrefix(w.buf, TypePush, int64(n))
+		return
+	}
+	w.WriteArrayLen(n)
+}
+
+func (w *Writer) WriteStringArray(elements []string) {
+	w.buf = AppendStringArray(w.buf, elements)
+	w.grown()
+}
+
+func (w *Writer) WriteDouble(f float64) {
+	if w.proto >= 3 {
+		w.buf = append(w.buf, TypeDouble)
+		w.buf = appendDouble(w.buf, f)
+		w.buf = append(w.buf, '\r', '\n')
+		return
+	}
+	w.WriteBulkString(FormatDouble(f))
+}
+
+func (w *Writer) WriteBool(b bool) {
+	if w.proto >= 3 {
+		if b {
+			w.buf = append(w.buf, "#t\r\n"...)
+		} else {
+			w.buf = append(w.buf, "#f\r\n"...)
+		}
+		return
+	}
+	if b {
+		w.WriteInteger(1)
+	} else {
+		w.WriteInteger(0)
+	}
+}
+
+// WriteBigNumber writes an integer given as its decimal digits.
+func (w *Writer) WriteBigNumber(digits string) {
+	if w.proto >= 3 {
+		w.buf = append(w.buf, TypeBigNumber)
+		w.buf = append(w.buf, digits...)
+		w.buf = append(w.buf, '\r', '\n')
+		return
+	}
+	w.WriteBulkString(digits)
+}
+
+// WriteVerbatim writes a verbatim string with a three letter format such as
+// "txt" or "mkd".
+func (w *Writer) WriteVerbatim(format, s string) {
+	if w.proto >= 3 {
+		w.buf = AppendPrefix(w.buf, TypeVerbatim, int64(len(s)+4))
+		w.buf = append(w.buf, format...)
+		w.buf = append(w.buf, ':')
+		w.buf = append(w.buf, s...)
+		w.buf = append(w.buf, '\r', '\n')
+		w.grown()
+		return
+	}
+	w.WriteBulkString(s)
+}
+
+// WriteRaw appends an already encoded reply.
+func (w *Writer) WriteRaw(b []byte) {
+	w.buf = append(w.buf, b...)
+	w.grown()
+}
+
+// WriteValue writes an already decoded value.
+func (w *Writer) WriteValue(v Value) {
+	switch v.Type {
+	case TypeSimpleString:
+		w.WriteSimpleString(v.Str)
+	case TypeError, TypeBlobError:
+		w.WriteRawError(v.Str)
+	case TypeInteger:
+		w.WriteInteger(v.Int)
+	case TypeNull:
+		w.WriteNull()
+	case TypeDouble:
+		w.WriteDouble(v.Float)
+	case TypeBoolean:
+		w.WriteBool(v.Int != 0)
+	case TypeBigNumber:
+		w.WriteBigNumber(v.Str)
+	case TypeVerbatim:
+		w.WriteVerbatim("txt", v.Str)
+	case TypeArray, TypeSet, TypePush:
+		if v.Null {
+			w.WriteNullArray()
+			return
+		}
+		switch v.Type {
+		case TypeSet:
+			w.WriteSetLen(len(v.Array))
+		case TypePush:
+			w.WritePushLen(len(v.Array))
+		default:
+			w.WriteArrayLen(len(v.Array))
+		}
+		for _, elem := range v.Array {
+			w.WriteValue(elem)
+		}
+	case TypeMap:
+		w.WriteMapLen(len(v.Array) / 2)
+		for _, elem := range v.Array {
+			w.WriteValue(elem)
+		}
+	default:
+		if v.Null {
+			w.WriteNull()
+			return
+		}
+		w.WriteBulkString(v.Str)
+	}
+}
+
+// FormatDouble formats f the way Redis replies with doubles.
+func FormatDouble(f float64) string {
+	return string(appendDouble(nil, f))
+}
+
+func appendDouble(dst []byte, f float64) []byte {
+	switch {
+	case math.IsInf(f, 1):
+		return append(dst, "inf"...)
+	case math.IsInf(f, -1):
+		return append(dst, "-inf"...)
+	case math.IsNaN(f):
+		return append(dst, "nan"...)
+	}
+	return strconv.AppendFloat(dst, f, 'g', -1, 64)
+}
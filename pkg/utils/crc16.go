@@ -0,0 +1,53 @@
+package utils
+
+// SlotCount is the number of hash slots the keyspace is divided into, as in
+// Redis Cluster.
+const SlotCount = 16384
+
+// crc16Table is the CRC16-CCITT (XMODEM) table for the polynomial 0x1021.
+var crc16Table = func() [256]uint16 {
+	var table [256]uint16
+	for i := range table {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// CRC16 returns the CRC16-CCITT (XMODEM) checksum of s, the one Redis
+// Cluster hashes keys with.
+func CRC16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^s[i]]
+	}
+	return crc
+}
+
+// KeyHashSlot returns the hash slot of a key or channel. When the name
+// contains a non empty {hash tag}, only the tag is hashed, so related names
+// can be forced into the same slot.
+func KeyHashSlot(key string) int {
+	for i := 0; i < len(key); i++ {
+		if key[i] != '{' {
+			continue
+		}
+		for j := i + 1; j < len(key); j++ {
+			if key[j] == '}' {
+				if j > i+1 {
+					key = key[i+1 : j]
+				}
+				return int(CRC16(key) & (SlotCount - 1))
+			}
+		}
+		break
+	}
+	return int(CRC16(key) & (SlotCount - 1))
+}
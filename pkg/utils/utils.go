@@ -1 +1,122 @@
 package utils
+
+// GlobMatch reports whether str matches the Redis style glob pattern.
+// Supported syntax: '*', '?', '[abc]', '[^abc]', '[a-z]' and '\' escapes.
+func GlobMatch(pattern, str string, nocase bool) bool {
+	skipLonger := false
+	return globMatch(pattern, str, nocase, &skipLonger, 0)
+}
+
+// maxGlobNesting bounds the recursion caused by '*' so hostile patterns
+// can't blow the stack.
+const maxGlobNesting = 1000
+
+func globMatch(p, s string, nocase bool, skipLonger *bool, nesting int) bool {
+	if nesting > maxGlobNesting {
+		return false
+	}
+
+	for len(p) > 0 && len(s) > 0 {
+		switch p[0] {
+		case '*':
+			for len(p) > 1 && p[1] == '*' {
+				p = p[1:]
+			}
+			if len(p) == 1 {
+				return true
+			}
+			for len(s) > 0 {
+				if globMatch(p[1:], s, nocase, skipLonger, nesting+1) {
+					return true
+				}
+				// The rest of the pattern already failed against the full
+				// remaining string, so trying shorter suffixes is pointless.
+				if *skipLonger {
+					return false
+				}
+				s = s[1:]
+			}
+			*skipLonger = true
+			return false
+		case '?':
+			s = s[1:]
+		case '[':
+			p = p[1:]
+			not := len(p) > 0 && p[0] == '^'
+			if not {
+				p = p[1:]
+			}
+			match := false
+			for len(p) > 0 && p[0] != ']' {
+				switch {
+				case p[0] == '\\' && len(p) >= 2:
+					p = p[1:]
+					if equalFold(p[0], s[0], nocase) {
+						match = true
+					}
+				case len(p) >= 3 && p[1] == '-':
+					start, end, c := p[0], p[2], s[0]
+					if start > end {
+						start, end = end, start
+					}
+					if nocase {
+						start, end, c = toLower(start), toLower(end), toLower(c)
+					}
+					if c >= start && c <= end {
+						match = true
+					}
+					p = p[2:]
+				default:
+					if equalFold(p[0], s[0], nocase) {
+						match = true
+					}
+				}
+				p = p[1:]
+			}
+			if not {
+				match = !match
+			}
+			if !match {
+				return false
+			}
+			s = s[1:]
+			if len(p) == 0 {
+				// Unterminated bracket, treat it as the end of the pattern.
+				return len(s) == 0
+			}
+		case '\\':
+			if len(p) >= 2 {
+				p = p[1:]
+			}
+			fallthrough
+		default:
+			if !equalFold(p[0], s[0], nocase) {
+				return false
+			}
+			s = s[1:]
+		}
+		p = p[1:]
+	}
+
+	if len(s) == 0 {
+		for len(p) > 0 && p[0] == '*' {
+			p = p[1:]
+		}
+		return len(p) == 0
+	}
+	return false
+}
+
+func equalFold(a, b byte, nocase bool) bool {
+	if nocase {
+		return toLower(a) == toLower(b)
+	}
+	return a == b
+}
+
+func toLower(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + ('a' - 'A')
+	}
+	return c
+}